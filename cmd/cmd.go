@@ -20,7 +20,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	corev1 "k8s.io/api/core/v1"
@@ -37,7 +39,9 @@ import (
 	"github.com/helen-frank/hcnmp/pkg/apis/config"
 	"github.com/helen-frank/hcnmp/pkg/server"
 	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/version"
 	"github.com/helen-frank/hcnmp/pkg/zone"
+	"github.com/helen-frank/hcnmp/pkg/zone/breaker"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
 )
@@ -47,6 +51,8 @@ type Options struct {
 	config      config.Config
 	kubeclient  clientset.Interface
 	genericclioptions.IOStreams
+
+	proxyCacheResourceTTLs map[string]string
 }
 
 func NewCommand(name string, in io.Reader, out, errout io.Writer) *cobra.Command {
@@ -68,6 +74,9 @@ func NewCommand(name string, in io.Reader, out, errout io.Writer) *cobra.Command
 			return nil
 		},
 	}
+	cmd.AddCommand(NewPortForwardCommand(o.IOStreams))
+	cmd.AddCommand(NewDiagnoseCommand(o.IOStreams))
+
 	flags := cmd.Flags()
 	flags.BoolVar(&o.config.Debug, "debug", true, "gin open DebugMode")
 	flags.IntVar(&o.config.Port, "port", 8080, "hcnmp listen port")
@@ -77,10 +86,62 @@ func NewCommand(name string, in io.Reader, out, errout io.Writer) *cobra.Command
 	flags.StringVar(&o.config.LocalClusterInfos, "local-cluster-info", "", "Local cluster-info")
 	flags.StringVar(&o.config.BasicAuthUser, "basic-auth-user", "admin", "hcnmp basic auth user")
 	flags.StringVar(&o.config.BasicAuthPassword, "basic-auth-password", "admin", "hcnmp basic auth password")
+	flags.StringVar(&o.config.ProxyPolicy, "proxy-policy", "hcnmp-proxy-policy", "configmap name holding the proxy policy in policy.yaml, everything is allowed if it does not exist, empty disables the policy")
+	flags.StringVar(&o.config.TokenSigningKey, "token-signing-key", "", "key of at least 32 bytes signing the hcnmp bearer tokens used by generated kubeconfigs, a random key kept in the hcnmp-token-signing-key secret of the hcnmp namespace if empty")
+	flags.StringSliceVar(&o.config.ExternalURLs, "external-urls", nil, "base urls of hcnmp written into generated kubeconfigs, the first one is the default and ?server= must be one of them, the url of the request is used if empty")
+	flags.StringVar(&o.config.DiscoveryCache, "discovery-cache", clientset.MemoryCache, "member cluster discovery cache backend, memory or disk")
+	flags.StringVar(&o.config.DiscoveryCacheDir, "discovery-cache-dir", "", "root directory of the disk discovery cache, every cluster is cached in a sub directory named by its id")
+	flags.Int64Var(&o.config.DiscoveryCacheMaxSize, "discovery-cache-max-size", 64<<20, "max bytes of the disk discovery cache per cluster, 0 means no limit")
+	flags.DurationVar(&o.config.DiscoveryCacheTTL, "discovery-cache-ttl", 10*time.Minute, "ttl of the disk discovery cache")
+	flags.IntVar(&o.config.CircuitBreakerFailures, "circuit-breaker-failures", 5, "consecutive failures that open the circuit breaker of a member cluster, 0 disables it")
+	flags.DurationVar(&o.config.CircuitBreakerSlowThreshold, "circuit-breaker-slow-threshold", 10*time.Second, "member cluster request latency counted as failure by the circuit breaker, 0 means no limit")
+	flags.DurationVar(&o.config.CircuitBreakerOpenDuration, "circuit-breaker-open-duration", 30*time.Second, "how long the circuit breaker stays open before a probe request is allowed")
+	flags.DurationVar(&o.config.ProxyCacheTTL, "proxy-cache-ttl", 0, "ttl of cached GET responses of the cluster proxy, 0 disables the cache except for proxy-cache-resource-ttls")
+	flags.StringToStringVar(&o.proxyCacheResourceTTLs, "proxy-cache-resource-ttls", nil, "ttl of cached GET responses per resource, e.g. pods=5s,events=2s,/version=1m")
+	flags.Int64Var(&o.config.ProxyCacheMaxSize, "proxy-cache-max-size", 64<<20, "max bytes of cached responses of the cluster proxy")
+	flags.StringSliceVar(&o.config.WebSocketAllowedOrigins, "websocket-allowed-origins", nil, "origins allowed to open WebSocket sessions such as the exec terminal besides hcnmp itself, * allows all")
+	flags.DurationVar(&o.config.ExecIdleTimeout, "exec-idle-timeout", 30*time.Minute, "close exec terminals without input for the duration, 0 means no timeout")
+	flags.StringVar(&o.config.RecordingDir, "recording-dir", "", "directory recording every exec terminal session in asciicast v2, sessions are refused if they can not be recorded, empty disables recording")
+	flags.DurationVar(&o.config.RecordingRetention, "recording-retention", 90*24*time.Hour, "how long exec terminal recordings are kept, 0 keeps them forever")
+	flags.StringSliceVar(&o.config.RecordingAuditors, "recording-auditors", nil, "hcnmp users allowed to access the recordings of everyone besides the basic auth user, the others only access their own")
+	flags.DurationVar(&o.config.OperationRetention, "operation-retention", 24*time.Hour, "how long finished operations such as workload restarts are kept")
+	flags.StringVar(&o.config.DiagnosticsImage, "diagnostics-image", version.Image(), "image of the ephemeral container running the network diagnostics of pods, it must contain /opt/app/hcnmp, the default is the image of the running build")
+	flags.StringVar(&o.config.DebugImage, "debug-image", "busybox:1.36", "default image of ephemeral debug containers and of the debug pods of nodes")
+	flags.StringSliceVar(&o.config.NodeDebugUsers, "node-debug-users", nil, "hcnmp users allowed to create privileged debug pods of nodes besides the basic auth user")
+	flags.StringVar(&o.config.NodeDebugNamespace, "node-debug-namespace", "hcnmp-node-debug", "dedicated namespace of the debug pods of nodes in member clusters, it is created when missing")
+	flags.DurationVar(&o.config.NodeDebugTTL, "node-debug-ttl", time.Hour, "default and max lifetime of the debug pods of nodes, they are deleted when it expires")
+	flags.Int64Var(&o.config.CopyMaxSize, "copy-max-size", 512<<20, "max bytes of an archive copied to or from a container, 0 means no limit")
+	flags.Float64Var(&o.config.RateLimitUserQPS, "rate-limit-user-qps", 50, "sustained requests per second of a hcnmp user, 0 means no limit")
+	flags.IntVar(&o.config.RateLimitUserBurst, "rate-limit-user-burst", 100, "burst of requests of a hcnmp user")
+	flags.IntVar(&o.config.RateLimitUserMaxInFlight, "rate-limit-user-max-in-flight", 50, "max concurrent requests of a hcnmp user except watches, exec and followed logs, 0 means no limit")
+	flags.StringToStringVar(&o.config.RateLimitGroupUserQuotas, "rate-limit-group-user-quotas", nil, "user quotas qps:burst:maxInFlight of route groups overriding rate-limit-user-*, the groups are cluster, operations, server and gateway, e.g. cluster=5:10:5,gateway=100:200:50")
+	flags.Float64Var(&o.config.RateLimitClusterQPS, "rate-limit-cluster-qps", 800, "sustained requests per second proxied to a member cluster, 0 means no limit")
+	flags.IntVar(&o.config.RateLimitClusterBurst, "rate-limit-cluster-burst", 1000, "burst of requests proxied to a member cluster")
+	flags.IntVar(&o.config.RateLimitClusterMaxInFlight, "rate-limit-cluster-max-in-flight", 400, "max concurrent requests proxied to a member cluster except watches, exec and followed logs, 0 means no limit")
+	flags.BoolVar(&o.config.LeaderElect, "leader-elect", true, "elect a leader among hcnmp replicas to run the background controllers")
+	flags.StringVar(&o.config.LeaderElectLeaseName, "leader-elect-lease-name", "hcnmp-leader", "lease name used by leader election in the hcnmp namespace")
+	flags.DurationVar(&o.config.LeaderElectLeaseDuration, "leader-elect-lease-duration", 15*time.Second, "duration that non-leader candidates will wait before trying to acquire leadership")
+	flags.DurationVar(&o.config.LeaderElectRenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "duration that the leader retries refreshing leadership before giving up")
+	flags.DurationVar(&o.config.LeaderElectRetryPeriod, "leader-elect-retry-period", 2*time.Second, "duration the candidates wait between tries of acquiring and renewing leadership")
 	return cmd
 }
 
 func (o *Options) Complete(cmd *cobra.Command) error {
+	cacheOptions := o.cacheOptions()
+	if err := cacheOptions.Validate(); err != nil {
+		return err
+	}
+	clientset.SetCacheOptions(cacheOptions)
+
+	o.config.ProxyCacheResourceTTLs = make(map[string]time.Duration, len(o.proxyCacheResourceTTLs))
+	for resource, ttl := range o.proxyCacheResourceTTLs {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return fmt.Errorf("proxy-cache-resource-ttls %v: %v", resource, err)
+		}
+		o.config.ProxyCacheResourceTTLs[resource] = d
+	}
+
 	kubeconfig, err := clientcmd.BuildConfigFromFlags("", o.config.KubeConfig)
 	if err != nil {
 		return err
@@ -165,10 +226,27 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		return fmt.Errorf("basic-auth-password not empty")
 	}
 
+	if len(o.config.TokenSigningKey) != 0 && len(o.config.TokenSigningKey) < 32 {
+		return fmt.Errorf("token-signing-key must have at least 32 bytes")
+	}
+
+	for i := range o.config.ExternalURLs {
+		u, err := url.Parse(o.config.ExternalURLs[i])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("external-urls %q must be an absolute http or https url", o.config.ExternalURLs[i])
+		}
+	}
+
 	return nil
 }
 
 func (o *Options) Run(cmd *cobra.Command) error {
+	proxy.SetBreakerOptions(breaker.Options{
+		FailureThreshold: o.config.CircuitBreakerFailures,
+		SlowThreshold:    o.config.CircuitBreakerSlowThreshold,
+		OpenDuration:     o.config.CircuitBreakerOpenDuration,
+	})
+
 	if err := proxy.InitProxy(o.config.ClusterInfos, o.config.NameSpace, o.config.LocalClusterInfos, o.kubeclient); err != nil {
 		return err
 	}
@@ -182,6 +260,15 @@ func (o *Options) Run(cmd *cobra.Command) error {
 	return nil
 }
 
+func (o *Options) cacheOptions() clientset.CacheOptions {
+	return clientset.CacheOptions{
+		Type:    o.config.DiscoveryCache,
+		Dir:     o.config.DiscoveryCacheDir,
+		MaxSize: o.config.DiscoveryCacheMaxSize,
+		TTL:     o.config.DiscoveryCacheTTL,
+	}
+}
+
 func NewOption(name string, ioStream genericclioptions.IOStreams) *Options {
 	return &Options{
 		IOStreams:   ioStream,
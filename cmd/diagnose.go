@@ -0,0 +1,125 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+
+	diagnosticsapi "github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+	"github.com/helen-frank/hcnmp/pkg/diagnostics"
+)
+
+type DiagnoseOptions struct {
+	Timeout            time.Duration
+	Count              int
+	InsecureSkipVerify bool
+	// Idle keeps the process running, it is the main process of the diagnostics ephemeral container
+	Idle bool
+
+	targets []diagnosticsapi.Target
+	genericclioptions.IOStreams
+}
+
+func NewDiagnoseCommand(streams genericclioptions.IOStreams) *cobra.Command {
+	o := &DiagnoseOptions{IOStreams: streams}
+	cmd := &cobra.Command{
+		Use:   "diagnose [--timeout=2s] [--count=3] [--insecure] URL [...URL_N]",
+		Short: "Check the network reachability of targets, the results are printed as JSON",
+		Long: templates.LongDesc(`
+			Check the network reachability of targets by resolving their host, connecting to their port,
+			measuring the connect latency and, for http and https, a GET of their path.
+
+			hcnmp runs it in an ephemeral container of a pod to diagnose the network of the pod,
+			no tool of the pod's image is needed.
+		`),
+		Example: templates.Examples(`
+			# Resolve a service, connect to a database and GET a health endpoint
+			hcnmp diagnose dns://kubernetes.default.svc tcp://postgres.db:5432 http://api.default:8080/healthz
+		`),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(args))
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.DurationVar(&o.Timeout, "timeout", diagnostics.DefaultTimeout, "timeout of every step")
+	flags.IntVar(&o.Count, "count", diagnostics.DefaultCount, "connects measuring the latency")
+	flags.BoolVar(&o.InsecureSkipVerify, "insecure", false, "skip the verification of https certificates")
+	flags.BoolVar(&o.Idle, "idle", false, "wait for a signal instead of checking targets")
+	return cmd
+}
+
+func (o *DiagnoseOptions) Complete(args []string) error {
+	for _, arg := range args {
+		target, err := diagnostics.ParseTarget(arg)
+		if err != nil {
+			return err
+		}
+		o.targets = append(o.targets, *target)
+	}
+	return nil
+}
+
+func (o *DiagnoseOptions) Validate() error {
+	if o.Idle {
+		return nil
+	}
+	if len(o.targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+	if len(o.targets) > diagnostics.MaxTargets {
+		return fmt.Errorf("at most %v targets are allowed", diagnostics.MaxTargets)
+	}
+	if o.Timeout <= 0 {
+		return errors.New("--timeout must be positive")
+	}
+	if o.Count <= 0 || o.Count > diagnostics.MaxCount {
+		return fmt.Errorf("--count must be between 1 and %v", diagnostics.MaxCount)
+	}
+	return nil
+}
+
+func (o *DiagnoseOptions) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if o.Idle {
+		<-ctx.Done()
+		return nil
+	}
+
+	results := diagnostics.Run(ctx, o.targets, diagnostics.Options{
+		Timeout:            o.Timeout,
+		Count:              o.Count,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	})
+	return json.NewEncoder(o.Out).Encode(results)
+}
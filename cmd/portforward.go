@@ -0,0 +1,418 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/util/templates"
+)
+
+const (
+	// portForwardBufferSize is the max size of the data of a WebSocket message sent to hcnmp
+	portForwardBufferSize = 32 * 1024
+	// portForwardQueueSize is the max number of messages of hcnmp queued for a local connection,
+	// the connection is reset when it does not keep up
+	portForwardQueueSize = 64
+)
+
+type PortForwardOptions struct {
+	Server    string
+	User      string
+	Password  string
+	Token     string
+	Cluster   string
+	Namespace string
+	Address   []string
+
+	pod   string
+	ports []forwardedPort
+	genericclioptions.IOStreams
+}
+
+type forwardedPort struct {
+	local  uint16
+	remote uint16
+}
+
+func NewPortForwardCommand(streams genericclioptions.IOStreams) *cobra.Command {
+	o := &PortForwardOptions{IOStreams: streams}
+	cmd := &cobra.Command{
+		Use:   "port-forward [pod/]NAME [LOCAL_PORT:]REMOTE_PORT [...[LOCAL_PORT_N:]REMOTE_PORT_N]",
+		Short: "Forward local ports to a pod of a member cluster through hcnmp",
+		Long: templates.LongDesc(`
+			Forward one or more local ports to a pod of a member cluster through the hcnmp API,
+			no kubeconfig of the member cluster is needed.
+		`),
+		Example: templates.Examples(`
+			# Listen on port 8080 locally, forwarding to port 80 of pod nginx in cluster dev
+			hcnmp port-forward --server=http://127.0.0.1:8080 --user=admin --password=admin --cluster=dev -n default pod/nginx 8080:80
+
+			# Listen on a random local port, forwarding to port 5432
+			hcnmp port-forward --server=http://127.0.0.1:8080 --token=$TOKEN --cluster=dev -n db postgres-0 :5432
+		`),
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdutil.CheckErr(o.Complete(args))
+			cmdutil.CheckErr(o.Validate())
+			cmdutil.CheckErr(o.Run())
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&o.Server, "server", "http://127.0.0.1:8080", "address of hcnmp")
+	flags.StringVar(&o.User, "user", "", "hcnmp basic auth user")
+	flags.StringVar(&o.Password, "password", "", "hcnmp basic auth password")
+	flags.StringVar(&o.Token, "token", "", "hcnmp bearer token, e.g. the token of a kubeconfig generated by hcnmp")
+	flags.StringVar(&o.Cluster, "cluster", "", "code of the member cluster")
+	flags.StringVarP(&o.Namespace, "namespace", "n", "default", "namespace of the pod")
+	flags.StringSliceVar(&o.Address, "address", []string{"localhost"}, "addresses to listen on (comma separated), only accepts IP addresses or localhost")
+	return cmd
+}
+
+func (o *PortForwardOptions) Complete(args []string) error {
+	if len(args) < 2 {
+		return errors.New("a pod and at least one port are required")
+	}
+
+	o.pod = strings.TrimPrefix(args[0], "pod/")
+	o.pod = strings.TrimPrefix(o.pod, "pods/")
+	for _, arg := range args[1:] {
+		port, err := parsePort(arg)
+		if err != nil {
+			return err
+		}
+		o.ports = append(o.ports, port)
+	}
+	return nil
+}
+
+func (o *PortForwardOptions) Validate() error {
+	if len(o.Cluster) == 0 {
+		return errors.New("--cluster is required")
+	}
+	if len(o.pod) == 0 || strings.Contains(o.pod, "/") {
+		return fmt.Errorf("invalid pod %q", o.pod)
+	}
+
+	u, err := url.Parse(o.Server)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme of --server %q", o.Server)
+	}
+	return nil
+}
+
+func (o *PortForwardOptions) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// all connections are tunneled through one WebSocket of hcnmp
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, o.url(), o.header())
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v: %v", err, resp.Status)
+		}
+		return err
+	}
+	defer ws.Close()
+	t := &tunnel{ws: ws, conns: map[uint32]chan error{}, local: map[uint32]*localConn{}}
+
+	listeners := make([]net.Listener, 0, len(o.ports)*len(o.Address))
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for _, port := range o.ports {
+		for _, address := range o.Address {
+			l, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(int(port.local))))
+			if err != nil {
+				return fmt.Errorf("unable to listen on %v: %v", address, err)
+			}
+			listeners = append(listeners, l)
+			fmt.Fprintf(o.Out, "Forwarding from %v -> %v\n", l.Addr(), port.remote)
+
+			go o.serve(ctx, t, l, port.remote)
+		}
+	}
+
+	tunnelErr := make(chan error, 1)
+	go func() {
+		tunnelErr <- t.run()
+	}()
+
+	select {
+	case <-ctx.Done():
+		_ = t.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		return nil
+	case err := <-tunnelErr:
+		return fmt.Errorf("lost connection to hcnmp: %v", err)
+	}
+}
+
+func (o *PortForwardOptions) serve(ctx context.Context, t *tunnel, l net.Listener, remote uint16) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(o.ErrOut, "error accepting connection on %v: %v\n", l.Addr(), err)
+			}
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			fmt.Fprintf(o.Out, "Handling connection for %v\n", remote)
+			if err := t.forward(conn, remote); err != nil {
+				fmt.Fprintf(o.ErrOut, "error forwarding port %v to pod %v: %v\n", remote, o.pod, err)
+			}
+		}()
+	}
+}
+
+func (o *PortForwardOptions) url() string {
+	u, _ := url.Parse(o.Server)
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u = u.JoinPath("/apis/server/v1/cluster", o.Cluster, "namespace", o.Namespace, "pod", o.pod, "portforward")
+	return u.String()
+}
+
+// portForwardMessage is the text message controlling the connections of the portforward endpoint of hcnmp.
+type portForwardMessage struct {
+	Op   string `json:"op"`
+	ID   uint32 `json:"id"`
+	Port uint16 `json:"port,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// tunnel multiplexes local connections over the WebSocket of hcnmp, binary messages carry the big endian
+// uint32 id of the connection followed by its data, and the text messages open and close connections.
+type tunnel struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu     sync.Mutex
+	nextID uint32
+	// conns receive the result of the connections when hcnmp closes them
+	conns map[uint32]chan error
+	// local are the local connections written by the data of hcnmp
+	local map[uint32]*localConn
+}
+
+// localConn is a local connection tunneled to the pod.
+type localConn struct {
+	conn net.Conn
+	// queue holds the data of hcnmp until it is written to conn, it is closed when the connection is finished
+	queue chan []byte
+	// drained is closed when the queue is written
+	drained chan struct{}
+}
+
+// forward tunnels conn to the remote port until hcnmp closes the connection.
+func (t *tunnel) forward(conn net.Conn, remote uint16) error {
+	done := make(chan error, 1)
+	lc := &localConn{
+		conn:    conn,
+		queue:   make(chan []byte, portForwardQueueSize),
+		drained: make(chan struct{}),
+	}
+	t.mu.Lock()
+	t.nextID++
+	id := t.nextID
+	t.conns[id] = done
+	t.local[id] = lc
+	t.mu.Unlock()
+
+	// remote to local, a slow local connection must not block the others sharing the WebSocket
+	go func() {
+		defer close(lc.drained)
+		for data := range lc.queue {
+			// a failed write shows up as a failed read of the local connection
+			_, _ = conn.Write(data)
+		}
+	}()
+
+	if err := t.send(portForwardMessage{Op: "open", ID: id, Port: remote}); err != nil {
+		t.finish(id, err)
+		return <-done
+	}
+
+	// local to remote, a message without data half-closes the connection
+	go func() {
+		buf := make([]byte, 4+portForwardBufferSize)
+		binary.BigEndian.PutUint32(buf, id)
+		for {
+			n, err := conn.Read(buf[4:])
+			if n > 0 {
+				if err := t.write(websocket.BinaryMessage, buf[:4+n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = t.write(websocket.BinaryMessage, buf[:4])
+				return
+			}
+		}
+	}()
+
+	err := <-done
+	if err == nil {
+		// hcnmp closed the connection after its data
+		<-lc.drained
+	}
+	return err
+}
+
+// run dispatches the messages of hcnmp to the local connections until the WebSocket is closed.
+func (t *tunnel) run() error {
+	for {
+		messageType, data, err := t.ws.ReadMessage()
+		if err != nil {
+			t.mu.Lock()
+			ids := make([]uint32, 0, len(t.conns))
+			for id := range t.conns {
+				ids = append(ids, id)
+			}
+			t.mu.Unlock()
+			for _, id := range ids {
+				t.finish(id, err)
+			}
+			return err
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			if len(data) < 4 {
+				continue
+			}
+			id := binary.BigEndian.Uint32(data)
+			full := false
+			t.mu.Lock()
+			if lc, ok := t.local[id]; ok {
+				select {
+				case lc.queue <- data[4:]:
+				default:
+					full = true
+				}
+			}
+			t.mu.Unlock()
+			if full {
+				// reset the connection, hcnmp drops the rest of its data
+				_ = t.send(portForwardMessage{Op: "close", ID: id})
+				t.finish(id, errors.New("connection reset, the local connection does not keep up with the data"))
+			}
+		case websocket.TextMessage:
+			msg := portForwardMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			switch msg.Op {
+			case "close":
+				t.finish(msg.ID, nil)
+			case "error":
+				t.finish(msg.ID, errors.New(msg.Data))
+			}
+		}
+	}
+}
+
+func (t *tunnel) finish(id uint32, err error) {
+	t.mu.Lock()
+	done, ok := t.conns[id]
+	if ok {
+		close(t.local[id].queue)
+	}
+	delete(t.conns, id)
+	delete(t.local, id)
+	t.mu.Unlock()
+	if ok {
+		done <- err
+	}
+}
+
+func (t *tunnel) send(msg portForwardMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.write(websocket.TextMessage, data)
+}
+
+func (t *tunnel) write(messageType int, data []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.ws.WriteMessage(messageType, data)
+}
+
+func (o *PortForwardOptions) header() http.Header {
+	header := http.Header{}
+	switch {
+	case len(o.Token) != 0:
+		header.Set("Authorization", "Bearer "+o.Token)
+	case len(o.User) != 0:
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(o.User+":"+o.Password)))
+	}
+	return header
+}
+
+// parsePort parses [LOCAL_PORT:]REMOTE_PORT, an empty LOCAL_PORT listens on a random port.
+func parsePort(s string) (forwardedPort, error) {
+	local, remote, found := strings.Cut(s, ":")
+	if !found {
+		local, remote = s, s
+	}
+
+	remotePort, err := strconv.ParseUint(remote, 10, 16)
+	if err != nil || remotePort == 0 {
+		return forwardedPort{}, fmt.Errorf("invalid remote port %q", s)
+	}
+
+	port := forwardedPort{remote: uint16(remotePort)}
+	if len(local) != 0 {
+		localPort, err := strconv.ParseUint(local, 10, 16)
+		if err != nil {
+			return forwardedPort{}, fmt.Errorf("invalid local port %q", s)
+		}
+		port.local = uint16(localPort)
+	}
+	return port, nil
+}
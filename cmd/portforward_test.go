@@ -0,0 +1,239 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		port    string
+		want    forwardedPort
+		wantErr bool
+	}{
+		{port: "80", want: forwardedPort{local: 80, remote: 80}},
+		{port: "8080:80", want: forwardedPort{local: 8080, remote: 80}},
+		{port: ":5432", want: forwardedPort{remote: 5432}},
+		{port: "0:5432", want: forwardedPort{remote: 5432}},
+		{port: "65535:65535", want: forwardedPort{local: 65535, remote: 65535}},
+		{port: "", wantErr: true},
+		{port: "0", wantErr: true},
+		{port: "8080:", wantErr: true},
+		{port: "8080:0", wantErr: true},
+		{port: "65536", wantErr: true},
+		{port: "65536:80", wantErr: true},
+		{port: "http", wantErr: true},
+		{port: "-1:80", wantErr: true},
+		{port: "8080:80:90", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.port, func(t *testing.T) {
+			got, err := parsePort(tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePort(%q) error = %v, wantErr %v", tt.port, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parsePort(%q) = %+v, want %+v", tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+// startTunnel runs a tunnel over a WebSocket and returns it with the hcnmp side of the WebSocket.
+func startTunnel(t *testing.T) (*tunnel, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcnmp := <-conns
+	tun := &tunnel{ws: ws, conns: map[uint32]chan error{}, local: map[uint32]*localConn{}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = tun.run()
+	}()
+	t.Cleanup(func() {
+		ws.Close()
+		hcnmp.Close()
+		<-done
+	})
+	return tun, hcnmp
+}
+
+// readHcnmp returns the next message sent to hcnmp, the data of binary messages is prefixed by the id.
+func readHcnmp(t *testing.T, hcnmp *websocket.Conn) (uint32, string) {
+	t.Helper()
+	_ = hcnmp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := hcnmp.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType == websocket.BinaryMessage {
+		return binary.BigEndian.Uint32(data), string(data[4:])
+	}
+	msg := portForwardMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg.ID, msg.Op + ":" + msg.Data
+}
+
+func writeHcnmp(t *testing.T, hcnmp *websocket.Conn, id uint32, data string) {
+	t.Helper()
+	if err := hcnmp.WriteMessage(websocket.BinaryMessage, append(binary.BigEndian.AppendUint32(nil, id), data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTunnelForward(t *testing.T) {
+	tun, hcnmp := startTunnel(t)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	result := make(chan error, 1)
+	go func() {
+		result <- tun.forward(local, 80)
+	}()
+
+	msg := portForwardMessage{}
+	_ = hcnmp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := hcnmp.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg != (portForwardMessage{Op: "open", ID: 1, Port: 80}) {
+		t.Fatalf("open = %+v, want connection 1 to port 80", msg)
+	}
+
+	if _, err := remote.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if id, data := readHcnmp(t, hcnmp); id != 1 || data != "ping" {
+		t.Errorf("hcnmp read %v:%q, want 1:ping", id, data)
+	}
+
+	// the data sent before close is written to the local connection
+	writeHcnmp(t, hcnmp, 1, "pong")
+	writeHcnmp(t, hcnmp, 1, "bye")
+	if err := hcnmp.WriteJSON(portForwardMessage{Op: "close", ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_ = remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("pongbye"))
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "pongbye" {
+		t.Errorf("local read %q, %v, want pongbye", buf, err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("forward() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("forward() does not return after close")
+	}
+}
+
+func TestTunnelForwardFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		// hcnmp is run after the connection 1 is opened
+		hcnmp     func(t *testing.T, hcnmp *websocket.Conn)
+		wantErr   string
+		wantReset bool
+	}{
+		{
+			name: "error",
+			hcnmp: func(t *testing.T, hcnmp *websocket.Conn) {
+				if err := hcnmp.WriteJSON(portForwardMessage{Op: "error", ID: 1, Data: "connection refused"}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: "connection refused",
+		},
+		{
+			name: "slow local connection",
+			hcnmp: func(t *testing.T, hcnmp *websocket.Conn) {
+				// the local connection reads nothing
+				for i := 0; i < portForwardQueueSize+2; i++ {
+					writeHcnmp(t, hcnmp, 1, strings.Repeat("x", 1024))
+				}
+			},
+			wantErr:   "connection reset, the local connection does not keep up with the data",
+			wantReset: true,
+		},
+		{
+			name: "lost connection",
+			hcnmp: func(t *testing.T, hcnmp *websocket.Conn) {
+				hcnmp.Close()
+			},
+			wantErr: "close 1006",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tun, hcnmp := startTunnel(t)
+			local, remote := net.Pipe()
+			defer remote.Close()
+			result := make(chan error, 1)
+			go func() {
+				result <- tun.forward(local, 80)
+				local.Close()
+			}()
+			if id, op := readHcnmp(t, hcnmp); id != 1 || op != "open:" {
+				t.Fatalf("hcnmp read %v:%q, want open of 1", id, op)
+			}
+
+			tt.hcnmp(t, hcnmp)
+			if tt.wantReset {
+				if id, op := readHcnmp(t, hcnmp); id != 1 || op != "close:" {
+					t.Errorf("hcnmp read %v:%q, want close of 1", id, op)
+				}
+			}
+			select {
+			case err := <-result:
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("forward() error = %v, want %q", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("forward() does not return")
+			}
+		})
+	}
+}
@@ -16,8 +16,42 @@ limitations under the License.
 
 package cluster
 
+import "time"
+
 type ClusterInfo struct {
-	ID         string `json:"id"`   // kube-system uid
-	Code       string `json:"code"` // cluster alias
-	Kubeconfig []byte `json:"kubeconfig"`
+	ID            string         `json:"id"`   // kube-system uid
+	Code          string         `json:"code"` // cluster alias
+	Kubeconfig    []byte         `json:"kubeconfig"`
+	Impersonation *Impersonation `json:"impersonation,omitempty"`
+}
+
+// Impersonation makes proxied requests impersonate the hcnmp user, so that the RBAC of member cluster applies.
+// The identity of Kubeconfig must be allowed to impersonate users and groups.
+type Impersonation struct {
+	Enabled bool `json:"enabled"`
+	// UserPrefix is prepended to the hcnmp user, e.g. "hcnmp:"
+	UserPrefix string `json:"userPrefix,omitempty"`
+	// Groups are impersonated for every user
+	Groups []string `json:"groups,omitempty"`
+	// UserGroups are the extra groups impersonated per hcnmp user
+	UserGroups map[string][]string `json:"userGroups,omitempty"`
+}
+
+// GroupsFor returns the groups impersonated for the hcnmp user.
+func (i *Impersonation) GroupsFor(user string) []string {
+	groups := make([]string, 0, len(i.Groups)+len(i.UserGroups[user]))
+	groups = append(groups, i.Groups...)
+	return append(groups, i.UserGroups[user]...)
+}
+
+type ClusterStatus struct {
+	Code           string               `json:"code"`
+	CircuitBreaker CircuitBreakerStatus `json:"circuitBreaker"`
+}
+
+type CircuitBreakerStatus struct {
+	State               string     `json:"state"` // Closed, HalfOpen or Open
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastFailure         string     `json:"lastFailure,omitempty"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
 }
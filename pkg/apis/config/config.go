@@ -16,6 +16,8 @@ limitations under the License.
 
 package config
 
+import "time"
+
 type Config struct {
 	Debug             bool
 	Port              int
@@ -25,4 +27,53 @@ type Config struct {
 	LocalClusterInfos string
 	BasicAuthUser     string
 	BasicAuthPassword string
+	TokenSigningKey   string
+	ExternalURLs      []string
+	ProxyPolicy       string
+
+	DiscoveryCache        string
+	DiscoveryCacheDir     string
+	DiscoveryCacheMaxSize int64
+	DiscoveryCacheTTL     time.Duration
+
+	CircuitBreakerFailures      int
+	CircuitBreakerSlowThreshold time.Duration
+	CircuitBreakerOpenDuration  time.Duration
+
+	ProxyCacheTTL          time.Duration
+	ProxyCacheResourceTTLs map[string]time.Duration
+	ProxyCacheMaxSize      int64
+
+	WebSocketAllowedOrigins []string
+	ExecIdleTimeout         time.Duration
+
+	RecordingDir       string
+	RecordingRetention time.Duration
+	RecordingAuditors  []string
+
+	OperationRetention time.Duration
+
+	DiagnosticsImage string
+	DebugImage       string
+
+	NodeDebugUsers     []string
+	NodeDebugNamespace string
+	NodeDebugTTL       time.Duration
+
+	CopyMaxSize int64
+
+	RateLimitUserQPS         float64
+	RateLimitUserBurst       int
+	RateLimitUserMaxInFlight int
+	// RateLimitGroupUserQuotas are the user quotas qps:burst:maxInFlight of route groups by name
+	RateLimitGroupUserQuotas    map[string]string
+	RateLimitClusterQPS         float64
+	RateLimitClusterBurst       int
+	RateLimitClusterMaxInFlight int
+
+	LeaderElect              bool
+	LeaderElectLeaseName     string
+	LeaderElectLeaseDuration time.Duration
+	LeaderElectRenewDeadline time.Duration
+	LeaderElectRetryPeriod   time.Duration
 }
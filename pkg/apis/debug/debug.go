@@ -0,0 +1,36 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package debug
+
+import "time"
+
+// Session is a debug container ready for the exec terminal.
+type Session struct {
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	// TargetContainer shares its process namespace with the debug container
+	TargetContainer string `json:"targetContainer,omitempty"`
+	// ExecPath is the path of the exec terminal of the debug container
+	ExecPath string `json:"execPath"`
+
+	// Node and ExpiresAt are set for the debug pods of nodes, they are deleted when they expire
+	Node      string     `json:"node,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
@@ -0,0 +1,90 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+const (
+	// SchemeDNS only resolves the host
+	SchemeDNS   = "dns"
+	SchemeTCP   = "tcp"
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+const (
+	StepDNS     = "dns"
+	StepTCP     = "tcp"
+	StepLatency = "latency"
+	StepHTTP    = "http"
+)
+
+// Target is checked by resolving its host, connecting to its port, measuring the connect latency
+// and, for http and https, a GET of its path.
+type Target struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	// Port defaults to 80 for http and 443 for https, it is required for tcp
+	Port int    `json:"port,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// Request is a diagnostics run from the network namespace of a pod.
+type Request struct {
+	Targets []Target `json:"targets"`
+	// TimeoutSeconds bounds every step, default 2
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+	// Count is how many connects measure the latency, default 3
+	Count int `json:"count,omitempty"`
+	// InsecureSkipVerify skips the verification of https certificates
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+}
+
+// Result is the outcome of the steps of a target, the steps after a failed one are not run.
+type Result struct {
+	Target  Target `json:"target"`
+	Success bool   `json:"success"`
+	Steps   []Step `json:"steps"`
+}
+
+type Step struct {
+	Name       string  `json:"name"`
+	Success    bool    `json:"success"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+
+	// Addresses are the resolved addresses of the dns step
+	Addresses []string `json:"addresses,omitempty"`
+	// Address is the connected address of the tcp step
+	Address string `json:"address,omitempty"`
+	// StatusCode is the response status of the http step
+	StatusCode int      `json:"statusCode,omitempty"`
+	Latency    *Latency `json:"latency,omitempty"`
+}
+
+// Latency is measured by repeated tcp connects, icmp would need privileges.
+type Latency struct {
+	Count  int     `json:"count"`
+	Failed int     `json:"failed"`
+	MinMs  float64 `json:"minMs"`
+	AvgMs  float64 `json:"avgMs"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+type ResultList struct {
+	APIVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Items      []Result `json:"items"`
+}
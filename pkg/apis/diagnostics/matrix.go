@@ -0,0 +1,140 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+import "time"
+
+const (
+	PathReachable   = "Reachable"
+	PathUnreachable = "Unreachable"
+	// PathPartial is reachable from some of the pods of a source only
+	PathPartial = "Partial"
+	// PathUnknown is not checked, e.g. no pod of the source is running
+	PathUnknown = "Unknown"
+)
+
+// MatrixRequest checks every target from the pods of every source.
+type MatrixRequest struct {
+	Sources []Source       `json:"sources"`
+	Targets []MatrixTarget `json:"targets"`
+
+	TimeoutSeconds     int  `json:"timeoutSeconds,omitempty"`
+	Count              int  `json:"count,omitempty"`
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// Concurrency is how many pods are checked at the same time, default 10
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// Source selects running pods of a namespace in one or more clusters.
+type Source struct {
+	// Name identifies the source in diffs, default namespace/pod or namespace/selector
+	Name string `json:"name,omitempty"`
+	// Clusters are comma separated cluster codes, ClusterSelector is a glob pattern of them, all clusters when both are empty
+	Clusters        string `json:"clusters,omitempty"`
+	ClusterSelector string `json:"clusterSelector,omitempty"`
+	Namespace       string `json:"namespace"`
+	// Pod is the name of a pod, otherwise the pods matching the label Selector
+	Pod      string `json:"pod,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	// Limit is how many matching pods are checked per cluster, default 1
+	Limit int `json:"limit,omitempty"`
+}
+
+// MatrixTarget is a target, or a port of a service resolved in the cluster of every source pod.
+type MatrixTarget struct {
+	// Name identifies the target in diffs, default its url
+	Name string `json:"name,omitempty"`
+	Target
+	Service *ServiceTarget `json:"service,omitempty"`
+}
+
+// ServiceTarget is checked as tcp://name.namespace.svc:port, unless the scheme of the target is set.
+type ServiceTarget struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Port      int    `json:"port"`
+}
+
+// Matrix is the reachability of the targets from every source pod, it can be saved as a baseline.
+type Matrix struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Request checked again by a diff against the matrix
+	Request MatrixRequest `json:"request"`
+	// Targets are the resolved targets of the request, in the order of the cells of every row
+	Targets []MatrixTarget `json:"targets"`
+	Rows    []MatrixRow    `json:"rows"`
+	Summary MatrixSummary  `json:"summary"`
+}
+
+// MatrixRow is a source pod and the outcome of every target from it.
+type MatrixRow struct {
+	Source    string `json:"source"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	// Pod is empty if no pod of the source is running in the cluster
+	Pod string `json:"pod,omitempty"`
+	// Error tells why the targets were not checked from the pod
+	Error string `json:"error,omitempty"`
+	Cells []Cell `json:"cells,omitempty"`
+}
+
+type Cell struct {
+	Target  string `json:"target"`
+	Success bool   `json:"success"`
+	// DurationMs is the sum of the durations of the steps
+	DurationMs float64 `json:"durationMs"`
+	FailedStep string  `json:"failedStep,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	Steps      []Step  `json:"steps"`
+}
+
+type MatrixSummary struct {
+	Paths       int `json:"paths"`
+	Reachable   int `json:"reachable"`
+	Unreachable int `json:"unreachable"`
+	// Errors are the rows whose targets were not checked
+	Errors int `json:"errors"`
+}
+
+// DiffRequest compares Current with Baseline, the request of Baseline is checked again if Current is nil.
+type DiffRequest struct {
+	Baseline Matrix  `json:"baseline"`
+	Current  *Matrix `json:"current,omitempty"`
+}
+
+// MatrixDiff lists the paths whose state changed since the baseline,
+// a path is a target from a source in a cluster, its pods are aggregated.
+type MatrixDiff struct {
+	APIVersion        string       `json:"apiVersion"`
+	Kind              string       `json:"kind"`
+	BaselineCreatedAt time.Time    `json:"baselineCreatedAt"`
+	Current           Matrix       `json:"current"`
+	Changes           []PathChange `json:"changes"`
+	// Broken are the changes from Reachable, Fixed the ones to Reachable
+	Broken int `json:"broken"`
+	Fixed  int `json:"fixed"`
+}
+
+type PathChange struct {
+	Source  string `json:"source"`
+	Cluster string `json:"cluster"`
+	Target  string `json:"target"`
+	Before  string `json:"before"`
+	After   string `json:"after"`
+}
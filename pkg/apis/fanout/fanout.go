@@ -0,0 +1,47 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// ClusterAnnotation is set on every item of List to the code of the cluster it comes from.
+const ClusterAnnotation = "hcnmp.io/cluster"
+
+// List is the merged result of a LIST sent to multiple clusters.
+type List struct {
+	APIVersion string                      `json:"apiVersion"`
+	Kind       string                      `json:"kind"`
+	Items      []unstructured.Unstructured `json:"items"`
+	// Clusters are the codes of clusters listed successfully
+	Clusters []string `json:"clusters"`
+	// Errors are the clusters failed to list
+	Errors []ClusterError `json:"errors,omitempty"`
+	// Continue holds the continue token of the clusters with more items,
+	// the rest is listed by ?clusters={code}&continue={token}
+	Continue map[string]string `json:"continue,omitempty"`
+	// Truncated are the clusters listed successfully but left out since the List reached the max items,
+	// they are listed again by ?clusters=
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+type ClusterError struct {
+	Cluster string `json:"cluster"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+}
@@ -0,0 +1,77 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// NodeDetail is the capacity of a node and the workloads consuming it.
+type NodeDetail struct {
+	Name          string `json:"name"`
+	Unschedulable bool   `json:"unschedulable"`
+	// Conditions are the Ready and the pressure conditions of the node
+	Conditions []corev1.NodeCondition `json:"conditions"`
+	Taints     []corev1.Taint         `json:"taints"`
+
+	Capacity    Resources `json:"capacity"`
+	Allocatable Resources `json:"allocatable"`
+	// Allocated is the sum of the non-terminated pods on the node
+	Allocated Allocated `json:"allocated"`
+
+	Namespaces []NamespaceBreakdown `json:"namespaces"`
+}
+
+type Resources struct {
+	CPU    resource.Quantity `json:"cpu"`
+	Memory resource.Quantity `json:"memory"`
+	Pods   int64             `json:"pods"`
+}
+
+// Allocated is what pods request, are limited to and use.
+type Allocated struct {
+	Requests Resources `json:"requests"`
+	Limits   Resources `json:"limits"`
+	// Usage is nil without metrics-server
+	Usage *Resources `json:"usage,omitempty"`
+
+	// Percent of the allocatable resources of the node
+	RequestsPercent Percent  `json:"requestsPercent"`
+	LimitsPercent   Percent  `json:"limitsPercent"`
+	UsagePercent    *Percent `json:"usagePercent,omitempty"`
+}
+
+type Percent struct {
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+}
+
+type NamespaceBreakdown struct {
+	Namespace string    `json:"namespace"`
+	Allocated Allocated `json:"allocated"`
+	// Owners are the controllers of the pods, e.g. a Deployment instead of its ReplicaSets
+	Owners []OwnerBreakdown `json:"owners"`
+}
+
+type OwnerBreakdown struct {
+	// Kind and Name are empty for pods without controller
+	Kind      string    `json:"kind"`
+	Name      string    `json:"name"`
+	Allocated Allocated `json:"allocated"`
+	Pods      []string  `json:"pods"`
+}
@@ -0,0 +1,88 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operation
+
+import "time"
+
+type State string
+
+const (
+	StateRunning   State = "Running"
+	StateSucceeded State = "Succeeded"
+	StateFailed    State = "Failed"
+	StateCancelled State = "Cancelled"
+)
+
+// Finished reports whether the operation will not change anymore.
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCancelled
+}
+
+const (
+	EventTypeNormal  = "Normal"
+	EventTypeWarning = "Warning"
+)
+
+// Operation is a long-running action of hcnmp, e.g. restarting a workload and waiting until it is ready.
+type Operation struct {
+	ID string `json:"id"`
+	// Type is the action, e.g. restart
+	Type    string `json:"type"`
+	User    string `json:"user"`
+	Cluster string `json:"cluster"`
+	Target  Target `json:"target"`
+
+	State State `json:"state"`
+	// Progress is nil until the operation reports it
+	Progress *Progress `json:"progress,omitempty"`
+	// Error is why the operation failed or was cancelled
+	Error string `json:"error,omitempty"`
+	// Result is the object the operation produced, e.g. the ready workload
+	Result interface{} `json:"result,omitempty"`
+	// Events are the latest events of the operation, the oldest first
+	Events []Event `json:"events"`
+
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	// Deadline is when the operation fails if it is still running
+	Deadline *time.Time `json:"deadline,omitempty"`
+}
+
+// Target is the object the operation acts on.
+type Target struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+type Progress struct {
+	Current int    `json:"current"`
+	Total   int    `json:"total"`
+	Message string `json:"message,omitempty"`
+}
+
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
+}
+
+type OperationList struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Items      []Operation `json:"items"`
+}
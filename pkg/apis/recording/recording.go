@@ -0,0 +1,45 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package recording
+
+import "time"
+
+// Recording is the index entry of a recorded exec terminal session, the session itself is an asciicast v2 file.
+type Recording struct {
+	ID        string   `json:"id"`
+	User      string   `json:"user"`
+	Cluster   string   `json:"cluster"`
+	Namespace string   `json:"namespace"`
+	Pod       string   `json:"pod"`
+	Container string   `json:"container,omitempty"`
+	Command   []string `json:"command"`
+
+	StartedAt time.Time  `json:"startedAt"`
+	EndedAt   *time.Time `json:"endedAt,omitempty"`
+	// ExitCode is the exit code of the command, nil while the session is running or when it failed
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Error is why the session failed
+	Error string `json:"error,omitempty"`
+	// Size is the bytes of the asciicast file
+	Size int64 `json:"size"`
+}
+
+type RecordingList struct {
+	APIVersion string      `json:"apiVersion"`
+	Kind       string      `json:"kind"`
+	Items      []Recording `json:"items"`
+}
@@ -0,0 +1,44 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package workload
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Revision is a revision of a workload, a replicaset of a deployment
+// or a controller revision of a statefulset or daemonset.
+type Revision struct {
+	Revision int64 `json:"revision"`
+	// Name is the name of the replicaset or controller revision
+	Name        string    `json:"name"`
+	ChangeCause string    `json:"changeCause,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Current tells whether the workload runs the revision
+	Current bool     `json:"current"`
+	Images  []string `json:"images"`
+
+	Template *corev1.PodTemplateSpec `json:"template,omitempty"`
+}
+
+type RevisionList struct {
+	APIVersion string     `json:"apiVersion"`
+	Kind       string     `json:"kind"`
+	Items      []Revision `json:"items"`
+}
@@ -0,0 +1,309 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package diagnostics checks the network reachability of targets without any tool of the container image,
+// it runs in the network namespace of a pod as the diagnose command of hcnmp.
+package diagnostics
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+)
+
+const (
+	DefaultTimeout = 2 * time.Second
+	DefaultCount   = 3
+
+	// MaxCount bounds the connects measuring the latency
+	MaxCount = 20
+	// MaxTargets bounds the targets of a run
+	MaxTargets = 50
+)
+
+// Options configures a run.
+type Options struct {
+	// Timeout bounds every step
+	Timeout            time.Duration
+	Count              int
+	InsecureSkipVerify bool
+}
+
+// Validate checks that the target is well-formed, it never reaches a shell but is passed as a url.
+func Validate(target *diagnostics.Target) error {
+	switch target.Scheme {
+	case diagnostics.SchemeDNS, diagnostics.SchemeTCP, diagnostics.SchemeHTTP, diagnostics.SchemeHTTPS:
+	default:
+		return fmt.Errorf("scheme of target %q must be dns, tcp, http or https", target.Host)
+	}
+
+	if net.ParseIP(target.Host) == nil {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimSuffix(target.Host, ".")); len(errs) != 0 {
+			return fmt.Errorf("host %q must be an ip or a dns name: %v", target.Host, strings.Join(errs, ", "))
+		}
+	}
+
+	if target.Port < 0 || target.Port > 65535 {
+		return fmt.Errorf("port of target %q must be between 1 and 65535", target.Host)
+	}
+	if target.Scheme == diagnostics.SchemeTCP && target.Port == 0 {
+		return fmt.Errorf("port of tcp target %q is required", target.Host)
+	}
+
+	if len(target.Path) != 0 {
+		if target.Scheme != diagnostics.SchemeHTTP && target.Scheme != diagnostics.SchemeHTTPS {
+			return fmt.Errorf("path of target %q is only supported by http and https", target.Host)
+		}
+		u, err := url.ParseRequestURI(target.Path)
+		if err != nil || len(u.Host) != 0 || !strings.HasPrefix(target.Path, "/") {
+			return fmt.Errorf("path %q of target %q must be an absolute path", target.Path, target.Host)
+		}
+	}
+	return nil
+}
+
+// TargetURL formats the target as scheme://host[:port][path].
+func TargetURL(target *diagnostics.Target) string {
+	u := url.URL{Scheme: target.Scheme, Host: target.Host}
+	if target.Port != 0 {
+		u.Host = net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	}
+	if len(target.Path) != 0 {
+		if pathURL, err := url.ParseRequestURI(target.Path); err == nil {
+			u.Path, u.RawQuery = pathURL.Path, pathURL.RawQuery
+		}
+	}
+	return u.String()
+}
+
+// ParseTarget parses and validates a target formatted by TargetURL.
+func ParseTarget(s string) (*diagnostics.Target, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %v", s, err)
+	}
+
+	target := &diagnostics.Target{
+		Scheme: u.Scheme,
+		Host:   u.Hostname(),
+		Path:   u.RequestURI(),
+	}
+	if target.Path == "/" && !strings.HasSuffix(s, "/") {
+		target.Path = ""
+	}
+	if port := u.Port(); len(port) != 0 {
+		if target.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid port of target %q", s)
+		}
+	}
+	if err := Validate(target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// Run checks the targets concurrently, the results are in the order of the targets.
+func Run(ctx context.Context, targets []diagnostics.Target, opts Options) []diagnostics.Result {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Count <= 0 {
+		opts.Count = DefaultCount
+	}
+
+	results := make([]diagnostics.Result, len(targets))
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = check(ctx, targets[i], opts)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func check(ctx context.Context, target diagnostics.Target, opts Options) diagnostics.Result {
+	result := diagnostics.Result{
+		Target: target,
+		Steps:  []diagnostics.Step{},
+	}
+	port := target.Port
+	if port == 0 {
+		port = map[string]int{diagnostics.SchemeHTTP: 80, diagnostics.SchemeHTTPS: 443}[target.Scheme]
+	}
+
+	steps := []func() diagnostics.Step{
+		func() diagnostics.Step { return resolve(ctx, target.Host, opts) },
+	}
+	if target.Scheme != diagnostics.SchemeDNS {
+		address := net.JoinHostPort(target.Host, strconv.Itoa(port))
+		steps = append(steps,
+			func() diagnostics.Step { return connect(ctx, address, opts) },
+			func() diagnostics.Step { return latency(ctx, address, opts) },
+		)
+	}
+	if target.Scheme == diagnostics.SchemeHTTP || target.Scheme == diagnostics.SchemeHTTPS {
+		steps = append(steps, func() diagnostics.Step { return get(ctx, target, port, opts) })
+	}
+
+	for _, step := range steps {
+		s := step()
+		result.Steps = append(result.Steps, s)
+		if !s.Success {
+			return result
+		}
+	}
+	result.Success = true
+	return result
+}
+
+func resolve(ctx context.Context, host string, opts Options) diagnostics.Step {
+	step := diagnostics.Step{Name: diagnostics.StepDNS}
+	if ip := net.ParseIP(host); ip != nil {
+		step.Success = true
+		step.Addresses = []string{ip.String()}
+		return step
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	step.DurationMs = milliseconds(time.Since(start))
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	step.Success = true
+	step.Addresses = addresses
+	return step
+}
+
+func connect(ctx context.Context, address string, opts Options) diagnostics.Step {
+	step := diagnostics.Step{Name: diagnostics.StepTCP}
+
+	start := time.Now()
+	conn, err := (&net.Dialer{Timeout: opts.Timeout}).DialContext(ctx, "tcp", address)
+	step.DurationMs = milliseconds(time.Since(start))
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	defer conn.Close()
+
+	step.Success = true
+	step.Address = conn.RemoteAddr().String()
+	return step
+}
+
+// latency connects Count times, it fails only if no connect succeeds.
+func latency(ctx context.Context, address string, opts Options) diagnostics.Step {
+	step := diagnostics.Step{Name: diagnostics.StepLatency}
+	l := &diagnostics.Latency{Count: opts.Count}
+
+	var (
+		total   time.Duration
+		lastErr error
+	)
+	start := time.Now()
+	for i := 0; i < opts.Count; i++ {
+		connectStart := time.Now()
+		conn, err := (&net.Dialer{Timeout: opts.Timeout}).DialContext(ctx, "tcp", address)
+		elapsed := time.Since(connectStart)
+		if err != nil {
+			l.Failed++
+			lastErr = err
+			continue
+		}
+		conn.Close()
+
+		ms := milliseconds(elapsed)
+		if total == 0 || ms < l.MinMs {
+			l.MinMs = ms
+		}
+		l.MaxMs = max(l.MaxMs, ms)
+		total += elapsed
+	}
+	step.DurationMs = milliseconds(time.Since(start))
+	step.Latency = l
+
+	if succeeded := l.Count - l.Failed; succeeded != 0 {
+		l.AvgMs = milliseconds(total / time.Duration(succeeded))
+		step.Success = true
+	}
+	if lastErr != nil {
+		step.Error = lastErr.Error()
+	}
+	return step
+}
+
+func get(ctx context.Context, target diagnostics.Target, port int, opts Options) diagnostics.Step {
+	step := diagnostics.Step{Name: diagnostics.StepHTTP}
+
+	u := TargetURL(&diagnostics.Target{Scheme: target.Scheme, Host: target.Host, Port: port, Path: target.Path})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		step.Error = err.Error()
+		return step
+	}
+	client := &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			// only the network of the pod is checked
+			Proxy:             nil,
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}, //nolint:gosec
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		step.DurationMs = milliseconds(time.Since(start))
+		step.Error = err.Error()
+		return step
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	step.DurationMs = milliseconds(time.Since(start))
+
+	step.StatusCode = resp.StatusCode
+	// any response proves the target is reachable, server errors are reported as failures
+	step.Success = resp.StatusCode < http.StatusInternalServerError
+	if !step.Success {
+		step.Error = resp.Status
+	}
+	return step
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
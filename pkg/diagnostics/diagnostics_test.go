@@ -0,0 +1,98 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"testing"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  diagnostics.Target
+		wantErr bool
+	}{
+		{name: "dns", target: diagnostics.Target{Scheme: diagnostics.SchemeDNS, Host: "kube-dns.kube-system.svc"}},
+		{name: "fqdn", target: diagnostics.Target{Scheme: diagnostics.SchemeDNS, Host: "example.com."}},
+		{name: "tcp", target: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "10.0.0.1", Port: 5432}},
+		{name: "ipv6", target: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "fd00::1", Port: 443}},
+		{name: "http", target: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "web.default.svc"}},
+		{name: "https with path", target: diagnostics.Target{Scheme: diagnostics.SchemeHTTPS, Host: "example.com", Port: 8443, Path: "/healthz?verbose=1"}},
+		{name: "unknown scheme", target: diagnostics.Target{Scheme: "ftp", Host: "example.com"}, wantErr: true},
+		{name: "empty scheme", target: diagnostics.Target{Host: "example.com"}, wantErr: true},
+		{name: "empty host", target: diagnostics.Target{Scheme: diagnostics.SchemeDNS}, wantErr: true},
+		{name: "invalid host", target: diagnostics.Target{Scheme: diagnostics.SchemeDNS, Host: "example.com;reboot"}, wantErr: true},
+		{name: "uppercase host", target: diagnostics.Target{Scheme: diagnostics.SchemeDNS, Host: "Example.com"}, wantErr: true},
+		{name: "tcp without port", target: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "db"}, wantErr: true},
+		{name: "negative port", target: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "db", Port: -1}, wantErr: true},
+		{name: "port too large", target: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "db", Port: 65536}, wantErr: true},
+		{name: "path of tcp", target: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "db", Port: 5432, Path: "/"}, wantErr: true},
+		{name: "relative path", target: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "web", Path: "healthz"}, wantErr: true},
+		{name: "path with host", target: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "web", Path: "http://evil.com/"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(&tt.target); (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%+v) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    diagnostics.Target
+		wantErr bool
+	}{
+		{target: "dns://kube-dns.kube-system.svc", want: diagnostics.Target{Scheme: diagnostics.SchemeDNS, Host: "kube-dns.kube-system.svc"}},
+		{target: "tcp://db:5432", want: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "db", Port: 5432}},
+		{target: "tcp://[fd00::1]:443", want: diagnostics.Target{Scheme: diagnostics.SchemeTCP, Host: "fd00::1", Port: 443}},
+		{target: "http://web.default.svc", want: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "web.default.svc"}},
+		{target: "http://web.default.svc/", want: diagnostics.Target{Scheme: diagnostics.SchemeHTTP, Host: "web.default.svc", Path: "/"}},
+		{target: "https://example.com:8443/healthz?verbose=1", want: diagnostics.Target{Scheme: diagnostics.SchemeHTTPS, Host: "example.com", Port: 8443, Path: "/healthz?verbose=1"}},
+		{target: "tcp://db", wantErr: true},
+		{target: "tcp://db:port", wantErr: true},
+		{target: "ftp://example.com", wantErr: true},
+		{target: "example.com:80", wantErr: true},
+		{target: "dns://example.com/path", wantErr: true},
+		{target: "http://exa mple.com", wantErr: true},
+		{target: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			got, err := ParseTarget(tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTarget(%q) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if *got != tt.want {
+				t.Errorf("ParseTarget(%q) = %+v, want %+v", tt.target, *got, tt.want)
+			}
+			// the target is formatted back as is
+			if s := TargetURL(got); s != tt.target {
+				t.Errorf("TargetURL(ParseTarget(%q)) = %q", tt.target, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+)
+
+// ResolveTarget fills the target of a service and defaults the name, then validates it.
+func ResolveTarget(target *diagnostics.MatrixTarget) error {
+	if svc := target.Service; svc != nil {
+		if errs := validation.IsDNS1035Label(svc.Name); len(errs) != 0 {
+			return fmt.Errorf("invalid service name %q: %v", svc.Name, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsDNS1123Label(svc.Namespace); len(errs) != 0 {
+			return fmt.Errorf("invalid namespace %q of service %v: %v", svc.Namespace, svc.Name, strings.Join(errs, ", "))
+		}
+		if len(target.Scheme) == 0 {
+			target.Scheme = diagnostics.SchemeTCP
+		}
+		target.Host = svc.Name + "." + svc.Namespace + ".svc"
+		target.Port = svc.Port
+	}
+
+	if err := Validate(&target.Target); err != nil {
+		return err
+	}
+	if len(target.Name) == 0 {
+		target.Name = TargetURL(&target.Target)
+	}
+	return nil
+}
+
+// SourceName is the name of the source, or namespace/pod or namespace/selector by default.
+func SourceName(source *diagnostics.Source) string {
+	if len(source.Name) != 0 {
+		return source.Name
+	}
+	if len(source.Pod) != 0 {
+		return source.Namespace + "/" + source.Pod
+	}
+	if len(source.Selector) != 0 {
+		return source.Namespace + "/" + source.Selector
+	}
+	return source.Namespace + "/*"
+}
+
+// Summarize counts the paths of the rows of the matrix.
+func Summarize(m *diagnostics.Matrix) {
+	m.Summary = diagnostics.MatrixSummary{}
+	for _, row := range m.Rows {
+		if len(row.Error) != 0 {
+			m.Summary.Errors++
+			continue
+		}
+		for _, cell := range row.Cells {
+			m.Summary.Paths++
+			if cell.Success {
+				m.Summary.Reachable++
+			} else {
+				m.Summary.Unreachable++
+			}
+		}
+	}
+}
+
+// Diff compares the states of the paths of the matrices, the changes are sorted by source, cluster and target.
+func Diff(baseline, current *diagnostics.Matrix) []diagnostics.PathChange {
+	before, after := pathStates(baseline), pathStates(current)
+
+	changes := []diagnostics.PathChange{}
+	for key, state := range after {
+		prev, ok := before[key]
+		if !ok {
+			prev = diagnostics.PathUnknown
+		}
+		if prev != state {
+			changes = append(changes, change(key, prev, state))
+		}
+	}
+	for key, prev := range before {
+		if _, ok := after[key]; !ok && prev != diagnostics.PathUnknown {
+			changes = append(changes, change(key, prev, diagnostics.PathUnknown))
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Target < b.Target
+	})
+	return changes
+}
+
+// pathKey is a target from a source in a cluster.
+type pathKey struct {
+	source, cluster, target string
+}
+
+func change(key pathKey, before, after string) diagnostics.PathChange {
+	return diagnostics.PathChange{
+		Source:  key.source,
+		Cluster: key.cluster,
+		Target:  key.target,
+		Before:  before,
+		After:   after,
+	}
+}
+
+// pathStates aggregates the cells of the pods of every source and cluster,
+// rows with errors make the paths of their source Unknown unless another pod checked them.
+func pathStates(m *diagnostics.Matrix) map[pathKey]string {
+	type counts struct{ reachable, unreachable int }
+	paths := make(map[pathKey]*counts)
+
+	for _, row := range m.Rows {
+		if len(row.Error) != 0 {
+			for _, target := range m.Targets {
+				key := pathKey{source: row.Source, cluster: row.Cluster, target: target.Name}
+				if _, ok := paths[key]; !ok {
+					paths[key] = &counts{}
+				}
+			}
+			continue
+		}
+		for _, cell := range row.Cells {
+			key := pathKey{source: row.Source, cluster: row.Cluster, target: cell.Target}
+			if _, ok := paths[key]; !ok {
+				paths[key] = &counts{}
+			}
+			if cell.Success {
+				paths[key].reachable++
+			} else {
+				paths[key].unreachable++
+			}
+		}
+	}
+
+	states := make(map[pathKey]string, len(paths))
+	for key, c := range paths {
+		switch {
+		case c.reachable != 0 && c.unreachable != 0:
+			states[key] = diagnostics.PathPartial
+		case c.reachable != 0:
+			states[key] = diagnostics.PathReachable
+		case c.unreachable != 0:
+			states[key] = diagnostics.PathUnreachable
+		default:
+			states[key] = diagnostics.PathUnknown
+		}
+	}
+	return states
+}
+
+// Cell converts the result of a target to a cell of the matrix.
+func Cell(name string, result *diagnostics.Result) diagnostics.Cell {
+	cell := diagnostics.Cell{
+		Target:  name,
+		Success: result.Success,
+		Steps:   result.Steps,
+	}
+	for _, step := range result.Steps {
+		cell.DurationMs += step.DurationMs
+		if !step.Success {
+			cell.FailedStep = step.Name
+			cell.Error = step.Error
+		}
+	}
+	cell.DurationMs = math.Round(cell.DurationMs*1000) / 1000
+	return cell
+}
@@ -0,0 +1,121 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+)
+
+// testMatrix is a matrix of the targets db and web with rows.
+func testMatrix(rows ...diagnostics.MatrixRow) *diagnostics.Matrix {
+	return &diagnostics.Matrix{
+		Targets: []diagnostics.MatrixTarget{{Name: "db"}, {Name: "web"}},
+		Rows:    rows,
+	}
+}
+
+// testRow is a row of a pod of source in cluster, reachable maps the checked targets to their success.
+func testRow(source, cluster string, reachable map[string]bool) diagnostics.MatrixRow {
+	row := diagnostics.MatrixRow{Source: source, Cluster: cluster}
+	for _, target := range []string{"db", "web"} {
+		if success, ok := reachable[target]; ok {
+			row.Cells = append(row.Cells, diagnostics.Cell{Target: target, Success: success})
+		}
+	}
+	return row
+}
+
+func testErrorRow(source, cluster string) diagnostics.MatrixRow {
+	return diagnostics.MatrixRow{Source: source, Cluster: cluster, Error: "no running pod"}
+}
+
+func TestDiff(t *testing.T) {
+	both := map[string]bool{"db": true, "web": true}
+
+	tests := []struct {
+		name     string
+		baseline *diagnostics.Matrix
+		current  *diagnostics.Matrix
+		want     []diagnostics.PathChange
+	}{
+		{
+			name:     "unchanged",
+			baseline: testMatrix(testRow("app", "dev", both)),
+			current:  testMatrix(testRow("app", "dev", both)),
+			want:     []diagnostics.PathChange{},
+		},
+		{
+			name:     "unreachable",
+			baseline: testMatrix(testRow("app", "dev", both)),
+			current:  testMatrix(testRow("app", "dev", map[string]bool{"db": false, "web": true})),
+			want: []diagnostics.PathChange{
+				{Source: "app", Cluster: "dev", Target: "db", Before: diagnostics.PathReachable, After: diagnostics.PathUnreachable},
+			},
+		},
+		{
+			name:     "one of the pods fails",
+			baseline: testMatrix(testRow("app", "dev", both), testRow("app", "dev", both)),
+			current:  testMatrix(testRow("app", "dev", both), testRow("app", "dev", map[string]bool{"db": true, "web": false})),
+			want: []diagnostics.PathChange{
+				{Source: "app", Cluster: "dev", Target: "web", Before: diagnostics.PathReachable, After: diagnostics.PathPartial},
+			},
+		},
+		{
+			name:     "error row",
+			baseline: testMatrix(testRow("app", "dev", both)),
+			current:  testMatrix(testErrorRow("app", "dev")),
+			want: []diagnostics.PathChange{
+				{Source: "app", Cluster: "dev", Target: "db", Before: diagnostics.PathReachable, After: diagnostics.PathUnknown},
+				{Source: "app", Cluster: "dev", Target: "web", Before: diagnostics.PathReachable, After: diagnostics.PathUnknown},
+			},
+		},
+		{
+			name:     "error row of another pod of the source",
+			baseline: testMatrix(testRow("app", "dev", both)),
+			current:  testMatrix(testErrorRow("app", "dev"), testRow("app", "dev", both)),
+			want:     []diagnostics.PathChange{},
+		},
+		{
+			name:     "still unknown",
+			baseline: testMatrix(testErrorRow("app", "dev")),
+			current:  testMatrix(),
+			want:     []diagnostics.PathChange{},
+		},
+		{
+			name:     "new and removed paths sorted by source, cluster and target",
+			baseline: testMatrix(testRow("app", "prod", map[string]bool{"web": true}), testRow("api", "dev", map[string]bool{"db": false})),
+			current:  testMatrix(testRow("app", "dev", map[string]bool{"web": true}), testRow("api", "dev", both)),
+			want: []diagnostics.PathChange{
+				{Source: "api", Cluster: "dev", Target: "db", Before: diagnostics.PathUnreachable, After: diagnostics.PathReachable},
+				{Source: "api", Cluster: "dev", Target: "web", Before: diagnostics.PathUnknown, After: diagnostics.PathReachable},
+				{Source: "app", Cluster: "dev", Target: "web", Before: diagnostics.PathUnknown, After: diagnostics.PathReachable},
+				{Source: "app", Cluster: "prod", Target: "web", Before: diagnostics.PathReachable, After: diagnostics.PathUnknown},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.baseline, tt.current); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
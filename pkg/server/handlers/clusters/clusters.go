@@ -215,6 +215,37 @@ func (h *handler) getClusters(c *gin.Context) {
 	c.JSON(http.StatusOK, clusterInfos)
 }
 
+func (h *handler) getClusterStatus(c *gin.Context) {
+	clusterCode := c.Param("clusterCode")
+	breakerStatus, err := proxy.GetClusterBreakerStatus(clusterCode)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, cluster.ClusterStatus{
+		Code:           clusterCode,
+		CircuitBreaker: breakerStatus,
+	})
+}
+
+func (h *handler) getClustersStatus(c *gin.Context) {
+	codes := proxy.ListClusterCodes()
+	clusterStatus := make([]cluster.ClusterStatus, 0, len(codes))
+	for i := range codes {
+		breakerStatus, err := proxy.GetClusterBreakerStatus(codes[i])
+		if err != nil {
+			continue
+		}
+		clusterStatus = append(clusterStatus, cluster.ClusterStatus{
+			Code:           codes[i],
+			CircuitBreaker: breakerStatus,
+		})
+	}
+
+	c.JSON(http.StatusOK, clusterStatus)
+}
+
 func (h *handler) updateCluster(c *gin.Context) {
 	clusterCode := c.Param("clusterCode")
 	if _, err := proxy.GetClusterPorxyClientFromCode(clusterCode); err != nil {
@@ -244,6 +275,7 @@ func (h *handler) updateCluster(c *gin.Context) {
 		return
 	}
 
+	var impersonation *cluster.Impersonation
 	if cm.BinaryData != nil {
 		// no change in preprocessed cluster information
 		data := cm.BinaryData[clusterCode]
@@ -258,6 +290,7 @@ func (h *handler) updateCluster(c *gin.Context) {
 			return
 		}
 
+		impersonation = clusterInfo.Impersonation
 		delete(cm.BinaryData, clusterCode)
 	}
 
@@ -290,9 +323,10 @@ func (h *handler) updateCluster(c *gin.Context) {
 	}
 
 	clusterInfo := cluster.ClusterInfo{
-		ID:         string(ns.UID),
-		Code:       clusterCode,
-		Kubeconfig: kubeconfig,
+		ID:            string(ns.UID),
+		Code:          clusterCode,
+		Kubeconfig:    kubeconfig,
+		Impersonation: impersonation,
 	}
 
 	if newData, err := utils.Std2Jsoniter.Marshal(clusterInfo); err != nil {
@@ -310,6 +344,53 @@ func (h *handler) updateCluster(c *gin.Context) {
 	c.JSON(http.StatusOK, nil)
 }
 
+func (h *handler) updateClusterImpersonation(c *gin.Context) {
+	clusterCode := c.Param("clusterCode")
+	if _, err := proxy.GetClusterPorxyClientFromCode(clusterCode); err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	impersonation := &cluster.Impersonation{}
+	if err := c.ShouldBindJSON(impersonation); err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	cm, err := h.client.CoreV1().ConfigMaps(h.namespace).Get(context.TODO(), h.clusterInfos, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	data, ok := cm.BinaryData[clusterCode]
+	if !ok {
+		servererror.HandleError(c, http.StatusNotFound, fmt.Errorf("cluster %v Not Found", clusterCode))
+		return
+	}
+
+	clusterInfo := &cluster.ClusterInfo{}
+	if err := utils.Std2Jsoniter.Unmarshal(data, clusterInfo); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	clusterInfo.Impersonation = impersonation
+
+	if newData, err := utils.Std2Jsoniter.Marshal(clusterInfo); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	} else {
+		cm.BinaryData[clusterCode] = newData
+	}
+
+	if _, err := h.client.CoreV1().ConfigMaps(h.namespace).Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
 func (h *handler) applyCluster(c *gin.Context) {
 	clusterCode := c.Param("clusterCode")
 	if _, err := proxy.GetClusterPorxyClientFromCode(clusterCode); err != nil {
@@ -335,6 +416,7 @@ func (h *handler) applyCluster(c *gin.Context) {
 			return
 		}
 	}
+	var impersonation *cluster.Impersonation
 	if cm.BinaryData == nil {
 		cm.BinaryData = make(map[string][]byte)
 	} else if data, ok := cm.BinaryData[clusterCode]; ok {
@@ -350,6 +432,7 @@ func (h *handler) applyCluster(c *gin.Context) {
 			return
 		}
 
+		impersonation = clusterInfo.Impersonation
 		delete(cm.BinaryData, clusterCode)
 	}
 
@@ -382,9 +465,10 @@ func (h *handler) applyCluster(c *gin.Context) {
 	}
 
 	clusterInfo := cluster.ClusterInfo{
-		ID:         string(ns.UID),
-		Code:       clusterCode,
-		Kubeconfig: kubeconfig,
+		ID:            string(ns.UID),
+		Code:          clusterCode,
+		Kubeconfig:    kubeconfig,
+		Impersonation: impersonation,
 	}
 
 	if newData, err := utils.Std2Jsoniter.Marshal(clusterInfo); err != nil {
@@ -17,6 +17,8 @@ limitations under the License.
 package clusters
 
 import (
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 
 	"github.com/gin-gonic/gin"
@@ -27,14 +29,21 @@ type handler struct {
 	clusterInfos      string
 	localClusterInfos string
 	client            clientset.Interface
+	tokens            *auth.Tokens
+	policy            *policy.Engine
+	externalURLs      []string
 }
 
-func InstallHandlers(routerGroup *gin.RouterGroup, namespace, clusterInfos, localClusterInfos string, client clientset.Interface) {
+func InstallHandlers(routerGroup *gin.RouterGroup, namespace, clusterInfos, localClusterInfos string, client clientset.Interface, tokens *auth.Tokens,
+	policyEngine *policy.Engine, externalURLs []string) {
 	h := &handler{
 		namespace:         namespace,
 		clusterInfos:      clusterInfos,
 		localClusterInfos: localClusterInfos,
 		client:            client,
+		tokens:            tokens,
+		policy:            policyEngine,
+		externalURLs:      externalURLs,
 	}
 
 	// /apis/cluster/v1/
@@ -44,8 +53,14 @@ func InstallHandlers(routerGroup *gin.RouterGroup, namespace, clusterInfos, loca
 		routerGroupV1.DELETE("/code/:clusterCode", h.removeCluster)
 		routerGroupV1.PUT("/code/:clusterCode", h.updateCluster)
 		routerGroupV1.GET("/code/:clusterCode", h.getCluster)
+		routerGroupV1.GET("/code/:clusterCode/status", h.getClusterStatus)
 		routerGroupV1.GET("/", h.getClusters)
+		routerGroupV1.GET("/status", h.getClustersStatus)
 		routerGroupV1.PATCH("/code/:clusterCode", h.applyCluster)
+		routerGroupV1.PUT("/code/:clusterCode/impersonation", h.updateClusterImpersonation)
+
+		// kubeconfig of the kubectl compatible gateway
+		routerGroupV1.GET("/kubeconfig", h.generateKubeconfig)
 	}
 
 }
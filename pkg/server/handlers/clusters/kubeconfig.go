@@ -0,0 +1,149 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusters
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	defaultKubeconfigTTL = 24 * time.Hour
+	maxKubeconfigTTL     = 30 * 24 * time.Hour
+)
+
+// generateKubeconfig returns a kubeconfig with one context per cluster the caller may access by the proxy policy,
+// every cluster points to the kubectl compatible gateway /clusters/{code} of hcnmp.
+// The kubeconfig carries a fresh bearer token, so callers authenticated by a bearer token are refused
+// to keep tokens from being renewed beyond their ttl.
+func (h *handler) generateKubeconfig(c *gin.Context) {
+	user := auth.User(c)
+	if len(user) == 0 {
+		servererror.HandleError(c, http.StatusUnauthorized, errors.New("unauthenticated user"))
+		return
+	}
+	if auth.TokenAuthenticated(c) {
+		servererror.HandleError(c, http.StatusForbidden, errors.New("kubeconfig can not be generated with a bearer token, use basic auth"))
+		return
+	}
+
+	ttl := defaultKubeconfigTTL
+	if ttlStr := c.Query("ttl"); len(ttlStr) != 0 {
+		var err error
+		if ttl, err = time.ParseDuration(ttlStr); err != nil {
+			servererror.HandleError(c, http.StatusBadRequest, err)
+			return
+		}
+		if ttl <= 0 || ttl > maxKubeconfigTTL {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("ttl must be positive and at most "+maxKubeconfigTTL.String()))
+			return
+		}
+	}
+
+	server, err := h.externalURL(c)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	codes := []string{}
+	for _, code := range proxy.ListClusterCodes() {
+		if err := h.policy.AuthorizeCluster(c, code); err != nil {
+			if apierrors.IsForbidden(err) {
+				continue
+			}
+			servererror.HandleError(c, http.StatusInternalServerError, err)
+			return
+		}
+		codes = append(codes, code)
+	}
+
+	token, _, err := h.tokens.Issue(user, ttl)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	authInfo := "hcnmp-" + user
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.AuthInfos[authInfo] = &clientcmdapi.AuthInfo{Token: token}
+
+	for i := range codes {
+		kubeconfig.Clusters[codes[i]] = &clientcmdapi.Cluster{
+			Server: server + "/clusters/" + codes[i],
+		}
+		kubeconfig.Contexts[codes[i]] = &clientcmdapi.Context{
+			Cluster:  codes[i],
+			AuthInfo: authInfo,
+		}
+	}
+	if len(codes) != 0 {
+		kubeconfig.CurrentContext = codes[0]
+	}
+
+	data, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/yaml", data)
+}
+
+// externalURL returns the base url of hcnmp written into the kubeconfig.
+// ?server= selects one of the configured external urls, the url of the request is used when none is configured,
+// the X-Forwarded headers are not trusted since the kubeconfig sends a bearer token to the url.
+func (h *handler) externalURL(c *gin.Context) (string, error) {
+	server := strings.TrimSuffix(c.Query("server"), "/")
+	if len(h.externalURLs) == 0 {
+		if len(server) != 0 {
+			return "", errors.New("server is not allowed without external urls configured")
+		}
+		return requestServer(c.Request), nil
+	}
+
+	if len(server) == 0 {
+		return strings.TrimSuffix(h.externalURLs[0], "/"), nil
+	}
+	for i := range h.externalURLs {
+		if server == strings.TrimSuffix(h.externalURLs[i], "/") {
+			return server, nil
+		}
+	}
+	return "", fmt.Errorf("server %q is not one of the external urls", server)
+}
+
+// requestServer returns the base url of hcnmp the request is sent to.
+func requestServer(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host
+}
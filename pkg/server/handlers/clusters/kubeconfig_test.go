@@ -0,0 +1,111 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clusters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+)
+
+func TestExternalURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		externalURLs []string
+		target       string
+		header       http.Header
+		want         string
+		wantErr      bool
+	}{
+		{name: "request host", target: "/kubeconfig", want: "http://hcnmp.example.com"},
+		{name: "forwarded headers ignored", target: "/kubeconfig",
+			header: http.Header{"X-Forwarded-Proto": {"https"}, "X-Forwarded-Host": {"attacker.example.com"}}, want: "http://hcnmp.example.com"},
+		{name: "server without external urls", target: "/kubeconfig?server=https://attacker.example.com", wantErr: true},
+		{name: "default external url", externalURLs: []string{"https://hcnmp.example.com/", "https://hcnmp.internal"},
+			target: "/kubeconfig", want: "https://hcnmp.example.com"},
+		{name: "selected external url", externalURLs: []string{"https://hcnmp.example.com", "https://hcnmp.internal"},
+			target: "/kubeconfig?server=https://hcnmp.internal/", want: "https://hcnmp.internal"},
+		{name: "server not in external urls", externalURLs: []string{"https://hcnmp.example.com"},
+			target: "/kubeconfig?server=https://attacker.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, tt.target, nil)
+			c.Request.Host = "hcnmp.example.com"
+			for k, v := range tt.header {
+				c.Request.Header[k] = v
+			}
+
+			h := &handler{externalURLs: tt.externalURLs}
+			got, err := h.externalURL(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("externalURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("externalURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateKubeconfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens := auth.NewTokens([]byte("0123456789abcdef0123456789abcdef"))
+	token, _, err := tokens.Issue("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &handler{tokens: tokens, policy: policy.NewEngine("hcnmp-system", "")}
+	router := gin.New()
+	router.GET("/kubeconfig", auth.MultiAuth(gin.Accounts{"alice": "secret"}, tokens), h.generateKubeconfig)
+
+	tests := []struct {
+		name   string
+		target string
+		auth   func(req *http.Request)
+		want   int
+	}{
+		{name: "basic auth", target: "/kubeconfig", auth: func(req *http.Request) { req.SetBasicAuth("alice", "secret") }, want: http.StatusOK},
+		{name: "bearer token", target: "/kubeconfig", auth: func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }, want: http.StatusForbidden},
+		{name: "unauthenticated", target: "/kubeconfig", auth: func(req *http.Request) {}, want: http.StatusUnauthorized},
+		{name: "bad ttl", target: "/kubeconfig?ttl=1y", auth: func(req *http.Request) { req.SetBasicAuth("alice", "secret") }, want: http.StatusBadRequest},
+		{name: "ttl too long", target: "/kubeconfig?ttl=1000h", auth: func(req *http.Request) { req.SetBasicAuth("alice", "secret") }, want: http.StatusBadRequest},
+		{name: "untrusted server", target: "/kubeconfig?server=https://attacker.example.com",
+			auth: func(req *http.Request) { req.SetBasicAuth("alice", "secret") }, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			tt.auth(req)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operations
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+)
+
+type handler struct {
+	manager *operation.Manager
+}
+
+func InstallHandlers(routerGroup *gin.RouterGroup, manager *operation.Manager) {
+	h := &handler{
+		manager: manager,
+	}
+
+	// /apis/operations/v1/
+	routerGroupV1 := routerGroup.Group("/v1")
+	{
+		routerGroupV1.GET("/", h.listOperations)
+		routerGroupV1.GET("/:id", h.getOperation)
+		routerGroupV1.POST("/:id/cancel", h.cancelOperation)
+	}
+}
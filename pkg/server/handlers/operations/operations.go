@@ -0,0 +1,125 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operations
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	operationapi "github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+)
+
+// listOperations lists the operations filtered by user, cluster, type and state,
+// users who are not admins only get their own operations.
+func (h *handler) listOperations(c *gin.Context) {
+	filter := operation.Filter{
+		User:    c.Query("user"),
+		Cluster: c.Query("cluster"),
+		Type:    c.Query("type"),
+		State:   operationapi.State(c.Query("state")),
+	}
+	if user := auth.User(c); !h.manager.IsAdmin(user) {
+		filter.User = user
+	}
+
+	c.JSON(http.StatusOK, operationapi.OperationList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Items:      h.manager.List(filter),
+	})
+}
+
+// getOperation returns the operation, or streams it as SSE "operation" events on every change
+// until it finishes when the request accepts text/event-stream or format=sse.
+func (h *handler) getOperation(c *gin.Context) {
+	op, ok := h.accessibleOperation(c)
+	if !ok {
+		return
+	}
+
+	if c.Query("format") != "sse" && !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		c.JSON(http.StatusOK, op)
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	for {
+		op, changed, err := h.manager.Updates(op.ID)
+		if err != nil {
+			c.SSEvent("error", err.Error())
+			c.Writer.Flush()
+			return
+		}
+		c.SSEvent("operation", op)
+		c.Writer.Flush()
+		if op.State.Finished() {
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+// cancelOperation cancels the running operation, operations which already finished get a 409.
+func (h *handler) cancelOperation(c *gin.Context) {
+	op, ok := h.accessibleOperation(c)
+	if !ok {
+		return
+	}
+
+	cancelled, err := h.manager.Cancel(op.ID, auth.User(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, operation.ErrFinished):
+			servererror.HandleError(c, http.StatusConflict, err)
+		case errors.Is(err, operation.ErrNotFound):
+			servererror.HandleError(c, http.StatusNotFound, err)
+		default:
+			servererror.HandleError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, cancelled)
+}
+
+// accessibleOperation returns the operation of :id if the user may access it, otherwise replies with the error.
+func (h *handler) accessibleOperation(c *gin.Context) (*operationapi.Operation, bool) {
+	op, err := h.manager.Get(c.Param("id"))
+	if err == nil && !h.manager.CanAccess(auth.User(c), op) {
+		// do not tell others whether the operation exists
+		err = operation.ErrNotFound
+	}
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return nil, false
+	}
+	return op, true
+}
@@ -0,0 +1,260 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	debugapi "github.com/helen-frank/hcnmp/pkg/apis/debug"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// diagnosticsContainerPrefix names the ephemeral containers running the network diagnostics
+	diagnosticsContainerPrefix = "hcnmp-diagnostics"
+	// debugContainerPrefix names the ephemeral debug containers
+	debugContainerPrefix = "debugger"
+	// containerStartTimeout bounds the wait for a debug container to run, including the image pull
+	containerStartTimeout = time.Minute
+)
+
+// diagnosticsCommand keeps the diagnostics ephemeral container running, the diagnostics are executed in it.
+var diagnosticsCommand = []string{"/opt/app/hcnmp", "diagnose", "--idle"}
+
+// DebugOptions configures the containers hcnmp adds to pods of member clusters.
+type DebugOptions struct {
+	// DiagnosticsImage is the image of the diagnostics ephemeral container, it must contain /opt/app/hcnmp
+	DiagnosticsImage string
+	// DebugImage is the default image of debug containers and of the debug pods of nodes
+	DebugImage string
+
+	// NodeDebugUsers are the hcnmp users allowed to create the privileged debug pods of nodes
+	NodeDebugUsers []string
+	// NodeDebugNamespace is the namespace of the debug pods of nodes in member clusters
+	NodeDebugNamespace string
+	// NodeDebugTTL is the default and max lifetime of the debug pods of nodes
+	NodeDebugTTL time.Duration
+}
+
+func (o *DebugOptions) isNodeDebugUser(user string) bool {
+	for _, u := range o.NodeDebugUsers {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// ephemeralContainer describes an ephemeral container added to a pod.
+type ephemeralContainer struct {
+	// prefix of the name, a random suffix is appended
+	prefix  string
+	image   string
+	command []string
+	// targetContainer shares its process namespace with the ephemeral container
+	targetContainer string
+	// interactive allocates stdin and a tty, the shell of a debug image keeps running with them
+	interactive bool
+	// reuse a running ephemeral container of the same prefix and image instead of adding one,
+	// ephemeral containers can not be removed from a pod
+	reuse bool
+}
+
+// debugPod adds an ephemeral debug container to the pod like kubectl debug, waits until it runs and replies
+// the session for the exec terminal. image defaults to the debug image, target shares the process namespace
+// of a container and command (repeated) overrides the entrypoint of the image.
+func (h *handler) debugPod(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	image := c.DefaultQuery("image", h.debug.DebugImage)
+	if len(image) == 0 || strings.ContainsAny(image, " \t\n") {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("invalid image %q", image))
+		return
+	}
+	target := c.Query("target")
+
+	if err := h.authorizePod(c, code, "patch", namespace, name, "ephemeralcontainers"); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+	if err := h.authorizePod(c, code, "create", namespace, name, "exec"); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+	// the debug container is added as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	container, err := ensureEphemeralContainer(c.Request.Context(), client, namespace, name, ephemeralContainer{
+		prefix:          debugContainerPrefix,
+		image:           image,
+		command:         c.QueryArray("command"),
+		targetContainer: target,
+		interactive:     true,
+	})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, debugapi.Session{
+		Cluster:         code,
+		Namespace:       namespace,
+		Pod:             name,
+		Container:       container,
+		Image:           image,
+		TargetContainer: target,
+		ExecPath:        path.Dir(c.Request.URL.Path) + "/exec?" + url.Values{"container": {container}}.Encode(),
+	})
+}
+
+// ensureEphemeralContainer adds the ephemeral container to the pod and waits until it runs, it returns its name.
+func ensureEphemeralContainer(ctx context.Context, client clientset.Interface, namespace, name string, spec ephemeralContainer) (string, error) {
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return "", apierrors.NewBadRequest(fmt.Sprintf("pod %v/%v is %v", namespace, name, pod.Status.Phase))
+	}
+	if len(spec.targetContainer) != 0 && !hasContainer(pod, spec.targetContainer) {
+		return "", apierrors.NewBadRequest(fmt.Sprintf("pod %v/%v has no container %v", namespace, name, spec.targetContainer))
+	}
+
+	if spec.reuse {
+		for _, ec := range pod.Spec.EphemeralContainers {
+			if !strings.HasPrefix(ec.Name, spec.prefix) || ec.Image != spec.image {
+				continue
+			}
+			if status := containerStatus(pod, ec.Name, true); status != nil && status.State.Running != nil {
+				return ec.Name, nil
+			}
+		}
+	}
+
+	container := corev1.EphemeralContainer{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:                     spec.prefix + "-" + utilrand.String(5),
+			Image:                    spec.image,
+			Command:                  spec.command,
+			ImagePullPolicy:          corev1.PullIfNotPresent,
+			TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+			Stdin:                    spec.interactive,
+			TTY:                      spec.interactive,
+		},
+		TargetContainerName: spec.targetContainer,
+	}
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, container)
+	if _, err := client.CoreV1().Pods(namespace).UpdateEphemeralContainers(ctx, name, pod, metav1.UpdateOptions{}); err != nil {
+		return "", err
+	}
+
+	return container.Name, waitForContainer(ctx, client, namespace, name, container.Name, true)
+}
+
+// waitForContainer waits until the container, or ephemeral container, of the pod runs.
+// It fails early if the container terminated or its spec is invalid, image pull errors are waited for
+// until containerStartTimeout and reported then.
+func waitForContainer(ctx context.Context, client clientset.Interface, namespace, name, container string, ephemeral bool) error {
+	var lastReason string
+	err := wait.PollUntilContextTimeout(ctx, time.Second, containerStartTimeout, true, func(ctx context.Context) (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		status := containerStatus(pod, container, ephemeral)
+		if status == nil {
+			return false, nil
+		}
+		switch {
+		case status.State.Running != nil:
+			return true, nil
+		case status.State.Terminated != nil:
+			terminated := status.State.Terminated
+			return false, fmt.Errorf("container %v terminated: %v %v", container, terminated.Reason, terminated.Message)
+		case status.State.Waiting != nil:
+			waiting := status.State.Waiting
+			lastReason = strings.TrimSpace(waiting.Reason + " " + waiting.Message)
+			// pulls are retried by the kubelet, e.g. of a slow registry, only a broken spec can not recover
+			switch waiting.Reason {
+			case "InvalidImageName", "CreateContainerConfigError":
+				return false, fmt.Errorf("container %v can not start: %v", container, lastReason)
+			}
+		}
+		return false, nil
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		if len(lastReason) != 0 {
+			return fmt.Errorf("container %v is not running after %v: %v", container, containerStartTimeout, lastReason)
+		}
+		return fmt.Errorf("container %v is not running after %v", container, containerStartTimeout)
+	}
+	return err
+}
+
+func hasContainer(pod *corev1.Pod, container string) bool {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == container {
+			return true
+		}
+	}
+	return false
+}
+
+func containerStatus(pod *corev1.Pod, container string, ephemeral bool) *corev1.ContainerStatus {
+	statuses := pod.Status.ContainerStatuses
+	if ephemeral {
+		statuses = pod.Status.EphemeralContainerStatuses
+	}
+	for i := range statuses {
+		if statuses[i].Name == container {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestWaitForContainer(t *testing.T) {
+	tests := []struct {
+		name      string
+		ephemeral bool
+		// status is the one of the container, or of the ephemeral container
+		status *corev1.ContainerStatus
+		// otherKind reports status for a container of the other kind with the same name
+		otherKind bool
+		// noPod leaves the pod out of the cluster
+		noPod bool
+
+		// wantErr is a substring of the error, empty when the container runs
+		wantErr string
+	}{
+		{
+			name:   "running",
+			status: &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		},
+		{
+			name:      "ephemeral running",
+			ephemeral: true,
+			status:    &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+		},
+		{
+			name: "terminated",
+			status: &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{Reason: "Error", Message: "exit 1"},
+			}},
+			wantErr: "container app terminated: Error exit 1",
+		},
+		{
+			name: "invalid image name",
+			status: &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "InvalidImageName", Message: "couldn't parse image"},
+			}},
+			wantErr: "container app can not start: InvalidImageName couldn't parse image",
+		},
+		{
+			name: "config error",
+			status: &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "CreateContainerConfigError", Message: "secret not found"},
+			}},
+			wantErr: "container app can not start: CreateContainerConfigError secret not found",
+		},
+		{
+			name: "image pull waited for",
+			status: &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{
+				Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"},
+			}},
+			wantErr: "container app is not running after 1m0s: ImagePullBackOff Back-off pulling image",
+		},
+		{
+			name:    "no status",
+			wantErr: "container app is not running after 1m0s",
+		},
+		{
+			name:      "status of a container of the same name",
+			ephemeral: true,
+			status:    &corev1.ContainerStatus{Name: "app", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+			otherKind: true,
+			wantErr:   "container app is not running after 1m0s",
+		},
+		{
+			name:    "pod not found",
+			noPod:   true,
+			wantErr: `pods "web" not found`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}}
+			if tt.status != nil {
+				if tt.ephemeral != tt.otherKind {
+					pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{*tt.status}
+				} else {
+					pod.Status.ContainerStatuses = []corev1.ContainerStatus{*tt.status}
+				}
+			}
+			client := fake.NewSimpleClientset()
+			if !tt.noPod {
+				client = fake.NewSimpleClientset(pod)
+			}
+
+			// the deadline stands in for containerStartTimeout
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err := waitForContainer(ctx, client, "default", "web", "app", tt.ephemeral)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("waitForContainer() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("waitForContainer() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	diagnosticsapi "github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+	"github.com/helen-frank/hcnmp/pkg/diagnostics"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+// diagnosePod checks the targets of the request from the network namespace of the pod.
+// The checks run in an ephemeral container of the diagnostics image, no tool of the pod's image is needed.
+func (h *handler) diagnosePod(c *gin.Context) {
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	req := &diagnosticsapi.Request{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateDiagnosticsRequest(req); err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeDiagnostics(c, c.Param("clusterCode"), namespace, name); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+	// the diagnostics container is added and executed as the caller
+	if client, err = impersonatedClient(c, c.Param("clusterCode"), client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	results, err := h.runDiagnostics(c.Request.Context(), client, namespace, name, req)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, diagnosticsapi.ResultList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Items:      results,
+	})
+}
+
+// podNetConnectServer checks whether the pod reaches server, optionally at port.
+// It is kept for compatibility: server is a host or a url, the checks are the ones of diagnosePod.
+func (h *handler) podNetConnectServer(c *gin.Context) {
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	target, err := connectTarget(c.Query("server"), c.Query("port"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeDiagnostics(c, c.Param("clusterCode"), namespace, name); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+	// the diagnostics container is added and executed as the caller
+	if client, err = impersonatedClient(c, c.Param("clusterCode"), client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	results, err := h.runDiagnostics(c.Request.Context(), client, namespace, name, &diagnosticsapi.Request{
+		Targets:        []diagnosticsapi.Target{*target},
+		TimeoutSeconds: 1,
+		Count:          1,
+	})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if !results[0].Success {
+		c.JSON(http.StatusBadRequest, results[0])
+		return
+	}
+	c.JSON(http.StatusOK, results[0])
+}
+
+// connectTarget converts the parameters of podNetConnectServer to a target:
+// a url is checked as is, a host with a port is a tcp target and a host alone is only resolved.
+func connectTarget(server, port string) (*diagnosticsapi.Target, error) {
+	if len(server) == 0 {
+		return nil, errors.New("server cannot be empty")
+	}
+
+	var target *diagnosticsapi.Target
+	if strings.Contains(server, "://") {
+		var err error
+		if target, err = diagnostics.ParseTarget(server); err != nil {
+			return nil, err
+		}
+	} else {
+		target = &diagnosticsapi.Target{Scheme: diagnosticsapi.SchemeDNS, Host: server}
+	}
+
+	if len(port) != 0 {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		if target.Scheme == diagnosticsapi.SchemeDNS {
+			target.Scheme = diagnosticsapi.SchemeTCP
+		}
+		target.Port = p
+	}
+
+	if err := diagnostics.Validate(target); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// validateDiagnosticsRequest validates the targets and defaults the timeout and count.
+func validateDiagnosticsRequest(req *diagnosticsapi.Request) error {
+	if len(req.Targets) == 0 {
+		return errors.New("at least one target is required")
+	}
+	if len(req.Targets) > diagnostics.MaxTargets {
+		return fmt.Errorf("at most %v targets are allowed", diagnostics.MaxTargets)
+	}
+	for i := range req.Targets {
+		if err := diagnostics.Validate(&req.Targets[i]); err != nil {
+			return err
+		}
+	}
+
+	if req.TimeoutSeconds == 0 {
+		req.TimeoutSeconds = int(diagnostics.DefaultTimeout / time.Second)
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > 30 {
+		return errors.New("timeoutSeconds must be between 1 and 30")
+	}
+	if req.Count == 0 {
+		req.Count = diagnostics.DefaultCount
+	}
+	if req.Count < 0 || req.Count > diagnostics.MaxCount {
+		return fmt.Errorf("count must be between 1 and %v", diagnostics.MaxCount)
+	}
+	return nil
+}
+
+// runDiagnostics executes the diagnose command of hcnmp in the diagnostics ephemeral container of the pod,
+// the container is added first unless it is running. The targets are passed as arguments, there is no shell.
+// client must be the impersonated client of the caller, see impersonatedClient.
+func (h *handler) runDiagnostics(ctx context.Context, client *clientset.Clientset, namespace, name string, req *diagnosticsapi.Request) ([]diagnosticsapi.Result, error) {
+	container, err := ensureEphemeralContainer(ctx, client, namespace, name, ephemeralContainer{
+		prefix:  diagnosticsContainerPrefix,
+		image:   h.debug.DiagnosticsImage,
+		command: diagnosticsCommand,
+		reuse:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := []string{diagnosticsCommand[0], "diagnose",
+		"--timeout", (time.Duration(req.TimeoutSeconds) * time.Second).String(),
+		"--count", strconv.Itoa(req.Count),
+	}
+	if req.InsecureSkipVerify {
+		cmd = append(cmd, "--insecure")
+	}
+	for i := range req.Targets {
+		cmd = append(cmd, diagnostics.TargetURL(&req.Targets[i]))
+	}
+
+	stdout, stderr, err := execute(ctx, client, namespace, name, container, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run diagnostics in %v/%v: %v, stderr: %v", namespace, name, err, strings.TrimSpace(string(stderr)))
+	}
+
+	results := []diagnosticsapi.Result{}
+	if err := utils.Std2Jsoniter.Unmarshal(stdout, &results); err != nil {
+		return nil, fmt.Errorf("invalid diagnostics output of %v/%v: %v", namespace, name, err)
+	}
+	if len(results) != len(req.Targets) {
+		return nil, fmt.Errorf("diagnostics of %v/%v returned %v results for %v targets", namespace, name, len(results), len(req.Targets))
+	}
+	return results, nil
+}
+
+// authorizeDiagnostics checks the proxy policy for executing in the pod and adding its ephemeral containers.
+func (h *handler) authorizeDiagnostics(c *gin.Context, code, namespace, name string) error {
+	if err := h.authorizePod(c, code, "create", namespace, name, "exec"); err != nil {
+		return err
+	}
+	return h.authorizePod(c, code, "patch", namespace, name, "ephemeralcontainers")
+}
+
+// authorizePod checks the proxy policy of the cluster for verb of the pod, or its subresource.
+func (h *handler) authorizePod(c *gin.Context, code, verb, namespace, name, subresource string) error {
+	return h.policy.Authorize(c, code, &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              verb,
+		APIVersion:        "v1",
+		Namespace:         namespace,
+		Resource:          "pods",
+		Subresource:       subresource,
+		Name:              name,
+	})
+}
@@ -0,0 +1,289 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/fanout"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	defaultFanoutConcurrency = 10
+	maxFanoutConcurrency     = 50
+	defaultFanoutTimeout     = 10 * time.Second
+	maxFanoutTimeout         = time.Minute
+	// maxFanoutItems bounds the items of the merged list, it is also the default limit of every cluster
+	maxFanoutItems = 10000
+)
+
+// fanoutList sends the LIST of urlPath to multiple clusters concurrently and merges the items,
+// every item is annotated with the code of its cluster.
+// The merged list holds at most maxFanoutItems items, the continue tokens of the clusters and the clusters left out
+// are returned to list the rest, watch is not supported.
+func (h *handler) fanoutList(c *gin.Context) {
+	urlPath, err := policy.CleanPath(c.Param("urlPath"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if watch, _ := strconv.ParseBool(c.Query("watch")); watch {
+		servererror.HandleError(c, http.StatusBadRequest, errors.New("watch is not supported by fanout"))
+		return
+	}
+
+	codes, err := selectClusters(c.Query("clusters"), c.Query("clusterSelector"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(c.Query("continue")) != 0 && len(codes) != 1 {
+		servererror.HandleError(c, http.StatusBadRequest, errors.New("continue requires exactly one cluster in clusters"))
+		return
+	}
+
+	limit := maxFanoutItems
+	if s := c.Query("limit"); len(s) != 0 {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("limit must be a non-negative integer"))
+			return
+		}
+		if limit == 0 || limit > maxFanoutItems {
+			limit = maxFanoutItems
+		}
+	}
+
+	concurrency := defaultFanoutConcurrency
+	if s := c.Query("concurrency"); len(s) != 0 {
+		if concurrency, err = strconv.Atoi(s); err != nil || concurrency <= 0 || concurrency > maxFanoutConcurrency {
+			servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("concurrency must be between 1 and %v", maxFanoutConcurrency))
+			return
+		}
+	}
+
+	timeout := defaultFanoutTimeout
+	if s := c.Query("timeout"); len(s) != 0 {
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 || timeout > maxFanoutTimeout {
+			servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("timeout must be a positive duration up to %v", maxFanoutTimeout))
+			return
+		}
+	}
+
+	// forward the list options, hcnmp parameters are not forwarded
+	params := c.Request.URL.Query()
+	for _, k := range []string{"clusters", "clusterSelector", "concurrency", "timeout"} {
+		params.Del(k)
+	}
+	params.Set("limit", strconv.Itoa(limit))
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, concurrency)
+		lists  = make(map[string]*unstructured.UnstructuredList, len(codes))
+		result = fanout.List{
+			APIVersion: "v1",
+			Kind:       "List",
+			Items:      []unstructured.Unstructured{},
+			Clusters:   []string{},
+		}
+	)
+
+	for i := range codes {
+		code := codes[i]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+			defer cancel()
+
+			list, err := h.listCluster(ctx, c, code, urlPath, params)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result.Errors = append(result.Errors, clusterError(code, err))
+				return
+			}
+			lists[code] = list
+		}()
+	}
+	wg.Wait()
+
+	mergeLists(&result, codes, lists)
+	sort.Slice(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Cluster < result.Errors[j].Cluster
+	})
+
+	c.JSON(http.StatusOK, result)
+}
+
+// mergeLists appends the items of lists in the order of codes to result, up to maxFanoutItems items,
+// the clusters after the first one exceeding it are left out.
+func mergeLists(result *fanout.List, codes []string, lists map[string]*unstructured.UnstructuredList) {
+	for i := range codes {
+		list, ok := lists[codes[i]]
+		if !ok {
+			continue
+		}
+		if len(result.Truncated) != 0 || len(result.Items)+len(list.Items) > maxFanoutItems {
+			result.Truncated = append(result.Truncated, codes[i])
+			continue
+		}
+		result.Clusters = append(result.Clusters, codes[i])
+		result.Items = append(result.Items, list.Items...)
+		if token := list.GetContinue(); len(token) != 0 {
+			if result.Continue == nil {
+				result.Continue = make(map[string]string)
+			}
+			result.Continue[codes[i]] = token
+		}
+	}
+}
+
+func (h *handler) listCluster(ctx context.Context, c *gin.Context, code, urlPath string, params url.Values) (*unstructured.UnstructuredList, error) {
+	if err := h.policy.Authorize(c, code, policy.NewRequestInfo(http.MethodGet, urlPath, params)); err != nil {
+		return nil, err
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	request := client.RESTClient().Get().AbsPath(urlPath)
+	for k, v := range params {
+		for i := range v {
+			request.Param(k, v[i])
+		}
+	}
+	for k, v := range impersonationHeaders(c, code) {
+		request.SetHeader(k, v...)
+	}
+
+	data, err := request.Do(ctx).Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := runtime.Decode(unstructured.UnstructuredJSONScheme, data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a list", urlPath)
+	}
+
+	for i := range list.Items {
+		annotations := list.Items[i].GetAnnotations()
+		if annotations == nil {
+			annotations = make(map[string]string, 1)
+		}
+		annotations[fanout.ClusterAnnotation] = code
+		list.Items[i].SetAnnotations(annotations)
+	}
+	return list, nil
+}
+
+// selectClusters returns the sorted codes of clusters named by the comma separated clusters,
+// or matching the glob pattern selector, all clusters when both are empty.
+func selectClusters(clusters, selector string) ([]string, error) {
+	if len(strings.TrimSpace(clusters)) != 0 && len(selector) != 0 {
+		return nil, errors.New("clusters and clusterSelector are mutually exclusive")
+	}
+
+	named := make(map[string]struct{})
+	for _, code := range strings.Split(clusters, ",") {
+		if code = strings.TrimSpace(code); len(code) != 0 {
+			named[code] = struct{}{}
+		}
+	}
+
+	all := proxy.ListClusterCodes()
+	if len(named) == 0 && len(selector) == 0 {
+		return all, nil
+	}
+
+	selected := make([]string, 0, len(all))
+	if len(named) != 0 {
+		for i := range all {
+			if _, ok := named[all[i]]; ok {
+				selected = append(selected, all[i])
+				delete(named, all[i])
+			}
+		}
+		if len(named) != 0 {
+			missing := make([]string, 0, len(named))
+			for code := range named {
+				missing = append(missing, code)
+			}
+			sort.Strings(missing)
+			return nil, fmt.Errorf("cluster %v Not Found", strings.Join(missing, ", "))
+		}
+	} else {
+		for i := range all {
+			matched, err := path.Match(selector, all[i])
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				selected = append(selected, all[i])
+			}
+		}
+	}
+	return selected, nil
+}
+
+func clusterError(code string, err error) fanout.ClusterError {
+	status := int32(http.StatusInternalServerError)
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+	if apiStatus, ok := err.(apierrors.APIStatus); ok {
+		status = apiStatus.Status().Code
+	}
+	return fanout.ClusterError{
+		Cluster: code,
+		Code:    status,
+		Message: err.Error(),
+	}
+}
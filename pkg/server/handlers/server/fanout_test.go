@@ -0,0 +1,134 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/fanout"
+)
+
+func TestFanoutListValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/fanout/*urlPath", (&handler{}).fanoutList)
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{name: "watch", target: "/fanout/api/v1/pods?watch=true", want: http.StatusBadRequest},
+		{name: "watch 1", target: "/fanout/api/v1/pods?watch=1", want: http.StatusBadRequest},
+		{name: "clusters and selector", target: "/fanout/api/v1/pods?clusters=a&clusterSelector=prod-*", want: http.StatusBadRequest},
+		{name: "continue of all clusters", target: "/fanout/api/v1/pods?continue=token", want: http.StatusBadRequest},
+		{name: "bad limit", target: "/fanout/api/v1/pods?limit=-1", want: http.StatusBadRequest},
+		{name: "bad concurrency", target: "/fanout/api/v1/pods?concurrency=100", want: http.StatusBadRequest},
+		{name: "bad timeout", target: "/fanout/api/v1/pods?timeout=1h", want: http.StatusBadRequest},
+		{name: "no clusters", target: "/fanout/api/v1/pods?watch=false&limit=0", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMergeLists(t *testing.T) {
+	list := func(n int, token string) *unstructured.UnstructuredList {
+		list := &unstructured.UnstructuredList{}
+		for i := 0; i < n; i++ {
+			item := unstructured.Unstructured{}
+			item.SetName("pod-" + strconv.Itoa(i))
+			list.Items = append(list.Items, item)
+		}
+		list.SetContinue(token)
+		return list
+	}
+
+	tests := []struct {
+		name          string
+		codes         []string
+		lists         map[string]*unstructured.UnstructuredList
+		wantItems     int
+		wantClusters  []string
+		wantContinue  map[string]string
+		wantTruncated []string
+	}{
+		{
+			name:         "ordered by codes",
+			codes:        []string{"a", "b", "c"},
+			lists:        map[string]*unstructured.UnstructuredList{"c": list(1, ""), "a": list(2, "")},
+			wantItems:    3,
+			wantClusters: []string{"a", "c"},
+		},
+		{
+			name:         "continue",
+			codes:        []string{"a", "b"},
+			lists:        map[string]*unstructured.UnstructuredList{"a": list(2, "next-a"), "b": list(1, "")},
+			wantItems:    3,
+			wantClusters: []string{"a", "b"},
+			wantContinue: map[string]string{"a": "next-a"},
+		},
+		{
+			name:         "exactly max items",
+			codes:        []string{"a", "b"},
+			lists:        map[string]*unstructured.UnstructuredList{"a": list(maxFanoutItems-1, ""), "b": list(1, "")},
+			wantItems:    maxFanoutItems,
+			wantClusters: []string{"a", "b"},
+		},
+		{
+			name:          "clusters after the max are left out",
+			codes:         []string{"a", "b", "c"},
+			lists:         map[string]*unstructured.UnstructuredList{"a": list(maxFanoutItems-1, ""), "b": list(2, "next-b"), "c": list(1, "")},
+			wantItems:     maxFanoutItems - 1,
+			wantClusters:  []string{"a"},
+			wantTruncated: []string{"b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := fanout.List{Clusters: []string{}}
+			mergeLists(&result, tt.codes, tt.lists)
+			if len(result.Items) != tt.wantItems {
+				t.Errorf("items = %d, want %d", len(result.Items), tt.wantItems)
+			}
+			if !reflect.DeepEqual(result.Clusters, tt.wantClusters) {
+				t.Errorf("clusters = %v, want %v", result.Clusters, tt.wantClusters)
+			}
+			if !reflect.DeepEqual(result.Continue, tt.wantContinue) {
+				t.Errorf("continue = %v, want %v", result.Continue, tt.wantContinue)
+			}
+			if !reflect.DeepEqual(result.Truncated, tt.wantTruncated) {
+				t.Errorf("truncated = %v, want %v", result.Truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
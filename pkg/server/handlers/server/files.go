@@ -0,0 +1,388 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/client-go/util/exec"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	tarContentType = "application/x-tar"
+	// copyErrorTrailer tells a download failed after the archive started streaming
+	copyErrorTrailer = "X-Hcnmp-Copy-Error"
+	// maxCopyStderr bounds the stderr of tar kept for errors
+	maxCopyStderr = 4096
+)
+
+var errCopyTooLarge = errors.New("copy exceeds the max size")
+
+// uploadScript extracts the archive into a temporary directory next to the files and moves them into the directory $1
+// only when the archive is complete, so that a failed upload leaves no partially written file. $2 is the name of
+// an uploaded single file which is renamed over the existing one, the entries of an archive are copied over.
+const uploadScript = `set -e
+tmp=$(mktemp -d "$1/.hcnmp-upload.XXXXXX")
+trap 'rm -rf "$tmp"' EXIT
+tar xmf - -C "$tmp"
+if [ -n "$2" ]; then
+	mv -f "$tmp/$2" "$1/$2"
+	exit
+fi
+for f in "$tmp"/* "$tmp"/.[!.]* "$tmp"/..?*; do
+	if [ -e "$f" ] || [ -L "$f" ]; then
+		cp -a "$f" "$1/"
+	fi
+done`
+
+// CopyOptions configures the file copy to and from containers.
+type CopyOptions struct {
+	// MaxSize bounds the bytes of an archive copied in either direction, 0 means no limit
+	MaxSize int64
+}
+
+// downloadFiles streams a tar archive of the file or directory at path in the container like kubectl cp,
+// tar runs in the container through exec, so the container needs tar. Errors after the archive started are sent
+// in the X-Hcnmp-Copy-Error trailer.
+func (h *handler) downloadFiles(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+	container := c.Query("container")
+
+	p, err := containerPath(c.Query("path"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizePod(c, code, "create", namespace, name, "exec"); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+
+	dir, base := path.Dir(p), path.Base(p)
+	if p == "/" {
+		base = "."
+	}
+	filename := base
+	if filename == "." {
+		filename = "root"
+	}
+
+	// stdout is copied until the end even if writing fails, cancel tar instead
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	w := &archiveWriter{c: c, filename: filename + ".tar", limit: h.copy.MaxSize, cancel: cancel}
+	stderr := &limitedBuffer{limit: maxCopyStderr}
+	err = stream(ctx, client, impersonatedConfig(c, code, client.ClientConfig()), namespace, name, container,
+		[]string{"tar", "cf", "-", "-C", dir, "--", base}, nil, w, stderr)
+	if w.err != nil {
+		err = w.err
+	}
+
+	if !w.started {
+		if err != nil {
+			servererror.HandleError(c, copyErrorStatus(err), copyError(err, stderr, namespace, name, container))
+			return
+		}
+		// an empty archive
+		w.commit()
+		return
+	}
+	if err != nil {
+		err = copyError(err, stderr, namespace, name, container)
+		klog.Errorf("failed to download %v of %v/%v/%v: %v", p, code, namespace, name, err)
+		c.Writer.Header().Set(copyErrorTrailer, err.Error())
+	}
+}
+
+// uploadFiles extracts the tar archive of the request body into the directory at path in the container.
+// A body of another content type is a single file written to path, its Content-Length is required.
+// Nothing is written to path unless the whole body is received and extracted, see uploadScript, so the container
+// needs sh, mktemp, cp and mv besides tar.
+func (h *handler) uploadFiles(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+	container := c.Query("container")
+
+	p, err := containerPath(c.Query("path"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	isArchive := c.ContentType() == tarContentType
+	if !isArchive {
+		if c.Request.ContentLength < 0 {
+			servererror.HandleError(c, http.StatusLengthRequired, errors.New("the Content-Length of an uploaded file is required, or upload a tar archive"))
+			return
+		}
+		if p == "/" {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("path of an uploaded file must not be /"))
+			return
+		}
+	}
+	if h.copy.MaxSize > 0 && c.Request.ContentLength > h.copy.MaxSize {
+		servererror.HandleError(c, http.StatusRequestEntityTooLarge, fmt.Errorf("%v: %v bytes", errCopyTooLarge, h.copy.MaxSize))
+		return
+	}
+
+	if err := h.authorizePod(c, code, "create", namespace, name, "exec"); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+
+	limited := &limitedReader{r: c.Request.Body, limit: h.copy.MaxSize}
+	var body io.Reader = limited
+	dir, file := p, ""
+	if !isArchive {
+		// wrap the file in an archive, tar in the container writes it
+		dir, file = path.Dir(p), path.Base(p)
+		body = fileArchive(file, c.Request.ContentLength, body)
+	}
+
+	stderr := &limitedBuffer{limit: maxCopyStderr}
+	err = stream(c.Request.Context(), client, impersonatedConfig(c, code, client.ClientConfig()), namespace, name, container,
+		[]string{"sh", "-c", uploadScript, "sh", dir, file}, body, io.Discard, stderr)
+	if limited.err != nil {
+		// tar fails on the truncated archive
+		err = limited.err
+	}
+	if err != nil {
+		servererror.HandleError(c, copyErrorStatus(err), copyError(err, stderr, namespace, name, container))
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+// containerPath validates the absolute path in the container, it is passed to tar as an argument.
+func containerPath(p string) (string, error) {
+	if len(p) == 0 {
+		return "", errors.New("path is required")
+	}
+	if !strings.HasPrefix(p, "/") || strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("path %q must be absolute", p)
+	}
+	return path.Clean(p), nil
+}
+
+// fileArchive streams a tar archive of a single file of size.
+func fileArchive(name string, size int64, r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     size,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, r, size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// copyError explains the failure of tar, in particular when the container has no tar.
+func copyError(err error, stderr *limitedBuffer, namespace, name, container string) error {
+	if errors.Is(err, errCopyTooLarge) {
+		return err
+	}
+	if tarNotFound(err) {
+		target := container
+		if len(target) == 0 {
+			target = "the default container"
+		}
+		return fmt.Errorf("tar is not found in %v of pod %v/%v, copying files needs it and uploading also sh, mktemp, cp and mv: "+
+			"add a debug container sharing its process namespace and copy from /proc/1/root instead", target, namespace, name)
+	}
+	if msg := strings.TrimSpace(stderr.String()); len(msg) != 0 {
+		return fmt.Errorf("%v: %v", err, msg)
+	}
+	return err
+}
+
+func copyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errCopyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case tarNotFound(err):
+		return http.StatusBadRequest
+	}
+	var exitErr exec.CodeExitError
+	if errors.As(err, &exitErr) {
+		// tar failed, e.g. the path does not exist
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// tarNotFound reports whether exec failed because the container has no tar or sh executable.
+func tarNotFound(err error) bool {
+	var exitErr exec.CodeExitError
+	if errors.As(err, &exitErr) && (exitErr.Code == 126 || exitErr.Code == 127) {
+		return true
+	}
+	return strings.Contains(err.Error(), "executable file not found") ||
+		strings.Contains(err.Error(), `exec: "tar"`) || strings.Contains(err.Error(), `exec: "sh"`)
+}
+
+// archiveWriter writes the archive to the response, the response starts with the first non-empty block
+// so that errors of tar before any file, e.g. a path not found, are still replied as errors.
+type archiveWriter struct {
+	c        *gin.Context
+	filename string
+	limit    int64
+	// cancel stops tar when writing fails
+	cancel context.CancelFunc
+
+	started bool
+	pending bytes.Buffer
+	written int64
+	err     error
+}
+
+func (w *archiveWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.written += int64(len(p))
+	if w.limit > 0 && w.written > w.limit {
+		return 0, w.fail(fmt.Errorf("%w: %v bytes", errCopyTooLarge, w.limit))
+	}
+
+	if !w.started {
+		w.pending.Write(p)
+		// an empty archive is blocks of zeros only, its size is 10240 bytes with the default blocking
+		if w.pending.Len() < 512 || (isZero(w.pending.Bytes()) && w.pending.Len() <= 10240) {
+			return len(p), nil
+		}
+		w.commit()
+		return len(p), nil
+	}
+
+	if _, err := w.c.Writer.Write(p); err != nil {
+		return 0, w.fail(err)
+	}
+	w.c.Writer.Flush()
+	return len(p), nil
+}
+
+func (w *archiveWriter) fail(err error) error {
+	w.err = err
+	w.cancel()
+	return err
+}
+
+// commit starts the response with the pending bytes.
+func (w *archiveWriter) commit() {
+	w.started = true
+	header := w.c.Writer.Header()
+	header.Set("Content-Type", tarContentType)
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v"`, w.filename))
+	header.Set("Trailer", copyErrorTrailer)
+	w.c.Status(http.StatusOK)
+	_, _ = w.c.Writer.Write(w.pending.Bytes())
+	w.pending.Reset()
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// limitedReader fails once more than limit bytes are read, unlike io.LimitReader which ends silently.
+// A limit of 0 means no limit.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	err   error
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if r.limit > 0 && r.read > r.limit {
+		r.err = fmt.Errorf("%w: %v bytes", errCopyTooLarge, r.limit)
+		return 0, r.err
+	}
+	return n, err
+}
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room > 0 {
+		b.Buffer.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestArchiveWriter(t *testing.T) {
+	block := bytes.Repeat([]byte{'a'}, 512)
+	zeros := make([]byte, 512)
+
+	tests := []struct {
+		name   string
+		limit  int64
+		writes [][]byte
+		// commit is called when the writes are done like downloadFiles does for an empty archive
+		commit      bool
+		wantStarted bool
+		wantBody    []byte
+		wantErr     error
+	}{
+		{
+			name:   "short write is pending",
+			writes: [][]byte{block[:100]},
+		},
+		{
+			name:        "first block starts the response",
+			writes:      [][]byte{block[:100], block[100:], []byte("tail")},
+			wantStarted: true,
+			wantBody:    append(append([]byte{}, block...), "tail"...),
+		},
+		{
+			name:   "empty archive is pending",
+			writes: [][]byte{bytes.Repeat(zeros, 20)},
+		},
+		{
+			name:        "empty archive committed",
+			writes:      [][]byte{bytes.Repeat(zeros, 20)},
+			commit:      true,
+			wantStarted: true,
+			wantBody:    bytes.Repeat(zeros, 20),
+		},
+		{
+			name:        "zeros longer than an empty archive",
+			writes:      [][]byte{bytes.Repeat(zeros, 20), zeros},
+			wantStarted: true,
+			wantBody:    bytes.Repeat(zeros, 21),
+		},
+		{
+			name:    "too large before the response started",
+			limit:   600,
+			writes:  [][]byte{block[:100], block},
+			wantErr: errCopyTooLarge,
+		},
+		{
+			name:        "too large after the response started",
+			limit:       600,
+			writes:      [][]byte{block, block[:88], block[:1]},
+			wantStarted: true,
+			wantBody:    append(append([]byte{}, block...), block[:88]...),
+			wantErr:     errCopyTooLarge,
+		},
+		{
+			name:        "no limit",
+			writes:      [][]byte{block, block, block},
+			wantStarted: true,
+			wantBody:    bytes.Repeat(block, 3),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			cancelled := false
+			w := &archiveWriter{c: c, filename: "etc.tar", limit: tt.limit, cancel: func() { cancelled = true }}
+
+			var err error
+			for _, p := range tt.writes {
+				if _, err = w.Write(p); err != nil {
+					break
+				}
+			}
+			if tt.commit {
+				w.commit()
+			}
+
+			if !errors.Is(err, tt.wantErr) || !errors.Is(w.err, tt.wantErr) {
+				t.Errorf("Write() error = %v, archiveWriter.err = %v, want %v", err, w.err, tt.wantErr)
+			}
+			if cancelled != (tt.wantErr != nil) {
+				t.Errorf("cancelled = %v, want %v", cancelled, tt.wantErr != nil)
+			}
+			if w.started != tt.wantStarted {
+				t.Fatalf("started = %v, want %v", w.started, tt.wantStarted)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), tt.wantBody) {
+				t.Errorf("body of %v bytes, want %v bytes", rec.Body.Len(), len(tt.wantBody))
+			}
+			if !tt.wantStarted {
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %v, want %v", rec.Code, http.StatusOK)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tarContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tarContentType)
+			}
+			if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename="etc.tar"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+		})
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		limit   int64
+		wantErr error
+	}{
+		{name: "below the limit", size: 100, limit: 101},
+		{name: "at the limit", size: 100, limit: 100},
+		{name: "over the limit", size: 101, limit: 100, wantErr: errCopyTooLarge},
+		{name: "no limit", size: 1 << 20},
+		{name: "empty", size: 0, limit: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := strings.Repeat("x", tt.size)
+			r := &limitedReader{r: strings.NewReader(data), limit: tt.limit}
+
+			got, err := io.ReadAll(r)
+			if !errors.Is(err, tt.wantErr) || !errors.Is(r.err, tt.wantErr) {
+				t.Fatalf("ReadAll() error = %v, limitedReader.err = %v, want %v", err, r.err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if int64(len(got)) > tt.limit {
+					t.Errorf("read %v bytes over the limit %v", len(got), tt.limit)
+				}
+				// the error sticks
+				if n, err := r.Read(make([]byte, 1)); n != 0 || !errors.Is(err, tt.wantErr) {
+					t.Errorf("Read() after the limit = %v, %v", n, err)
+				}
+				return
+			}
+			if string(got) != data {
+				t.Errorf("read %v bytes, want %v", len(got), len(data))
+			}
+		})
+	}
+}
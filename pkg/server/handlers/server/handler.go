@@ -18,33 +18,122 @@ package server
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 
+	"github.com/helen-frank/hcnmp/pkg/server/leader"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/cache"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/recording"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 )
 
 type handler struct {
 	client clientset.Interface
+	policy *policy.Engine
+	cache  *cache.Cache
+
+	webSocket WebSocketOptions
+	upgrader  *websocket.Upgrader
+	recorder  *recording.Recorder
+
+	operations *operation.Manager
+	debug      DebugOptions
+	copy       CopyOptions
+}
+
+// Options configures the handlers of the member clusters.
+type Options struct {
+	Client     clientset.Interface
+	Policy     *policy.Engine
+	Cache      *cache.Cache
+	WebSocket  WebSocketOptions
+	Recorder   *recording.Recorder
+	Operations *operation.Manager
+	Debug      DebugOptions
+	Copy       CopyOptions
 }
 
-func InstallHandlers(routerGroup *gin.RouterGroup, client clientset.Interface) {
-	h := &handler{
-		client: client,
+func newHandler(o Options) *handler {
+	return &handler{
+		client:    o.Client,
+		policy:    o.Policy,
+		cache:     o.Cache,
+		webSocket: o.WebSocket,
+		upgrader:  o.WebSocket.upgrader(),
+		recorder:  o.Recorder,
+
+		operations: o.Operations,
+		debug:      o.Debug,
+		copy:       o.Copy,
 	}
+}
+
+func InstallHandlers(routerGroup *gin.RouterGroup, o Options) {
+	h := newHandler(o)
+
+	// the debug pods of nodes are deleted by one replica
+	leader.Register("node-debug-cleanup", h.cleanupNodeDebugPods)
 
 	// /apis/server/v1/
 	routerGroupV1 := routerGroup.Group("/v1")
 	{
 		// Proxy cluster for all native api
-		routerGroupV1.Any("/proxy/cluster/:clusterCode/*urlPath", h.proxyCluster)
+		routerGroupV1.Any("/proxy/cluster/:clusterCode/*urlPath", h.policy.Middleware(), h.cache.Middleware(h.cacheIdentity), h.proxyCluster)
+
+		// Table of native api with kubectl columns, e.g. /table/cluster/a/apis/apps/v1/deployments
+		routerGroupV1.GET("/table/cluster/:clusterCode/*urlPath", h.policy.Middleware(), h.getTable)
+
+		// List native api of multiple clusters, e.g. /fanout/api/v1/pods?clusters=a,b
+		routerGroupV1.GET("/fanout/*urlPath", h.fanoutList)
+
+		// reachability of targets from pods of multiple clusters
+		routerGroupV1.POST("/diagnostics/matrix", h.connectivityMatrix)
+		routerGroupV1.POST("/diagnostics/matrix/diff", h.diffConnectivityMatrix)
 
 		// node
 		routerGroupV1.GET("/cluster/:clusterCode/node/:name/namespace", h.listNamespaceOfNode)
+		routerGroupV1.GET("/cluster/:clusterCode/node/:name/detail", h.getNodeDetail)
+		routerGroupV1.POST("/cluster/:clusterCode/node/:name/cordon", h.cordonNode)
+		routerGroupV1.POST("/cluster/:clusterCode/node/:name/uncordon", h.uncordonNode)
+		routerGroupV1.POST("/cluster/:clusterCode/node/:name/drain", h.drainNode)
+		routerGroupV1.POST("/cluster/:clusterCode/node/:name/debug", h.debugNode)
+		routerGroupV1.DELETE("/cluster/:clusterCode/node/:name/debug/:pod", h.deleteNodeDebug)
 
 		// deployment
 		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/deployments/:name/pods", h.listPodOfDeployment)
 		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/deployments/:name/restart", h.restartDeployment)
+		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/deployments/:name/logs", h.streamDeploymentLogs)
+
+		// workload, kind is deployments, statefulsets, daemonsets or rollouts
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/restart", h.restartWorkload)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/scale", h.scaleWorkload)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/pause", h.pauseWorkload)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/resume", h.resumeWorkload)
+		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/revisions", h.listRevisions)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/workloads/:kind/:name/rollback", h.rollbackWorkload)
 
 		// pod
 		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/pod/:name/connect", h.podNetConnectServer)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/pod/:name/diagnostics", h.diagnosePod)
+		routerGroupV1.POST("/cluster/:clusterCode/namespace/:namespace/pod/:name/debug", h.debugPod)
+		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/pod/:name/files", h.downloadFiles)
+		routerGroupV1.PUT("/cluster/:clusterCode/namespace/:namespace/pod/:name/files", h.uploadFiles)
+		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/pod/:name/exec", h.execTerminal)
+		routerGroupV1.GET("/cluster/:clusterCode/namespace/:namespace/pod/:name/portforward", h.portForward)
+
+		// recordings of exec terminals
+		routerGroupV1.GET("/recordings", h.listRecordings)
+		routerGroupV1.GET("/recordings/:id", h.getRecording)
+		routerGroupV1.GET("/recordings/:id/download", h.downloadRecording)
+		routerGroupV1.GET("/recordings/:id/replay", h.replayRecording)
 	}
 }
+
+// InstallGatewayHandlers exposes every cluster at a kube-apiserver compatible base path,
+// /clusters/{clusterCode} can be used as the server of kubectl and helm.
+func InstallGatewayHandlers(routerGroup *gin.RouterGroup, o Options) {
+	h := newHandler(o)
+
+	routerGroup.Any("/:clusterCode/*urlPath", h.policy.Middleware(), h.cache.Middleware(h.cacheIdentity), h.proxyCluster)
+}
@@ -0,0 +1,370 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	defaultMaxLogRequests = 20
+	// logResyncPeriod is how often the pods of the deployment are resolved again when following
+	logResyncPeriod = 5 * time.Second
+	// maxLogLineSize bounds the memory of a single log line, longer lines are split
+	maxLogLineSize = 64 * 1024
+)
+
+// logLine is a line of a container log, it is the data of the "log" SSE event.
+type logLine struct {
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Line      string `json:"line,omitempty"`
+	// Error is set instead of Line when the log of the container can not be streamed
+	Error string `json:"error,omitempty"`
+}
+
+// logStreamer streams the logs of the containers of a deployment into lines.
+type logStreamer struct {
+	client    clientset.Interface
+	namespace string
+	container string
+	opts      corev1.PodLogOptions
+	max       int
+
+	lines chan logLine
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// streams are the started streams by pod/container/restartCount
+	streams map[string]struct{}
+	active  int
+	// skipped is set while containers are skipped for max, the error is sent once until they are streamed
+	skipped bool
+}
+
+// streamDeploymentLogs streams the logs of all pods of the deployment, every line is prefixed by its pod and container.
+// The response is an SSE stream of "log" events when the request accepts text/event-stream or format=sse,
+// plain chunked text otherwise. With follow=true new pods of a rollout are picked up until the client disconnects.
+func (h *handler) streamDeploymentLogs(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	opts, maxLogRequests, err := podLogOptions(c)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.policy.Authorize(c, code, &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              "get",
+		APIVersion:        "v1",
+		Namespace:         namespace,
+		Resource:          "pods",
+		Subresource:       "log",
+	}); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the pods and logs are read as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	pods, err := utils.ListDeploymentPods(ctx, client, *deployment)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	s := &logStreamer{
+		client:    client,
+		namespace: namespace,
+		container: c.Query("container"),
+		opts:      opts,
+		max:       maxLogRequests,
+		lines:     make(chan logLine, 100),
+		streams:   make(map[string]struct{}),
+	}
+	s.start(ctx, pods, true)
+
+	sse := c.Query("format") == "sse" || strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+	} else {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Header("X-Content-Type-Options", "nosniff")
+	}
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	done := make(chan struct{})
+	if opts.Follow {
+		go s.resync(ctx, *deployment)
+	} else {
+		go func() {
+			s.wg.Wait()
+			close(done)
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			// drain the lines of the finished streams
+			for {
+				select {
+				case line := <-s.lines:
+					writeLogLine(c, sse, line)
+				default:
+					c.Writer.Flush()
+					return
+				}
+			}
+		case line := <-s.lines:
+			writeLogLine(c, sse, line)
+			// flush batches of lines
+			if len(s.lines) == 0 {
+				c.Writer.Flush()
+			}
+		}
+	}
+}
+
+// resync starts the streams of the new pods and restarted containers of the deployment until ctx is done.
+func (s *logStreamer) resync(ctx context.Context, deployment appsv1.Deployment) {
+	ticker := time.NewTicker(logResyncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pods, err := utils.ListDeploymentPods(ctx, s.client, deployment)
+		if err != nil {
+			klog.Errorf("failed to list pods of deployment %v/%v: %v", deployment.Namespace, deployment.Name, err)
+			continue
+		}
+		s.start(ctx, pods, false)
+	}
+}
+
+// start streams the started containers of pods which are not streamed yet,
+// initial tells the streams of the first pods, tailLines and sinceSeconds do not apply to later ones.
+func (s *logStreamer) start(ctx context.Context, pods []corev1.Pod, initial bool) {
+	skipped := false
+	defer func() {
+		if !skipped {
+			// every container is streamed again, the next excess is reported
+			s.mu.Lock()
+			s.skipped = false
+			s.mu.Unlock()
+		}
+	}()
+
+	for i := range pods {
+		for _, status := range containerStatuses(&pods[i], s.container) {
+			if !s.opts.Previous && status.State.Running == nil && status.State.Terminated == nil {
+				continue
+			}
+			if s.opts.Previous && status.LastTerminationState.Terminated == nil {
+				continue
+			}
+
+			key := fmt.Sprintf("%v/%v/%v", pods[i].Name, status.Name, status.RestartCount)
+			opts := s.opts
+			opts.Container = status.Name
+			if !initial {
+				opts.TailLines = nil
+				opts.SinceSeconds = nil
+			}
+
+			s.mu.Lock()
+			if _, ok := s.streams[key]; ok {
+				s.mu.Unlock()
+				continue
+			}
+			if s.active >= s.max {
+				skipped = true
+				reported := s.skipped
+				s.skipped = true
+				s.mu.Unlock()
+				if !reported {
+					s.send(ctx, logLine{Pod: pods[i].Name, Container: status.Name,
+						Error: fmt.Sprintf("more than %v log streams, increase maxLogRequests to stream all pods", s.max)})
+				}
+				continue
+			}
+			s.streams[key] = struct{}{}
+			s.active++
+			s.mu.Unlock()
+
+			s.wg.Add(1)
+			go func(pod string) {
+				defer func() {
+					s.mu.Lock()
+					s.active--
+					s.mu.Unlock()
+					s.wg.Done()
+				}()
+				if err := s.stream(ctx, pod, &opts); err != nil && ctx.Err() == nil {
+					s.send(ctx, logLine{Pod: pod, Container: opts.Container, Error: err.Error()})
+				}
+			}(pods[i].Name)
+		}
+	}
+}
+
+func (s *logStreamer) stream(ctx context.Context, pod string, opts *corev1.PodLogOptions) error {
+	stream, err := s.client.CoreV1().Pods(s.namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	reader := bufio.NewReaderSize(stream, maxLogLineSize)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) != 0 {
+			s.send(ctx, logLine{Pod: pod, Container: opts.Container, Line: strings.TrimRight(string(line), "\r\n")})
+		}
+		switch {
+		case err == nil, errors.Is(err, bufio.ErrBufferFull):
+		case errors.Is(err, io.EOF):
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+func (s *logStreamer) send(ctx context.Context, line logLine) {
+	select {
+	case s.lines <- line:
+	case <-ctx.Done():
+	}
+}
+
+// containerStatuses returns the statuses of the containers of pod, only the one of container if it is not empty.
+func containerStatuses(pod *corev1.Pod, container string) []corev1.ContainerStatus {
+	statuses := make([]corev1.ContainerStatus, 0, len(pod.Status.ContainerStatuses))
+	for _, status := range pod.Status.ContainerStatuses {
+		if len(container) == 0 || status.Name == container {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+func writeLogLine(c *gin.Context, sse bool, line logLine) {
+	if sse {
+		event := "log"
+		if len(line.Error) != 0 {
+			event = "error"
+		}
+		c.SSEvent(event, line)
+		return
+	}
+
+	text := line.Line
+	if len(line.Error) != 0 {
+		text = "error: " + line.Error
+	}
+	_, _ = fmt.Fprintf(c.Writer, "[%v/%v] %v\n", line.Pod, line.Container, text)
+}
+
+// podLogOptions parses follow, sinceSeconds, tailLines, previous, timestamps and maxLogRequests of the request.
+func podLogOptions(c *gin.Context) (corev1.PodLogOptions, int, error) {
+	opts := corev1.PodLogOptions{}
+	var err error
+
+	for k, v := range map[string]*bool{"follow": &opts.Follow, "previous": &opts.Previous, "timestamps": &opts.Timestamps} {
+		if s := c.Query(k); len(s) != 0 {
+			if *v, err = strconv.ParseBool(s); err != nil {
+				return opts, 0, fmt.Errorf("%v must be a bool", k)
+			}
+		}
+	}
+
+	for k, v := range map[string]**int64{"sinceSeconds": &opts.SinceSeconds, "tailLines": &opts.TailLines} {
+		if s := c.Query(k); len(s) != 0 {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				return opts, 0, fmt.Errorf("%v must be a non-negative integer", k)
+			}
+			*v = &n
+		}
+	}
+
+	maxLogRequests := defaultMaxLogRequests
+	if s := c.Query("maxLogRequests"); len(s) != 0 {
+		if maxLogRequests, err = strconv.Atoi(s); err != nil || maxLogRequests <= 0 {
+			return opts, 0, errors.New("maxLogRequests must be a positive integer")
+		}
+	}
+
+	if opts.Follow && opts.Previous {
+		return opts, 0, errors.New("follow and previous can not be used together")
+	}
+	return opts, maxLogRequests, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestLogStreamerStart(t *testing.T) {
+	pod := func(name string, restarts int32) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+				Name:         "app",
+				RestartCount: restarts,
+				State:        corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			}}},
+		}
+	}
+	waiting := pod("waiting", 0)
+	waiting.Status.ContainerStatuses[0].State = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}
+
+	// the steps run in order on one streamer with at most 1 stream at a time,
+	// the fake streams end at once so every step starts with no active stream
+	steps := []struct {
+		name        string
+		pods        []corev1.Pod
+		wantStreams int
+		wantErrors  int
+	}{
+		{name: "excess is reported", pods: []corev1.Pod{pod("a", 0), pod("b", 0)}, wantStreams: 1, wantErrors: 1},
+		{name: "excess is reported once", pods: []corev1.Pod{pod("b", 0), pod("c", 0)}, wantStreams: 1},
+		{name: "skipped pod is streamed later", pods: []corev1.Pod{pod("a", 0), pod("b", 0), pod("c", 0)}, wantStreams: 1},
+		{name: "streamed pods are skipped", pods: []corev1.Pod{pod("a", 0), pod("b", 0), pod("c", 0)}},
+		{name: "waiting containers are skipped", pods: []corev1.Pod{waiting}},
+		{name: "restarted container", pods: []corev1.Pod{pod("a", 1)}, wantStreams: 1},
+		{name: "excess is reported again", pods: []corev1.Pod{pod("d", 0), pod("e", 0)}, wantStreams: 1, wantErrors: 1},
+	}
+
+	ctx := context.Background()
+	s := &logStreamer{
+		client:    fake.NewSimpleClientset(),
+		namespace: "default",
+		max:       1,
+		lines:     make(chan logLine, 100),
+		streams:   make(map[string]struct{}),
+	}
+	for i, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			s.start(ctx, step.pods, i == 0)
+			s.wg.Wait()
+
+			streams, errors := 0, 0
+			for len(s.lines) != 0 {
+				line := <-s.lines
+				if len(line.Error) != 0 {
+					errors++
+				} else {
+					streams++
+				}
+			}
+			if streams != step.wantStreams || errors != step.wantErrors {
+				t.Errorf("%d streams, %d errors, want %d streams, %d errors", streams, errors, step.wantStreams, step.wantErrors)
+			}
+		})
+	}
+}
+
+func TestPodLogOptions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name       string
+		query      string
+		wantFollow bool
+		wantTail   int64
+		wantMax    int
+		wantErr    bool
+	}{
+		{name: "default", wantMax: defaultMaxLogRequests},
+		{name: "follow", query: "follow=true&tailLines=10&maxLogRequests=5", wantFollow: true, wantTail: 10, wantMax: 5},
+		{name: "bad follow", query: "follow=yes", wantErr: true},
+		{name: "negative tail", query: "tailLines=-1", wantErr: true},
+		{name: "zero max", query: "maxLogRequests=0", wantErr: true},
+		{name: "follow previous", query: "follow=true&previous=true", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodGet, "/logs?"+tt.query, nil)
+
+			opts, max, err := podLogOptions(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("podLogOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			tail := int64(0)
+			if opts.TailLines != nil {
+				tail = *opts.TailLines
+			}
+			if opts.Follow != tt.wantFollow || tail != tt.wantTail || max != tt.wantMax {
+				t.Errorf("follow, tailLines, maxLogRequests = %v, %v, %v, want %v, %v, %v", opts.Follow, tail, max, tt.wantFollow, tt.wantTail, tt.wantMax)
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	diagnosticsapi "github.com/helen-frank/hcnmp/pkg/apis/diagnostics"
+	operationapi "github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/diagnostics"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	defaultMatrixConcurrency = 10
+	maxMatrixConcurrency     = 50
+	// maxMatrixSourceLimit bounds the pods of a source per cluster
+	maxMatrixSourceLimit = 10
+	// maxMatrixSourcePods bounds the pods of all sources of a matrix
+	maxMatrixSourcePods = 100
+
+	defaultMatrixTimeout = 10 * time.Minute
+)
+
+// matrixSourcePod is a pod checking the targets of a matrix.
+type matrixSourcePod struct {
+	source  string
+	cluster string
+	pod     *corev1.Pod
+	// client is the client of the cluster impersonating the caller
+	client *clientset.Clientset
+}
+
+// matrixCheck is a validated matrix request with its source pods, the matrix holds the rows of the
+// sources and pods which can not be checked.
+type matrixCheck struct {
+	matrix *diagnosticsapi.Matrix
+	pods   []matrixSourcePod
+	opts   *diagnosticsapi.Request
+}
+
+// connectivityMatrix checks every target from the pods of every source, across clusters, and replies an operation
+// whose result is the matrix, bounded by timeout (default 10m). The matrix can be saved as a baseline for diffConnectivityMatrix.
+func (h *handler) connectivityMatrix(c *gin.Context) {
+	req := &diagnosticsapi.MatrixRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	timeout, err := queryTimeout(c, defaultMatrixTimeout)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	check, err := h.newMatrixCheck(c, req)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	h.startOperation(c, matrixOperation("connectivity-matrix", auth.User(c), req), timeout,
+		func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+			return h.checkMatrix(ctx, check, r), nil
+		})
+}
+
+// diffConnectivityMatrix compares a matrix with a baseline and replies the paths whose state changed. The request of the
+// baseline is checked again as an operation whose result is the diff, bounded by timeout (default 10m), unless the current
+// matrix is given.
+func (h *handler) diffConnectivityMatrix(c *gin.Context) {
+	req := &diagnosticsapi.DiffRequest{}
+	if err := c.ShouldBindJSON(req); err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Current != nil {
+		c.JSON(http.StatusOK, matrixDiff(&req.Baseline, req.Current))
+		return
+	}
+
+	timeout, err := queryTimeout(c, defaultMatrixTimeout)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	check, err := h.newMatrixCheck(c, &req.Baseline.Request)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	h.startOperation(c, matrixOperation("connectivity-matrix-diff", auth.User(c), &req.Baseline.Request), timeout,
+		func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+			return matrixDiff(&req.Baseline, h.checkMatrix(ctx, check, r)), nil
+		})
+}
+
+func matrixOperation(operationType, user string, req *diagnosticsapi.MatrixRequest) operationapi.Operation {
+	sources := make([]string, 0, len(req.Sources))
+	for i := range req.Sources {
+		sources = append(sources, diagnostics.SourceName(&req.Sources[i]))
+	}
+	return operationapi.Operation{
+		Type: operationType,
+		User: user,
+		Target: operationapi.Target{
+			Kind: "ConnectivityMatrix",
+			Name: strings.Join(sources, ","),
+		},
+	}
+}
+
+func matrixDiff(baseline, current *diagnosticsapi.Matrix) *diagnosticsapi.MatrixDiff {
+	diff := &diagnosticsapi.MatrixDiff{
+		APIVersion:        "v1",
+		Kind:              "ConnectivityMatrixDiff",
+		BaselineCreatedAt: baseline.CreatedAt,
+		Current:           *current,
+		Changes:           diagnostics.Diff(baseline, current),
+	}
+	for _, change := range diff.Changes {
+		switch {
+		case change.Before == diagnosticsapi.PathReachable:
+			diff.Broken++
+		case change.After == diagnosticsapi.PathReachable:
+			diff.Fixed++
+		}
+	}
+	return diff
+}
+
+// newMatrixCheck validates the request and selects the source pods the caller may diagnose.
+func (h *handler) newMatrixCheck(c *gin.Context, req *diagnosticsapi.MatrixRequest) (*matrixCheck, error) {
+	opts, err := validateMatrixRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pods, rows := h.matrixSourcePods(c, req.Sources)
+	if len(pods) > maxMatrixSourcePods {
+		return nil, fmt.Errorf("the sources select %v pods, at most %v can be checked", len(pods), maxMatrixSourcePods)
+	}
+
+	return &matrixCheck{
+		matrix: &diagnosticsapi.Matrix{
+			APIVersion: "v1",
+			Kind:       "ConnectivityMatrix",
+			CreatedAt:  time.Now(),
+			Request:    *req,
+			Targets:    req.Targets,
+			Rows:       rows,
+		},
+		pods: pods,
+		opts: opts,
+	}, nil
+}
+
+// checkMatrix checks the targets from the source pods of check, the checked pods are reported as progress.
+func (h *handler) checkMatrix(ctx context.Context, check *matrixCheck, r *operation.Reporter) *diagnosticsapi.Matrix {
+	m := check.matrix
+	req := &m.Request
+	if m.Rows == nil {
+		m.Rows = []diagnosticsapi.MatrixRow{}
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, req.Concurrency)
+		done int
+	)
+	r.Progress(0, len(check.pods), fmt.Sprintf("0 of %v pods checked", len(check.pods)))
+	for i := range check.pods {
+		pod := check.pods[i]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			row := h.checkMatrixRow(ctx, pod, req.Targets, check.opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+			m.Rows = append(m.Rows, row)
+			done++
+			r.Progress(done, len(check.pods), fmt.Sprintf("%v of %v pods checked", done, len(check.pods)))
+		}()
+	}
+	wg.Wait()
+
+	// keep the order of rows stable
+	sort.SliceStable(m.Rows, func(i, j int) bool {
+		a, b := m.Rows[i], m.Rows[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Pod < b.Pod
+	})
+	diagnostics.Summarize(m)
+	return m
+}
+
+// checkMatrixRow checks the targets from the pod.
+func (h *handler) checkMatrixRow(ctx context.Context, pod matrixSourcePod, targets []diagnosticsapi.MatrixTarget, opts *diagnosticsapi.Request) diagnosticsapi.MatrixRow {
+	row := diagnosticsapi.MatrixRow{
+		Source:    pod.source,
+		Cluster:   pod.cluster,
+		Namespace: pod.pod.Namespace,
+		Pod:       pod.pod.Name,
+	}
+
+	results, err := h.runDiagnostics(ctx, pod.client, pod.pod.Namespace, pod.pod.Name, opts)
+	if err != nil {
+		row.Error = err.Error()
+		return row
+	}
+
+	row.Cells = make([]diagnosticsapi.Cell, 0, len(results))
+	for i := range results {
+		row.Cells = append(row.Cells, diagnostics.Cell(targets[i].Name, &results[i]))
+	}
+	return row
+}
+
+// matrixSourcePods returns the running pods of the sources which are authorized for diagnostics,
+// the sources or clusters without such pods are returned as rows with errors.
+func (h *handler) matrixSourcePods(c *gin.Context, sources []diagnosticsapi.Source) ([]matrixSourcePod, []diagnosticsapi.MatrixRow) {
+	var (
+		pods []matrixSourcePod
+		rows []diagnosticsapi.MatrixRow
+	)
+
+	for i := range sources {
+		source := &sources[i]
+		name := diagnostics.SourceName(source)
+
+		codes, err := selectClusters(source.Clusters, source.ClusterSelector)
+		if err != nil {
+			rows = append(rows, diagnosticsapi.MatrixRow{Source: name, Namespace: source.Namespace, Error: err.Error()})
+			continue
+		}
+
+		for _, code := range codes {
+			client, err := proxy.GetClusterPorxyClientFromCode(code)
+			if err == nil {
+				// the pods are selected and diagnosed as the caller
+				client, err = impersonatedClient(c, code, client)
+			}
+			if err != nil {
+				rows = append(rows, diagnosticsapi.MatrixRow{Source: name, Cluster: code, Namespace: source.Namespace, Error: err.Error()})
+				continue
+			}
+
+			selected, err := h.selectSourcePods(c, client, code, source)
+			if err != nil {
+				rows = append(rows, diagnosticsapi.MatrixRow{Source: name, Cluster: code, Namespace: source.Namespace, Error: err.Error()})
+				continue
+			}
+
+			for j := range selected {
+				if err := h.authorizeDiagnostics(c, code, selected[j].Namespace, selected[j].Name); err != nil {
+					rows = append(rows, diagnosticsapi.MatrixRow{
+						Source:    name,
+						Cluster:   code,
+						Namespace: selected[j].Namespace,
+						Pod:       selected[j].Name,
+						Error:     err.Error(),
+					})
+					continue
+				}
+				pods = append(pods, matrixSourcePod{source: name, cluster: code, pod: &selected[j], client: client})
+			}
+		}
+	}
+	return pods, rows
+}
+
+// selectSourcePods returns the pod of the source, or up to limit running pods matching its selector sorted by name.
+func (h *handler) selectSourcePods(c *gin.Context, client *clientset.Clientset, code string, source *diagnosticsapi.Source) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	if len(source.Pod) != 0 {
+		if err := h.authorizePod(c, code, "get", source.Namespace, source.Pod, ""); err != nil {
+			return nil, err
+		}
+		pod, err := client.CoreV1().Pods(source.Namespace).Get(c.Request.Context(), source.Pod, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		pods = []corev1.Pod{*pod}
+	} else {
+		if err := h.authorizePod(c, code, "list", source.Namespace, "", ""); err != nil {
+			return nil, err
+		}
+		list, err := client.CoreV1().Pods(source.Namespace).List(c.Request.Context(), metav1.ListOptions{
+			LabelSelector: source.Selector,
+			FieldSelector: "status.phase=" + string(corev1.PodRunning),
+		})
+		if err != nil {
+			return nil, err
+		}
+		pods = list.Items
+	}
+
+	running := make([]corev1.Pod, 0, len(pods))
+	for i := range pods {
+		// the privileged debug pods of nodes are never diagnosed, see authorizeNodeDebugSession
+		if _, ok := pods[i].Labels[nodeDebugLabel]; ok {
+			continue
+		}
+		if pods[i].Status.Phase == corev1.PodRunning && pods[i].DeletionTimestamp == nil {
+			running = append(running, pods[i])
+		}
+	}
+	if len(running) == 0 {
+		return nil, fmt.Errorf("no running pod of %v", diagnostics.SourceName(source))
+	}
+
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Name < running[j].Name
+	})
+	if len(running) > source.Limit {
+		running = running[:source.Limit]
+	}
+	return running, nil
+}
+
+// validateMatrixRequest resolves the targets and defaults the request, it returns the options of the diagnostics.
+func validateMatrixRequest(req *diagnosticsapi.MatrixRequest) (*diagnosticsapi.Request, error) {
+	if len(req.Sources) == 0 {
+		return nil, errors.New("at least one source is required")
+	}
+	for i := range req.Sources {
+		source := &req.Sources[i]
+		if errs := validation.IsDNS1123Label(source.Namespace); len(errs) != 0 {
+			return nil, fmt.Errorf("invalid namespace %q of source %v: %v", source.Namespace, i, strings.Join(errs, ", "))
+		}
+		if len(source.Pod) != 0 && len(source.Selector) != 0 {
+			return nil, fmt.Errorf("source %v can not have both pod and selector", diagnostics.SourceName(source))
+		}
+		if _, err := labels.Parse(source.Selector); err != nil {
+			return nil, fmt.Errorf("invalid selector of source %v: %v", diagnostics.SourceName(source), err)
+		}
+		if source.Limit == 0 {
+			source.Limit = 1
+		}
+		if source.Limit < 0 || source.Limit > maxMatrixSourceLimit {
+			return nil, fmt.Errorf("limit of source %v must be between 1 and %v", diagnostics.SourceName(source), maxMatrixSourceLimit)
+		}
+	}
+
+	if req.Concurrency == 0 {
+		req.Concurrency = defaultMatrixConcurrency
+	}
+	if req.Concurrency < 0 || req.Concurrency > maxMatrixConcurrency {
+		return nil, fmt.Errorf("concurrency must be between 1 and %v", maxMatrixConcurrency)
+	}
+
+	opts := &diagnosticsapi.Request{
+		Targets:            make([]diagnosticsapi.Target, 0, len(req.Targets)),
+		TimeoutSeconds:     req.TimeoutSeconds,
+		Count:              req.Count,
+		InsecureSkipVerify: req.InsecureSkipVerify,
+	}
+	names := make(map[string]struct{}, len(req.Targets))
+	for i := range req.Targets {
+		if err := diagnostics.ResolveTarget(&req.Targets[i]); err != nil {
+			return nil, err
+		}
+		if _, ok := names[req.Targets[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate target %v", req.Targets[i].Name)
+		}
+		names[req.Targets[i].Name] = struct{}{}
+		opts.Targets = append(opts.Targets, req.Targets[i].Target)
+	}
+	if err := validateDiagnosticsRequest(opts); err != nil {
+		return nil, err
+	}
+	req.TimeoutSeconds, req.Count = opts.TimeoutSeconds, opts.Count
+	return opts, nil
+}
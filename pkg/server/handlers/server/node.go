@@ -18,15 +18,32 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+	"k8s.io/kubectl/pkg/drain"
 
+	operationapi "github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
 	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
 )
 
+const defaultDrainTimeout = 30 * time.Minute
+
 // listNamespaceOfNode get all namespace on node
 func (h *handler) listNamespaceOfNode(c *gin.Context) {
 	name := c.Param("name")
@@ -56,3 +73,224 @@ func (h *handler) listNamespaceOfNode(c *gin.Context) {
 
 	c.JSON(http.StatusOK, namespaces)
 }
+
+// cordonNode marks the node unschedulable like kubectl cordon.
+func (h *handler) cordonNode(c *gin.Context) {
+	h.setUnschedulable(c, true)
+}
+
+// uncordonNode marks the node schedulable like kubectl uncordon.
+func (h *handler) uncordonNode(c *gin.Context) {
+	h.setUnschedulable(c, false)
+}
+
+func (h *handler) setUnschedulable(c *gin.Context, unschedulable bool) {
+	name := c.Param("name")
+
+	if err := h.authorizeNode(c, "patch", name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the node is changed as the caller
+	if client, err = impersonatedClient(c, c.Param("clusterCode"), client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	node, err := client.CoreV1().Nodes().Get(c.Request.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := drain.RunCordonOrUncordon(&drain.Helper{Ctx: c.Request.Context(), Client: client}, node, unschedulable); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	node, err = client.CoreV1().Nodes().Get(c.Request.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, node)
+}
+
+// drainNode cordons the node and evicts its pods like kubectl drain, evictions blocked by PodDisruptionBudgets are retried.
+// It replies an operation reporting every evicted pod, bounded by timeout (default 30m).
+func (h *handler) drainNode(c *gin.Context) {
+	code := c.Param("clusterCode")
+	name := c.Param("name")
+
+	helper, timeout, err := nodeDrainOptions(c)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeNode(c, "patch", name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+	// evictions of the pods of every namespace, or their deletion when evictions are disabled
+	evict := &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              "create",
+		APIVersion:        "v1",
+		Resource:          "pods",
+		Subresource:       "eviction",
+	}
+	if helper.DisableEviction {
+		evict.Verb = "delete"
+		evict.Subresource = ""
+	}
+	if err := h.policy.Authorize(c, code, evict); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the node is drained as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	node, err := client.CoreV1().Nodes().Get(c.Request.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.startOperation(c, operationapi.Operation{
+		Type:    "drain",
+		User:    auth.User(c),
+		Cluster: code,
+		Target: operationapi.Target{
+			Kind: "Node",
+			Name: name,
+		},
+	}, timeout, func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+		return runNodeDrain(ctx, client, node, helper, r)
+	})
+}
+
+// runNodeDrain is drain.RunNodeDrain reporting to the operation, it returns the drained node.
+func runNodeDrain(ctx context.Context, client clientset.Interface, node *corev1.Node, helper *drain.Helper, r *operation.Reporter) (*corev1.Node, error) {
+	helper.Ctx = ctx
+	helper.Client = client
+	helper.Out = &eventWriter{reporter: r, eventType: operationapi.EventTypeNormal}
+	// evictions blocked by PodDisruptionBudgets are reported here before they are retried
+	helper.ErrOut = &eventWriter{reporter: r, eventType: operationapi.EventTypeWarning}
+
+	if err := drain.RunCordonOrUncordon(helper, node, true); err != nil {
+		return nil, err
+	}
+	r.Event(operationapi.EventTypeNormal, fmt.Sprintf("cordoned node %v", node.Name))
+
+	list, errs := helper.GetPodsForDeletion(node.Name)
+	if errs != nil {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	if warnings := list.Warnings(); len(warnings) != 0 {
+		r.Event(operationapi.EventTypeWarning, warnings)
+	}
+
+	pods := list.Pods()
+	var (
+		mu   sync.Mutex
+		done int
+	)
+	r.Progress(0, len(pods), fmt.Sprintf("0 of %v pods done", len(pods)))
+	helper.OnPodDeletedOrEvicted = func(pod *corev1.Pod, usingEviction bool) {
+		verb := "deleted"
+		if usingEviction {
+			verb = "evicted"
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		r.Progress(done, len(pods), fmt.Sprintf("%v pod %v/%v, %v of %v pods done", verb, pod.Namespace, pod.Name, done, len(pods)))
+	}
+	if err := helper.DeleteOrEvictPods(pods); err != nil {
+		return nil, err
+	}
+
+	return client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{})
+}
+
+// nodeDrainOptions parses gracePeriodSeconds, ignoreDaemonSets, deleteEmptyDirData, force, disableEviction,
+// podSelector and timeout of the request, the defaults are the ones of kubectl drain except for timeout.
+func nodeDrainOptions(c *gin.Context) (*drain.Helper, time.Duration, error) {
+	helper := &drain.Helper{
+		GracePeriodSeconds: -1,
+		PodSelector:        c.Query("podSelector"),
+		ChunkSize:          cmdutil.DefaultChunkSize,
+	}
+	var err error
+
+	for k, v := range map[string]*bool{
+		"ignoreDaemonSets":   &helper.IgnoreAllDaemonSets,
+		"deleteEmptyDirData": &helper.DeleteEmptyDirData,
+		"force":              &helper.Force,
+		"disableEviction":    &helper.DisableEviction,
+	} {
+		if s := c.Query(k); len(s) != 0 {
+			if *v, err = strconv.ParseBool(s); err != nil {
+				return nil, 0, fmt.Errorf("%v must be a bool", k)
+			}
+		}
+	}
+
+	if s := c.Query("gracePeriodSeconds"); len(s) != 0 {
+		if helper.GracePeriodSeconds, err = strconv.Atoi(s); err != nil {
+			return nil, 0, errors.New("gracePeriodSeconds must be an integer, negative uses the one of the pod")
+		}
+	}
+
+	timeout, err := queryTimeout(c, defaultDrainTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	helper.Timeout = timeout
+	return helper, timeout, nil
+}
+
+// authorizeNode checks the proxy policy for verb of the node, or its subresource.
+func (h *handler) authorizeNode(c *gin.Context, verb, name, subresource string) error {
+	return h.policy.Authorize(c, c.Param("clusterCode"), &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              verb,
+		APIVersion:        "v1",
+		Resource:          "nodes",
+		Subresource:       subresource,
+		Name:              name,
+	})
+}
+
+// eventWriter records every line written to it as an event of the operation.
+type eventWriter struct {
+	reporter  *operation.Reporter
+	eventType string
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			w.reporter.Event(w.eventType, line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,127 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNodeDrainOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+
+		wantErr                bool
+		wantGracePeriodSeconds int
+		wantIgnoreDaemonSets   bool
+		wantDeleteEmptyDirData bool
+		wantForce              bool
+		wantDisableEviction    bool
+		wantPodSelector        string
+		wantTimeout            time.Duration
+	}{
+		{
+			name:                   "defaults",
+			wantGracePeriodSeconds: -1,
+			wantTimeout:            defaultDrainTimeout,
+		},
+		{
+			name:                   "all options",
+			query:                  "gracePeriodSeconds=30&ignoreDaemonSets=true&deleteEmptyDirData=true&force=true&disableEviction=true&podSelector=app%3Dweb&timeout=10m",
+			wantGracePeriodSeconds: 30,
+			wantIgnoreDaemonSets:   true,
+			wantDeleteEmptyDirData: true,
+			wantForce:              true,
+			wantDisableEviction:    true,
+			wantPodSelector:        "app=web",
+			wantTimeout:            10 * time.Minute,
+		},
+		{
+			name:                   "explicit false",
+			query:                  "ignoreDaemonSets=false&force=0",
+			wantGracePeriodSeconds: -1,
+			wantTimeout:            defaultDrainTimeout,
+		},
+		{
+			name:                   "zero grace period",
+			query:                  "gracePeriodSeconds=0",
+			wantGracePeriodSeconds: 0,
+			wantTimeout:            defaultDrainTimeout,
+		},
+		{
+			name:    "invalid bool",
+			query:   "force=yes",
+			wantErr: true,
+		},
+		{
+			name:    "invalid grace period",
+			query:   "gracePeriodSeconds=1.5",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timeout",
+			query:   "timeout=10",
+			wantErr: true,
+		},
+		{
+			name:    "negative timeout",
+			query:   "timeout=-1m",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/drain?"+tt.query, nil)
+
+			helper, timeout, err := nodeDrainOptions(c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodeDrainOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if helper.GracePeriodSeconds != tt.wantGracePeriodSeconds {
+				t.Errorf("gracePeriodSeconds = %v, want %v", helper.GracePeriodSeconds, tt.wantGracePeriodSeconds)
+			}
+			if helper.IgnoreAllDaemonSets != tt.wantIgnoreDaemonSets {
+				t.Errorf("ignoreDaemonSets = %v, want %v", helper.IgnoreAllDaemonSets, tt.wantIgnoreDaemonSets)
+			}
+			if helper.DeleteEmptyDirData != tt.wantDeleteEmptyDirData {
+				t.Errorf("deleteEmptyDirData = %v, want %v", helper.DeleteEmptyDirData, tt.wantDeleteEmptyDirData)
+			}
+			if helper.Force != tt.wantForce {
+				t.Errorf("force = %v, want %v", helper.Force, tt.wantForce)
+			}
+			if helper.DisableEviction != tt.wantDisableEviction {
+				t.Errorf("disableEviction = %v, want %v", helper.DisableEviction, tt.wantDisableEviction)
+			}
+			if helper.PodSelector != tt.wantPodSelector {
+				t.Errorf("podSelector = %q, want %q", helper.PodSelector, tt.wantPodSelector)
+			}
+			if timeout != tt.wantTimeout || helper.Timeout != tt.wantTimeout {
+				t.Errorf("timeout = %v, helper timeout = %v, want %v", timeout, helper.Timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
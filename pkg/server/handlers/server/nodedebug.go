@@ -0,0 +1,364 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	debugapi "github.com/helen-frank/hcnmp/pkg/apis/debug"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// nodeDebugLabel marks the debug pods of nodes created by hcnmp
+	nodeDebugLabel = "hcnmp.io/node-debug"
+	// nodeDebugUserAnnotation is the hcnmp user who created the debug pod
+	nodeDebugUserAnnotation = "hcnmp.io/user"
+	// nodeDebugExpiresAnnotation is when the debug pod is deleted, in RFC 3339
+	nodeDebugExpiresAnnotation = "hcnmp.io/expires-at"
+
+	nodeDebugContainer       = "debugger"
+	nodeDebugCleanupInterval = time.Minute
+)
+
+// debugNode creates a privileged pod on the node sharing its pid, network and ipc namespaces, with the root
+// filesystem of the node mounted at /host, and replies the session for the exec terminal like kubectl debug node.
+// The pod is root on the node: only the node debug users may create it, and it is deleted after ttl.
+func (h *handler) debugNode(c *gin.Context) {
+	code := c.Param("clusterCode")
+	name := c.Param("name")
+	user := auth.User(c)
+	namespace := h.debug.NodeDebugNamespace
+
+	image := c.DefaultQuery("image", h.debug.DebugImage)
+	if len(image) == 0 || strings.ContainsAny(image, " \t\n") {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("invalid image %q", image))
+		return
+	}
+	ttl := h.debug.NodeDebugTTL
+	if s := c.Query("ttl"); len(s) != 0 {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil || ttl < time.Minute || ttl > h.debug.NodeDebugTTL {
+			servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("ttl must be a duration between 1m and %v", h.debug.NodeDebugTTL))
+			return
+		}
+	}
+
+	if err := h.authorizeNodeDebug(c, "create", namespace, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	node, err := client.CoreV1().Nodes().Get(c.Request.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := ensureNamespace(c.Request.Context(), client, namespace); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	pod, err := client.CoreV1().Pods(namespace).Create(c.Request.Context(), nodeDebugPod(node.Name, namespace, image, user, expiresAt), metav1.CreateOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	klog.Infof("node debug: user %v created pod %v/%v with image %v on node %v of cluster %v, expires at %v",
+		user, namespace, pod.Name, image, node.Name, code, expiresAt.Format(time.RFC3339))
+	recordNodeEvent(c.Request.Context(), client, node.Name, corev1.EventTypeWarning, "NodeDebugStarted",
+		fmt.Sprintf("hcnmp user %v started privileged debug pod %v/%v with image %v, expires at %v", user, namespace, pod.Name, image, expiresAt.Format(time.RFC3339)))
+
+	if err := waitForContainer(c.Request.Context(), client, namespace, pod.Name, nodeDebugContainer, false); err != nil {
+		// do not leave a privileged pod behind which nobody can use
+		if err := client.CoreV1().Pods(namespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("failed to delete node debug pod %v/%v of cluster %v: %v", namespace, pod.Name, code, err)
+		}
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	clusterPath := strings.TrimSuffix(c.Request.URL.Path, "/node/"+name+"/debug")
+	c.JSON(http.StatusCreated, debugapi.Session{
+		Cluster:   code,
+		Namespace: namespace,
+		Pod:       pod.Name,
+		Container: nodeDebugContainer,
+		Image:     image,
+		ExecPath: fmt.Sprintf("%v/namespace/%v/pod/%v/exec?%v", clusterPath, namespace, pod.Name,
+			url.Values{"container": {nodeDebugContainer}}.Encode()),
+		Node:      node.Name,
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// deleteNodeDebug deletes a debug pod of the node before it expires.
+func (h *handler) deleteNodeDebug(c *gin.Context) {
+	code := c.Param("clusterCode")
+	name := c.Param("name")
+	podName := c.Param("pod")
+	namespace := h.debug.NodeDebugNamespace
+
+	if err := h.authorizeNodeDebug(c, "delete", namespace, podName); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	pod, err := client.CoreV1().Pods(namespace).Get(c.Request.Context(), podName, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if pod.Labels[nodeDebugLabel] != "true" || pod.Spec.NodeName != name {
+		servererror.HandleError(c, http.StatusNotFound, fmt.Errorf("pod %v/%v is not a debug pod of node %v", namespace, podName, name))
+		return
+	}
+
+	if err := client.CoreV1().Pods(namespace).Delete(c.Request.Context(), podName, metav1.DeleteOptions{}); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	user := auth.User(c)
+	klog.Infof("node debug: user %v deleted pod %v/%v on node %v of cluster %v", user, namespace, podName, name, code)
+	recordNodeEvent(c.Request.Context(), client, name, corev1.EventTypeNormal, "NodeDebugStopped",
+		fmt.Sprintf("hcnmp user %v deleted debug pod %v/%v", user, namespace, podName))
+
+	c.JSON(http.StatusOK, nil)
+}
+
+// authorizeNodeDebug allows the node debug users only, then checks the proxy policy for the virtual
+// nodes/debug subresource and for verb of the debug pod, and for exec when creating it.
+func (h *handler) authorizeNodeDebug(c *gin.Context, verb, namespace, pod string) error {
+	code := c.Param("clusterCode")
+	if user := auth.User(c); !h.debug.isNodeDebugUser(user) {
+		return apierrors.NewForbidden(corev1.Resource("nodes/debug"), c.Param("name"),
+			fmt.Errorf("user %q is not allowed to debug nodes, see --node-debug-users", user))
+	}
+
+	if err := h.authorizeNode(c, verb, c.Param("name"), "debug"); err != nil {
+		return err
+	}
+	if err := h.authorizePod(c, code, verb, namespace, pod, ""); err != nil {
+		return err
+	}
+	if verb == "create" {
+		return h.authorizePod(c, code, "create", namespace, pod, "exec")
+	}
+	return nil
+}
+
+// authorizeNodeDebugSession refuses the exec, attach and portforward sessions of the debug pods of nodes
+// to everybody but the node debug user who created them, the policy alone may allow sessions in their namespace.
+func (h *handler) authorizeNodeDebugSession(c *gin.Context, client clientset.Interface, namespace, name string) error {
+	pod, err := client.CoreV1().Pods(namespace).Get(c.Request.Context(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// the session fails on the missing pod
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := pod.Labels[nodeDebugLabel]; !ok {
+		return nil
+	}
+
+	user := auth.User(c)
+	if h.debug.isNodeDebugUser(user) && pod.Annotations[nodeDebugUserAnnotation] == user {
+		return nil
+	}
+	return apierrors.NewForbidden(corev1.Resource("pods"), name,
+		fmt.Errorf("pod %v/%v is a debug pod of node %v created by another user", namespace, name, pod.Spec.NodeName))
+}
+
+// handleNodeDebugSessionError replies the error of authorizeNodeDebugSession, 403 when the session is refused
+// and 500 when the pod can not be read, like abortWithError.
+func handleNodeDebugSessionError(c *gin.Context, err error) {
+	code := http.StatusInternalServerError
+	if apierrors.IsForbidden(err) {
+		code = http.StatusForbidden
+	}
+	servererror.HandleError(c, code, err)
+}
+
+// ensureNamespace creates the namespace of the debug pods of nodes when it is missing.
+func ensureNamespace(ctx context.Context, client clientset.Interface, namespace string) error {
+	_, err := client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	_, err = client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   namespace,
+			Labels: map[string]string{"app.kubernetes.io/managed-by": "hcnmp"},
+		},
+	}, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// nodeDebugPod is the pod of kubectl debug node with the sysadmin profile, its deadline is the ttl
+// so that the kubelet stops it even if hcnmp does not delete it.
+func nodeDebugPod(node, namespace, image, user string, expiresAt time.Time) *corev1.Pod {
+	// keep the name short for long node names
+	prefix := strings.TrimRight(node[:min(len(node), 40)], ".-")
+	deadline := int64(time.Until(expiresAt).Seconds())
+	privileged := true
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "node-debugger-" + prefix + "-" + utilrand.String(5),
+			Namespace: namespace,
+			Labels: map[string]string{
+				nodeDebugLabel:                 "true",
+				"app.kubernetes.io/managed-by": "hcnmp",
+			},
+			Annotations: map[string]string{
+				nodeDebugUserAnnotation:    user,
+				nodeDebugExpiresAnnotation: expiresAt.Format(time.RFC3339),
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:              node,
+			HostPID:               true,
+			HostNetwork:           true,
+			HostIPC:               true,
+			RestartPolicy:         corev1.RestartPolicyNever,
+			ActiveDeadlineSeconds: &deadline,
+			// run on tainted nodes, e.g. the unhealthy ones
+			Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}},
+			Containers: []corev1.Container{{
+				Name:  nodeDebugContainer,
+				Image: image,
+				// the shell of the image keeps running with stdin and a tty
+				Stdin:                    true,
+				TTY:                      true,
+				ImagePullPolicy:          corev1.PullIfNotPresent,
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+				SecurityContext:          &corev1.SecurityContext{Privileged: &privileged},
+				VolumeMounts:             []corev1.VolumeMount{{Name: "host-root", MountPath: "/host"}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name:         "host-root",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/"}},
+			}},
+		},
+	}
+}
+
+// recordNodeEvent records an event of the node in its cluster, it is the audit trail seen by the cluster admins.
+func recordNodeEvent(ctx context.Context, client clientset.Interface, node, eventType, reason, message string) {
+	now := metav1.Now()
+	if _, err := client.CoreV1().Events(metav1.NamespaceDefault).Create(ctx, &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: node + ".",
+			Namespace:    metav1.NamespaceDefault,
+		},
+		// events of nodes use the name of the node as uid like the kubelet
+		InvolvedObject: corev1.ObjectReference{Kind: "Node", Name: node, UID: types.UID(node)},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: "hcnmp"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{}); err != nil {
+		klog.Errorf("failed to record event %v of node %v: %v", reason, node, err)
+	}
+}
+
+// cleanupNodeDebugPods deletes the expired debug pods of nodes in every cluster, it runs on the leader.
+func (h *handler) cleanupNodeDebugPods(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for _, code := range proxy.ListClusterCodes() {
+			client, err := proxy.GetClusterPorxyClientFromCode(code)
+			if err != nil {
+				continue
+			}
+			if err := cleanupClusterNodeDebugPods(ctx, client, h.debug.NodeDebugNamespace); err != nil {
+				klog.Errorf("failed to clean up node debug pods of cluster %v: %v", code, err)
+			}
+		}
+	}, nodeDebugCleanupInterval)
+}
+
+// cleanupClusterNodeDebugPods deletes the expired debug pods of nodes created by hcnmp in namespace.
+func cleanupClusterNodeDebugPods(ctx context.Context, client clientset.Interface, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	pods, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: nodeDebugLabel + "=true,app.kubernetes.io/managed-by=hcnmp",
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		expiresAt, err := time.Parse(time.RFC3339, pod.Annotations[nodeDebugExpiresAnnotation])
+		if err != nil {
+			// not a pod created by hcnmp, its activeDeadlineSeconds stops it otherwise
+			klog.Warningf("skipped node debug pod %v/%v with invalid %v: %v", pod.Namespace, pod.Name, nodeDebugExpiresAnnotation, err)
+			continue
+		}
+		if time.Now().Before(expiresAt) {
+			continue
+		}
+		if err := client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			klog.Errorf("failed to delete expired node debug pod %v/%v: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		klog.Infof("node debug: deleted expired pod %v/%v of user %v on node %v", pod.Namespace, pod.Name, pod.Annotations[nodeDebugUserAnnotation], pod.Spec.NodeName)
+		recordNodeEvent(ctx, client, pod.Spec.NodeName, corev1.EventTypeNormal, "NodeDebugExpired",
+			fmt.Sprintf("hcnmp deleted expired debug pod %v/%v of user %v", pod.Namespace, pod.Name, pod.Annotations[nodeDebugUserAnnotation]))
+	}
+	return nil
+}
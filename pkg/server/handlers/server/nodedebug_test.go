@@ -0,0 +1,183 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestAuthorizeNodeDebugSession(t *testing.T) {
+	debugPod := nodeDebugPod("node-1", "hcnmp-node-debug", "busybox", "alice", time.Now().Add(time.Hour))
+	debugPod.Name = "debugger"
+	regularPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "hcnmp-node-debug"}}
+
+	tests := []struct {
+		name       string
+		pod        string
+		user       string
+		debugUsers []string
+		// getErr fails reading the pod
+		getErr error
+
+		wantCode int
+	}{
+		{name: "creator", pod: "debugger", user: "alice", debugUsers: []string{"alice"}, wantCode: http.StatusOK},
+		{name: "other debug user", pod: "debugger", user: "bob", debugUsers: []string{"alice", "bob"}, wantCode: http.StatusForbidden},
+		{name: "creator no longer a debug user", pod: "debugger", user: "alice", wantCode: http.StatusForbidden},
+		{name: "regular pod", pod: "web", user: "bob", wantCode: http.StatusOK},
+		{name: "missing pod", pod: "gone", user: "bob", wantCode: http.StatusOK},
+		{name: "pod can not be read", pod: "debugger", user: "alice", debugUsers: []string{"alice"}, getErr: apierrors.NewServiceUnavailable("etcd is down"), wantCode: http.StatusServiceUnavailable},
+		{name: "plain error", pod: "debugger", user: "alice", debugUsers: []string{"alice"}, getErr: context.DeadlineExceeded, wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(debugPod, regularPod)
+			if tt.getErr != nil {
+				client.PrependReactor("get", "pods", func(clienttesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.getErr
+				})
+			}
+			h := &handler{debug: DebugOptions{NodeDebugUsers: tt.debugUsers}}
+			rec := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(rec)
+			c.Request = httptest.NewRequest(http.MethodGet, "/exec", nil)
+			c.Set(gin.AuthUserKey, tt.user)
+
+			err := h.authorizeNodeDebugSession(c, client, "hcnmp-node-debug", tt.pod)
+			if err == nil {
+				if tt.wantCode != http.StatusOK {
+					t.Fatalf("authorizeNodeDebugSession() error = nil, want %v", tt.wantCode)
+				}
+				return
+			}
+			handleNodeDebugSessionError(c, err)
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %v, want %v: %v", rec.Code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestNodeDebugPod(t *testing.T) {
+	tests := []struct {
+		node       string
+		wantPrefix string
+	}{
+		{node: "node-1", wantPrefix: "node-debugger-node-1-"},
+		{node: "ip-10-0-0-1.ec2.internal", wantPrefix: "node-debugger-ip-10-0-0-1.ec2.internal-"},
+		{
+			// cut to 40 characters, without a trailing separator
+			node:       "a-very-long-node-name-of-a-managed-node-.group.example.com",
+			wantPrefix: "node-debugger-a-very-long-node-name-of-a-managed-node-",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.node, func(t *testing.T) {
+			expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+			pod := nodeDebugPod(tt.node, "hcnmp-node-debug", "busybox", "alice", expiresAt)
+
+			if !strings.HasPrefix(pod.Name, tt.wantPrefix) || len(pod.Name) != len(tt.wantPrefix)+5 {
+				t.Errorf("name = %v, want %v and 5 random characters", pod.Name, tt.wantPrefix)
+			}
+			if pod.Namespace != "hcnmp-node-debug" || pod.Spec.NodeName != tt.node {
+				t.Errorf("pod %v/%v on %v, want hcnmp-node-debug on %v", pod.Namespace, pod.Name, pod.Spec.NodeName, tt.node)
+			}
+			if pod.Labels[nodeDebugLabel] != "true" {
+				t.Errorf("labels = %v, want %v", pod.Labels, nodeDebugLabel)
+			}
+			if pod.Annotations[nodeDebugUserAnnotation] != "alice" || pod.Annotations[nodeDebugExpiresAnnotation] != expiresAt.Format(time.RFC3339) {
+				t.Errorf("annotations = %v, want the user and expiry", pod.Annotations)
+			}
+			if deadline := *pod.Spec.ActiveDeadlineSeconds; deadline < 3590 || deadline > 3600 {
+				t.Errorf("activeDeadlineSeconds = %v, want the ttl", deadline)
+			}
+			if !pod.Spec.HostPID || !pod.Spec.HostNetwork || !pod.Spec.HostIPC {
+				t.Error("pod does not share the namespaces of the node")
+			}
+			container := pod.Spec.Containers[0]
+			if container.Name != nodeDebugContainer || container.Image != "busybox" || !*container.SecurityContext.Privileged {
+				t.Errorf("container = %+v, want a privileged %v of busybox", container, nodeDebugContainer)
+			}
+			if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].MountPath != "/host" || pod.Spec.Volumes[0].HostPath.Path != "/" {
+				t.Errorf("volumes = %+v, want the root of the node at /host", pod.Spec.Volumes)
+			}
+		})
+	}
+}
+
+func TestCleanupClusterNodeDebugPods(t *testing.T) {
+	debugPod := func(name, expiresAt string) *corev1.Pod {
+		pod := nodeDebugPod("node-1", "hcnmp-node-debug", "busybox", "alice", time.Now())
+		pod.Name = name
+		pod.Annotations[nodeDebugExpiresAnnotation] = expiresAt
+		return pod
+	}
+	unmanaged := debugPod("unmanaged", time.Now().Add(-time.Hour).Format(time.RFC3339))
+	delete(unmanaged.Labels, "app.kubernetes.io/managed-by")
+
+	tests := []struct {
+		pod         *corev1.Pod
+		wantDeleted bool
+	}{
+		{pod: debugPod("expired", time.Now().Add(-time.Minute).Format(time.RFC3339)), wantDeleted: true},
+		{pod: debugPod("running", time.Now().Add(time.Hour).Format(time.RFC3339))},
+		{pod: debugPod("invalid", "tomorrow")},
+		{pod: unmanaged},
+	}
+
+	objs := make([]runtime.Object, 0, len(tests))
+	for _, tt := range tests {
+		objs = append(objs, tt.pod)
+	}
+	client := fake.NewSimpleClientset(objs...)
+	if err := cleanupClusterNodeDebugPods(context.TODO(), client, "hcnmp-node-debug"); err != nil {
+		t.Fatalf("cleanupClusterNodeDebugPods() error = %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pod.Name, func(t *testing.T) {
+			_, err := client.CoreV1().Pods("hcnmp-node-debug").Get(context.TODO(), tt.pod.Name, metav1.GetOptions{})
+			if deleted := apierrors.IsNotFound(err); deleted != tt.wantDeleted {
+				t.Errorf("deleted = %v, want %v: %v", deleted, tt.wantDeleted, err)
+			}
+		})
+	}
+
+	events, err := client.CoreV1().Events(metav1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list events: %v", err)
+	}
+	if len(events.Items) != 1 || events.Items[0].Reason != "NodeDebugExpired" || events.Items[0].InvolvedObject.Name != "node-1" {
+		t.Errorf("events = %+v, want NodeDebugExpired of node-1", events.Items)
+	}
+}
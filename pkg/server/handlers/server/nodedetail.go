@@ -0,0 +1,409 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	resourcehelper "k8s.io/kubectl/pkg/util/resource"
+
+	nodeapi "github.com/helen-frank/hcnmp/pkg/apis/node"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+// ownerConcurrency is how many intermediate owners of pods are read at a time
+const ownerConcurrency = 10
+
+var (
+	nodeMetricsGVR = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "nodes"}
+	podMetricsGVR  = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+	// intermediateOwners are the controllers of pods which are controlled by another workload themselves
+	intermediateOwners = map[schema.GroupKind]schema.GroupVersionResource{
+		{Group: "apps", Kind: "ReplicaSet"}: {Group: "apps", Version: "v1", Resource: "replicasets"},
+		{Group: "batch", Kind: "Job"}:       {Group: "batch", Version: "v1", Resource: "jobs"},
+	}
+
+	// nodeConditions are the conditions of NodeDetail
+	nodeConditions = map[corev1.NodeConditionType]struct{}{
+		corev1.NodeReady:              {},
+		corev1.NodeMemoryPressure:     {},
+		corev1.NodeDiskPressure:       {},
+		corev1.NodePIDPressure:        {},
+		corev1.NodeNetworkUnavailable: {},
+	}
+)
+
+// allocation sums the resources of pods.
+type allocation struct {
+	pods     []string
+	requests corev1.ResourceList
+	limits   corev1.ResourceList
+	// usage is nil without metrics
+	usage corev1.ResourceList
+}
+
+type owner struct {
+	kind string
+	name string
+}
+
+// getNodeDetail returns the non-terminated pods on the node grouped by namespace and owner, with their requests,
+// limits and, when metrics-server is installed, usage compared with the allocatable resources of the node.
+func (h *handler) getNodeDetail(c *gin.Context) {
+	code := c.Param("clusterCode")
+	name := c.Param("name")
+
+	if err := h.authorizeNode(c, "get", name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+	if err := h.policy.Authorize(c, code, &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              "list",
+		APIVersion:        "v1",
+		Resource:          "pods",
+	}); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	ctx := c.Request.Context()
+	node, err := client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	// the pods, their owners and the metrics are read as the caller
+	impersonated, err := impersonatedClient(c, code, client)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	// the same pods as kubectl describe node counts
+	podList, err := impersonated.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.AndSelectors(
+			fields.OneTermEqualSelector("spec.nodeName", name),
+			fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+			fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+		).String(),
+	})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nodeDetail(ctx, impersonated, node, podList.Items))
+}
+
+func nodeDetail(ctx context.Context, client clientset.Interface, node *corev1.Node, pods []corev1.Pod) *nodeapi.NodeDetail {
+	namespaces := make(map[string]struct{})
+	for i := range pods {
+		namespaces[pods[i].Namespace] = struct{}{}
+	}
+	nodeUsage, podUsages := metricsUsage(ctx, client, node.Name, namespaces)
+	owners := podOwners(ctx, client, pods)
+
+	total := newAllocation(nodeUsage != nil)
+	byNamespace := make(map[string]*allocation)
+	byOwner := make(map[string]map[owner]*allocation)
+	for i := range pods {
+		pod := &pods[i]
+		requests, limits := resourcehelper.PodRequestsAndLimits(pod)
+		usage := podUsages[types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name}]
+
+		if _, ok := byNamespace[pod.Namespace]; !ok {
+			byNamespace[pod.Namespace] = newAllocation(nodeUsage != nil)
+			byOwner[pod.Namespace] = make(map[owner]*allocation)
+		}
+		o := owners[pod.UID]
+		if _, ok := byOwner[pod.Namespace][o]; !ok {
+			byOwner[pod.Namespace][o] = newAllocation(nodeUsage != nil)
+		}
+
+		for _, a := range []*allocation{total, byNamespace[pod.Namespace], byOwner[pod.Namespace][o]} {
+			a.add(pod.Name, requests, limits, usage)
+		}
+	}
+
+	allocatable := node.Status.Allocatable
+	detail := &nodeapi.NodeDetail{
+		Name:          node.Name,
+		Unschedulable: node.Spec.Unschedulable,
+		Conditions:    []corev1.NodeCondition{},
+		Taints:        node.Spec.Taints,
+		Capacity:      toResources(node.Status.Capacity, node.Status.Capacity.Pods().Value()),
+		Allocatable:   toResources(allocatable, allocatable.Pods().Value()),
+		Allocated:     total.toAllocated(allocatable),
+		Namespaces:    make([]nodeapi.NamespaceBreakdown, 0, len(byNamespace)),
+	}
+	if detail.Taints == nil {
+		detail.Taints = []corev1.Taint{}
+	}
+	for _, condition := range node.Status.Conditions {
+		if _, ok := nodeConditions[condition.Type]; ok {
+			detail.Conditions = append(detail.Conditions, condition)
+		}
+	}
+	// the usage of the node includes the system daemons which are not pods
+	if nodeUsage != nil {
+		usage := toResources(nodeUsage, int64(len(pods)))
+		detail.Allocated.Usage = &usage
+		usagePercent := percent(nodeUsage, allocatable)
+		detail.Allocated.UsagePercent = &usagePercent
+	}
+
+	for namespace, a := range byNamespace {
+		breakdown := nodeapi.NamespaceBreakdown{
+			Namespace: namespace,
+			Allocated: a.toAllocated(allocatable),
+			Owners:    make([]nodeapi.OwnerBreakdown, 0, len(byOwner[namespace])),
+		}
+		for o, a := range byOwner[namespace] {
+			sort.Strings(a.pods)
+			breakdown.Owners = append(breakdown.Owners, nodeapi.OwnerBreakdown{
+				Kind:      o.kind,
+				Name:      o.name,
+				Allocated: a.toAllocated(allocatable),
+				Pods:      a.pods,
+			})
+		}
+		sort.Slice(breakdown.Owners, func(i, j int) bool {
+			if breakdown.Owners[i].Kind != breakdown.Owners[j].Kind {
+				return breakdown.Owners[i].Kind < breakdown.Owners[j].Kind
+			}
+			return breakdown.Owners[i].Name < breakdown.Owners[j].Name
+		})
+		detail.Namespaces = append(detail.Namespaces, breakdown)
+	}
+	sort.Slice(detail.Namespaces, func(i, j int) bool {
+		return detail.Namespaces[i].Namespace < detail.Namespaces[j].Namespace
+	})
+	return detail
+}
+
+// podOwners returns the workload controlling every pod, e.g. the Deployment instead of its ReplicaSet,
+// pods without controller have an empty owner. Only the referenced intermediate owners are read, once each
+// and at most ownerConcurrency at a time.
+func podOwners(ctx context.Context, client clientset.Interface, pods []corev1.Pod) map[types.UID]owner {
+	type intermediate struct {
+		gvr       schema.GroupVersionResource
+		namespace string
+		ref       *metav1.OwnerReference
+	}
+	// the intermediate owners to read by uid
+	intermediates := make(map[types.UID]intermediate)
+
+	owners := make(map[types.UID]owner, len(pods))
+	for i := range pods {
+		pod := &pods[i]
+		ref := metav1.GetControllerOf(pod)
+		if ref == nil {
+			owners[pod.UID] = owner{}
+			continue
+		}
+		owners[pod.UID] = owner{kind: ref.Kind, name: ref.Name}
+
+		gv, _ := schema.ParseGroupVersion(ref.APIVersion)
+		if gvr, ok := intermediateOwners[schema.GroupKind{Group: gv.Group, Kind: ref.Kind}]; ok {
+			intermediates[ref.UID] = intermediate{gvr: gvr, namespace: pod.Namespace, ref: ref}
+		}
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, ownerConcurrency)
+		// the controllers of the intermediate owners by uid, nil when they have none or can not be read
+		controllers = make(map[types.UID]*metav1.OwnerReference, len(intermediates))
+	)
+	for uid, o := range intermediates {
+		uid, o := uid, o
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			controller := intermediateController(ctx, client, o.gvr, o.namespace, o.ref)
+			mu.Lock()
+			defer mu.Unlock()
+			controllers[uid] = controller
+		}()
+	}
+	wg.Wait()
+
+	for i := range pods {
+		pod := &pods[i]
+		if ref := metav1.GetControllerOf(pod); ref != nil && controllers[ref.UID] != nil {
+			owners[pod.UID] = owner{kind: controllers[ref.UID].Kind, name: controllers[ref.UID].Name}
+		}
+	}
+	return owners
+}
+
+// intermediateController returns the controller of the intermediate owner ref, nil when it has none.
+func intermediateController(ctx context.Context, client clientset.Interface, gvr schema.GroupVersionResource, namespace string, ref *metav1.OwnerReference) *metav1.OwnerReference {
+	obj, err := client.Metadata().Resource(gvr).Namespace(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("failed to get %v %v/%v: %v", gvr.Resource, namespace, ref.Name, err)
+		return nil
+	}
+	// the owner was replaced by another one of the same name
+	if obj.UID != ref.UID {
+		return nil
+	}
+	return metav1.GetControllerOf(obj)
+}
+
+// metricsUsage returns the usage of the node and of the pods in namespaces from metrics-server,
+// the usage of the node is nil when metrics-server is not installed.
+func metricsUsage(ctx context.Context, client clientset.Interface, nodeName string, namespaces map[string]struct{}) (corev1.ResourceList, map[types.NamespacedName]corev1.ResourceList) {
+	podUsages := make(map[types.NamespacedName]corev1.ResourceList)
+
+	nodeMetrics, err := client.Resource(nodeMetricsGVR).Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("no metrics of node %v: %v", nodeName, err)
+		return nil, podUsages
+	}
+	nodeUsage := usageOf(nodeMetrics.Object)
+
+	for namespace := range namespaces {
+		list, err := client.Resource(podMetricsGVR).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			klog.Errorf("failed to list pod metrics of namespace %v: %v", namespace, err)
+			continue
+		}
+		for _, podMetrics := range list.Items {
+			containers, _, _ := unstructured.NestedSlice(podMetrics.Object, "containers")
+			usage := corev1.ResourceList{}
+			for _, container := range containers {
+				if m, ok := container.(map[string]interface{}); ok {
+					addResources(usage, usageOf(m))
+				}
+			}
+			podUsages[types.NamespacedName{Namespace: namespace, Name: podMetrics.GetName()}] = usage
+		}
+	}
+	return nodeUsage, podUsages
+}
+
+// usageOf parses the usage of a node or container metrics.
+func usageOf(obj map[string]interface{}) corev1.ResourceList {
+	usage := corev1.ResourceList{}
+	values, _, _ := unstructured.NestedStringMap(obj, "usage")
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		if q, err := resource.ParseQuantity(values[string(name)]); err == nil {
+			usage[name] = q
+		}
+	}
+	return usage
+}
+
+func newAllocation(withUsage bool) *allocation {
+	a := &allocation{
+		pods:     []string{},
+		requests: corev1.ResourceList{},
+		limits:   corev1.ResourceList{},
+	}
+	if withUsage {
+		a.usage = corev1.ResourceList{}
+	}
+	return a
+}
+
+func (a *allocation) add(pod string, requests, limits, usage corev1.ResourceList) {
+	a.pods = append(a.pods, pod)
+	addResources(a.requests, requests)
+	addResources(a.limits, limits)
+	if a.usage != nil {
+		addResources(a.usage, usage)
+	}
+}
+
+func (a *allocation) toAllocated(allocatable corev1.ResourceList) nodeapi.Allocated {
+	pods := int64(len(a.pods))
+	allocated := nodeapi.Allocated{
+		Requests:        toResources(a.requests, pods),
+		Limits:          toResources(a.limits, pods),
+		RequestsPercent: percent(a.requests, allocatable),
+		LimitsPercent:   percent(a.limits, allocatable),
+	}
+	if a.usage != nil {
+		usage := toResources(a.usage, pods)
+		allocated.Usage = &usage
+		usagePercent := percent(a.usage, allocatable)
+		allocated.UsagePercent = &usagePercent
+	}
+	return allocated
+}
+
+func addResources(total, list corev1.ResourceList) {
+	for name, q := range list {
+		if value, ok := total[name]; ok {
+			value.Add(q)
+			total[name] = value
+		} else {
+			total[name] = q.DeepCopy()
+		}
+	}
+}
+
+func toResources(list corev1.ResourceList, pods int64) nodeapi.Resources {
+	return nodeapi.Resources{
+		CPU:    *list.Cpu(),
+		Memory: *list.Memory(),
+		Pods:   pods,
+	}
+}
+
+// percent returns list in percent of allocatable, rounded to 2 decimals.
+func percent(list, allocatable corev1.ResourceList) nodeapi.Percent {
+	p := nodeapi.Percent{}
+	if cpu := allocatable.Cpu().MilliValue(); cpu != 0 {
+		p.CPU = math.Round(float64(list.Cpu().MilliValue())/float64(cpu)*10000) / 100
+	}
+	if memory := allocatable.Memory().Value(); memory != 0 {
+		p.Memory = math.Round(float64(list.Memory().Value())/float64(memory)*10000) / 100
+	}
+	return p
+}
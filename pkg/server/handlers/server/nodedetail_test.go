@@ -0,0 +1,122 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	metadatafake "k8s.io/client-go/metadata/fake"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestPodOwners(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	intermediates := []struct {
+		kind schema.GroupKind
+		obj  metav1.PartialObjectMetadata
+	}{
+		{
+			kind: schema.GroupKind{Group: "apps", Kind: "ReplicaSet"},
+			obj: metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+				Name: "web-abc", Namespace: "default", UID: "rs",
+				OwnerReferences: []metav1.OwnerReference{controllerRef("apps/v1", "Deployment", "web", "deploy")},
+			}},
+		},
+		{
+			kind: schema.GroupKind{Group: "apps", Kind: "ReplicaSet"},
+			obj:  metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "orphan-abc", Namespace: "default", UID: "orphan-rs"}},
+		},
+		{
+			kind: schema.GroupKind{Group: "batch", Kind: "Job"},
+			obj: metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+				Name: "backup-1", Namespace: "default", UID: "job",
+				OwnerReferences: []metav1.OwnerReference{controllerRef("batch/v1", "CronJob", "backup", "cronjob")},
+			}},
+		},
+		{
+			// replaced the replicaset referenced by the pod
+			kind: schema.GroupKind{Group: "apps", Kind: "ReplicaSet"},
+			obj:  metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "replaced", Namespace: "default", UID: "new"}},
+		},
+	}
+	for _, o := range intermediates {
+		gvr := intermediateOwners[o.kind]
+		obj := o.obj
+		if _, err := client.Metadata().Resource(gvr).Namespace("default").(metadatafake.MetadataClient).CreateFake(&obj, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create %v %v: %v", o.kind.Kind, obj.Name, err)
+		}
+	}
+
+	tests := []struct {
+		pod  string
+		ref  *metav1.OwnerReference
+		want owner
+	}{
+		{pod: "standalone", want: owner{}},
+		{pod: "deployment", ref: ownerRef("apps/v1", "ReplicaSet", "web-abc", "rs"), want: owner{kind: "Deployment", name: "web"}},
+		{pod: "deployment-2", ref: ownerRef("apps/v1", "ReplicaSet", "web-abc", "rs"), want: owner{kind: "Deployment", name: "web"}},
+		{pod: "replicaset", ref: ownerRef("apps/v1", "ReplicaSet", "orphan-abc", "orphan-rs"), want: owner{kind: "ReplicaSet", name: "orphan-abc"}},
+		{pod: "cronjob", ref: ownerRef("batch/v1", "Job", "backup-1", "job"), want: owner{kind: "CronJob", name: "backup"}},
+		{pod: "replaced", ref: ownerRef("apps/v1", "ReplicaSet", "replaced", "old"), want: owner{kind: "ReplicaSet", name: "replaced"}},
+		{pod: "missing", ref: ownerRef("apps/v1", "ReplicaSet", "gone", "gone"), want: owner{kind: "ReplicaSet", name: "gone"}},
+		{pod: "statefulset", ref: ownerRef("apps/v1", "StatefulSet", "db", "sts"), want: owner{kind: "StatefulSet", name: "db"}},
+	}
+
+	pods := make([]corev1.Pod, 0, len(tests))
+	for _, tt := range tests {
+		pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: tt.pod, Namespace: "default", UID: types.UID(tt.pod)}}
+		if tt.ref != nil {
+			pod.OwnerReferences = []metav1.OwnerReference{*tt.ref}
+		}
+		pods = append(pods, pod)
+	}
+
+	owners := podOwners(context.TODO(), client, pods)
+	gets := 0
+	for _, action := range client.Metadata().(*metadatafake.FakeMetadataClient).Actions() {
+		if action.GetVerb() == "get" {
+			gets++
+		}
+	}
+	// every intermediate owner is read once
+	if gets != 5 {
+		t.Errorf("intermediate owners read %v times, want 5", gets)
+	}
+	for _, tt := range tests {
+		t.Run(tt.pod, func(t *testing.T) {
+			if got := owners[types.UID(tt.pod)]; got != tt.want {
+				t.Errorf("owner = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func controllerRef(apiVersion, kind, name string, uid types.UID) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: uid, Controller: &controller}
+}
+
+func ownerRef(apiVersion, kind, name string, uid types.UID) *metav1.OwnerReference {
+	ref := controllerRef(apiVersion, kind, name, uid)
+	return &ref
+}
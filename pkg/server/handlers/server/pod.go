@@ -3,104 +3,30 @@ package server
 import (
 	"bytes"
 	"context"
-	"errors"
 	"io"
 	"net/http"
-	"os/exec"
 
-	"github.com/gin-gonic/gin"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
-	"k8s.io/klog"
 	"k8s.io/kubectl/pkg/scheme"
 
-	"github.com/helen-frank/hcnmp/pkg/server/servererror"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
-	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
 )
 
-func (h *handler) podNetConnectServer(c *gin.Context) {
-	namespace := c.Param("namespace")
-	name := c.Param("name")
-	containerName := c.Query("container")
-	server := c.Query("server")
-	if server == "" {
-		servererror.HandleError(c, http.StatusBadRequest, errors.New("server cannot be empty"))
-		return
-	}
-	port := c.Query("port")
-
-	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
-	if err != nil {
-		servererror.HandleError(c, http.StatusInternalServerError, err)
-		return
-	}
-
-	execCmd := []string{"sh", "-c", "curl --connect-timeout 1 " + server}
-	if port != "" {
-		execCmd[len(execCmd)-1] += ":" + port
-	}
-
-	if _, stderr, err := execute(client, namespace, name, containerName, execCmd); err != nil {
-		if _, ok := err.(apierrors.APIStatus); ok {
-			servererror.HandleError(c, http.StatusInternalServerError, err)
-			return
-		}
-
-		curlErr := err.Error()
-		klog.Errorf("failed to exec command, err: %v, stderr: %v", err, string(stderr))
-		curlNotFound := false
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 127 {
-			curlNotFound = true
-		}
-
-		// Try using nc and ping
-		if port != "" {
-			execCmd = []string{"sh", "-c", "nc -z -w 1 " + server + " " + port}
-		} else {
-			execCmd = []string{"sh", "-c", "ping -W 1 -c 1 " + server}
-		}
-
-		if _, stderr, err := execute(client, namespace, name, containerName, execCmd); err != nil {
-			if _, ok := err.(apierrors.APIStatus); ok {
-				servererror.HandleError(c, http.StatusInternalServerError, err)
-				return
-			}
-
-			execCmdStr := "nc"
-			if len(port) == 0 {
-				execCmdStr = "ping"
-			}
-
-			cmdNotFound := false
-			if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 127 {
-				cmdNotFound = true
-			}
-
-			if curlNotFound {
-				if cmdNotFound {
-					err = errors.New("curl and " + execCmdStr + " not found")
-				} else {
-					err = errors.New("curl not found and exec " + execCmdStr + " err: " + err.Error() + ", stderr: " + string(stderr))
-				}
-			} else {
-				strTemp := "exec curl failed, err: " + curlErr + " and "
-				if cmdNotFound {
-					err = errors.New(strTemp + execCmdStr + " not found")
-				} else {
-					err = errors.New(strTemp + "exec " + execCmdStr + " err: " + err.Error() + ", stderr: " + string(stderr))
-				}
-			}
-			servererror.HandleError(c, http.StatusBadRequest, err)
-			return
-		}
-	}
-
-	c.JSON(http.StatusOK, nil)
+// execute runs the command in the container without stdin and tty, its output is buffered.
+func execute(ctx context.Context, client *clientset.Clientset, namespace, name, containerName string, execCmd []string) (stdout, stderr []byte, err error) {
+	stdoutBuf := &bytes.Buffer{}
+	stderrBuf := &bytes.Buffer{}
+	// the output is returned on failures too, stderr explains a non-zero exit code
+	err = stream(ctx, client, client.ClientConfig(), namespace, name, containerName, execCmd, nil, stdoutBuf, stderrBuf)
+	return stdoutBuf.Bytes(), stderrBuf.Bytes(), err
 }
 
-func execute(client *clientset.Clientset, namespace, name, containerName string, execCmd []string) (stdout, stderr []byte, err error) {
+// stream runs the command in the container without tty with the rest config, e.g. impersonating the user,
+// stdin is not attached if it is nil.
+func stream(ctx context.Context, client *clientset.Clientset, config *rest.Config, namespace, name, containerName string, execCmd []string,
+	stdin io.Reader, stdout, stderr io.Writer) error {
 	req := client.CoreV1().RESTClient().Post().
 		Name(name).
 		Resource("pods").
@@ -109,33 +35,21 @@ func execute(client *clientset.Clientset, namespace, name, containerName string,
 		VersionedParams(&corev1.PodExecOptions{
 			Container: containerName,
 			Command:   execCmd,
+			Stdin:     stdin != nil,
 			Stdout:    true,
 			Stderr:    true,
 			TTY:       false,
 		}, scheme.ParameterCodec)
 
-	exec, err := remotecommand.NewSPDYExecutor(client.ClientConfig(), http.MethodPost, req.URL())
+	exec, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 
-	stdoutBuf := bytes.NewBuffer([]byte{})
-	stderrBuf := bytes.NewBuffer([]byte{})
-	if err := exec.StreamWithContext(context.Background(), remotecommand.StreamOptions{
-		Stdout: stdoutBuf,
-		Stderr: stderrBuf,
+	return exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
 		Tty:    false,
-	}); err != nil {
-		return nil, nil, err
-	}
-
-	if stdout, err = io.ReadAll(stdoutBuf); err != nil {
-		return nil, nil, err
-	}
-
-	if stderr, err = io.ReadAll(stderrBuf); err != nil {
-		return nil, nil, err
-	}
-
-	return
+	})
 }
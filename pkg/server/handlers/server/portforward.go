@@ -0,0 +1,439 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// portForwardBufferSize is the max size of the data of a WebSocket message carrying port-forward data
+	portForwardBufferSize = 32 * 1024
+	// maxPortForwardConnections is the max number of connections tunneled over one WebSocket
+	maxPortForwardConnections = 128
+	// portForwardQueueSize is the max number of messages of the client queued for a connection,
+	// the connection is reset when the pod does not keep up
+	portForwardQueueSize = 64
+
+	// port-forward message ops, see portForwardMessage
+	opOpen  = "open"
+	opClose = "close"
+)
+
+// portForwardMessage is the json text message controlling the connections of a port-forward WebSocket.
+// The client opens a connection with ID and Port and resets it with close, the server sends close when the pod
+// closed the connection and error with Data when it failed, e.g. nothing listens on the port.
+type portForwardMessage struct {
+	Op   string `json:"op"`
+	ID   uint32 `json:"id"`
+	Port uint16 `json:"port,omitempty"`
+	Data string `json:"data,omitempty"`
+}
+
+// portForwardSession multiplexes the connections of a WebSocket over one SPDY connection to the pod,
+// like kubectl port-forward does.
+type portForwardSession struct {
+	conn       *websocket.Conn
+	streamConn httpstream.Connection
+
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	conns map[uint32]*forwardedConn
+}
+
+// forwardedConn is a connection of the client tunneled to a port of the pod.
+type forwardedConn struct {
+	id          uint32
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+	// input is the data sent by the client, an empty message half-closes the connection
+	input chan []byte
+	// done is closed when the connection is removed
+	done chan struct{}
+}
+
+// portForward tunnels connections to the ports of the pod over a WebSocket. Every binary message starts with
+// the big endian uint32 id of its connection followed by the data, in both directions, and a binary message
+// without data from the client half-closes the connection. The client opens connections and the server closes them
+// with text messages, see portForwardMessage, all connections share one connection to the member cluster.
+func (h *handler) portForward(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if err := h.policy.Authorize(c, code, &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              "create",
+		APIVersion:        "v1",
+		Namespace:         namespace,
+		Resource:          "pods",
+		Subresource:       "portforward",
+		Name:              name,
+	}); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(name).
+		SubResource("portforward")
+
+	transport, upgrader, err := spdy.RoundTripperFor(impersonatedConfig(c, code, client.ClientConfig()))
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, req.URL())
+	streamConn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadGateway, fmt.Errorf("failed to port-forward pod %v/%v: %v", namespace, name, err))
+		return
+	}
+	defer streamConn.Close()
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		klog.Errorf("failed to upgrade port-forward of %v/%v/%v: %v", code, namespace, name, err)
+		return
+	}
+	defer conn.Close()
+
+	s := &portForwardSession{
+		conn:       conn,
+		streamConn: streamConn,
+		conns:      map[uint32]*forwardedConn{},
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	go s.keepalive(ctx)
+
+	closeCode, reason := websocket.CloseNormalClosure, ""
+	if err := s.run(ctx); err != nil {
+		// close reasons are limited to 123 bytes
+		closeCode, reason = websocket.CloseInternalServerErr, truncate(err.Error(), 123)
+	}
+	s.closeAll()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, reason), time.Now().Add(terminalWriteTimeout))
+}
+
+// run dispatches the messages of the client until it is gone or the connection to the pod is lost.
+func (s *portForwardSession) run(ctx context.Context) error {
+	lost := make(chan struct{})
+	go func() {
+		select {
+		case <-s.streamConn.CloseChan():
+			close(lost)
+			// unblock the read of the client
+			_ = s.conn.SetReadDeadline(time.Now())
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-lost:
+				return errors.New("lost connection to pod")
+			default:
+				return nil
+			}
+		}
+
+		switch messageType {
+		case websocket.TextMessage:
+			msg := portForwardMessage{}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				return fmt.Errorf("invalid message: %v", err)
+			}
+			switch msg.Op {
+			case opOpen:
+				s.open(msg.ID, msg.Port)
+			case opClose:
+				s.reset(msg.ID)
+			}
+		case websocket.BinaryMessage:
+			if len(data) < 4 {
+				return errors.New("invalid message: missing connection id")
+			}
+			s.input(binary.BigEndian.Uint32(data), data[4:])
+		}
+	}
+}
+
+// open creates the streams of a connection to port, the same as kubectl port-forward creates.
+func (s *portForwardSession) open(id uint32, port uint16) {
+	if port == 0 {
+		_ = s.send(portForwardMessage{Op: opError, ID: id, Data: "port must be between 1 and 65535"})
+		return
+	}
+
+	s.mu.Lock()
+	_, exists := s.conns[id]
+	count := len(s.conns)
+	s.mu.Unlock()
+	switch {
+	case exists:
+		_ = s.send(portForwardMessage{Op: opError, ID: id, Data: fmt.Sprintf("connection %v is already open", id)})
+		return
+	case count >= maxPortForwardConnections:
+		_ = s.send(portForwardMessage{Op: opError, ID: id, Data: fmt.Sprintf("at most %v connections may be open", maxPortForwardConnections)})
+		return
+	}
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatUint(uint64(id), 10))
+	errorStream, err := s.streamConn.CreateStream(headers)
+	if err != nil {
+		_ = s.send(portForwardMessage{Op: opError, ID: id, Data: err.Error()})
+		return
+	}
+	// the error stream is read only
+	errorStream.Close()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := s.streamConn.CreateStream(headers)
+	if err != nil {
+		s.streamConn.RemoveStreams(errorStream)
+		_ = s.send(portForwardMessage{Op: opError, ID: id, Data: err.Error()})
+		return
+	}
+
+	fc := &forwardedConn{
+		id:          id,
+		dataStream:  dataStream,
+		errorStream: errorStream,
+		input:       make(chan []byte, portForwardQueueSize),
+		done:        make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.conns[id] = fc
+	s.mu.Unlock()
+
+	forwardErr := make(chan error, 1)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			forwardErr <- err
+		case len(message) != 0:
+			forwardErr <- errors.New(string(message))
+		default:
+			forwardErr <- nil
+		}
+	}()
+
+	go s.writeToPod(fc)
+	go func() {
+		s.readFromPod(fc)
+
+		// the error of the pod arrives when it is done with the connection
+		msg := portForwardMessage{Op: opClose, ID: id}
+		select {
+		case err := <-forwardErr:
+			if err != nil {
+				msg = portForwardMessage{Op: opError, ID: id, Data: err.Error()}
+			}
+		case <-fc.done:
+		}
+		if s.remove(fc) {
+			_ = s.send(msg)
+		}
+	}()
+}
+
+// input queues the data of the client for the connection, the data of closed connections is dropped.
+// The connection is reset when its queue is full, a slow pod must not block the other connections.
+func (s *portForwardSession) input(id uint32, data []byte) {
+	s.mu.Lock()
+	fc, ok := s.conns[id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case fc.input <- data:
+	case <-fc.done:
+	default:
+		if s.remove(fc) {
+			_ = s.send(portForwardMessage{Op: opError, ID: id, Data: "connection reset, the pod does not keep up with the data"})
+		}
+	}
+}
+
+// reset removes the connection closed by the client.
+func (s *portForwardSession) reset(id uint32) {
+	s.mu.Lock()
+	fc, ok := s.conns[id]
+	s.mu.Unlock()
+	if ok {
+		s.remove(fc)
+	}
+}
+
+func (s *portForwardSession) writeToPod(fc *forwardedConn) {
+	for {
+		select {
+		case data := <-fc.input:
+			// the client is done sending, tell the pod
+			if len(data) == 0 {
+				fc.dataStream.Close()
+				return
+			}
+			if _, err := fc.dataStream.Write(data); err != nil {
+				fc.dataStream.Reset()
+				return
+			}
+		case <-fc.done:
+			return
+		}
+	}
+}
+
+func (s *portForwardSession) readFromPod(fc *forwardedConn) {
+	buf := make([]byte, 4+portForwardBufferSize)
+	binary.BigEndian.PutUint32(buf, fc.id)
+	for {
+		n, err := fc.dataStream.Read(buf[4:])
+		if n > 0 {
+			if err := s.write(websocket.BinaryMessage, buf[:4+n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// remove releases the streams of the connection, it reports false when the connection was already removed.
+func (s *portForwardSession) remove(fc *forwardedConn) bool {
+	s.mu.Lock()
+	if s.conns[fc.id] != fc {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.conns, fc.id)
+	close(fc.done)
+	s.mu.Unlock()
+
+	fc.dataStream.Reset()
+	s.streamConn.RemoveStreams(fc.dataStream, fc.errorStream)
+	return true
+}
+
+func (s *portForwardSession) closeAll() {
+	s.mu.Lock()
+	conns := make([]*forwardedConn, 0, len(s.conns))
+	for _, fc := range s.conns {
+		conns = append(conns, fc)
+	}
+	s.mu.Unlock()
+
+	for _, fc := range conns {
+		s.remove(fc)
+	}
+}
+
+func (s *portForwardSession) send(msg portForwardMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return s.write(websocket.TextMessage, data)
+}
+
+func (s *portForwardSession) write(messageType int, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(terminalWriteTimeout))
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// keepalive pings the client so that proxies do not close an idle but open port-forward.
+func (s *portForwardSession) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(terminalPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(terminalWriteTimeout))
+			s.writeMu.Unlock()
+			if err != nil {
+				_ = s.conn.SetReadDeadline(time.Now())
+				return
+			}
+		}
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a utf8 rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
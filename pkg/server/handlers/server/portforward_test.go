@@ -0,0 +1,411 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// fakeStream is a stream of fakeStreamConn, the pod writes its data with pod and reads the data of the client from written.
+type fakeStream struct {
+	headers http.Header
+	reader  *io.PipeReader
+	pod     *io.PipeWriter
+	written chan []byte
+	// gate blocks the writes until it is closed, nil does not block
+	gate chan struct{}
+
+	closeOnce, resetOnce sync.Once
+	closed, reset        chan struct{}
+}
+
+func newFakeStream(headers http.Header, gate chan struct{}) *fakeStream {
+	reader, pod := io.Pipe()
+	return &fakeStream{
+		headers: headers,
+		reader:  reader,
+		pod:     pod,
+		written: make(chan []byte, 256),
+		gate:    gate,
+		closed:  make(chan struct{}),
+		reset:   make(chan struct{}),
+	}
+}
+
+func (s *fakeStream) Read(p []byte) (int, error) {
+	return s.reader.Read(p)
+}
+
+func (s *fakeStream) Write(p []byte) (int, error) {
+	if s.gate != nil {
+		select {
+		case <-s.gate:
+		case <-s.reset:
+			return 0, errors.New("stream reset")
+		}
+	}
+	select {
+	case s.written <- append([]byte(nil), p...):
+		return len(p), nil
+	case <-s.reset:
+		return 0, errors.New("stream reset")
+	}
+}
+
+func (s *fakeStream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func (s *fakeStream) Reset() error {
+	s.resetOnce.Do(func() {
+		close(s.reset)
+		s.reader.CloseWithError(errors.New("stream reset"))
+	})
+	return nil
+}
+
+func (s *fakeStream) Headers() http.Header { return s.headers }
+func (s *fakeStream) Identifier() uint32   { return 0 }
+
+// fakeStreamConn is the port-forward connection to a pod, the pod refuses the connections of refused
+// and does not read the data of the connections of slow.
+type fakeStreamConn struct {
+	refused map[string]string
+	slow    map[string]bool
+	gate    chan struct{}
+
+	mu      sync.Mutex
+	streams map[string]*fakeStream
+	closeCh chan bool
+}
+
+func newFakeStreamConn() *fakeStreamConn {
+	return &fakeStreamConn{
+		refused: map[string]string{},
+		slow:    map[string]bool{},
+		gate:    make(chan struct{}),
+		streams: map[string]*fakeStream{},
+		closeCh: make(chan bool),
+	}
+}
+
+func (c *fakeStreamConn) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	headers = headers.Clone()
+	port := headers.Get(corev1.PortHeader)
+	if headers.Get(corev1.StreamType) == corev1.StreamTypeError {
+		s := newFakeStream(headers, nil)
+		go func() {
+			if message, ok := c.refused[port]; ok {
+				_, _ = s.pod.Write([]byte(message))
+			}
+			s.pod.Close()
+		}()
+		return s, nil
+	}
+
+	var gate chan struct{}
+	if c.slow[port] {
+		gate = c.gate
+	}
+	s := newFakeStream(headers, gate)
+	if _, ok := c.refused[port]; ok {
+		s.pod.Close()
+	}
+	c.mu.Lock()
+	c.streams[headers.Get(corev1.PortForwardRequestIDHeader)] = s
+	c.mu.Unlock()
+	return s, nil
+}
+
+// stream waits for the data stream of the connection id.
+func (c *fakeStreamConn) stream(t *testing.T, id uint32) *fakeStream {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.mu.Lock()
+		s := c.streams[strconv.FormatUint(uint64(id), 10)]
+		c.mu.Unlock()
+		if s != nil {
+			return s
+		}
+	}
+	t.Fatalf("no data stream of connection %v", id)
+	return nil
+}
+
+func (c *fakeStreamConn) Close() error                               { return nil }
+func (c *fakeStreamConn) CloseChan() <-chan bool                     { return c.closeCh }
+func (c *fakeStreamConn) SetIdleTimeout(timeout time.Duration)       {}
+func (c *fakeStreamConn) RemoveStreams(streams ...httpstream.Stream) {}
+
+// startPortForward runs a portForwardSession on streamConn and returns the client side of its WebSocket.
+func startPortForward(t *testing.T, streamConn *fakeStreamConn) *websocket.Conn {
+	t.Helper()
+	conn, client := websocketPair(t)
+	s := &portForwardSession{conn: conn, streamConn: streamConn, conns: map[uint32]*forwardedConn{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.run(ctx)
+		s.closeAll()
+		conn.Close()
+	}()
+	t.Cleanup(func() {
+		close(streamConn.gate)
+		client.Close()
+		cancel()
+		<-done
+	})
+	return client
+}
+
+func binaryMessage(id uint32, data string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, id), data...)
+}
+
+// readPortForward returns the next message of the server, the data of binary messages is prefixed by "id:".
+func readPortForward(t *testing.T, client *websocket.Conn) string {
+	t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType == websocket.BinaryMessage {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10) + ":" + string(data[4:])
+	}
+	return string(data)
+}
+
+func control(msg portForwardMessage) string {
+	data, _ := json.Marshal(msg)
+	return string(data)
+}
+
+func TestPortForwardSessionOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		opens []portForwardMessage
+		// the opens are followed by an open of port 0 which ends the synchronous replies
+		want []portForwardMessage
+	}{
+		{
+			name:  "open",
+			opens: []portForwardMessage{{Op: opOpen, ID: 1, Port: 80}, {Op: opOpen, ID: 2, Port: 80}},
+		},
+		{
+			name:  "invalid port",
+			opens: []portForwardMessage{{Op: opOpen, ID: 1}},
+			want:  []portForwardMessage{{Op: opError, ID: 1, Data: "port must be between 1 and 65535"}},
+		},
+		{
+			name:  "duplicate id",
+			opens: []portForwardMessage{{Op: opOpen, ID: 1, Port: 80}, {Op: opOpen, ID: 1, Port: 443}},
+			want:  []portForwardMessage{{Op: opError, ID: 1, Data: "connection 1 is already open"}},
+		},
+		{
+			name:  "refused by the pod",
+			opens: []portForwardMessage{{Op: opOpen, ID: 1, Port: 81}},
+			want:  []portForwardMessage{{Op: opError, ID: 1, Data: "connection refused"}},
+		},
+		{
+			name:  "unknown op",
+			opens: []portForwardMessage{{Op: "ping", ID: 1, Port: 80}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamConn := newFakeStreamConn()
+			streamConn.refused["81"] = "connection refused"
+			client := startPortForward(t, streamConn)
+
+			end := portForwardMessage{Op: opOpen, ID: 999}
+			for _, msg := range append(tt.opens, end) {
+				if err := client.WriteJSON(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := []portForwardMessage{}
+			for ended := false; !ended || len(got) < len(tt.want); {
+				msg := portForwardMessage{}
+				if err := json.Unmarshal([]byte(readPortForward(t, client)), &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.ID == end.ID {
+					ended = true
+					continue
+				}
+				got = append(got, msg)
+			}
+			if len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("replies = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPortForwardSessionFraming(t *testing.T) {
+	streamConn := newFakeStreamConn()
+	client := startPortForward(t, streamConn)
+
+	if err := client.WriteJSON(portForwardMessage{Op: opOpen, ID: 7, Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteMessage(websocket.BinaryMessage, binaryMessage(7, "ping")); err != nil {
+		t.Fatal(err)
+	}
+	// the data of unknown connections is dropped
+	if err := client.WriteMessage(websocket.BinaryMessage, binaryMessage(8, "lost")); err != nil {
+		t.Fatal(err)
+	}
+	stream := streamConn.stream(t, 7)
+	if got := string(<-stream.written); got != "ping" {
+		t.Errorf("pod read %q, want ping", got)
+	}
+
+	if _, err := stream.pod.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readPortForward(t, client); got != "7:pong" {
+		t.Errorf("client read %q, want 7:pong", got)
+	}
+
+	// a message with only the id half-closes the connection
+	if err := client.WriteMessage(websocket.BinaryMessage, binaryMessage(7, "")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stream.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("data stream is not closed")
+	}
+
+	// the pod closes the connection after its data
+	if _, err := stream.pod.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	stream.pod.Close()
+	for _, want := range []string{"7:bye", control(portForwardMessage{Op: opClose, ID: 7})} {
+		if got := readPortForward(t, client); got != want {
+			t.Errorf("client read %q, want %q", got, want)
+		}
+	}
+
+	// messages without the id end the session
+	if err := client.WriteMessage(websocket.BinaryMessage, []byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := client.ReadMessage(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("read after an invalid message error = %v, want the session closed", err)
+	}
+}
+
+func TestPortForwardSessionMaxConnections(t *testing.T) {
+	streamConn := newFakeStreamConn()
+	client := startPortForward(t, streamConn)
+
+	for id := uint32(1); id <= maxPortForwardConnections+1; id++ {
+		if err := client.WriteJSON(portForwardMessage{Op: opOpen, ID: id, Port: 80}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := control(portForwardMessage{Op: opError, ID: maxPortForwardConnections + 1, Data: "at most 128 connections may be open"})
+	if got := readPortForward(t, client); got != want {
+		t.Fatalf("client read %q, want %q", got, want)
+	}
+
+	// a closed connection frees its slot
+	if err := client.WriteJSON(portForwardMessage{Op: opClose, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-streamConn.stream(t, 1).reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection closed by the client is not reset")
+	}
+	if err := client.WriteJSON(portForwardMessage{Op: opOpen, ID: 200, Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WriteJSON(portForwardMessage{Op: opOpen, ID: 201, Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	want = control(portForwardMessage{Op: opError, ID: 201, Data: "at most 128 connections may be open"})
+	if got := readPortForward(t, client); got != want {
+		t.Errorf("client read %q, want %q", got, want)
+	}
+}
+
+func TestPortForwardSessionSlowConnection(t *testing.T) {
+	streamConn := newFakeStreamConn()
+	streamConn.slow["80"] = true
+	client := startPortForward(t, streamConn)
+
+	for _, msg := range []portForwardMessage{{Op: opOpen, ID: 1, Port: 80}, {Op: opOpen, ID: 2, Port: 443}} {
+		if err := client.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the pod reads nothing of connection 1, its queue overflows
+	for i := 0; i < portForwardQueueSize+2; i++ {
+		if err := client.WriteMessage(websocket.BinaryMessage, binaryMessage(1, strings.Repeat("x", 1024))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.WriteMessage(websocket.BinaryMessage, binaryMessage(2, "fast")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := control(portForwardMessage{Op: opError, ID: 1, Data: "connection reset, the pod does not keep up with the data"})
+	if got := readPortForward(t, client); got != want {
+		t.Fatalf("client read %q, want %q", got, want)
+	}
+	select {
+	case <-streamConn.stream(t, 1).reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow connection is not reset")
+	}
+	// the other connections are not blocked by the slow one
+	select {
+	case data := <-streamConn.stream(t, 2).written:
+		if string(data) != "fast" {
+			t.Errorf("pod read %q, want fast", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection 2 is blocked by the slow connection")
+	}
+}
@@ -17,47 +17,152 @@ limitations under the License.
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/klog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
 
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
 	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
 )
 
+// proxyCluster transparently proxies the request to the kube-apiserver of cluster,
+// watch, follow logs, exec, attach and portforward are streamed, exec and attach are refused while sessions are recorded.
 func (h *handler) proxyCluster(c *gin.Context) {
+	info := policy.NewRequestInfo(c.Request.Method, c.Param("urlPath"), c.Request.URL.Query())
+	if h.recorder.Enabled() && unrecorded(info) {
+		// the raw streams can not be recorded, the sessions must go through the recorded web terminal
+		abortWithError(c, apierrors.NewForbidden(schema.GroupResource{Resource: info.Resource + "/" + info.Subresource}, info.Name,
+			fmt.Errorf("sessions are recorded, use /apis/server/v1/cluster/%v/namespace/%v/pod/%v/exec instead",
+				c.Param("clusterCode"), info.Namespace, info.Name)))
+		return
+	}
+
 	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	if podSession(info) {
+		if err := h.authorizeNodeDebugSession(c, client, info.Namespace, info.Name); err != nil {
+			abortWithError(c, err)
+			return
+		}
+	}
+
+	proxyHandler, err := client.ProxyHandler()
 	if err != nil {
 		servererror.HandleError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	request := client.RESTClient().Verb(c.Request.Method).AbsPath(c.Param("urlPath")).Body(c.Request.Body)
-	for k, v := range c.Request.URL.Query() {
-		var s string
-		for i := range v {
-			if i != 0 {
-				s += ","
-			}
-			s += v[i]
+	req := c.Request.Clone(c.Request.Context())
+	req.URL.Path = c.Param("urlPath")
+	req.URL.RawPath = ""
+	// the hcnmp credentials must not be forwarded, the member cluster is accessed with its kubeconfig
+	req.Header.Del("Authorization")
+	impersonate(c, req)
+
+	proxyHandler.ServeHTTP(c.Writer, req)
+}
+
+// podSession reports whether info is an exec, attach or portforward session of pod.
+func podSession(info *policy.RequestInfo) bool {
+	if !info.IsResourceRequest || info.APIGroup != "" || info.Resource != "pods" || len(info.Name) == 0 {
+		return false
+	}
+	return info.Subresource == "exec" || info.Subresource == "attach" || info.Subresource == "portforward"
+}
+
+// unrecorded reports whether info is an interactive session of pod which the proxy can not record.
+func unrecorded(info *policy.RequestInfo) bool {
+	return podSession(info) && info.Subresource != "portforward"
+}
+
+// abortWithError replies err as a Status of the kube-apiserver, clients of the proxy such as kubectl decode it.
+func abortWithError(c *gin.Context, err error) {
+	var status metav1.Status
+	if apiStatus, ok := err.(apierrors.APIStatus); ok {
+		status = apiStatus.Status()
+	} else {
+		status = apierrors.NewInternalError(err).ErrStatus
+	}
+	status.APIVersion = "v1"
+	status.Kind = "Status"
+	c.AbortWithStatusJSON(int(status.Code), status)
+}
+
+// impersonate replaces the impersonation headers of req by the authenticated hcnmp user
+// when the cluster enables impersonation, the headers sent by the caller are always dropped.
+func impersonate(c *gin.Context, req *http.Request) {
+	for k := range req.Header {
+		if strings.HasPrefix(k, "Impersonate-") {
+			req.Header.Del(k)
 		}
-		request.Param(k, s)
 	}
-	for k, v := range c.Request.Header {
-		request.SetHeader(k, v...)
+
+	for k, v := range impersonationHeaders(c, c.Param("clusterCode")) {
+		req.Header[k] = v
 	}
+}
 
-	var statusCode int
-	data, err := request.Do(c).StatusCode(&statusCode).Raw()
-	if err != nil {
-		klog.Error(err)
-		if serr, ok := err.(*apierrors.StatusError); ok {
-			c.JSON(int(serr.ErrStatus.Code), err)
-		} else {
-			c.JSON(http.StatusInternalServerError, err)
+// impersonationHeaders returns the impersonation headers of the authenticated hcnmp user on cluster.
+func impersonationHeaders(c *gin.Context, code string) http.Header {
+	header := http.Header{}
+	impersonation := proxy.GetClusterImpersonation(code)
+	if impersonation == nil || !impersonation.Enabled {
+		return header
+	}
+
+	user := auth.User(c)
+	header.Set(transport.ImpersonateUserHeader, impersonation.UserPrefix+user)
+	for _, group := range impersonation.GroupsFor(user) {
+		header.Add(transport.ImpersonateGroupHeader, group)
+	}
+	return header
+}
+
+// impersonatedConfig returns a copy of cfg impersonating the authenticated hcnmp user on cluster,
+// it is used by the streaming clients which can not set the impersonation headers per request.
+func impersonatedConfig(c *gin.Context, code string, cfg *rest.Config) *rest.Config {
+	cfg = rest.CopyConfig(cfg)
+	header := impersonationHeaders(c, code)
+	if user := header.Get(transport.ImpersonateUserHeader); len(user) != 0 {
+		cfg.Impersonate = rest.ImpersonationConfig{
+			UserName: user,
+			Groups:   header.Values(transport.ImpersonateGroupHeader),
 		}
 	}
-	c.Data(statusCode, "application/json, text/plain, */*", data)
+	return cfg
+}
+
+// impersonatedClient returns a client of cluster impersonating the authenticated hcnmp user,
+// client is returned as is when the cluster does not enable impersonation.
+// The clients are cached by client per identity, so they are rebuilt together with the cluster client.
+func impersonatedClient(c *gin.Context, code string, client *clientset.Clientset) (*clientset.Clientset, error) {
+	header := impersonationHeaders(c, code)
+	if len(header) == 0 {
+		return client, nil
+	}
+	return client.Impersonate(rest.ImpersonationConfig{
+		UserName: header.Get(transport.ImpersonateUserHeader),
+		Groups:   header.Values(transport.ImpersonateGroupHeader),
+	})
+}
+
+// cacheIdentity returns the identity proxied requests are sent with, responses are only shared within it.
+func (h *handler) cacheIdentity(c *gin.Context) string {
+	header := impersonationHeaders(c, c.Param("clusterCode"))
+	return strings.Join(header.Values(transport.ImpersonateUserHeader), ",") + "|" +
+		strings.Join(header.Values(transport.ImpersonateGroupHeader), ",")
 }
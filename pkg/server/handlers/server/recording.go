@@ -0,0 +1,202 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	recordingapi "github.com/helen-frank/hcnmp/pkg/apis/recording"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/recording"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+)
+
+// defaultReplayIdleLimit caps the pauses of a replay, like the idle_time_limit of asciinema
+const defaultReplayIdleLimit = 2 * time.Second
+
+// listRecordings lists the exec terminal recordings filtered by user, cluster, namespace, pod, since and until (RFC3339),
+// users who are not auditors only get their own recordings.
+func (h *handler) listRecordings(c *gin.Context) {
+	filter := recording.Filter{
+		User:      c.Query("user"),
+		Cluster:   c.Query("cluster"),
+		Namespace: c.Query("namespace"),
+		Pod:       c.Query("pod"),
+	}
+	for k, v := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if s := c.Query(k); len(s) != 0 {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("%v must be a RFC3339 time", k))
+				return
+			}
+			*v = t
+		}
+	}
+	if user := auth.User(c); !h.recorder.IsAuditor(user) {
+		filter.User = user
+	}
+
+	items, err := h.recorder.List(filter)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, recordingapi.RecordingList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Items:      items,
+	})
+}
+
+func (h *handler) getRecording(c *gin.Context) {
+	rec, ok := h.accessibleRecording(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// downloadRecording returns the asciicast v2 file of the recording, it can be played with asciinema.
+func (h *handler) downloadRecording(c *gin.Context) {
+	rec, ok := h.accessibleRecording(c)
+	if !ok {
+		return
+	}
+
+	f, err := h.recorder.Open(rec.ID)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.cast"`, rec.ID))
+	http.ServeContent(c.Writer, c.Request, rec.ID+".cast", rec.StartedAt, f)
+}
+
+// replayRecording replays the output of the recording as SSE with its original timing,
+// "o" events carry the output and "r" events the terminal size, speed accelerates the replay
+// and idleLimit caps the pauses (default 2s). The replay ends with an "end" event,
+// or with an "error" event when the recording can not be read.
+func (h *handler) replayRecording(c *gin.Context) {
+	rec, ok := h.accessibleRecording(c)
+	if !ok {
+		return
+	}
+
+	speed := 1.0
+	if s := c.Query("speed"); len(s) != 0 {
+		var err error
+		if speed, err = strconv.ParseFloat(s, 64); err != nil || speed <= 0 {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("speed must be a positive number"))
+			return
+		}
+	}
+	idleLimit := defaultReplayIdleLimit
+	if s := c.Query("idleLimit"); len(s) != 0 {
+		var err error
+		if idleLimit, err = time.ParseDuration(s); err != nil || idleLimit <= 0 {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("idleLimit must be a positive duration"))
+			return
+		}
+	}
+
+	f, err := h.recorder.Open(rec.ID)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	// the first line is the header
+	if scanner.Scan() {
+		c.SSEvent("header", string(scanner.Bytes()))
+		c.Writer.Flush()
+	}
+
+	last := 0.0
+	for scanner.Scan() {
+		event := []interface{}{}
+		if err := utils.Std2Jsoniter.Unmarshal(scanner.Bytes(), &event); err != nil || len(event) != 3 {
+			continue
+		}
+		elapsed, _ := event[0].(float64)
+		code, _ := event[1].(string)
+		data, _ := event[2].(string)
+		if code == "i" {
+			continue
+		}
+
+		delay := time.Duration((elapsed - last) / speed * float64(time.Second))
+		last = elapsed
+		if delay > idleLimit {
+			delay = idleLimit
+		}
+		if delay > 0 {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+
+		c.SSEvent(code, data)
+		c.Writer.Flush()
+	}
+	if err := scanner.Err(); err != nil {
+		c.SSEvent("error", err.Error())
+		c.Writer.Flush()
+		return
+	}
+	c.SSEvent("end", "")
+	c.Writer.Flush()
+}
+
+// accessibleRecording returns the recording of :id if the user may access it, otherwise replies with the error.
+func (h *handler) accessibleRecording(c *gin.Context) (*recordingapi.Recording, bool) {
+	rec, err := h.recorder.Get(c.Param("id"))
+	if err == nil && !h.recorder.CanAccess(auth.User(c), rec) {
+		// do not tell others whether the recording exists
+		err = recording.ErrNotFound
+	}
+	if err != nil {
+		if errors.Is(err, recording.ErrNotFound) {
+			servererror.HandleError(c, http.StatusNotFound, err)
+			return nil, false
+		}
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return rec, true
+}
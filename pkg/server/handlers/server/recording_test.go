@@ -0,0 +1,119 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	recordingapi "github.com/helen-frank/hcnmp/pkg/apis/recording"
+	"github.com/helen-frank/hcnmp/pkg/server/recording"
+)
+
+func TestReplayRecording(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	recorder := recording.New(recording.Options{Dir: dir})
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set(gin.AuthUserKey, c.GetHeader("X-User"))
+	})
+	router.GET("/recordings/:id/replay", (&handler{recorder: recorder}).replayRecording)
+
+	tests := []struct {
+		name       string
+		events     []string
+		user       string
+		query      string
+		wantStatus int
+		wantEvents []string
+	}{
+		{
+			name:       "replay",
+			events:     []string{`[0.1,"o","ls\r\n"]`, `[0.2,"i","x"]`, `[0.3,"r","120x40"]`},
+			user:       "alice",
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"header", "o", "r", "end"},
+		},
+		{
+			name:       "malformed events are skipped",
+			events:     []string{`not json`, `[0.1,"o"]`, `[0.2,"o","a"]`},
+			user:       "alice",
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"header", "o", "end"},
+		},
+		{
+			name:       "unreadable event",
+			events:     []string{`[0.1,"o","a"]`, `[0.2,"o","` + strings.Repeat("a", 2<<20) + `"]`, `[0.3,"o","b"]`},
+			user:       "alice",
+			wantStatus: http.StatusOK,
+			wantEvents: []string{"header", "o", "error"},
+		},
+		{name: "other user", user: "bob", wantStatus: http.StatusNotFound},
+		{name: "bad speed", user: "alice", query: "speed=0", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := recorder.Start(recordingapi.Recording{User: "alice"}, 80, 24)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.OpenFile(filepath.Join(dir, s.ID()+".cast"), os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, event := range tt.events {
+				if _, err := f.WriteString(event + "\n"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.Close()
+
+			req := httptest.NewRequest(http.MethodGet, "/recordings/"+s.ID()+"/replay?"+tt.query, nil)
+			req.Header.Set("X-User", tt.user)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			events := []string{}
+			for _, line := range strings.Split(w.Body.String(), "\n") {
+				if event, ok := strings.CutPrefix(line, "event:"); ok {
+					events = append(events, event)
+				}
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	operationapi "github.com/helen-frank/hcnmp/pkg/apis/operation"
+	workloadapi "github.com/helen-frank/hcnmp/pkg/apis/workload"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+// history is the revision history of a workload.
+type history struct {
+	// revisions are sorted by revision, the newest first
+	revisions []revision
+	// paused tells whether the rollout of the workload is paused
+	paused bool
+}
+
+// revision is a revision with the patch rolling the workload back to it.
+type revision struct {
+	workloadapi.Revision
+
+	patchType types.PatchType
+	patch     []byte
+}
+
+// listRevisions lists the revisions of the workload like kubectl rollout history, the newest first.
+func (h *handler) listRevisions(c *gin.Context) {
+	kind, ok := workloadKindParam(c)
+	if !ok {
+		return
+	}
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if !kind.revisions {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("%v have no revision history", kind.gvr.Resource))
+		return
+	}
+
+	if err := h.authorizeWorkload(c, kind, "get", namespace, name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the revisions are read as the caller
+	if client, err = impersonatedClient(c, c.Param("clusterCode"), client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	hist, err := workloadHistory(c.Request.Context(), client, kind, namespace, name)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]workloadapi.Revision, 0, len(hist.revisions))
+	for _, rev := range hist.revisions {
+		items = append(items, rev.Revision)
+	}
+	c.JSON(http.StatusOK, workloadapi.RevisionList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Items:      items,
+	})
+}
+
+// rollbackWorkload rolls the workload back to revision like kubectl rollout undo, the previous revision by default.
+// It replies an operation waiting until the workload is ready, bounded by timeout (default 5m).
+func (h *handler) rollbackWorkload(c *gin.Context) {
+	kind, ok := workloadKindParam(c)
+	if !ok {
+		return
+	}
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if !kind.revisions {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("%v can not be rolled back", kind.gvr.Resource))
+		return
+	}
+	var toRevision int64
+	if s := c.Query("revision"); len(s) != 0 {
+		var err error
+		if toRevision, err = strconv.ParseInt(s, 10, 64); err != nil || toRevision < 0 {
+			servererror.HandleError(c, http.StatusBadRequest, errors.New("revision must be a non-negative integer"))
+			return
+		}
+	}
+	timeout, err := queryTimeout(c, defaultWorkloadTimeout)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeWorkload(c, kind, "patch", namespace, name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the workload is rolled back as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	hist, err := workloadHistory(c.Request.Context(), client, kind, namespace, name)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if hist.paused {
+		servererror.HandleError(c, http.StatusConflict, fmt.Errorf("can not roll back paused %v %v/%v, resume it first", kind.kind, namespace, name))
+		return
+	}
+	target, err := hist.find(toRevision)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if target.Current {
+		servererror.HandleError(c, http.StatusConflict, fmt.Errorf("%v %v/%v already runs revision %v", kind.kind, namespace, name, target.Revision.Revision))
+		return
+	}
+
+	rolledBack, err := client.Resource(kind.gvr).Namespace(namespace).Patch(c.Request.Context(), name, target.patchType, target.patch, metav1.PatchOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.startOperation(c, operationapi.Operation{
+		Type:    "rollback",
+		User:    auth.User(c),
+		Cluster: code,
+		Target: operationapi.Target{
+			Kind:      kind.kind,
+			Namespace: namespace,
+			Name:      name,
+		},
+	}, timeout, func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+		r.Event(operationapi.EventTypeNormal, fmt.Sprintf("rolled back %v %v/%v to revision %v", kind.kind, namespace, name, target.Revision.Revision))
+		return waitForWorkload(ctx, client, kind, rolledBack, r)
+	})
+}
+
+// find returns the revision, 0 is the one before the current revision.
+func (hist *history) find(toRevision int64) (*revision, error) {
+	if toRevision == 0 {
+		for i := range hist.revisions {
+			if hist.revisions[i].Current && i+1 < len(hist.revisions) {
+				return &hist.revisions[i+1], nil
+			}
+		}
+		return nil, errors.New("no previous revision to roll back to")
+	}
+
+	for i := range hist.revisions {
+		if hist.revisions[i].Revision.Revision == toRevision {
+			return &hist.revisions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("revision %v not found", toRevision)
+}
+
+// workloadHistory returns the revisions of deployments from their replicasets
+// and of statefulsets and daemonsets from their controller revisions.
+func workloadHistory(ctx context.Context, client clientset.Interface, kind workloadKind, namespace, name string) (*history, error) {
+	hist := &history{}
+
+	switch kind.kind {
+	case "Deployment":
+		deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		hist.paused = deployment.Spec.Paused
+
+		allRS, err := utils.ListDeploymentReplicaSets(ctx, client, *deployment)
+		if err != nil {
+			return nil, err
+		}
+		for i := range allRS {
+			rev, err := replicaSetRevision(&allRS[i], deployment)
+			if err != nil {
+				continue
+			}
+			hist.revisions = append(hist.revisions, *rev)
+		}
+	case "StatefulSet":
+		sts, err := client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		revisions, err := utils.ListControllerRevisions(ctx, client, sts, sts.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		for i := range revisions {
+			rev, err := controllerRevision(&revisions[i], revisions[i].Name == sts.Status.UpdateRevision)
+			if err != nil {
+				continue
+			}
+			hist.revisions = append(hist.revisions, *rev)
+		}
+	case "DaemonSet":
+		ds, err := client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		revisions, err := utils.ListControllerRevisions(ctx, client, ds, ds.Spec.Selector)
+		if err != nil {
+			return nil, err
+		}
+		// the controller revision of the current template of a daemonset is the latest one
+		var latest int64
+		for i := range revisions {
+			latest = max(latest, revisions[i].Revision)
+		}
+		for i := range revisions {
+			rev, err := controllerRevision(&revisions[i], revisions[i].Revision == latest)
+			if err != nil {
+				continue
+			}
+			hist.revisions = append(hist.revisions, *rev)
+		}
+	default:
+		return nil, fmt.Errorf("%v have no revision history", kind.gvr.Resource)
+	}
+
+	sort.Slice(hist.revisions, func(i, j int) bool {
+		return hist.revisions[i].Revision.Revision > hist.revisions[j].Revision.Revision
+	})
+	return hist, nil
+}
+
+// deploymentAnnotationsToSkip are the annotations of a deployment kept on rollback,
+// the other annotations are restored from the replicaset like kubectl rollout undo does.
+var deploymentAnnotationsToSkip = map[string]struct{}{
+	corev1.LastAppliedConfigAnnotation:          {},
+	utils.DeploymentRevisionAnnotation:          {},
+	"deployment.kubernetes.io/revision-history": {},
+	"deployment.kubernetes.io/desired-replicas": {},
+	"deployment.kubernetes.io/max-replicas":     {},
+	"deprecated.deployment.rollback.to":         {},
+}
+
+// replicaSetRevision rolls back by replacing the pod template and the annotations of the deployment with the ones
+// of the replicaset, the patch fails when the deployment changed since it was read.
+func replicaSetRevision(rs *appsv1.ReplicaSet, deployment *appsv1.Deployment) (*revision, error) {
+	value := rs.Annotations[utils.DeploymentRevisionAnnotation]
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	template := rs.Spec.Template.DeepCopy()
+	// the label is added by the deployment controller to every replicaset
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+	annotations := map[string]string{}
+	for k := range deploymentAnnotationsToSkip {
+		if v, ok := deployment.Annotations[k]; ok {
+			annotations[k] = v
+		}
+	}
+	for k, v := range rs.Annotations {
+		if _, ok := deploymentAnnotationsToSkip[k]; !ok {
+			annotations[k] = v
+		}
+	}
+
+	patch, err := utils.Std2Jsoniter.Marshal([]map[string]interface{}{
+		{"op": "test", "path": "/metadata/resourceVersion", "value": deployment.ResourceVersion},
+		{"op": "replace", "path": "/spec/template", "value": template},
+		{"op": "replace", "path": "/metadata/annotations", "value": annotations},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &revision{
+		Revision: workloadapi.Revision{
+			Revision:    number,
+			Name:        rs.Name,
+			ChangeCause: rs.Annotations[utils.ChangeCauseAnnotation],
+			CreatedAt:   rs.CreationTimestamp.Time,
+			Current:     value == deployment.Annotations[utils.DeploymentRevisionAnnotation],
+			Images:      templateImages(template),
+			Template:    template,
+		},
+		patchType: types.JSONPatchType,
+		patch:     patch,
+	}, nil
+}
+
+// controllerRevision rolls back by the data of the controller revision, it is a strategic merge patch
+// replacing the pod template of the statefulset or daemonset.
+func controllerRevision(cr *appsv1.ControllerRevision, current bool) (*revision, error) {
+	data := struct {
+		Spec struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}{}
+	if err := utils.Std2Jsoniter.Unmarshal(cr.Data.Raw, &data); err != nil {
+		return nil, err
+	}
+
+	return &revision{
+		Revision: workloadapi.Revision{
+			Revision:    cr.Revision,
+			Name:        cr.Name,
+			ChangeCause: cr.Annotations[utils.ChangeCauseAnnotation],
+			CreatedAt:   cr.CreationTimestamp.Time,
+			Current:     current,
+			Images:      templateImages(&data.Spec.Template),
+			Template:    &data.Spec.Template,
+		},
+		patchType: types.StrategicMergePatchType,
+		patch:     cr.Data.Raw,
+	}, nil
+}
+
+func templateImages(template *corev1.PodTemplateSpec) []string {
+	images := make([]string, 0, len(template.Spec.Containers))
+	for _, container := range template.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	return images
+}
@@ -0,0 +1,233 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	workloadapi "github.com/helen-frank/hcnmp/pkg/apis/workload"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestReplicaSetRevision(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app",
+			Namespace:       "default",
+			ResourceVersion: "2",
+			Annotations: map[string]string{
+				utils.DeploymentRevisionAnnotation: "2",
+				utils.ChangeCauseAnnotation:        "kubectl set image deployment/app app=nginx:2",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{Template: podTemplate(map[string]string{"app": "app"})},
+	}
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		resourceVersion string
+
+		wantErr         bool
+		wantCurrent     bool
+		wantPatchErr    bool
+		wantAnnotations map[string]string
+	}{
+		{
+			name: "previous revision",
+			annotations: map[string]string{
+				utils.DeploymentRevisionAnnotation:          "1",
+				utils.ChangeCauseAnnotation:                 "kubectl create deployment app",
+				"deployment.kubernetes.io/desired-replicas": "3",
+			},
+			resourceVersion: "2",
+			wantAnnotations: map[string]string{
+				utils.DeploymentRevisionAnnotation: "2",
+				utils.ChangeCauseAnnotation:        "kubectl create deployment app",
+			},
+		},
+		{
+			name:            "current revision",
+			annotations:     map[string]string{utils.DeploymentRevisionAnnotation: "2"},
+			resourceVersion: "2",
+			wantCurrent:     true,
+			wantAnnotations: map[string]string{utils.DeploymentRevisionAnnotation: "2"},
+		},
+		{
+			name:            "deployment changed",
+			annotations:     map[string]string{utils.DeploymentRevisionAnnotation: "1"},
+			resourceVersion: "1",
+			wantPatchErr:    true,
+		},
+		{
+			name:        "invalid revision",
+			annotations: map[string]string{utils.DeploymentRevisionAnnotation: "first"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := podTemplate(map[string]string{"app": "app", appsv1.DefaultDeploymentUniqueLabelKey: "abc"})
+			template.Spec.Containers[0].Image = "nginx:1"
+			rs := &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "app-abc", Namespace: "default", Annotations: tt.annotations},
+				Spec:       appsv1.ReplicaSetSpec{Template: template},
+			}
+			read := deployment.DeepCopy()
+			read.ResourceVersion = tt.resourceVersion
+
+			rev, err := replicaSetRevision(rs, read)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("replicaSetRevision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if rev.Current != tt.wantCurrent {
+				t.Errorf("current = %v, want %v", rev.Current, tt.wantCurrent)
+			}
+			if rev.ChangeCause != tt.annotations[utils.ChangeCauseAnnotation] {
+				t.Errorf("change cause = %q, want %q", rev.ChangeCause, tt.annotations[utils.ChangeCauseAnnotation])
+			}
+
+			client := fake.NewSimpleClientset(deployment.DeepCopy())
+			patched, err := client.AppsV1().Deployments("default").Patch(context.TODO(), "app", rev.patchType, rev.patch, metav1.PatchOptions{})
+			if (err != nil) != tt.wantPatchErr {
+				t.Fatalf("patch error = %v, wantErr %v", err, tt.wantPatchErr)
+			}
+			if err != nil {
+				return
+			}
+			if image := patched.Spec.Template.Spec.Containers[0].Image; image != "nginx:1" {
+				t.Errorf("image = %v, want nginx:1", image)
+			}
+			if _, ok := patched.Spec.Template.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok {
+				t.Errorf("labels = %v, want no %v", patched.Spec.Template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+			}
+			if len(patched.Annotations) != len(tt.wantAnnotations) {
+				t.Errorf("annotations = %v, want %v", patched.Annotations, tt.wantAnnotations)
+			}
+			for k, v := range tt.wantAnnotations {
+				if patched.Annotations[k] != v {
+					t.Errorf("annotation %v = %q, want %q", k, patched.Annotations[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestControllerRevision(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		current bool
+
+		wantErr    bool
+		wantImages []string
+	}{
+		{
+			name:       "template",
+			data:       `{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"nginx:1"},{"name":"sidecar","image":"envoy"}]}}}}`,
+			current:    true,
+			wantImages: []string{"nginx:1", "envoy"},
+		},
+		{
+			name:       "no template",
+			data:       `{"spec":{}}`,
+			wantImages: []string{},
+		},
+		{
+			name:    "invalid data",
+			data:    `{"spec":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &appsv1.ControllerRevision{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app-6d4b",
+					Annotations: map[string]string{utils.ChangeCauseAnnotation: "kubectl apply"},
+				},
+				Data:     runtime.RawExtension{Raw: []byte(tt.data)},
+				Revision: 3,
+			}
+
+			rev, err := controllerRevision(cr, tt.current)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("controllerRevision() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if rev.Revision.Revision != 3 || rev.Name != "app-6d4b" || rev.ChangeCause != "kubectl apply" || rev.Current != tt.current {
+				t.Errorf("controllerRevision() = %+v, want revision 3 of app-6d4b, current %v", rev.Revision, tt.current)
+			}
+			if len(rev.Images) != len(tt.wantImages) {
+				t.Fatalf("images = %v, want %v", rev.Images, tt.wantImages)
+			}
+			for i := range tt.wantImages {
+				if rev.Images[i] != tt.wantImages[i] {
+					t.Errorf("images = %v, want %v", rev.Images, tt.wantImages)
+				}
+			}
+			if string(rev.patch) != tt.data {
+				t.Errorf("patch = %s, want the data of the revision", rev.patch)
+			}
+		})
+	}
+}
+
+func TestHistoryFind(t *testing.T) {
+	hist := &history{revisions: []revision{
+		{Revision: workloadRevision(3, false)},
+		{Revision: workloadRevision(2, true)},
+		{Revision: workloadRevision(1, false)},
+	}}
+
+	tests := []struct {
+		toRevision int64
+		want       int64
+		wantErr    bool
+	}{
+		{toRevision: 0, want: 1},
+		{toRevision: 3, want: 3},
+		{toRevision: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		rev, err := hist.find(tt.toRevision)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("find(%v) error = %v, wantErr %v", tt.toRevision, err, tt.wantErr)
+		}
+		if err == nil && rev.Revision.Revision != tt.want {
+			t.Errorf("find(%v) = %v, want %v", tt.toRevision, rev.Revision.Revision, tt.want)
+		}
+	}
+}
+
+func workloadRevision(number int64, current bool) workloadapi.Revision {
+	return workloadapi.Revision{Revision: number, Current: current}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/duration"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+// tableAccept asks the kube-apiserver for a Table, falling back to plain json for servers without Table support.
+const tableAccept = "application/json;as=Table;v=v1;g=meta.k8s.io,application/json;as=Table;v=v1beta1;g=meta.k8s.io,application/json"
+
+// getTable returns the resources of urlPath as a meta.k8s.io/v1 Table with the kubectl columns of the member cluster,
+// resources the member cluster can not print get the default NAME and AGE columns.
+// includeObject=None|Metadata|Object is forwarded to the member cluster.
+func (h *handler) getTable(c *gin.Context) {
+	code := c.Param("clusterCode")
+	urlPath := c.Param("urlPath")
+	params := c.Request.URL.Query()
+
+	info := policy.NewRequestInfo(http.MethodGet, urlPath, params)
+	if !info.IsResourceRequest || (info.Verb != "get" && info.Verb != "list") {
+		servererror.HandleError(c, http.StatusBadRequest, errors.New("table is only supported for get and list of resources"))
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+
+	request := client.RESTClient().Get().AbsPath(urlPath).SetHeader("Accept", tableAccept)
+	for k, v := range params {
+		for i := range v {
+			request.Param(k, v[i])
+		}
+	}
+	for k, v := range impersonationHeaders(c, code) {
+		request.SetHeader(k, v...)
+	}
+
+	data, err := request.Do(c.Request.Context()).Raw()
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	obj, err := runtime.Decode(unstructured.UnstructuredJSONScheme, data)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if obj.GetObjectKind().GroupVersionKind().Kind == "Table" {
+		c.Data(http.StatusOK, "application/json", data)
+		return
+	}
+
+	table, err := defaultTable(obj, params.Get("includeObject"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, table)
+}
+
+// defaultTable prints obj like the default table convertor of the kube-apiserver.
+func defaultTable(obj runtime.Object, includeObject string) (*metav1.Table, error) {
+	table := &metav1.Table{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: metav1.SchemeGroupVersion.String(),
+			Kind:       "Table",
+		},
+		ColumnDefinitions: []metav1.TableColumnDefinition{
+			{Name: "Name", Type: "string", Format: "name", Description: "Name must be unique within a namespace."},
+			{Name: "Age", Type: "string", Description: "CreationTimestamp is a timestamp representing the server time when this object was created."},
+		},
+		Rows: []metav1.TableRow{},
+	}
+
+	items := []unstructured.Unstructured{}
+	switch t := obj.(type) {
+	case *unstructured.UnstructuredList:
+		items = t.Items
+		table.ResourceVersion = t.GetResourceVersion()
+		table.Continue = t.GetContinue()
+		table.RemainingItemCount = t.GetRemainingItemCount()
+	case *unstructured.Unstructured:
+		items = append(items, *t)
+		table.ResourceVersion = t.GetResourceVersion()
+	}
+
+	now := time.Now()
+	for i := range items {
+		age := "<unknown>"
+		if created := items[i].GetCreationTimestamp(); !created.IsZero() {
+			age = duration.HumanDuration(now.Sub(created.Time))
+		}
+
+		row := metav1.TableRow{
+			Cells: []interface{}{items[i].GetName(), age},
+		}
+		var err error
+		switch includeObject {
+		case "None":
+		case "Object":
+			row.Object.Raw, err = items[i].MarshalJSON()
+		default:
+			// the kube-apiserver includes the metadata by default
+			var meta metav1.ObjectMeta
+			if meta, err = objectMeta(&items[i]); err == nil {
+				row.Object.Raw, err = utils.Std2Jsoniter.Marshal(metav1.PartialObjectMetadata{
+					TypeMeta: metav1.TypeMeta{
+						APIVersion: metav1.SchemeGroupVersion.String(),
+						Kind:       "PartialObjectMetadata",
+					},
+					ObjectMeta: meta,
+				})
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to print %v: %w", items[i].GetName(), err)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table, nil
+}
+
+func objectMeta(obj *unstructured.Unstructured) (metav1.ObjectMeta, error) {
+	meta := metav1.ObjectMeta{}
+	if metadata, ok := obj.Object["metadata"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(metadata, &meta); err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestDefaultTable(t *testing.T) {
+	pod := func(name string, created time.Time) unstructured.Unstructured {
+		obj := unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1", "kind": "Pod"}}
+		obj.SetName(name)
+		obj.SetNamespace("default")
+		if !created.IsZero() {
+			obj.SetCreationTimestamp(metav1.NewTime(created))
+		}
+		return obj
+	}
+	list := &unstructured.UnstructuredList{Items: []unstructured.Unstructured{pod("a", time.Now().Add(-2*time.Hour)), pod("b", time.Time{})}}
+	list.SetResourceVersion("42")
+	list.SetContinue("next")
+	single := pod("a", time.Now().Add(-time.Minute))
+	badMeta := &unstructured.Unstructured{Object: map[string]interface{}{"metadata": map[string]interface{}{"name": "bad", "labels": "app"}}}
+	badObject := &unstructured.Unstructured{Object: map[string]interface{}{"metadata": map[string]interface{}{"name": "bad"}, "spec": func() {}}}
+
+	tests := []struct {
+		name          string
+		obj           runtime.Object
+		includeObject string
+		wantCells     [][]interface{}
+		wantKind      string
+		wantVersion   string
+		wantContinue  string
+		wantErr       bool
+	}{
+		{name: "list with metadata", obj: list, wantCells: [][]interface{}{{"a", "120m"}, {"b", "<unknown>"}},
+			wantKind: "PartialObjectMetadata", wantVersion: "42", wantContinue: "next"},
+		{name: "list with objects", obj: list, includeObject: "Object", wantCells: [][]interface{}{{"a", "120m"}, {"b", "<unknown>"}},
+			wantKind: "Pod", wantVersion: "42", wantContinue: "next"},
+		{name: "list without objects", obj: list, includeObject: "None", wantCells: [][]interface{}{{"a", "120m"}, {"b", "<unknown>"}},
+			wantVersion: "42", wantContinue: "next"},
+		{name: "single object", obj: &single, wantCells: [][]interface{}{{"a", "60s"}}, wantKind: "PartialObjectMetadata"},
+		{name: "bad metadata", obj: badMeta, wantErr: true},
+		{name: "bad metadata without objects", obj: badMeta, includeObject: "None", wantCells: [][]interface{}{{"bad", "<unknown>"}}},
+		{name: "bad object", obj: badObject, includeObject: "Object", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := defaultTable(tt.obj, tt.includeObject)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("defaultTable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if table.Kind != "Table" || len(table.ColumnDefinitions) != 2 {
+				t.Errorf("table %v with %d columns, want Table with 2 columns", table.Kind, len(table.ColumnDefinitions))
+			}
+			if table.ResourceVersion != tt.wantVersion || table.Continue != tt.wantContinue {
+				t.Errorf("resourceVersion, continue = %q, %q, want %q, %q", table.ResourceVersion, table.Continue, tt.wantVersion, tt.wantContinue)
+			}
+			if len(table.Rows) != len(tt.wantCells) {
+				t.Fatalf("%d rows, want %d", len(table.Rows), len(tt.wantCells))
+			}
+			for i, row := range table.Rows {
+				if row.Cells[0] != tt.wantCells[i][0] || row.Cells[1] != tt.wantCells[i][1] {
+					t.Errorf("row %d = %v, want %v", i, row.Cells, tt.wantCells[i])
+				}
+				kind := ""
+				if len(row.Object.Raw) != 0 {
+					var meta metav1.TypeMeta
+					if err := json.Unmarshal(row.Object.Raw, &meta); err != nil {
+						t.Fatal(err)
+					}
+					kind = meta.Kind
+				}
+				if kind != tt.wantKind {
+					t.Errorf("row %d object kind = %q, want %q", i, kind, tt.wantKind)
+				}
+			}
+		})
+	}
+}
+
+func TestGetTableValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/table/cluster/:clusterCode/*urlPath", (&handler{}).getTable)
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{name: "non resource", target: "/table/cluster/a/version", want: http.StatusBadRequest},
+		{name: "watch", target: "/table/cluster/a/api/v1/pods?watch=true", want: http.StatusBadRequest},
+		{name: "unknown cluster", target: "/table/cluster/a/api/v1/pods", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
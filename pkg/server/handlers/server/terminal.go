@@ -0,0 +1,394 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog"
+
+	recordingapi "github.com/helen-frank/hcnmp/pkg/apis/recording"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/recording"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// terminal message ops, see terminalMessage
+	opStdin  = "stdin"
+	opStdout = "stdout"
+	opResize = "resize"
+	opExit   = "exit"
+	opError  = "error"
+	// opRecording tells the client the id of the recording of the session
+	opRecording = "recording"
+
+	terminalPingPeriod   = 30 * time.Second
+	terminalWriteTimeout = 10 * time.Second
+
+	// the terminal size until the client sends a resize
+	defaultTerminalWidth  = 80
+	defaultTerminalHeight = 24
+)
+
+// defaultTerminalCommand opens bash when the container has it, sh otherwise.
+var defaultTerminalCommand = []string{"/bin/sh", "-c", "TERM=xterm-256color; export TERM; [ -x /bin/bash ] && exec /bin/bash || exec /bin/sh"}
+
+// WebSocketOptions configures the WebSocket endpoints.
+type WebSocketOptions struct {
+	// AllowedOrigins are the origins allowed besides the one of hcnmp itself, "*" allows all
+	AllowedOrigins []string
+	// ExecIdleTimeout closes a terminal without input for the duration, 0 means no timeout
+	ExecIdleTimeout time.Duration
+}
+
+func (o *WebSocketOptions) upgrader() *websocket.Upgrader {
+	allowed := make(map[string]struct{}, len(o.AllowedOrigins))
+	for _, origin := range o.AllowedOrigins {
+		allowed[origin] = struct{}{}
+	}
+
+	return &websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if len(origin) == 0 {
+				return true
+			}
+			if _, ok := allowed["*"]; ok {
+				return true
+			}
+			if _, ok := allowed[origin]; ok {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && u.Host == r.Host
+		},
+	}
+}
+
+// terminalMessage is the json message exchanged over the terminal WebSocket.
+// The client sends stdin with Data and resize with Cols and Rows,
+// the server sends stdout with Data, exit with Code and error with Data when the session ends.
+type terminalMessage struct {
+	Op   string `json:"op"`
+	Data string `json:"data,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Code int    `json:"code,omitempty"`
+}
+
+// terminalSession bridges a WebSocket to the stdin, stdout and resize events of a TTY exec session.
+type terminalSession struct {
+	conn        *websocket.Conn
+	idleTimeout time.Duration
+	done        <-chan struct{}
+	cancel      context.CancelFunc
+
+	sizes chan remotecommand.TerminalSize
+	stdin []byte
+	// recording is nil when sessions are not recorded
+	recording *recording.Session
+
+	writeMu sync.Mutex
+	// partial is the incomplete utf8 rune at the end of the last stdout write
+	partial []byte
+}
+
+// execTerminal opens an interactive TTY exec session in the container of the pod over a WebSocket.
+// container selects the container, command (repeated) overrides the default shell.
+func (h *handler) execTerminal(c *gin.Context) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if err := h.policy.Authorize(c, code, &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              "create",
+		APIVersion:        "v1",
+		Namespace:         namespace,
+		Resource:          "pods",
+		Subresource:       "exec",
+		Name:              name,
+	}); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err := h.authorizeNodeDebugSession(c, client, namespace, name); err != nil {
+		handleNodeDebugSessionError(c, err)
+		return
+	}
+
+	command := c.QueryArray("command")
+	if len(command) == 0 {
+		command = defaultTerminalCommand
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Name(name).
+		Resource("pods").
+		Namespace(namespace).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: c.Query("container"),
+			Command:   command,
+			Stdin:     true,
+			Stdout:    true,
+			Stderr:    true,
+			TTY:       true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(impersonatedConfig(c, code, client.ClientConfig()), http.MethodPost, req.URL())
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has replied with the error
+		klog.Errorf("failed to upgrade exec terminal of %v/%v/%v: %v", code, namespace, name, err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	session := &terminalSession{
+		conn:        conn,
+		idleTimeout: h.webSocket.ExecIdleTimeout,
+		done:        ctx.Done(),
+		cancel:      cancel,
+		sizes:       make(chan remotecommand.TerminalSize, 1),
+	}
+
+	if h.recorder.Enabled() {
+		// sessions must not run unrecorded when recording is enabled
+		if session.recording, err = h.recorder.Start(recordingapi.Recording{
+			User:      auth.User(c),
+			Cluster:   code,
+			Namespace: namespace,
+			Pod:       name,
+			Container: c.Query("container"),
+			Command:   command,
+		}, defaultTerminalWidth, defaultTerminalHeight); err != nil {
+			klog.Errorf("failed to record exec terminal of %v/%v/%v: %v", code, namespace, name, err)
+			session.exit(errors.New("failed to start the session recording"))
+			return
+		}
+		_ = session.send(terminalMessage{Op: opRecording, Data: session.recording.ID()})
+	}
+
+	go session.keepalive(ctx)
+
+	session.exit(executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:             session,
+		Stdout:            session,
+		Tty:               true,
+		TerminalSizeQueue: session,
+	}))
+}
+
+// Read returns the stdin sent by the client, resize messages are queued for Next.
+func (s *terminalSession) Read(p []byte) (int, error) {
+	for len(s.stdin) == 0 {
+		if s.idleTimeout > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(s.idleTimeout))
+		}
+
+		msg := terminalMessage{}
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			var netErr interface{ Timeout() bool }
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				_ = s.send(terminalMessage{Op: opError, Data: "terminal closed after " + s.idleTimeout.String() + " without input"})
+			}
+			// the client is gone, stop the exec session
+			s.cancel()
+			return 0, io.EOF
+		}
+
+		switch msg.Op {
+		case opStdin:
+			if err := s.record(func(r *recording.Session) error { return r.Input(msg.Data) }); err != nil {
+				return 0, err
+			}
+			s.stdin = []byte(msg.Data)
+		case opResize:
+			if msg.Cols == 0 || msg.Rows == 0 {
+				continue
+			}
+			if err := s.record(func(r *recording.Session) error { return r.Resize(msg.Cols, msg.Rows) }); err != nil {
+				return 0, err
+			}
+			// only the latest size matters
+			select {
+			case <-s.sizes:
+			default:
+			}
+			s.sizes <- remotecommand.TerminalSize{Width: msg.Cols, Height: msg.Rows}
+		}
+	}
+
+	n := copy(p, s.stdin)
+	s.stdin = s.stdin[n:]
+	return n, nil
+}
+
+// Write sends the stdout of the exec session to the client, splitting the data on utf8 boundaries.
+func (s *terminalSession) Write(p []byte) (int, error) {
+	s.writeMu.Lock()
+	data := append(s.partial, p...)
+	end := len(data)
+	// hold back an incomplete rune at the end, at most utf8.UTFMax-1 bytes
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax+1; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	s.partial = append([]byte(nil), data[end:]...)
+	s.writeMu.Unlock()
+
+	if end == 0 {
+		return len(p), nil
+	}
+	output := string(data[:end])
+	if err := s.record(func(r *recording.Session) error { return r.Output(output) }); err != nil {
+		return 0, err
+	}
+	if err := s.send(terminalMessage{Op: opStdout, Data: output}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush sends the bytes held back by Write when the session ends, the output ended within a rune.
+func (s *terminalSession) flush() {
+	s.writeMu.Lock()
+	partial := s.partial
+	s.partial = nil
+	s.writeMu.Unlock()
+
+	if len(partial) == 0 {
+		return
+	}
+	output := string(partial)
+	if err := s.record(func(r *recording.Session) error { return r.Output(output) }); err != nil {
+		klog.Errorf("failed to record the output of recording %v: %v", s.recording.ID(), err)
+	}
+	_ = s.send(terminalMessage{Op: opStdout, Data: output})
+}
+
+// record runs fn with the recording of the session, if any.
+func (s *terminalSession) record(fn func(r *recording.Session) error) error {
+	if s.recording == nil {
+		return nil
+	}
+	return fn(s.recording)
+}
+
+// Next returns the next terminal size, nil when the session is done.
+func (s *terminalSession) Next() *remotecommand.TerminalSize {
+	select {
+	case size := <-s.sizes:
+		return &size
+	case <-s.done:
+		return nil
+	}
+}
+
+func (s *terminalSession) send(msg terminalMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(terminalWriteTimeout))
+	return s.conn.WriteJSON(msg)
+}
+
+// keepalive pings the client so that proxies do not close an idle but open terminal.
+func (s *terminalSession) keepalive(ctx context.Context) {
+	ticker := time.NewTicker(terminalPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.writeMu.Lock()
+			err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(terminalWriteTimeout))
+			s.writeMu.Unlock()
+			if err != nil {
+				s.cancel()
+			}
+		}
+	}
+}
+
+// exit tells the client the result of the exec session and closes the WebSocket.
+func (s *terminalSession) exit(err error) {
+	s.flush()
+
+	msg := terminalMessage{Op: opExit}
+	var exitCode *int
+	var exitErr interface{ ExitStatus() int }
+	switch {
+	case err == nil:
+		exitCode = &msg.Code
+	case errors.As(err, &exitErr):
+		msg.Code = exitErr.ExitStatus()
+		exitCode = &msg.Code
+		err = nil
+	default:
+		msg = terminalMessage{Op: opError, Data: err.Error()}
+	}
+	_ = s.send(msg)
+
+	if s.recording != nil {
+		if err := s.recording.Close(exitCode, err); err != nil {
+			klog.Errorf("failed to close recording %v: %v", s.recording.ID(), err)
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(terminalWriteTimeout))
+}
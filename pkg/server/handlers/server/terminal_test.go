@@ -0,0 +1,187 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// websocketPair returns the server and the client side of a WebSocket connection.
+func websocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+	t.Cleanup(func() {
+		client.Close()
+		conn.Close()
+	})
+	return conn, client
+}
+
+func TestTerminalSessionWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		flush  bool
+		want   []string
+	}{
+		{name: "ascii", writes: []string{"hello", " world"}, want: []string{"hello", " world"}},
+		{name: "two byte rune split", writes: []string{"a\xc3", "\xa9b"}, want: []string{"a", "éb"}},
+		{name: "four byte rune split", writes: []string{"\xf0", "\x9f\x98", "\x80!"}, want: []string{"😀!"}},
+		{name: "complete rune at the end", writes: []string{"中", "文"}, want: []string{"中", "文"}},
+		{name: "incomplete rune flushed", writes: []string{"a\xe4\xb8"}, flush: true, want: []string{"a", "\ufffd\ufffd"}},
+		{name: "nothing to flush", writes: []string{"a"}, flush: true, want: []string{"a"}},
+		{name: "invalid bytes are not held", writes: []string{"\x80\x80"}, want: []string{"\ufffd\ufffd"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := websocketPair(t)
+			s := &terminalSession{conn: conn}
+
+			for _, w := range tt.writes {
+				if n, err := s.Write([]byte(w)); err != nil || n != len(w) {
+					t.Fatalf("Write() = %d, %v, want %d", n, err, len(w))
+				}
+			}
+			if tt.flush {
+				s.flush()
+			}
+			if err := s.send(terminalMessage{Op: opExit}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for {
+				msg := terminalMessage{}
+				if err := client.ReadJSON(&msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Op == opExit {
+					break
+				}
+				if msg.Op != opStdout {
+					t.Fatalf("op = %q, want %q", msg.Op, opStdout)
+				}
+				got = append(got, msg.Data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stdout = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalSessionRead(t *testing.T) {
+	tests := []struct {
+		name      string
+		messages  []terminalMessage
+		bufSize   int
+		want      []string
+		wantSizes []remotecommand.TerminalSize
+	}{
+		{
+			name:     "stdin",
+			messages: []terminalMessage{{Op: opStdin, Data: "ls\r"}, {Op: opStdin, Data: "exit\r"}},
+			bufSize:  16,
+			want:     []string{"ls\r", "exit\r"},
+		},
+		{
+			name:     "stdin split by the buffer",
+			messages: []terminalMessage{{Op: opStdin, Data: "hello"}},
+			bufSize:  2,
+			want:     []string{"he", "ll", "o"},
+		},
+		{
+			name:      "resize keeps the latest size",
+			messages:  []terminalMessage{{Op: opResize, Cols: 80, Rows: 24}, {Op: opResize}, {Op: opResize, Cols: 120, Rows: 40}, {Op: opStdin, Data: "a"}},
+			bufSize:   16,
+			want:      []string{"a"},
+			wantSizes: []remotecommand.TerminalSize{{Width: 120, Height: 40}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := websocketPair(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := &terminalSession{conn: conn, done: ctx.Done(), cancel: cancel, sizes: make(chan remotecommand.TerminalSize, 1)}
+
+			for _, msg := range tt.messages {
+				if err := client.WriteJSON(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := []string{}
+			buf := make([]byte, tt.bufSize)
+			for range tt.want {
+				n, err := s.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, string(buf[:n]))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stdin = %q, want %q", got, tt.want)
+			}
+
+			sizes := []remotecommand.TerminalSize{}
+			for len(s.sizes) != 0 {
+				sizes = append(sizes, *s.Next())
+			}
+			if len(sizes) != 0 || len(tt.wantSizes) != 0 {
+				if !reflect.DeepEqual(sizes, tt.wantSizes) {
+					t.Errorf("sizes = %v, want %v", sizes, tt.wantSizes)
+				}
+			}
+
+			// the session ends when the client is gone
+			client.Close()
+			if _, err := s.Read(buf); err != io.EOF {
+				t.Errorf("Read() after close error = %v, want EOF", err)
+			}
+			if ctx.Err() == nil {
+				t.Error("exec session is not cancelled")
+			}
+		})
+	}
+}
@@ -0,0 +1,419 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	watchtools "k8s.io/client-go/tools/watch"
+
+	operationapi "github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/servererror"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// RestartedAtAnnotation is the pod template annotation set by kubectl rollout restart
+	RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	defaultWorkloadTimeout = 5 * time.Minute
+)
+
+// workloadKind is a kind of workload supported by the workload actions.
+type workloadKind struct {
+	gvr  schema.GroupVersionResource
+	kind string
+
+	scalable bool
+	pausable bool
+	// revisions tells whether the revision history and rollback are supported
+	revisions bool
+}
+
+// workloadKinds are the supported workloads by resource
+var workloadKinds = map[string]workloadKind{
+	"deployments": {
+		gvr:  schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		kind: "Deployment", scalable: true, pausable: true, revisions: true,
+	},
+	"statefulsets": {
+		gvr:  schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+		kind: "StatefulSet", scalable: true, revisions: true,
+	},
+	"daemonsets": {
+		gvr:  schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"},
+		kind: "DaemonSet", revisions: true,
+	},
+	// argo rollouts are restarted by spec.restartAt instead of the pod template
+	"rollouts": {
+		gvr:  schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+		kind: "Rollout", scalable: true, pausable: true,
+	},
+}
+
+// restartWorkload restarts the workload of :kind like kubectl rollout restart, the wait until it is ready
+// is an operation bounded by timeout (default 5m).
+func (h *handler) restartWorkload(c *gin.Context) {
+	kind, ok := workloadKindParam(c)
+	if !ok {
+		return
+	}
+	h.restart(c, kind)
+}
+
+// restartDeployment is kept for compatibility, it is restartWorkload of deployments.
+func (h *handler) restartDeployment(c *gin.Context) {
+	h.restart(c, workloadKinds["deployments"])
+}
+
+func (h *handler) restart(c *gin.Context, kind workloadKind) {
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	timeout, err := queryTimeout(c, defaultWorkloadTimeout)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeWorkload(c, kind, "patch", namespace, name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the workload is changed as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	restarted, err := restartWorkload(c.Request.Context(), client, kind, namespace, name)
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	h.startOperation(c, operationapi.Operation{
+		Type:    "restart",
+		User:    auth.User(c),
+		Cluster: code,
+		Target: operationapi.Target{
+			Kind:      kind.kind,
+			Namespace: namespace,
+			Name:      name,
+		},
+	}, timeout, func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+		r.Event(operationapi.EventTypeNormal, fmt.Sprintf("restarted %v %v/%v", kind.kind, namespace, name))
+		return waitForWorkload(ctx, client, kind, restarted, r)
+	})
+}
+
+// startOperation starts fn as an operation and replies 202 with the operation, its location is in the Location header.
+func (h *handler) startOperation(c *gin.Context, op operationapi.Operation, timeout time.Duration, fn operation.Func) {
+	started := h.operations.Start(op, timeout, fn)
+	c.Header("Location", "/apis/operations/v1/"+started.ID)
+	c.JSON(http.StatusAccepted, started)
+}
+
+// scaleWorkload sets the replicas of the workload by its scale subresource, with wait=true it replies an operation
+// waiting until the workload is ready, bounded by timeout (default 5m).
+func (h *handler) scaleWorkload(c *gin.Context) {
+	kind, ok := workloadKindParam(c)
+	if !ok {
+		return
+	}
+	code := c.Param("clusterCode")
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if !kind.scalable {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("%v can not be scaled", kind.gvr.Resource))
+		return
+	}
+	replicas, err := strconv.ParseInt(c.Query("replicas"), 10, 32)
+	if err != nil || replicas < 0 {
+		servererror.HandleError(c, http.StatusBadRequest, errors.New("replicas must be a non-negative integer"))
+		return
+	}
+	timeout, err := queryTimeout(c, defaultWorkloadTimeout)
+	if err != nil {
+		servererror.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.authorizeWorkload(c, kind, "patch", namespace, name, "scale"); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(code)
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the workload is changed as the caller
+	if client, err = impersonatedClient(c, code, client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	data, err := utils.Std2Jsoniter.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+		},
+	})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	resource := client.Resource(kind.gvr).Namespace(namespace)
+	scale, err := resource.Patch(c.Request.Context(), name, types.MergePatchType, data, metav1.PatchOptions{}, "scale")
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if c.Query("wait") != "true" {
+		c.JSON(http.StatusOK, scale)
+		return
+	}
+
+	scaled, err := resource.Get(c.Request.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	h.startOperation(c, operationapi.Operation{
+		Type:    "scale",
+		User:    auth.User(c),
+		Cluster: code,
+		Target: operationapi.Target{
+			Kind:      kind.kind,
+			Namespace: namespace,
+			Name:      name,
+		},
+	}, timeout, func(ctx context.Context, r *operation.Reporter) (interface{}, error) {
+		r.Event(operationapi.EventTypeNormal, fmt.Sprintf("scaled %v %v/%v to %v replicas", kind.kind, namespace, name, replicas))
+		return waitForWorkload(ctx, client, kind, scaled, r)
+	})
+}
+
+// pauseWorkload pauses the rollout of the workload like kubectl rollout pause.
+func (h *handler) pauseWorkload(c *gin.Context) {
+	h.setPaused(c, true)
+}
+
+// resumeWorkload resumes the paused rollout of the workload like kubectl rollout resume.
+func (h *handler) resumeWorkload(c *gin.Context) {
+	h.setPaused(c, false)
+}
+
+func (h *handler) setPaused(c *gin.Context, paused bool) {
+	kind, ok := workloadKindParam(c)
+	if !ok {
+		return
+	}
+	namespace := c.Param("namespace")
+	name := c.Param("name")
+
+	if !kind.pausable {
+		servererror.HandleError(c, http.StatusBadRequest, fmt.Errorf("%v can not be paused", kind.gvr.Resource))
+		return
+	}
+
+	if err := h.authorizeWorkload(c, kind, "patch", namespace, name, ""); err != nil {
+		servererror.HandleError(c, http.StatusForbidden, err)
+		return
+	}
+
+	client, err := proxy.GetClusterPorxyClientFromCode(c.Param("clusterCode"))
+	if err != nil {
+		servererror.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	// the workload is changed as the caller
+	if client, err = impersonatedClient(c, c.Param("clusterCode"), client); err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	data, err := utils.Std2Jsoniter.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"paused": paused,
+		},
+	})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	obj, err := client.Resource(kind.gvr).Namespace(namespace).Patch(c.Request.Context(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		servererror.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, obj)
+}
+
+// restartWorkload restarts the pods of the workload by the restartedAt annotation of its pod template,
+// the labels and so the selector of the pods are not changed.
+func restartWorkload(ctx context.Context, client clientset.Interface, kind workloadKind, namespace, name string) (*unstructured.Unstructured, error) {
+	now := time.Now().Format(time.RFC3339)
+
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]interface{}{
+						RestartedAtAnnotation: now,
+					},
+				},
+			},
+		},
+	}
+	if kind.kind == "Rollout" {
+		patch = map[string]interface{}{
+			"spec": map[string]interface{}{
+				"restartAt": now,
+			},
+		}
+	}
+
+	data, err := utils.Std2Jsoniter.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	return client.Resource(kind.gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, data, metav1.PatchOptions{})
+}
+
+// waitForWorkload waits until the status of the workload evaluated by utils.Status is ready, it returns the ready workload.
+// The replicas of the workload are reported as the progress of the operation.
+func waitForWorkload(ctx context.Context, client clientset.Interface, kind workloadKind, obj *unstructured.Unstructured, r *operation.Reporter) (*unstructured.Unstructured, error) {
+	resource := client.Resource(kind.gvr).Namespace(obj.GetNamespace())
+	selector := fields.OneTermEqualSelector("metadata.name", obj.GetName()).String()
+
+	r.Progress(workloadProgress(obj))
+	if status, err := utils.Status(obj); err == nil && status == utils.StatusReady {
+		return obj, nil
+	}
+
+	event, err := watchtools.Until(ctx, obj.GetResourceVersion(), &cache.ListWatch{
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return resource.Watch(ctx, options)
+		},
+	}, func(event watch.Event) (bool, error) {
+		switch event.Type {
+		case watch.Deleted:
+			return false, fmt.Errorf("%v %v/%v was deleted", kind.kind, obj.GetNamespace(), obj.GetName())
+		case watch.Error:
+			return false, fmt.Errorf("failed to watch %v %v/%v", kind.kind, obj.GetNamespace(), obj.GetName())
+		}
+
+		u, ok := event.Object.(*unstructured.Unstructured)
+		if !ok {
+			return false, nil
+		}
+		r.Progress(workloadProgress(u))
+		status, err := utils.Status(u)
+		if err != nil {
+			return false, err
+		}
+		return status == utils.StatusReady, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event.Object.(*unstructured.Unstructured), nil
+}
+
+// workloadProgress returns the updated and desired replicas of the workload.
+func workloadProgress(u *unstructured.Unstructured) (int, int, string) {
+	if u.GetKind() == "DaemonSet" {
+		desired, _, _ := unstructured.NestedInt64(u.Object, "status", "desiredNumberScheduled")
+		updated, _, _ := unstructured.NestedInt64(u.Object, "status", "updatedNumberScheduled")
+		ready, _, _ := unstructured.NestedInt64(u.Object, "status", "numberReady")
+		return int(updated), int(desired), fmt.Sprintf("%v of %v pods updated, %v ready", updated, desired, ready)
+	}
+
+	replicas, found, _ := unstructured.NestedInt64(u.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	updated, _, _ := unstructured.NestedInt64(u.Object, "status", "updatedReplicas")
+	ready, _, _ := unstructured.NestedInt64(u.Object, "status", "readyReplicas")
+	return int(updated), int(replicas), fmt.Sprintf("%v of %v replicas updated, %v ready", updated, replicas, ready)
+}
+
+// authorizeWorkload checks the proxy policy for verb of the workload, or its subresource.
+func (h *handler) authorizeWorkload(c *gin.Context, kind workloadKind, verb, namespace, name, subresource string) error {
+	return h.policy.Authorize(c, c.Param("clusterCode"), &policy.RequestInfo{
+		IsResourceRequest: true,
+		Path:              c.Request.URL.Path,
+		Verb:              verb,
+		APIGroup:          kind.gvr.Group,
+		APIVersion:        kind.gvr.Version,
+		Namespace:         namespace,
+		Resource:          kind.gvr.Resource,
+		Subresource:       subresource,
+		Name:              name,
+	})
+}
+
+// workloadKindParam returns the workload kind of :kind, otherwise replies 404.
+func workloadKindParam(c *gin.Context) (workloadKind, bool) {
+	kind, ok := workloadKinds[c.Param("kind")]
+	if !ok {
+		servererror.HandleError(c, http.StatusNotFound, fmt.Errorf("unsupported workload kind %q", c.Param("kind")))
+	}
+	return kind, ok
+}
+
+// queryTimeout parses the timeout of the request, defaultTimeout if it is not set.
+func queryTimeout(c *gin.Context, defaultTimeout time.Duration) (time.Duration, error) {
+	timeout := defaultTimeout
+	if s := c.Query("timeout"); len(s) != 0 {
+		var err error
+		if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+			return 0, errors.New("timeout must be a positive duration")
+		}
+	}
+	return timeout, nil
+}
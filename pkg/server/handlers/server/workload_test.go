@@ -0,0 +1,197 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestWorkloadKinds(t *testing.T) {
+	tests := []struct {
+		resource      string
+		wantKind      string
+		wantGroup     string
+		wantScalable  bool
+		wantPausable  bool
+		wantRevisions bool
+	}{
+		{resource: "deployments", wantKind: "Deployment", wantGroup: "apps", wantScalable: true, wantPausable: true, wantRevisions: true},
+		{resource: "statefulsets", wantKind: "StatefulSet", wantGroup: "apps", wantScalable: true, wantRevisions: true},
+		{resource: "daemonsets", wantKind: "DaemonSet", wantGroup: "apps", wantRevisions: true},
+		{resource: "rollouts", wantKind: "Rollout", wantGroup: "argoproj.io", wantScalable: true, wantPausable: true},
+	}
+	if len(workloadKinds) != len(tests) {
+		t.Errorf("%d workload kinds, want %d", len(workloadKinds), len(tests))
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.resource, func(t *testing.T) {
+			kind, ok := workloadKinds[tt.resource]
+			if !ok {
+				t.Fatalf("workload kind %v is not supported", tt.resource)
+			}
+			if kind.kind != tt.wantKind || kind.gvr.Group != tt.wantGroup || kind.gvr.Resource != tt.resource {
+				t.Errorf("kind = %v %v, want %v %v/%v", kind.kind, kind.gvr, tt.wantKind, tt.wantGroup, tt.resource)
+			}
+			if kind.scalable != tt.wantScalable || kind.pausable != tt.wantPausable || kind.revisions != tt.wantRevisions {
+				t.Errorf("scalable, pausable, revisions = %v, %v, %v, want %v, %v, %v",
+					kind.scalable, kind.pausable, kind.revisions, tt.wantScalable, tt.wantPausable, tt.wantRevisions)
+			}
+		})
+	}
+}
+
+func TestRestartWorkload(t *testing.T) {
+	labels := map[string]string{"app": "web"}
+	template := map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "web"}},
+	}
+	rollout := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+		"spec":       map[string]interface{}{"template": template},
+	}}
+	client := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Template: podTemplate(labels)},
+		},
+		&appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Template: podTemplate(labels)},
+		},
+		&appsv1.DaemonSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DaemonSet"},
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       appsv1.DaemonSetSpec{Template: podTemplate(labels)},
+		},
+		rollout,
+	)
+
+	tests := []struct {
+		resource string
+		// wantPath is the field set to the restart time
+		wantPath []string
+		wantErr  bool
+	}{
+		{resource: "deployments", wantPath: []string{"spec", "template", "metadata", "annotations", RestartedAtAnnotation}},
+		{resource: "statefulsets", wantPath: []string{"spec", "template", "metadata", "annotations", RestartedAtAnnotation}},
+		{resource: "daemonsets", wantPath: []string{"spec", "template", "metadata", "annotations", RestartedAtAnnotation}},
+		{resource: "rollouts", wantPath: []string{"spec", "restartAt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.resource, func(t *testing.T) {
+			before := time.Now().Add(-time.Second)
+			obj, err := restartWorkload(context.Background(), client, workloadKinds[tt.resource], "default", "web")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, found, err := unstructured.NestedString(obj.Object, tt.wantPath...)
+			if err != nil || !found {
+				t.Fatalf("%v is not set: %v", tt.wantPath, err)
+			}
+			restartedAt, err := time.Parse(time.RFC3339, value)
+			if err != nil || restartedAt.Before(before.Truncate(time.Second)) {
+				t.Errorf("restart time = %q, %v, want now", value, err)
+			}
+			// the labels and so the selector of the pods are kept
+			if labels, _, _ := unstructured.NestedStringMap(obj.Object, "spec", "template", "metadata", "labels"); labels["app"] != "web" {
+				t.Errorf("pod template labels = %v, want app=web", labels)
+			}
+			if tt.resource == "rollouts" {
+				if _, found, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "template", "metadata", "annotations"); found {
+					t.Error("rollout pod template is changed")
+				}
+			}
+		})
+	}
+
+	if _, err := restartWorkload(context.Background(), client, workloadKinds["deployments"], "default", "missing"); err == nil {
+		t.Error("restart of a missing deployment succeeded")
+	}
+}
+
+func TestWorkloadProgress(t *testing.T) {
+	replicas := int32(3)
+	tests := []struct {
+		name        string
+		obj         runtime.Object
+		wantCurrent int
+		wantTotal   int
+		wantMessage string
+	}{
+		{
+			name: "deployment",
+			obj: &appsv1.Deployment{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+				Spec:     appsv1.DeploymentSpec{Replicas: &replicas},
+				Status:   appsv1.DeploymentStatus{UpdatedReplicas: 2, ReadyReplicas: 1},
+			},
+			wantCurrent: 2, wantTotal: 3, wantMessage: "2 of 3 replicas updated, 1 ready",
+		},
+		{
+			name: "default replicas",
+			obj: &appsv1.StatefulSet{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			},
+			wantCurrent: 0, wantTotal: 1, wantMessage: "0 of 1 replicas updated, 0 ready",
+		},
+		{
+			name: "daemonset",
+			obj: &appsv1.DaemonSet{
+				TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DaemonSet"},
+				Status:   appsv1.DaemonSetStatus{DesiredNumberScheduled: 5, UpdatedNumberScheduled: 4, NumberReady: 3},
+			},
+			wantCurrent: 4, wantTotal: 5, wantMessage: "4 of 5 pods updated, 3 ready",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := runtime.DefaultUnstructuredConverter.ToUnstructured(tt.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current, total, message := workloadProgress(&unstructured.Unstructured{Object: data})
+			if current != tt.wantCurrent || total != tt.wantTotal || message != tt.wantMessage {
+				t.Errorf("workloadProgress() = %v, %v, %q, want %v, %v, %q", current, total, message, tt.wantCurrent, tt.wantTotal, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func podTemplate(labels map[string]string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}},
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/zone"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+)
+
+var (
+	mu          sync.Mutex
+	controllers = make(map[string]Controller)
+
+	isLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_leader_is_leader",
+			Help:      "Whether this hcnmp replica is the leader running the singleton controllers.",
+		},
+	)
+
+	leaderTransitions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_leader_transitions_total",
+			Help:      "Total number of times this hcnmp replica acquired leadership.",
+		},
+	)
+
+	controllerRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_leader_controller_running",
+			Help:      "Whether the singleton controller is running on this hcnmp replica.",
+		}, []string{"controller"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(isLeader, leaderTransitions, controllerRunning)
+}
+
+// Controller is background work that must only run on one hcnmp replica at a time.
+// Run blocks until ctx is done, ctx is cancelled when leadership is lost.
+type Controller func(ctx context.Context)
+
+// Register registers a singleton controller, it must be called before Run.
+func Register(name string, c Controller) {
+	if err := register(name, c); err != nil {
+		klog.Fatal(err)
+	}
+}
+
+func register(name string, c Controller) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := controllers[name]; ok {
+		return fmt.Errorf("controller %v registered twice", name)
+	}
+	controllers[name] = c
+	return nil
+}
+
+// Options configures the lease based leader election.
+type Options struct {
+	// Enabled false runs the controllers on every replica without election.
+	Enabled       bool
+	LeaseName     string
+	Namespace     string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Run campaigns for the lease and runs the registered controllers while leading, it blocks until ctx is done.
+func Run(ctx context.Context, client clientset.Interface, opts Options) error {
+	if !opts.Enabled {
+		isLeader.Set(1)
+		runControllers(ctx)
+		return nil
+	}
+
+	id, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	id += "_" + string(uuid.NewUUID())
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      opts.LeaseName,
+			Namespace: opts.Namespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: id,
+		},
+	}
+
+	l := &leadership{id: id}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   opts.LeaseDuration,
+		RenewDeadline:   opts.RenewDeadline,
+		RetryPeriod:     opts.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            opts.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: l.lead,
+			OnStoppedLeading: func() {
+				klog.Infof("%v stopped leading", id)
+				isLeader.Set(0)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					klog.Infof("new leader elected: %v", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Run returns when leadership is lost, campaign again until ctx is done
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+		// wait for the controllers to stop before campaigning again
+		l.wait()
+	}
+	return nil
+}
+
+// leadership serializes the controllers of successive leaderships, client-go starts OnStartedLeading
+// in a goroutine and the elector may return before the controllers of the lost leadership stopped.
+type leadership struct {
+	id string
+	mu sync.Mutex
+}
+
+// lead runs the controllers until ctx is done, after the controllers of the previous leadership stopped.
+func (l *leadership) lead(ctx context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ctx.Err() != nil {
+		// leadership was lost before the previous controllers stopped
+		return
+	}
+	klog.Infof("%v started leading", l.id)
+	isLeader.Set(1)
+	leaderTransitions.Inc()
+	runControllers(ctx)
+}
+
+// wait waits for the controllers of the current leadership to stop.
+func (l *leadership) wait() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+}
+
+// runControllers runs every registered controller and waits for all of them to return.
+func runControllers(ctx context.Context) {
+	mu.Lock()
+	names := make([]string, 0, len(controllers))
+	for name := range controllers {
+		names = append(names, name)
+	}
+	mu.Unlock()
+	sort.Strings(names)
+
+	wg := sync.WaitGroup{}
+	for i := range names {
+		name := names[i]
+		mu.Lock()
+		c := controllers[name]
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			klog.Infof("starting controller %v", name)
+			controllerRunning.WithLabelValues(name).Set(1)
+			defer controllerRunning.WithLabelValues(name).Set(0)
+			c(ctx)
+			klog.Infof("controller %v stopped", name)
+		}()
+	}
+	wg.Wait()
+}
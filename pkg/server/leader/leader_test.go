@@ -0,0 +1,228 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+// setControllers replaces the registered controllers until the test ends.
+func setControllers(t *testing.T, c map[string]Controller) {
+	mu.Lock()
+	saved := controllers
+	controllers = c
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		controllers = saved
+		mu.Unlock()
+	})
+}
+
+// counter is a controller counting its runs until ctx is done.
+type counter struct {
+	runs    atomic.Int32
+	running atomic.Int32
+	started chan struct{}
+}
+
+func newCounter() *counter {
+	return &counter{started: make(chan struct{}, 10)}
+}
+
+func (c *counter) run(ctx context.Context) {
+	c.runs.Add(1)
+	c.running.Add(1)
+	defer c.running.Add(-1)
+	c.started <- struct{}{}
+	<-ctx.Done()
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		wantErr []bool
+	}{
+		{name: "distinct", names: []string{"a", "b"}, wantErr: []bool{false, false}},
+		{name: "twice", names: []string{"a", "b", "a"}, wantErr: []bool{false, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setControllers(t, map[string]Controller{})
+			for i, name := range tt.names {
+				if err := register(name, func(context.Context) {}); (err != nil) != tt.wantErr[i] {
+					t.Errorf("register(%q) error = %v, wantErr %v", name, err, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLeadershipLead(t *testing.T) {
+	tests := []struct {
+		name string
+		// lost cancels the leadership before it starts
+		lost     bool
+		wantRuns int32
+	}{
+		{name: "runs the controllers", wantRuns: 1},
+		{name: "lost before leading", lost: true, wantRuns: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCounter()
+			setControllers(t, map[string]Controller{"counter": c.run})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.lost {
+				cancel()
+			}
+			done := make(chan struct{})
+			l := &leadership{id: "test"}
+			go func() {
+				defer close(done)
+				l.lead(ctx)
+			}()
+			if !tt.lost {
+				<-c.started
+			}
+			cancel()
+			<-done
+
+			if got := c.runs.Load(); got != tt.wantRuns {
+				t.Errorf("runs = %v, want %v", got, tt.wantRuns)
+			}
+			if got := c.running.Load(); got != 0 {
+				t.Errorf("%v controllers still running", got)
+			}
+		})
+	}
+}
+
+// TestLeadershipGenerations checks that the controllers of a new leadership start after the previous ones stopped.
+func TestLeadershipGenerations(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	var running, overlapped atomic.Int32
+	setControllers(t, map[string]Controller{
+		// the controller ignores the lost leadership until released
+		"slow": func(ctx context.Context) {
+			if running.Add(1) > 1 {
+				overlapped.Add(1)
+			}
+			defer running.Add(-1)
+			started <- struct{}{}
+			<-ctx.Done()
+			<-release
+		},
+	})
+
+	l := &leadership{id: "test"}
+	first, lose := context.WithCancel(context.Background())
+	go l.lead(first)
+	<-started
+	lose()
+
+	second, stop := context.WithCancel(context.Background())
+	defer stop()
+	secondDone := make(chan struct{})
+	go func() {
+		defer close(secondDone)
+		l.lead(second)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("the next leadership started before the previous controllers stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	<-started
+	stop()
+	<-secondDone
+	l.wait()
+
+	if got := overlapped.Load(); got != 0 {
+		t.Errorf("controllers of %v leaderships overlapped", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "without election", opts: Options{}},
+		{name: "with election", opts: Options{
+			Enabled:       true,
+			LeaseName:     "hcnmp",
+			Namespace:     "hcnmp",
+			LeaseDuration: 15 * time.Second,
+			RenewDeadline: 10 * time.Second,
+			RetryPeriod:   time.Second,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCounter()
+			setControllers(t, map[string]Controller{"counter": c.run})
+			client := fake.NewSimpleClientset()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- Run(ctx, client, tt.opts)
+			}()
+
+			select {
+			case <-c.started:
+			case <-time.After(10 * time.Second):
+				t.Fatal("the controllers did not start")
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if got := c.running.Load(); got != 0 {
+				t.Errorf("%v controllers still running after Run returned", got)
+			}
+
+			if tt.opts.Enabled {
+				lease, err := client.CoordinationV1().Leases(tt.opts.Namespace).Get(context.Background(), tt.opts.LeaseName, metav1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				// the lease is released when ctx is done
+				if lease.Spec.HolderIdentity != nil && len(*lease.Spec.HolderIdentity) != 0 {
+					t.Errorf("lease still held by %v", *lease.Spec.HolderIdentity)
+				}
+			}
+		})
+	}
+}
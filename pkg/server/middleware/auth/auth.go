@@ -17,11 +17,44 @@ limitations under the License.
 package auth
 
 import (
+	"net/http"
+	"strings"
+
 	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
-func MultiAuth(accounts gin.Accounts) gin.HandlerFunc {
+// tokenAuthKey marks requests authenticated by a bearer token
+const tokenAuthKey = "hcnmp/token-auth"
+
+// MultiAuth authenticates the request by bearer token issued by tokens, or by basic auth of accounts.
+func MultiAuth(accounts gin.Accounts, tokens *Tokens) gin.HandlerFunc {
+	basicAuth := gin.BasicAuthForRealm(accounts, "")
 	return func(c *gin.Context) {
-		gin.BasicAuthForRealm(accounts, "")(c)
+		if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			user, err := tokens.Verify(strings.TrimSpace(token))
+			if err != nil {
+				status := apierrors.NewUnauthorized(err.Error()).ErrStatus
+				status.APIVersion = "v1"
+				status.Kind = "Status"
+				c.AbortWithStatusJSON(http.StatusUnauthorized, status)
+				return
+			}
+			c.Set(gin.AuthUserKey, user)
+			c.Set(tokenAuthKey, true)
+			return
+		}
+
+		basicAuth(c)
 	}
 }
+
+// User returns the authenticated user of the request.
+func User(c *gin.Context) string {
+	return c.GetString(gin.AuthUserKey)
+}
+
+// TokenAuthenticated reports whether the request is authenticated by a bearer token instead of basic auth.
+func TokenAuthenticated(c *gin.Context) bool {
+	return c.GetBool(tokenAuthKey)
+}
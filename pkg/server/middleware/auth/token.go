@@ -0,0 +1,144 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/helen-frank/hcnmp/pkg/utils"
+)
+
+const (
+	tokenPrefix = "hcnmp"
+
+	// SigningKeySecret is the secret keeping the generated signing key shared by the hcnmp replicas
+	SigningKeySecret = "hcnmp-token-signing-key"
+	signingKeyData   = "key"
+	signingKeySize   = 32
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// Tokens issues and verifies the bearer tokens of hcnmp users,
+// they are used by clients such as kubectl which do not support basic auth.
+type Tokens struct {
+	key []byte
+}
+
+type tokenClaims struct {
+	User      string `json:"u"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// NewTokens creates Tokens signing with key, every hcnmp replica must use the same key.
+func NewTokens(key []byte) *Tokens {
+	return &Tokens{key: key}
+}
+
+// LoadSigningKey returns the signing key in SigningKeySecret of namespace,
+// a random key is generated and stored when the secret does not exist.
+func LoadSigningKey(ctx context.Context, client kubernetes.Interface, namespace string) ([]byte, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, SigningKeySecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		key := make([]byte, signingKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		secret, err = client.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      SigningKeySecret,
+				Namespace: namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "hcnmp"},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{signingKeyData: key},
+		}, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// another replica created it first
+			secret, err = client.CoreV1().Secrets(namespace).Get(ctx, SigningKeySecret, metav1.GetOptions{})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := secret.Data[signingKeyData]
+	if len(key) < signingKeySize {
+		return nil, fmt.Errorf("secret %v/%v must have a %q of at least %v bytes", namespace, SigningKeySecret, signingKeyData, signingKeySize)
+	}
+	return key, nil
+}
+
+// Issue returns a token of user valid for ttl.
+func (t *Tokens) Issue(user string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	payload, err := utils.Std2Jsoniter.Marshal(tokenClaims{
+		User:      user,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return tokenPrefix + "." + encoded + "." + t.sign(encoded), expiresAt, nil
+}
+
+// Verify returns the user of token.
+func (t *Tokens) Verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return "", errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(parts[1]))) {
+		return "", errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errInvalidToken
+	}
+	claims := tokenClaims{}
+	if err := utils.Std2Jsoniter.Unmarshal(payload, &claims); err != nil {
+		return "", errInvalidToken
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return "", errors.New("token expired")
+	}
+	return claims.User, nil
+}
+
+func (t *Tokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
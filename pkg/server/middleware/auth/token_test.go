@@ -0,0 +1,75 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokensVerify(t *testing.T) {
+	tokens := NewTokens([]byte("0123456789abcdef0123456789abcdef"))
+	other := NewTokens([]byte("fedcba9876543210fedcba9876543210"))
+
+	valid, _, err := tokens.Issue("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := tokens.Issue("alice", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, _, err := other.Issue("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+	forgedPayload := base64.RawURLEncoding.EncodeToString([]byte(`{"u":"admin","exp":4102444800}`))
+	notJSON := base64.RawURLEncoding.EncodeToString([]byte("alice"))
+
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", token: valid, want: "alice"},
+		{name: "expired", token: expired, wantErr: true},
+		{name: "signed with another key", token: foreign, wantErr: true},
+		{name: "forged payload", token: parts[0] + "." + forgedPayload + "." + parts[2], wantErr: true},
+		{name: "wrong prefix", token: "kube." + parts[1] + "." + parts[2], wantErr: true},
+		{name: "missing signature", token: parts[0] + "." + parts[1], wantErr: true},
+		{name: "extra part", token: valid + ".x", wantErr: true},
+		{name: "signed payload not json", token: parts[0] + "." + notJSON + "." + tokens.sign(notJSON), wantErr: true},
+		{name: "signed payload not base64", token: parts[0] + ".!!." + tokens.sign("!!"), wantErr: true},
+		{name: "empty", token: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokens.Verify(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Verify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/zone"
+)
+
+const (
+	resultHit       = "hit"
+	resultMiss      = "miss"
+	resultCoalesced = "coalesced"
+	resultBypass    = "bypass"
+
+	// CacheHeader tells the client whether the response is served from the cache.
+	CacheHeader = "X-Hcnmp-Cache"
+)
+
+var (
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_proxy_cache_requests_total",
+			Help:      "Total number of cacheable proxy requests by result, hit, miss, coalesced or bypass.",
+		}, []string{"cluster", "result"},
+	)
+
+	cacheSizeBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_proxy_cache_size_bytes",
+			Help:      "Bytes of proxy responses held in the cache.",
+		},
+	)
+
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_proxy_cache_entries",
+			Help:      "Number of proxy responses held in the cache.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, cacheSizeBytes, cacheEntries)
+}
+
+// Options configures the proxy response cache.
+type Options struct {
+	// TTL is the default time to live of responses, 0 disables the cache for resources not in ResourceTTLs.
+	TTL time.Duration
+	// ResourceTTLs overrides TTL per resource, e.g. pods: 5s, the key of non resource requests is their path.
+	ResourceTTLs map[string]time.Duration
+	// MaxSize is the max bytes of all cached responses, the least recently used are evicted.
+	MaxSize int64
+}
+
+// IdentityFunc returns the identity the request is sent to the member cluster with.
+type IdentityFunc func(c *gin.Context) string
+
+// Cache is a short-lived cache of GET responses of proxied requests,
+// identical in-flight requests are coalesced into one upstream request.
+type Cache struct {
+	opts Options
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	inflight map[string]*call
+}
+
+type entry struct {
+	key       string
+	status    int
+	header    http.Header
+	body      []byte
+	storedAt  time.Time
+	expiresAt time.Time
+}
+
+func (e *entry) size() int64 {
+	return int64(len(e.key) + len(e.body))
+}
+
+type call struct {
+	done chan struct{}
+	// entry is nil when the response can not be shared
+	entry *entry
+}
+
+// New creates a Cache.
+func New(opts Options) *Cache {
+	return &Cache{
+		opts:     opts,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*call),
+	}
+}
+
+// Enabled reports whether any response may be cached.
+func (ca *Cache) Enabled() bool {
+	if ca.opts.MaxSize <= 0 {
+		return false
+	}
+	if ca.opts.TTL > 0 {
+		return true
+	}
+	for _, ttl := range ca.opts.ResourceTTLs {
+		if ttl > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware caches the responses of the route with :clusterCode and *urlPath.
+// "Cache-Control: no-cache" or "max-age=0" skips reading the cache, "no-store" skips the cache entirely.
+func (ca *Cache) Middleware(identity IdentityFunc) gin.HandlerFunc {
+	if !ca.Enabled() {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		ttl := ca.ttlFor(c)
+		if ttl <= 0 {
+			c.Next()
+			return
+		}
+
+		cluster := c.Param("clusterCode")
+		noStore, noCache := cacheControl(c.Request.Header.Get("Cache-Control"))
+		if noStore {
+			cacheRequests.WithLabelValues(cluster, resultBypass).Inc()
+			c.Next()
+			return
+		}
+
+		key := ca.key(c, identity)
+		if !noCache {
+			if e := ca.get(key); e != nil {
+				cacheRequests.WithLabelValues(cluster, resultHit).Inc()
+				writeEntry(c, e, "HIT")
+				return
+			}
+		}
+
+		ca.mu.Lock()
+		if inflight, ok := ca.inflight[key]; ok && !noCache {
+			ca.mu.Unlock()
+			select {
+			case <-inflight.done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+			if inflight.entry != nil {
+				cacheRequests.WithLabelValues(cluster, resultCoalesced).Inc()
+				writeEntry(c, inflight.entry, "HIT")
+				return
+			}
+			// the leader response could not be shared, send the request on its own
+			cacheRequests.WithLabelValues(cluster, resultMiss).Inc()
+			c.Next()
+			return
+		}
+		leader := &call{done: make(chan struct{})}
+		if !noCache {
+			ca.inflight[key] = leader
+		}
+		ca.mu.Unlock()
+
+		cacheRequests.WithLabelValues(cluster, resultMiss).Inc()
+		c.Header(CacheHeader, "MISS")
+		w := &bodyWriter{ResponseWriter: c.Writer, limit: ca.maxEntrySize()}
+		c.Writer = w
+		defer func() {
+			c.Writer = w.ResponseWriter
+			// a cancelled request may have copied part of the body only
+			if w.Status() == http.StatusOK && !w.overflow && c.Request.Context().Err() == nil {
+				now := time.Now()
+				leader.entry = &entry{
+					key:       key,
+					status:    w.Status(),
+					header:    w.Header().Clone(),
+					body:      w.buf.Bytes(),
+					storedAt:  now,
+					expiresAt: now.Add(ttl),
+				}
+				ca.set(leader.entry)
+			}
+
+			ca.mu.Lock()
+			if ca.inflight[key] == leader {
+				delete(ca.inflight, key)
+			}
+			ca.mu.Unlock()
+			close(leader.done)
+		}()
+
+		c.Next()
+	}
+}
+
+// ttlFor returns the ttl of the request, 0 if it can not be cached.
+func (ca *Cache) ttlFor(c *gin.Context) time.Duration {
+	req := c.Request
+	if req.Method != http.MethodGet || httpstream.IsUpgradeRequest(req) {
+		return 0
+	}
+
+	query := req.URL.Query()
+	if strings.EqualFold(query.Get("follow"), "true") {
+		return 0
+	}
+
+	info := policy.NewRequestInfo(req.Method, c.Param("urlPath"), query)
+	if info.Verb == "watch" {
+		return 0
+	}
+
+	resource := info.Path
+	if info.IsResourceRequest {
+		resource = info.Resource
+		if len(info.Subresource) != 0 {
+			resource += "/" + info.Subresource
+		}
+	}
+	if ttl, ok := ca.opts.ResourceTTLs[resource]; ok {
+		return ttl
+	}
+	return ca.opts.TTL
+}
+
+func (ca *Cache) key(c *gin.Context, identity IdentityFunc) string {
+	return strings.Join([]string{
+		c.Param("clusterCode"),
+		c.Param("urlPath"),
+		c.Request.URL.Query().Encode(),
+		c.Request.Header.Get("Accept"),
+		c.Request.Header.Get("Accept-Encoding"),
+		identity(c),
+	}, "\x00")
+}
+
+// maxEntrySize keeps a single response from evicting most of the cache.
+func (ca *Cache) maxEntrySize() int64 {
+	return ca.opts.MaxSize / 8
+}
+
+func (ca *Cache) get(key string) *entry {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	elem, ok := ca.entries[key]
+	if !ok {
+		return nil
+	}
+	e := elem.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		ca.remove(elem)
+		return nil
+	}
+	ca.lru.MoveToFront(elem)
+	return e
+}
+
+func (ca *Cache) set(e *entry) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if elem, ok := ca.entries[e.key]; ok {
+		ca.remove(elem)
+	}
+	ca.entries[e.key] = ca.lru.PushFront(e)
+	ca.size += e.size()
+
+	for ca.size > ca.opts.MaxSize {
+		ca.remove(ca.lru.Back())
+	}
+	cacheSizeBytes.Set(float64(ca.size))
+	cacheEntries.Set(float64(len(ca.entries)))
+}
+
+func (ca *Cache) remove(elem *list.Element) {
+	e := ca.lru.Remove(elem).(*entry)
+	delete(ca.entries, e.key)
+	ca.size -= e.size()
+	cacheSizeBytes.Set(float64(ca.size))
+	cacheEntries.Set(float64(len(ca.entries)))
+}
+
+func writeEntry(c *gin.Context, e *entry, result string) {
+	for k, v := range e.header {
+		c.Writer.Header()[k] = v
+	}
+	c.Header(CacheHeader, result)
+	c.Header("Age", strconv.Itoa(int(time.Since(e.storedAt).Seconds())))
+	c.Data(e.status, e.header.Get("Content-Type"), e.body)
+	c.Abort()
+}
+
+func cacheControl(value string) (noStore, noCache bool) {
+	for _, directive := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			noStore = true
+		case "no-cache", "max-age=0":
+			noCache = true
+		}
+	}
+	return
+}
+
+// bodyWriter copies the response body up to limit bytes.
+type bodyWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (w *bodyWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *bodyWriter) capture(data []byte) {
+	if w.overflow {
+		return
+	}
+	if int64(w.buf.Len()+len(data)) > w.limit {
+		w.overflow = true
+		w.buf.Reset()
+		return
+	}
+	w.buf.Write(data)
+}
@@ -0,0 +1,279 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testUpstream counts the requests reaching the proxied cluster, it replies status and body
+// after release is closed when it is not nil.
+type testUpstream struct {
+	requests atomic.Int32
+	entered  chan struct{}
+	release  chan struct{}
+	status   int
+	body     string
+}
+
+func testRouter(ca *Cache, upstream *testUpstream) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	identity := func(c *gin.Context) string {
+		return c.GetHeader("X-Test-User")
+	}
+	r.GET("/:clusterCode/*urlPath", ca.Middleware(identity), func(c *gin.Context) {
+		upstream.requests.Add(1)
+		if upstream.entered != nil {
+			upstream.entered <- struct{}{}
+		}
+		if upstream.release != nil {
+			<-upstream.release
+		}
+		c.Data(upstream.status, "application/json", []byte(upstream.body))
+	})
+	return r
+}
+
+type testRequest struct {
+	path   string
+	header map[string]string
+	// wantCache is the X-Hcnmp-Cache header of the response
+	wantCache string
+}
+
+func serve(r http.Handler, req testRequest) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	httpReq := httptest.NewRequest(http.MethodGet, req.path, nil)
+	for k, v := range req.header {
+		httpReq.Header.Set(k, v)
+	}
+	r.ServeHTTP(w, httpReq)
+	return w
+}
+
+func TestCacheMiddleware(t *testing.T) {
+	pods := "/dev/api/v1/namespaces/default/pods"
+	opts := Options{
+		TTL:          time.Minute,
+		ResourceTTLs: map[string]time.Duration{"events": 0, "pods/log": time.Minute},
+		MaxSize:      1 << 20,
+	}
+
+	tests := []struct {
+		name          string
+		opts          Options
+		status        int
+		body          string
+		requests      []testRequest
+		wantUpstreams int32
+	}{
+		{
+			name: "second request is a hit",
+			requests: []testRequest{
+				{path: pods, wantCache: "MISS"},
+				{path: pods, wantCache: "HIT"},
+			},
+			wantUpstreams: 1,
+		},
+		{
+			name: "different query is a miss",
+			requests: []testRequest{
+				{path: pods, wantCache: "MISS"},
+				{path: pods + "?labelSelector=app%3Dweb", wantCache: "MISS"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "different identity is a miss",
+			requests: []testRequest{
+				{path: pods, header: map[string]string{"X-Test-User": "alice"}, wantCache: "MISS"},
+				{path: pods, header: map[string]string{"X-Test-User": "bob"}, wantCache: "MISS"},
+				{path: pods, header: map[string]string{"X-Test-User": "alice"}, wantCache: "HIT"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "no-cache refreshes the entry",
+			requests: []testRequest{
+				{path: pods, wantCache: "MISS"},
+				{path: pods, header: map[string]string{"Cache-Control": "no-cache"}, wantCache: "MISS"},
+				{path: pods, header: map[string]string{"Cache-Control": "max-age=0"}, wantCache: "MISS"},
+				{path: pods, wantCache: "HIT"},
+			},
+			wantUpstreams: 3,
+		},
+		{
+			name: "no-store bypasses the cache",
+			requests: []testRequest{
+				{path: pods, header: map[string]string{"Cache-Control": "no-store"}},
+				{path: pods, wantCache: "MISS"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "watches are not cached",
+			requests: []testRequest{
+				{path: pods + "?watch=true"},
+				{path: pods + "?watch=true"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "followed logs are not cached",
+			requests: []testRequest{
+				{path: pods + "/web/log?follow=true"},
+				{path: pods + "/web/log?follow=true"},
+				{path: pods + "/web/log", wantCache: "MISS"},
+				{path: pods + "/web/log", wantCache: "HIT"},
+			},
+			wantUpstreams: 3,
+		},
+		{
+			name: "resource ttl 0 disables the cache",
+			requests: []testRequest{
+				{path: "/dev/api/v1/namespaces/default/events"},
+				{path: "/dev/api/v1/namespaces/default/events"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name:   "errors are not cached",
+			status: http.StatusInternalServerError,
+			requests: []testRequest{
+				{path: pods, wantCache: "MISS"},
+				{path: pods, wantCache: "MISS"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "responses over an eighth of the max size are not cached",
+			opts: Options{TTL: time.Minute, MaxSize: 64},
+			body: strings.Repeat("x", 9),
+			requests: []testRequest{
+				{path: pods, wantCache: "MISS"},
+				{path: pods, wantCache: "MISS"},
+			},
+			wantUpstreams: 2,
+		},
+		{
+			name: "disabled cache",
+			opts: Options{MaxSize: 1 << 20},
+			requests: []testRequest{
+				{path: pods},
+				{path: pods},
+			},
+			wantUpstreams: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.opts.MaxSize == 0 {
+				tt.opts = opts
+			}
+			if tt.status == 0 {
+				tt.status = http.StatusOK
+			}
+			if len(tt.body) == 0 {
+				tt.body = `{"kind":"PodList"}`
+			}
+			upstream := &testUpstream{status: tt.status, body: tt.body}
+			r := testRouter(New(tt.opts), upstream)
+
+			for i, req := range tt.requests {
+				w := serve(r, req)
+				if w.Code != tt.status {
+					t.Errorf("request %v: status = %v, want %v", i, w.Code, tt.status)
+				}
+				if w.Body.String() != tt.body {
+					t.Errorf("request %v: body = %q, want %q", i, w.Body.String(), tt.body)
+				}
+				if got := w.Header().Get(CacheHeader); got != req.wantCache {
+					t.Errorf("request %v: %v = %q, want %q", i, CacheHeader, got, req.wantCache)
+				}
+			}
+			if got := upstream.requests.Load(); got != tt.wantUpstreams {
+				t.Errorf("upstream requests = %v, want %v", got, tt.wantUpstreams)
+			}
+		})
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	pods := "/dev/api/v1/namespaces/default/pods"
+
+	tests := []struct {
+		name          string
+		status        int
+		wantUpstreams int32
+	}{
+		// the followers wait for the leader and share its response
+		{name: "shared response", status: http.StatusOK, wantUpstreams: 1},
+		// the followers send their own requests when the response of the leader can not be shared
+		{name: "unshareable response", status: http.StatusServiceUnavailable, wantUpstreams: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &testUpstream{
+				status:  tt.status,
+				body:    `{"kind":"PodList"}`,
+				entered: make(chan struct{}, 5),
+				release: make(chan struct{}),
+			}
+			r := testRouter(New(Options{TTL: time.Minute, MaxSize: 1 << 20}), upstream)
+
+			codes := make([]int, 5)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes[0] = serve(r, testRequest{path: pods}).Code
+			}()
+			// the leader is in flight
+			<-upstream.entered
+
+			for i := 1; i < len(codes); i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					codes[i] = serve(r, testRequest{path: pods}).Code
+				}(i)
+			}
+			close(upstream.release)
+			wg.Wait()
+
+			for i, code := range codes {
+				if code != tt.status {
+					t.Errorf("request %v: status = %v, want %v", i, code, tt.status)
+				}
+			}
+			if got := upstream.requests.Load(); got != tt.wantUpstreams {
+				t.Errorf("upstream requests = %v, want %v", got, tt.wantUpstreams)
+			}
+		})
+	}
+}
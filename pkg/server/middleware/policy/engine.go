@@ -0,0 +1,241 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+	"github.com/helen-frank/hcnmp/pkg/zone/proxy"
+)
+
+const (
+	// PolicyKey is the key of the ConfigMap data holding the Policy in yaml or json.
+	PolicyKey = "policy.yaml"
+
+	// syncTimeout bounds how long requests wait for the Policy to be loaded
+	syncTimeout = 10 * time.Second
+)
+
+// Engine evaluates the Policy loaded from a ConfigMap, it is reloaded whenever the ConfigMap changes.
+// Requests wait until the ConfigMap is synced, everything is allowed while it does not exist.
+type Engine struct {
+	namespace string
+	name      string
+	policy    atomic.Pointer[Policy]
+	// synced is closed once the ConfigMap is synced
+	synced chan struct{}
+}
+
+// NewEngine creates an Engine of the ConfigMap namespace/name, an empty name disables the policy.
+func NewEngine(namespace, name string) *Engine {
+	e := &Engine{
+		namespace: namespace,
+		name:      name,
+		synced:    make(chan struct{}),
+	}
+	e.policy.Store(&Policy{})
+	if len(name) == 0 {
+		close(e.synced)
+	}
+	return e
+}
+
+// Run watches the ConfigMap and reloads the Policy until ctx is done.
+func (e *Engine) Run(ctx context.Context, client clientset.Interface) {
+	if len(e.name) == 0 {
+		return
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(e.namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", e.name).String()
+		}))
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			e.load(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			e.load(obj)
+		},
+		DeleteFunc: func(_ interface{}) {
+			klog.Warningf("proxy policy %v/%v deleted, allow all", e.namespace, e.name)
+			e.policy.Store(&Policy{})
+		},
+	}); err != nil {
+		klog.Errorf("failed to watch proxy policy: %v", err)
+		return
+	}
+
+	factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		if len(informer.GetStore().List()) == 0 {
+			klog.Warningf("proxy policy %v/%v not found, allow all until it is created", e.namespace, e.name)
+		}
+		close(e.synced)
+	}
+	<-ctx.Done()
+	factory.Shutdown()
+}
+
+// waitForSync waits until the Policy is loaded, requests are not authorized by a Policy not loaded yet.
+func (e *Engine) waitForSync(ctx context.Context) error {
+	select {
+	case <-e.synced:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(syncTimeout)
+	defer timer.Stop()
+	select {
+	case <-e.synced:
+		return nil
+	case <-ctx.Done():
+		return apierrors.NewServiceUnavailable("hcnmp proxy policy is not loaded yet")
+	case <-timer.C:
+		return apierrors.NewServiceUnavailable("hcnmp proxy policy is not loaded yet")
+	}
+}
+
+func (e *Engine) load(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	p := &Policy{}
+	if err := yaml.Unmarshal([]byte(cm.Data[PolicyKey]), p); err != nil {
+		klog.Errorf("failed to parse proxy policy %v/%v, keep the previous one: %v", e.namespace, e.name, err)
+		return
+	}
+	if err := p.Validate(); err != nil {
+		klog.Errorf("invalid proxy policy %v/%v, keep the previous one: %v", e.namespace, e.name, err)
+		return
+	}
+
+	klog.Infof("proxy policy %v/%v loaded, %v rules", e.namespace, e.name, len(p.Rules))
+	e.policy.Store(p)
+}
+
+// Authorize evaluates the request of the authenticated hcnmp user to cluster,
+// it returns a Forbidden error when the request is denied, or ServiceUnavailable before the Policy is loaded.
+func (e *Engine) Authorize(c *gin.Context, cluster string, info *RequestInfo) error {
+	if err := e.waitForSync(c.Request.Context()); err != nil {
+		return err
+	}
+
+	user := auth.User(c)
+	groups := []string{}
+	if impersonation := proxy.GetClusterImpersonation(cluster); impersonation != nil {
+		groups = impersonation.GroupsFor(user)
+	}
+
+	allowed, rule := e.policy.Load().Evaluate(&Attributes{
+		Cluster:     cluster,
+		User:        user,
+		Groups:      groups,
+		RequestInfo: info,
+	})
+	if allowed {
+		return nil
+	}
+
+	reason := "denied by hcnmp proxy policy"
+	if rule != nil && len(rule.Name) != 0 {
+		reason = fmt.Sprintf("denied by hcnmp proxy policy rule %q", rule.Name)
+	}
+
+	if !info.IsResourceRequest {
+		return apierrors.NewForbidden(schema.GroupResource{}, info.Path, fmt.Errorf("%v", reason))
+	}
+
+	resource := info.Resource
+	if len(info.Subresource) != 0 {
+		resource += "/" + info.Subresource
+	}
+	return apierrors.NewForbidden(schema.GroupResource{Group: info.APIGroup, Resource: resource}, info.Name,
+		fmt.Errorf("user %q cannot %v in cluster %v: %v", user, info.Verb, cluster, reason))
+}
+
+// AuthorizeCluster returns a Forbidden error when the Policy denies every resource request of the
+// authenticated hcnmp user to cluster, e.g. to leave the cluster out of the kubeconfig of the user.
+func (e *Engine) AuthorizeCluster(c *gin.Context, cluster string) error {
+	if err := e.waitForSync(c.Request.Context()); err != nil {
+		return err
+	}
+
+	user := auth.User(c)
+	groups := []string{}
+	if impersonation := proxy.GetClusterImpersonation(cluster); impersonation != nil {
+		groups = impersonation.GroupsFor(user)
+	}
+	if e.policy.Load().AllowsCluster(&Attributes{Cluster: cluster, User: user, Groups: groups}) {
+		return nil
+	}
+	return apierrors.NewForbidden(schema.GroupResource{}, cluster,
+		fmt.Errorf("user %q cannot access cluster %v: denied by hcnmp proxy policy", user, cluster))
+}
+
+// Middleware authorizes the proxied request of the route with :clusterCode and *urlPath,
+// the urlPath param is replaced by the cleaned path so that the authorized path is forwarded.
+func (e *Engine) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		urlPath, err := CleanPath(c.Param("urlPath"))
+		if err != nil {
+			abort(c, apierrors.NewBadRequest(err.Error()))
+			return
+		}
+		for i := range c.Params {
+			if c.Params[i].Key == "urlPath" {
+				c.Params[i].Value = urlPath
+			}
+		}
+
+		info := NewRequestInfo(c.Request.Method, urlPath, c.Request.URL.Query())
+		if err := e.Authorize(c, c.Param("clusterCode"), info); err != nil {
+			abort(c, err.(*apierrors.StatusError))
+			return
+		}
+		c.Next()
+	}
+}
+
+func abort(c *gin.Context, err *apierrors.StatusError) {
+	status := err.ErrStatus
+	status.APIVersion = "v1"
+	status.Kind = "Status"
+	c.AbortWithStatusJSON(int(status.Code), status)
+}
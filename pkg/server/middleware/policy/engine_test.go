@@ -0,0 +1,96 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+func testContext(ctx context.Context, method, urlPath string) (*gin.Context, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/clusters/test"+urlPath, nil).WithContext(ctx)
+	c.Params = gin.Params{{Key: "clusterCode", Value: "test"}, {Key: "urlPath", Value: urlPath}}
+	return c, w
+}
+
+func TestEngineWaitsForSync(t *testing.T) {
+	e := NewEngine("hcnmp-system", "hcnmp-proxy-policy")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c, _ := testContext(ctx, http.MethodGet, "/api/v1/pods")
+	if err := e.Authorize(c, "test", NewRequestInfo(http.MethodGet, "/api/v1/pods", nil)); !apierrors.IsServiceUnavailable(err) {
+		t.Fatalf("Authorize() before sync = %v, want ServiceUnavailable", err)
+	}
+
+	e.policy.Store(&Policy{Rules: []Rule{{Effect: EffectDeny, Resources: []string{"secrets"}}}})
+	close(e.synced)
+	c, _ = testContext(context.Background(), http.MethodGet, "/api/v1/secrets")
+	if err := e.Authorize(c, "test", NewRequestInfo(http.MethodGet, "/api/v1/secrets", nil)); !apierrors.IsForbidden(err) {
+		t.Errorf("Authorize() after sync = %v, want Forbidden", err)
+	}
+}
+
+func TestEngineDisabled(t *testing.T) {
+	e := NewEngine("hcnmp-system", "")
+	c, _ := testContext(context.Background(), http.MethodGet, "/api/v1/secrets")
+	if err := e.Authorize(c, "test", NewRequestInfo(http.MethodGet, "/api/v1/secrets", nil)); err != nil {
+		t.Errorf("Authorize() = %v, want allowed", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	e := NewEngine("hcnmp-system", "")
+	e.policy.Store(&Policy{Rules: []Rule{{Effect: EffectDeny, Resources: []string{"secrets"}}}})
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantPath string
+	}{
+		{name: "allowed", path: "/api/v1/pods/", wantCode: http.StatusOK, wantPath: "/api/v1/pods"},
+		{name: "denied", path: "/api/v1/namespaces/default/secrets", wantCode: http.StatusForbidden},
+		{name: "empty segment", path: "/api/v1/namespaces/default//secrets", wantCode: http.StatusBadRequest},
+		{name: "dot dot segment", path: "/api/v1/namespaces/default/pods/../secrets", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, w := testContext(context.Background(), http.MethodGet, tt.path)
+			e.Middleware()(c)
+
+			code := http.StatusOK
+			if c.IsAborted() {
+				code = w.Code
+			}
+			if code != tt.wantCode {
+				t.Fatalf("status = %v, want %v", code, tt.wantCode)
+			}
+			if len(tt.wantPath) != 0 && c.Param("urlPath") != tt.wantPath {
+				t.Errorf("urlPath = %q, want %q", c.Param("urlPath"), tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	EffectAllow = "Allow"
+	EffectDeny  = "Deny"
+)
+
+// Policy decides whether a request may be forwarded to a member cluster.
+// Rules are evaluated in order and the first matching rule decides, DefaultEffect applies when no rule matches.
+type Policy struct {
+	DefaultEffect string `json:"defaultEffect,omitempty"`
+	Rules         []Rule `json:"rules,omitempty"`
+}
+
+// Rule matches a request when all of its non-empty fields match, "*" matches everything.
+type Rule struct {
+	Name   string `json:"name,omitempty"`
+	Effect string `json:"effect"`
+	// Clusters are glob patterns of cluster codes, e.g. "prod-*"
+	Clusters []string `json:"clusters,omitempty"`
+	Users    []string `json:"users,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// Verbs are kubernetes verbs, e.g. get, list, watch, create, delete
+	Verbs     []string `json:"verbs,omitempty"`
+	APIGroups []string `json:"apiGroups,omitempty"`
+	// Resources are resources with optional subresource, e.g. "secrets", "pods/exec", "pods/*"
+	Resources []string `json:"resources,omitempty"`
+	// Namespaces and Names are glob patterns
+	Namespaces []string `json:"namespaces,omitempty"`
+	Names      []string `json:"names,omitempty"`
+	// NonResourceURLs are glob patterns of non resource paths, e.g. "/version", "/openapi/*",
+	// a rule with NonResourceURLs only matches non resource requests and the other way round.
+	NonResourceURLs []string `json:"nonResourceURLs,omitempty"`
+}
+
+// Attributes are what a Policy is evaluated against.
+type Attributes struct {
+	Cluster string
+	User    string
+	Groups  []string
+	*RequestInfo
+}
+
+// Validate checks the Policy.
+func (p *Policy) Validate() error {
+	switch p.DefaultEffect {
+	case "", EffectAllow, EffectDeny:
+	default:
+		return fmt.Errorf("unsupported defaultEffect %q", p.DefaultEffect)
+	}
+
+	for i := range p.Rules {
+		switch p.Rules[i].Effect {
+		case EffectAllow, EffectDeny:
+		default:
+			return fmt.Errorf("rule %v: unsupported effect %q", i, p.Rules[i].Effect)
+		}
+
+		for _, patterns := range [][]string{p.Rules[i].Clusters, p.Rules[i].Namespaces, p.Rules[i].Names, p.Rules[i].NonResourceURLs} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("rule %v: bad pattern %q: %v", i, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate returns whether a is allowed, and the rule that decided it, nil for DefaultEffect.
+func (p *Policy) Evaluate(a *Attributes) (bool, *Rule) {
+	for i := range p.Rules {
+		if p.Rules[i].matches(a) {
+			return p.Rules[i].Effect == EffectAllow, &p.Rules[i]
+		}
+	}
+	return p.DefaultEffect != EffectDeny, nil
+}
+
+// AllowsCluster reports whether some resource request of a to a.Cluster may be allowed, the RequestInfo of a is ignored.
+// It is false when a rule denying every resource request of the cluster matches before any allowing rule.
+func (p *Policy) AllowsCluster(a *Attributes) bool {
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !matchGlob(r.Clusters, a.Cluster) || !matchExact(r.Users, a.User) || !matchAny(r.Groups, a.Groups) {
+			continue
+		}
+		if r.Effect == EffectAllow {
+			return true
+		}
+		if r.coversResources() {
+			return false
+		}
+	}
+	return p.DefaultEffect != EffectDeny
+}
+
+// coversResources reports whether the rule matches every resource request of its clusters, users and groups.
+func (r *Rule) coversResources() bool {
+	all := func(rules []string) bool {
+		return len(rules) == 0 || matchExact(rules, "*")
+	}
+	return len(r.NonResourceURLs) == 0 && all(r.Verbs) && all(r.APIGroups) && all(r.Resources) && all(r.Namespaces) && all(r.Names)
+}
+
+func (r *Rule) matches(a *Attributes) bool {
+	if !matchGlob(r.Clusters, a.Cluster) ||
+		!matchExact(r.Users, a.User) ||
+		!matchAny(r.Groups, a.Groups) ||
+		!matchExact(r.Verbs, a.Verb) {
+		return false
+	}
+
+	if !a.IsResourceRequest {
+		return len(r.NonResourceURLs) != 0 && matchGlob(r.NonResourceURLs, a.Path)
+	}
+
+	return len(r.NonResourceURLs) == 0 &&
+		matchExact(r.APIGroups, a.APIGroup) &&
+		matchResource(r.Resources, a.Resource, a.Subresource) &&
+		matchGlob(r.Namespaces, a.Namespace) &&
+		matchGlob(r.Names, a.Name)
+}
+
+func matchExact(rules []string, value string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if rule == "*" || rule == value {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(rules []string, values []string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for i := range values {
+		if matchExact(rules, values[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(rules []string, value string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule, value); matched || rule == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchResource follows the resource matching of RBAC:
+// "pods" matches pods only, "pods/*" any subresource of pods, "*/scale" the scale subresource of any resource.
+func matchResource(rules []string, resource, subresource string) bool {
+	if len(rules) == 0 {
+		return true
+	}
+
+	combined := resource
+	if len(subresource) != 0 {
+		combined += "/" + subresource
+	}
+	for _, rule := range rules {
+		switch {
+		case rule == "*" || rule == combined:
+			return true
+		case len(subresource) != 0 && rule == resource+"/*":
+			return true
+		case strings.HasPrefix(rule, "*/") && rule[2:] == subresource:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	p := &Policy{
+		DefaultEffect: EffectAllow,
+		Rules: []Rule{
+			{Name: "readonly-prod", Effect: EffectDeny, Clusters: []string{"prod-*"}, Users: []string{"dev"},
+				Verbs: []string{"create", "update", "patch", "delete", "deletecollection"}},
+			{Name: "no-secrets", Effect: EffectDeny, Resources: []string{"secrets"}, Groups: []string{"hcnmp:users"}},
+			{Name: "no-exec", Effect: EffectDeny, Resources: []string{"pods/exec", "pods/attach"}, Namespaces: []string{"kube-*"}},
+			{Name: "no-scale", Effect: EffectDeny, APIGroups: []string{"apps"}, Resources: []string{"*/scale"}, Names: []string{"db-*"}},
+			{Name: "no-metrics", Effect: EffectDeny, NonResourceURLs: []string{"/metrics", "/debug/*"}},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cluster  string
+		user     string
+		groups   []string
+		method   string
+		path     string
+		want     bool
+		wantRule string
+	}{
+		{name: "default", cluster: "dev-1", user: "dev", method: http.MethodDelete, path: "/api/v1/namespaces/default/pods/nginx", want: true},
+		{name: "write prod", cluster: "prod-1", user: "dev", method: http.MethodDelete, path: "/api/v1/namespaces/default/pods/nginx", wantRule: "readonly-prod"},
+		{name: "read prod", cluster: "prod-1", user: "dev", method: http.MethodGet, path: "/api/v1/namespaces/default/pods/nginx", want: true},
+		{name: "write prod as other user", cluster: "prod-1", user: "ops", method: http.MethodPost, path: "/api/v1/namespaces/default/pods", want: true},
+		{name: "secrets of group", user: "dev", groups: []string{"hcnmp:users"}, method: http.MethodGet, path: "/api/v1/namespaces/default/secrets", wantRule: "no-secrets"},
+		{name: "secrets of other group", user: "dev", groups: []string{"hcnmp:admins"}, method: http.MethodGet, path: "/api/v1/namespaces/default/secrets", want: true},
+		{name: "exec in kube-system", method: http.MethodPost, path: "/api/v1/namespaces/kube-system/pods/coredns/exec", wantRule: "no-exec"},
+		{name: "exec in default", method: http.MethodPost, path: "/api/v1/namespaces/default/pods/nginx/exec", want: true},
+		{name: "pods in kube-system", method: http.MethodGet, path: "/api/v1/namespaces/kube-system/pods/coredns", want: true},
+		{name: "scale db", method: http.MethodPut, path: "/apis/apps/v1/namespaces/default/statefulsets/db-0/scale", wantRule: "no-scale"},
+		{name: "scale web", method: http.MethodPut, path: "/apis/apps/v1/namespaces/default/deployments/web/scale", want: true},
+		{name: "non resource", method: http.MethodGet, path: "/debug/pprof", wantRule: "no-metrics"},
+		{name: "resource is not non resource", method: http.MethodGet, path: "/api/v1/namespaces/default/configmaps/metrics", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, rule := p.Evaluate(&Attributes{
+				Cluster:     tt.cluster,
+				User:        tt.user,
+				Groups:      tt.groups,
+				RequestInfo: NewRequestInfo(tt.method, tt.path, nil),
+			})
+			if allowed != tt.want {
+				t.Errorf("allowed = %v, want %v", allowed, tt.want)
+			}
+			name := ""
+			if rule != nil {
+				name = rule.Name
+			}
+			if name != tt.wantRule {
+				t.Errorf("rule = %q, want %q", name, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	p := &Policy{
+		DefaultEffect: EffectDeny,
+		Rules:         []Rule{{Name: "read", Effect: EffectAllow, Verbs: []string{"get", "list", "watch"}}},
+	}
+
+	if allowed, _ := p.Evaluate(&Attributes{RequestInfo: NewRequestInfo(http.MethodGet, "/api/v1/pods", nil)}); !allowed {
+		t.Error("list is denied, want allowed by rule read")
+	}
+	if allowed, rule := p.Evaluate(&Attributes{RequestInfo: NewRequestInfo(http.MethodPost, "/api/v1/namespaces/default/pods", nil)}); allowed || rule != nil {
+		t.Errorf("create = %v by %v, want denied by default", allowed, rule)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{name: "empty", policy: Policy{}},
+		{name: "bad default", policy: Policy{DefaultEffect: "deny"}, wantErr: true},
+		{name: "bad effect", policy: Policy{Rules: []Rule{{Effect: "Maybe"}}}, wantErr: true},
+		{name: "bad pattern", policy: Policy{Rules: []Rule{{Effect: EffectDeny, Clusters: []string{"prod-["}}}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyAllowsCluster(t *testing.T) {
+	rules := []Rule{
+		{Name: "readonly-prod", Effect: EffectDeny, Clusters: []string{"prod-*"}, Users: []string{"dev"},
+			Verbs: []string{"create", "update", "patch", "delete"}},
+		{Name: "no-secure", Effect: EffectDeny, Clusters: []string{"secure-*"}, Groups: []string{"hcnmp:users"}},
+		{Name: "all-verbs", Effect: EffectDeny, Clusters: []string{"vault"}, Verbs: []string{"*"}},
+		{Name: "ops-staging", Effect: EffectAllow, Clusters: []string{"staging"}, Users: []string{"ops"}},
+		{Name: "no-metrics", Effect: EffectDeny, Clusters: []string{"staging"}, NonResourceURLs: []string{"/metrics"}},
+	}
+
+	tests := []struct {
+		name          string
+		defaultEffect string
+		cluster       string
+		user          string
+		groups        []string
+		want          bool
+	}{
+		{name: "no rule", cluster: "dev-1", user: "dev", want: true},
+		{name: "partially denied", cluster: "prod-1", user: "dev", want: true},
+		{name: "denied for group", cluster: "secure-1", user: "dev", groups: []string{"hcnmp:users"}},
+		{name: "other group", cluster: "secure-1", user: "dev", groups: []string{"hcnmp:admins"}, want: true},
+		{name: "wildcard verbs", cluster: "vault", user: "ops"},
+		{name: "non resource only", cluster: "staging", user: "dev", want: true},
+		{name: "default deny", defaultEffect: EffectDeny, cluster: "dev-1", user: "dev"},
+		{name: "default deny allowed by rule", defaultEffect: EffectDeny, cluster: "staging", user: "ops", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Policy{DefaultEffect: tt.defaultEffect, Rules: rules}
+			if got := p.AllowsCluster(&Attributes{Cluster: tt.cluster, User: tt.user, Groups: tt.groups}); got != tt.want {
+				t.Errorf("AllowsCluster() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// RequestInfo is the kubernetes attributes of a proxied request,
+// it is a simplified version of the RequestInfo of k8s.io/apiserver.
+type RequestInfo struct {
+	IsResourceRequest bool
+	Path              string
+	Verb              string
+	APIGroup          string
+	APIVersion        string
+	Namespace         string
+	Resource          string
+	Subresource       string
+	Name              string
+}
+
+// namespaceSubresources are the subresources of namespace, e.g. /api/v1/namespaces/{name}/status
+var namespaceSubresources = map[string]struct{}{
+	"status":   {},
+	"finalize": {},
+}
+
+// CleanPath validates the urlPath of a proxied request and returns it cleaned, the same path must be
+// authorized and forwarded. Empty, . and .. segments are rejected, the kube-apiserver would resolve them
+// to another resource than the policy sees.
+func CleanPath(urlPath string) (string, error) {
+	if !strings.HasPrefix(urlPath, "/") {
+		return "", fmt.Errorf("path %q must be absolute", urlPath)
+	}
+	segments := strings.Split(strings.TrimSuffix(urlPath[1:], "/"), "/")
+	for i, segment := range segments {
+		switch segment {
+		case "":
+			// only the root path has no segment
+			if len(segments) != 1 {
+				return "", fmt.Errorf("path %q has an empty segment", urlPath)
+			}
+		case ".", "..":
+			return "", fmt.Errorf("path %q has a %q segment", urlPath, segments[i])
+		}
+	}
+	return path.Clean(urlPath), nil
+}
+
+// NewRequestInfo parses the kube-apiserver urlPath and query of a request with method,
+// urlPath must be cleaned by CleanPath.
+func NewRequestInfo(method, urlPath string, query url.Values) *RequestInfo {
+	info := &RequestInfo{
+		Path: urlPath,
+		Verb: strings.ToLower(method),
+	}
+
+	parts := splitPath(urlPath)
+	if len(parts) < 1 || (parts[0] != "api" && parts[0] != "apis") {
+		return info
+	}
+	prefix := parts[0]
+	parts = parts[1:]
+
+	if prefix == "apis" {
+		// /apis and /apis/{group} are discovery
+		if len(parts) < 2 {
+			return info
+		}
+		info.APIGroup = parts[0]
+		parts = parts[1:]
+	}
+
+	// /api and /api/{version} are discovery
+	if len(parts) < 2 {
+		return info
+	}
+	info.APIVersion = parts[0]
+	parts = parts[1:]
+	info.IsResourceRequest = true
+
+	switch method {
+	case http.MethodPost:
+		info.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		info.Verb = "get"
+	case http.MethodPut:
+		info.Verb = "update"
+	case http.MethodPatch:
+		info.Verb = "patch"
+	case http.MethodDelete:
+		info.Verb = "delete"
+	}
+
+	// deprecated watch path, e.g. /api/v1/watch/pods
+	if parts[0] == "watch" {
+		info.Verb = "watch"
+		parts = parts[1:]
+		if len(parts) == 0 {
+			return info
+		}
+	}
+
+	if parts[0] == "namespaces" {
+		if len(parts) > 1 {
+			info.Namespace = parts[1]
+			// a resource in the namespace, not the namespace itself
+			if _, ok := namespaceSubresources[valueAt(parts, 2)]; len(parts) > 2 && !ok {
+				parts = parts[2:]
+			}
+		}
+	}
+
+	switch {
+	case len(parts) >= 3:
+		info.Subresource = parts[2]
+		fallthrough
+	case len(parts) >= 2:
+		info.Name = parts[1]
+		fallthrough
+	case len(parts) >= 1:
+		info.Resource = parts[0]
+	}
+
+	// the namespace of a namespace is itself
+	if info.Resource == "namespaces" {
+		info.Namespace = info.Name
+	}
+
+	if len(info.Name) == 0 {
+		switch info.Verb {
+		case "get":
+			info.Verb = "list"
+		case "delete":
+			info.Verb = "deletecollection"
+		}
+	}
+
+	if (info.Verb == "list" || info.Verb == "get") && isWatch(query) {
+		info.Verb = "watch"
+	}
+	return info
+}
+
+func isWatch(query url.Values) bool {
+	switch strings.ToLower(query.Get("watch")) {
+	case "1", "true":
+		return true
+	}
+	return false
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if len(p) == 0 {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+func valueAt(parts []string, i int) string {
+	if i < len(parts) {
+		return parts[i]
+	}
+	return ""
+}
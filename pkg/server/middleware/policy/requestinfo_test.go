@@ -0,0 +1,158 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/", want: "/"},
+		{path: "/api/v1/pods", want: "/api/v1/pods"},
+		{path: "/api/v1/pods/", want: "/api/v1/pods"},
+		{path: "/apis/apps/v1/namespaces/default/deployments/nginx/scale", want: "/apis/apps/v1/namespaces/default/deployments/nginx/scale"},
+		{path: "", wantErr: true},
+		{path: "api/v1/pods", wantErr: true},
+		{path: "//api/v1/secrets", wantErr: true},
+		{path: "/api//v1/secrets", wantErr: true},
+		{path: "/api/v1/namespaces//secrets", wantErr: true},
+		{path: "/api/v1/./secrets", wantErr: true},
+		{path: "/api/v1/pods/../secrets", wantErr: true},
+		{path: "/api/v1/namespaces/default/pods/..", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := CleanPath(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CleanPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRequestInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		query  url.Values
+		want   RequestInfo
+	}{
+		{
+			name:   "non resource",
+			method: http.MethodGet,
+			path:   "/version",
+			want:   RequestInfo{Path: "/version", Verb: "get"},
+		},
+		{
+			name:   "discovery of core",
+			method: http.MethodGet,
+			path:   "/api/v1",
+			want:   RequestInfo{Path: "/api/v1", Verb: "get"},
+		},
+		{
+			name:   "discovery of group",
+			method: http.MethodGet,
+			path:   "/apis/apps",
+			want:   RequestInfo{Path: "/apis/apps", Verb: "get"},
+		},
+		{
+			name:   "list cluster scoped",
+			method: http.MethodGet,
+			path:   "/api/v1/nodes",
+			want:   RequestInfo{IsResourceRequest: true, Path: "/api/v1/nodes", Verb: "list", APIVersion: "v1", Resource: "nodes"},
+		},
+		{
+			name:   "get namespaced",
+			method: http.MethodGet,
+			path:   "/api/v1/namespaces/default/secrets/token",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/namespaces/default/secrets/token", Verb: "get",
+				APIVersion: "v1", Namespace: "default", Resource: "secrets", Name: "token"},
+		},
+		{
+			name:   "watch by query",
+			method: http.MethodGet,
+			path:   "/apis/apps/v1/namespaces/default/deployments",
+			query:  url.Values{"watch": {"true"}},
+			want: RequestInfo{IsResourceRequest: true, Path: "/apis/apps/v1/namespaces/default/deployments", Verb: "watch",
+				APIGroup: "apps", APIVersion: "v1", Namespace: "default", Resource: "deployments"},
+		},
+		{
+			name:   "deprecated watch path",
+			method: http.MethodGet,
+			path:   "/api/v1/watch/namespaces/default/pods",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/watch/namespaces/default/pods", Verb: "watch",
+				APIVersion: "v1", Namespace: "default", Resource: "pods"},
+		},
+		{
+			name:   "subresource",
+			method: http.MethodPost,
+			path:   "/api/v1/namespaces/default/pods/nginx/exec",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/namespaces/default/pods/nginx/exec", Verb: "create",
+				APIVersion: "v1", Namespace: "default", Resource: "pods", Name: "nginx", Subresource: "exec"},
+		},
+		{
+			name:   "namespace",
+			method: http.MethodDelete,
+			path:   "/api/v1/namespaces/test",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/namespaces/test", Verb: "delete",
+				APIVersion: "v1", Namespace: "test", Resource: "namespaces", Name: "test"},
+		},
+		{
+			name:   "namespace subresource",
+			method: http.MethodPut,
+			path:   "/api/v1/namespaces/test/finalize",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/namespaces/test/finalize", Verb: "update",
+				APIVersion: "v1", Namespace: "test", Resource: "namespaces", Name: "test", Subresource: "finalize"},
+		},
+		{
+			name:   "delete collection",
+			method: http.MethodDelete,
+			path:   "/api/v1/namespaces/default/pods",
+			want: RequestInfo{IsResourceRequest: true, Path: "/api/v1/namespaces/default/pods", Verb: "deletecollection",
+				APIVersion: "v1", Namespace: "default", Resource: "pods"},
+		},
+		{
+			name:   "patch",
+			method: http.MethodPatch,
+			path:   "/apis/apps/v1/namespaces/default/deployments/nginx",
+			want: RequestInfo{IsResourceRequest: true, Path: "/apis/apps/v1/namespaces/default/deployments/nginx", Verb: "patch",
+				APIGroup: "apps", APIVersion: "v1", Namespace: "default", Resource: "deployments", Name: "nginx"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewRequestInfo(tt.method, tt.path, tt.query)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("NewRequestInfo(%v, %v) = %+v, want %+v", tt.method, tt.path, *got, tt.want)
+			}
+		})
+	}
+}
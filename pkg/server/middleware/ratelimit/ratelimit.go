@@ -0,0 +1,307 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/zone"
+)
+
+const (
+	scopeUser    = "user"
+	scopeCluster = "cluster"
+
+	reasonRate     = "rate"
+	reasonInFlight = "inflight"
+
+	// idleTimeout is how long the buckets of an idle user or cluster are kept
+	idleTimeout = 10 * time.Minute
+)
+
+var (
+	rejectedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_rate_limit_rejected_total",
+			Help:      "Total number of requests rejected with 429 by route group, scope user or cluster, and reason rate or inflight.",
+		}, []string{"group", "scope", "reason"},
+	)
+
+	inFlightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_rate_limit_inflight_requests",
+			Help:      "Number of in-flight requests counted against the max-in-flight quotas by route group.",
+		}, []string{"group"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(rejectedRequests, inFlightRequests)
+}
+
+// Quota limits the requests of a single user or cluster, a zero field disables that limit.
+type Quota struct {
+	// QPS and Burst configure the token bucket
+	QPS   float64
+	Burst int
+	// MaxInFlight is the max number of concurrent requests, long-running requests such as watch, exec
+	// and followed logs are not counted as they would hold the quota for their whole lifetime.
+	MaxInFlight int
+}
+
+func (q Quota) enabled() bool {
+	return q.QPS > 0 || q.MaxInFlight > 0
+}
+
+// ParseQuota parses a quota of the form qps:burst:maxInFlight, e.g. 20:40:10, a 0 disables that limit.
+func ParseQuota(s string) (Quota, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Quota{}, fmt.Errorf("quota %q must be qps:burst:maxInFlight", s)
+	}
+
+	qps, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || qps < 0 {
+		return Quota{}, fmt.Errorf("invalid qps %q of quota %q", parts[0], s)
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 0 {
+		return Quota{}, fmt.Errorf("invalid burst %q of quota %q", parts[1], s)
+	}
+	maxInFlight, err := strconv.Atoi(parts[2])
+	if err != nil || maxInFlight < 0 {
+		return Quota{}, fmt.Errorf("invalid maxInFlight %q of quota %q", parts[2], s)
+	}
+	return Quota{QPS: qps, Burst: burst, MaxInFlight: maxInFlight}, nil
+}
+
+// Options configures the quotas of a Limiter.
+type Options struct {
+	// User applies to every authenticated hcnmp user per route group
+	User Quota
+	// Groups overrides User for the route groups by name
+	Groups map[string]Quota
+	// Cluster applies to every member cluster of the routes with :clusterCode, it is shared by the route groups
+	Cluster Quota
+}
+
+// userQuota returns the quota of a user in group.
+func (o *Options) userQuota(group string) Quota {
+	if quota, ok := o.Groups[group]; ok {
+		return quota
+	}
+	return o.User
+}
+
+// Limiter enforces the quotas of route groups, requests beyond them get a 429 with Retry-After.
+// Every route group has its own user buckets, while the cluster buckets are shared.
+type Limiter struct {
+	opts Options
+
+	mu sync.Mutex
+	// users are keyed by group/user
+	users    map[string]*bucket
+	clusters map[string]*bucket
+	lastGC   time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	inFlight int
+	lastSeen time.Time
+}
+
+// New creates a Limiter.
+func New(opts Options) *Limiter {
+	return &Limiter{
+		opts:     opts,
+		users:    make(map[string]*bucket),
+		clusters: make(map[string]*bucket),
+		lastGC:   time.Now(),
+	}
+}
+
+// Middleware limits the requests of the route group by user and by cluster.
+func (l *Limiter) Middleware(group string) gin.HandlerFunc {
+	userQuota := l.opts.userQuota(group)
+	if !userQuota.enabled() && !l.opts.Cluster.enabled() {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+
+	return func(c *gin.Context) {
+		user := auth.User(c)
+		cluster := c.Param("clusterCode")
+		longRunning := isLongRunning(c)
+
+		release, retryAfter, scope, reason := l.admit(group, userQuota, user, cluster, longRunning)
+		if release == nil {
+			rejectedRequests.WithLabelValues(group, scope, reason).Inc()
+			message := fmt.Sprintf("too many requests of %v %q, please retry after %v seconds", scope, user, retryAfter)
+			if scope == scopeCluster {
+				message = fmt.Sprintf("too many requests to cluster %v, please retry after %v seconds", cluster, retryAfter)
+			}
+			status := apierrors.NewTooManyRequests(message, retryAfter).ErrStatus
+			status.APIVersion = "v1"
+			status.Kind = "Status"
+			c.Header("Retry-After", fmt.Sprint(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, status)
+			return
+		}
+		defer release()
+
+		c.Next()
+	}
+}
+
+// admit takes a token and an in-flight slot of the user in group and of the cluster,
+// release is nil when the request is rejected, with the seconds to retry after.
+func (l *Limiter) admit(group string, userQuota Quota, user, cluster string, longRunning bool) (release func(), retryAfter int, scope, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.gc(now)
+
+	type check struct {
+		scope string
+		quota Quota
+		b     *bucket
+	}
+	checks := make([]check, 0, 2)
+	if userQuota.enabled() {
+		checks = append(checks, check{scopeUser, userQuota, l.bucket(l.users, group+"/"+user, userQuota, now)})
+	}
+	if l.opts.Cluster.enabled() && len(cluster) != 0 {
+		checks = append(checks, check{scopeCluster, l.opts.Cluster, l.bucket(l.clusters, cluster, l.opts.Cluster, now)})
+	}
+
+	// check the in-flight quotas first, so that a rejected request does not consume tokens
+	if !longRunning {
+		for _, ch := range checks {
+			if ch.quota.MaxInFlight > 0 && ch.b.inFlight >= ch.quota.MaxInFlight {
+				return nil, 1, ch.scope, reasonInFlight
+			}
+		}
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(checks))
+	for _, ch := range checks {
+		if ch.b.limiter == nil {
+			continue
+		}
+		r := ch.b.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			for _, reserved := range reservations {
+				reserved.CancelAt(now)
+			}
+			return nil, retrySeconds(delay), ch.scope, reasonRate
+		}
+		reservations = append(reservations, r)
+	}
+
+	if longRunning {
+		return func() {}, 0, "", ""
+	}
+
+	for _, ch := range checks {
+		ch.b.inFlight++
+	}
+	inFlightRequests.WithLabelValues(group).Inc()
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, ch := range checks {
+			ch.b.inFlight--
+			ch.b.lastSeen = time.Now()
+		}
+		inFlightRequests.WithLabelValues(group).Dec()
+	}, 0, "", ""
+}
+
+func (l *Limiter) bucket(buckets map[string]*bucket, key string, quota Quota, now time.Time) *bucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{}
+		if quota.QPS > 0 {
+			b.limiter = rate.NewLimiter(rate.Limit(quota.QPS), max(quota.Burst, 1))
+		}
+		buckets[key] = b
+	}
+	b.lastSeen = now
+	return b
+}
+
+// gc removes the buckets of users and clusters idle for idleTimeout, a full bucket equals a new one.
+func (l *Limiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < idleTimeout {
+		return
+	}
+	l.lastGC = now
+
+	for _, buckets := range []map[string]*bucket{l.users, l.clusters} {
+		for key, b := range buckets {
+			if b.inFlight == 0 && now.Sub(b.lastSeen) > idleTimeout {
+				delete(buckets, key)
+			}
+		}
+	}
+}
+
+// isLongRunning reports whether the request is a watch, a followed log, an SSE stream or an upgraded stream.
+func isLongRunning(c *gin.Context) bool {
+	if httpstream.IsUpgradeRequest(c.Request) {
+		return true
+	}
+
+	query := c.Request.URL.Query()
+	if strings.EqualFold(query.Get("follow"), "true") {
+		return true
+	}
+	if query.Get("format") == "sse" || strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		return true
+	}
+	if urlPath := c.Param("urlPath"); len(urlPath) != 0 {
+		return policy.NewRequestInfo(c.Request.Method, urlPath, query).Verb == "watch"
+	}
+	return false
+}
+
+func retrySeconds(delay time.Duration) int {
+	if delay <= 0 || delay == rate.InfDuration {
+		return 1
+	}
+	return int(math.Ceil(delay.Seconds()))
+}
@@ -0,0 +1,210 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testRouter routes /:group/:clusterCode/*urlPath of user through the Middleware of every group,
+// the handlers block on release when it is not nil.
+func testRouter(l *Limiter, user string, release chan struct{}, groups ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(gin.AuthUserKey, user)
+	})
+	for _, group := range groups {
+		r.Any("/"+group+"/:clusterCode/*urlPath", l.Middleware(group), func(c *gin.Context) {
+			if release != nil {
+				<-release
+			}
+			c.Status(http.StatusOK)
+		})
+	}
+	return r
+}
+
+func serve(r http.Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		quota   string
+		want    Quota
+		wantErr bool
+	}{
+		{quota: "20:40:10", want: Quota{QPS: 20, Burst: 40, MaxInFlight: 10}},
+		{quota: "0.5:1:0", want: Quota{QPS: 0.5, Burst: 1}},
+		{quota: "0:0:0", want: Quota{}},
+		{quota: "20:40", wantErr: true},
+		{quota: "20:40:10:1", wantErr: true},
+		{quota: "fast:40:10", wantErr: true},
+		{quota: "-1:40:10", wantErr: true},
+		{quota: "20:-1:10", wantErr: true},
+		{quota: "20:40:many", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.quota, func(t *testing.T) {
+			got, err := ParseQuota(tt.quota)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseQuota(%q) error = %v, wantErr %v", tt.quota, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseQuota(%q) = %+v, want %+v", tt.quota, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		paths      []string
+		wantStatus []int
+	}{
+		{
+			name:       "user burst",
+			opts:       Options{User: Quota{QPS: 0.001, Burst: 2}},
+			paths:      []string{"/server/a/api", "/server/a/api", "/server/a/api"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "user buckets per group",
+			opts:       Options{User: Quota{QPS: 0.001, Burst: 1}},
+			paths:      []string{"/server/a/api", "/gateway/a/api", "/server/a/api"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "group quota overrides user quota",
+			opts:       Options{User: Quota{QPS: 0.001, Burst: 1}, Groups: map[string]Quota{"gateway": {QPS: 0.001, Burst: 3}}},
+			paths:      []string{"/server/a/api", "/server/a/api", "/gateway/a/api", "/gateway/a/api", "/gateway/a/api", "/gateway/a/api"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "group without limit",
+			opts:       Options{User: Quota{QPS: 0.001, Burst: 1}, Groups: map[string]Quota{"gateway": {}}},
+			paths:      []string{"/gateway/a/api", "/gateway/a/api", "/gateway/a/api"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:       "cluster bucket shared by groups",
+			opts:       Options{Cluster: Quota{QPS: 0.001, Burst: 2}},
+			paths:      []string{"/server/a/api", "/gateway/a/api", "/server/a/api", "/gateway/b/api"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRouter(New(tt.opts), "dev", nil, "server", "gateway")
+			for i, p := range tt.paths {
+				w := serve(r, p)
+				if w.Code != tt.wantStatus[i] {
+					t.Fatalf("request %v %v: status = %v, want %v", i, p, w.Code, tt.wantStatus[i])
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %v %v: 429 without Retry-After", i, p)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	r := testRouter(New(Options{User: Quota{QPS: 0.1, Burst: 1}}), "dev", nil, "server")
+	serve(r, "/server/a/api")
+
+	w := serve(r, "/server/a/api")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %v, want 429", w.Code)
+	}
+	// the next token comes after 10s
+	if got := w.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %q, want 10", got)
+	}
+}
+
+func TestInFlight(t *testing.T) {
+	l := New(Options{User: Quota{MaxInFlight: 1}, Cluster: Quota{MaxInFlight: 2}})
+	release := make(chan struct{})
+	r := testRouter(l, "dev", release, "server")
+
+	done := make(chan int)
+	go func() {
+		done <- serve(r, "/server/a/api").Code
+	}()
+	waitInFlight(t, l, "server/dev", 1)
+
+	// the user has no slot left, the cluster has
+	if w := serve(r, "/server/a/api"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("second request: status = %v, Retry-After %q, want 429 after 1", w.Code, w.Header().Get("Retry-After"))
+	}
+	// long-running requests are not counted
+	go func() {
+		done <- serve(r, "/server/a/api/v1/pods?watch=true").Code
+	}()
+
+	release <- struct{}{}
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("blocked request: status = %v, want 200", code)
+		}
+	}
+	waitInFlight(t, l, "server/dev", 0)
+	l.mu.Lock()
+	clusterInFlight := l.clusters["a"].inFlight
+	l.mu.Unlock()
+	if got := clusterInFlight; got != 0 {
+		t.Errorf("cluster in-flight = %v after release, want 0", got)
+	}
+
+	// the slot is released
+	close(release)
+	if w := serve(r, "/server/a/api"); w.Code != http.StatusOK {
+		t.Errorf("after release: status = %v, want 200", w.Code)
+	}
+}
+
+func waitInFlight(t *testing.T, l *Limiter, key string, want int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		l.mu.Lock()
+		b, ok := l.users[key]
+		got := 0
+		if ok {
+			got = b.inFlight
+		}
+		l.mu.Unlock()
+		if ok && got == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("in-flight of %v never became %v", key, want)
+}
@@ -0,0 +1,498 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/leader"
+	"github.com/helen-frank/hcnmp/pkg/zone"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+)
+
+const (
+	// maxEvents is how many of the latest events an operation keeps
+	maxEvents = 100
+
+	// gcPeriod is how often finished operations older than the retention are removed
+	gcPeriod = time.Minute
+	// storeTimeout bounds a write of an operation to its ConfigMap
+	storeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrNotFound is returned for unknown operation ids
+	ErrNotFound = errors.New("operation not found")
+	// ErrFinished is returned when cancelling an operation which already finished
+	ErrFinished = errors.New("operation already finished")
+
+	operationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_operations_total",
+			Help:      "Total number of finished operations by type and state.",
+		}, []string{"type", "state"},
+	)
+
+	operationsRunning = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_operations_running",
+			Help:      "Number of running operations by type.",
+		}, []string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(operationsTotal, operationsRunning)
+}
+
+// Options configures the Manager.
+type Options struct {
+	// Retention is how long finished operations are kept
+	Retention time.Duration
+	// Admins are the hcnmp users allowed to access the operations of everyone,
+	// the other users can only access their own operations
+	Admins []string
+	// Client keeps the operations in ConfigMaps of Namespace so that every replica serves and cancels them,
+	// nil keeps them only in memory of the replica running them
+	Client    clientset.Interface
+	Namespace string
+}
+
+// Func runs an operation and returns its result, it must return soon after ctx is done.
+type Func func(ctx context.Context, r *Reporter) (interface{}, error)
+
+// Manager runs long-running operations in the background of the replica which started them,
+// their state is kept in memory and written to ConfigMaps for the other replicas.
+type Manager struct {
+	opts   Options
+	admins map[string]struct{}
+	// store is nil when the operations are only kept in memory
+	store *store
+
+	mu         sync.RWMutex
+	operations map[string]*entry
+}
+
+type entry struct {
+	mu        sync.Mutex
+	op        operation.Operation
+	cancel    context.CancelFunc
+	cancelled bool
+	// changed is closed and replaced on every change of op
+	changed chan struct{}
+}
+
+// Filter selects operations, empty fields match everything.
+type Filter struct {
+	User    string
+	Cluster string
+	Type    string
+	State   operation.State
+}
+
+// New creates a Manager.
+func New(opts Options) *Manager {
+	admins := make(map[string]struct{}, len(opts.Admins))
+	for _, user := range opts.Admins {
+		admins[user] = struct{}{}
+	}
+	m := &Manager{
+		opts:       opts,
+		admins:     admins,
+		operations: make(map[string]*entry),
+	}
+	if opts.Client != nil {
+		m.store = newStore(opts.Client, opts.Namespace)
+		// the stored operations are removed by one replica
+		leader.Register("operation-gc", m.gcStore)
+	}
+	return m
+}
+
+// CanAccess reports whether user may access op.
+func (m *Manager) CanAccess(user string, op *operation.Operation) bool {
+	return m.IsAdmin(user) || op.User == user
+}
+
+// IsAdmin reports whether user may access the operations of everyone.
+func (m *Manager) IsAdmin(user string) bool {
+	_, ok := m.admins[user]
+	return ok
+}
+
+// Start runs fn as the operation op in the background and returns the running operation,
+// the operation fails when it is still running after timeout, 0 means no timeout.
+func (m *Manager) Start(op operation.Operation, timeout time.Duration, fn Func) operation.Operation {
+	now := time.Now()
+	op.ID = string(uuid.NewUUID())
+	op.State = operation.StateRunning
+	op.CreatedAt = now
+	op.Events = []operation.Event{}
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout > 0 {
+		deadline := now.Add(timeout)
+		op.Deadline = &deadline
+		ctx, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	e := &entry{
+		op:      op,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	m.mu.Lock()
+	m.operations[op.ID] = e
+	m.mu.Unlock()
+
+	operationsRunning.WithLabelValues(op.Type).Inc()
+	go m.run(ctx, e, timeout, fn)
+	if m.store != nil {
+		go m.persist(e)
+	}
+
+	return e.snapshot()
+}
+
+func (m *Manager) run(ctx context.Context, e *entry, timeout time.Duration, fn Func) {
+	defer e.cancel()
+
+	var (
+		result interface{}
+		err    error
+	)
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				klog.Errorf("operation %v panicked: %v", e.op.ID, r)
+				err = fmt.Errorf("operation panicked: %v", r)
+			}
+		}()
+		result, err = fn(ctx, &Reporter{entry: e})
+	}()
+
+	e.update(func(op *operation.Operation) {
+		now := time.Now()
+		op.CompletedAt = &now
+		switch {
+		case err == nil:
+			op.State = operation.StateSucceeded
+			op.Result = result
+		case e.cancelled:
+			op.State = operation.StateCancelled
+			op.Error = "operation was cancelled"
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			op.State = operation.StateFailed
+			op.Error = fmt.Sprintf("operation timed out after %v", timeout)
+			if op.Progress != nil && len(op.Progress.Message) != 0 {
+				op.Error += ": " + op.Progress.Message
+			}
+		default:
+			op.State = operation.StateFailed
+			op.Error = err.Error()
+		}
+
+		operationsRunning.WithLabelValues(op.Type).Dec()
+		operationsTotal.WithLabelValues(op.Type, string(op.State)).Inc()
+	})
+}
+
+// persist writes the operation of e to its ConfigMap on its changes, at most every persistPeriod,
+// until it finished.
+func (m *Manager) persist(e *entry) {
+	renew := time.NewTicker(renewPeriod)
+	defer renew.Stop()
+	for {
+		e.mu.Lock()
+		changed := e.changed
+		e.mu.Unlock()
+
+		op := e.snapshot()
+		ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+		if err := m.store.save(ctx, op); err != nil {
+			klog.Errorf("failed to store operation %v: %v", op.ID, err)
+		}
+		cancel()
+		if op.State.Finished() {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-renew.C:
+		}
+		time.Sleep(persistPeriod)
+	}
+}
+
+// Get returns the operation id.
+func (m *Manager) Get(id string) (*operation.Operation, error) {
+	op, _, err := m.Updates(id)
+	return op, err
+}
+
+// Updates returns the operation id and a channel closed at its next change.
+func (m *Manager) Updates(id string) (*operation.Operation, <-chan struct{}, error) {
+	e, ok := m.get(id)
+	if !ok {
+		// the operation may run in another replica
+		if m.store != nil {
+			if op, changed, ok := m.store.get(id); ok {
+				return op, changed, nil
+			}
+		}
+		return nil, nil, ErrNotFound
+	}
+
+	e.mu.Lock()
+	changed := e.changed
+	e.mu.Unlock()
+	op := e.snapshot()
+	return &op, changed, nil
+}
+
+// Cancel cancels the running operation id on behalf of user, the operations of other replicas
+// are cancelled by the replica running them.
+func (m *Manager) Cancel(id, user string) (*operation.Operation, error) {
+	e, ok := m.get(id)
+	if !ok {
+		return m.cancelStored(id, user)
+	}
+
+	var err error
+	e.update(func(op *operation.Operation) {
+		if op.State.Finished() {
+			err = ErrFinished
+			return
+		}
+		e.cancelled = true
+		appendEvent(op, operation.EventTypeWarning, fmt.Sprintf("cancelled by %v", user))
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.cancel()
+
+	op := e.snapshot()
+	return &op, nil
+}
+
+func (m *Manager) cancelStored(id, user string) (*operation.Operation, error) {
+	if m.store == nil {
+		return nil, ErrNotFound
+	}
+	op, _, ok := m.store.get(id)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if op.State.Finished() {
+		return nil, ErrFinished
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	if err := m.store.cancel(ctx, id, user); err != nil {
+		return nil, fmt.Errorf("failed to cancel operation %v: %v", id, err)
+	}
+	// the replica running the operation records the cancellation, the caller sees it requested
+	appendEvent(op, operation.EventTypeWarning, fmt.Sprintf("cancellation requested by %v", user))
+	return op, nil
+}
+
+// cancelRequested cancels the local operation id once another replica asked for it.
+func (m *Manager) cancelRequested(id, user string) {
+	e, ok := m.get(id)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	cancelled := e.cancelled
+	e.mu.Unlock()
+	if cancelled {
+		return
+	}
+
+	if _, err := m.Cancel(id, user); err != nil && !errors.Is(err, ErrFinished) {
+		klog.Errorf("failed to cancel operation %v: %v", id, err)
+	}
+}
+
+// List returns the operations matching filter, the newest first.
+func (m *Manager) List(filter Filter) []operation.Operation {
+	m.mu.RLock()
+	entries := make([]*entry, 0, len(m.operations))
+	for _, e := range m.operations {
+		entries = append(entries, e)
+	}
+	m.mu.RUnlock()
+
+	list := make([]operation.Operation, 0, len(entries))
+	local := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		op := e.snapshot()
+		local[op.ID] = struct{}{}
+		if filter.matches(&op) {
+			list = append(list, op)
+		}
+	}
+	if m.store != nil {
+		for _, op := range m.store.list() {
+			if _, ok := local[op.ID]; !ok && filter.matches(&op) {
+				list = append(list, op)
+			}
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list
+}
+
+// Run removes the finished operations older than the retention until ctx is done,
+// then cancels the running operations.
+func (m *Manager) Run(ctx context.Context) {
+	if m.store != nil {
+		go m.store.run(ctx, m.cancelRequested)
+	}
+
+	ticker := time.NewTicker(gcPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			m.mu.RLock()
+			for _, e := range m.operations {
+				e.cancel()
+			}
+			m.mu.RUnlock()
+			return
+		case <-ticker.C:
+			m.gc(time.Now().Add(-m.opts.Retention))
+		}
+	}
+}
+
+// gcStore removes the stored operations older than the retention until ctx is done.
+func (m *Manager) gcStore(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		m.store.gc(ctx, time.Now().Add(-m.opts.Retention))
+	}, gcPeriod)
+}
+
+func (m *Manager) gc(before time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, e := range m.operations {
+		op := e.snapshot()
+		if op.CompletedAt != nil && op.CompletedAt.Before(before) {
+			delete(m.operations, id)
+		}
+	}
+}
+
+func (m *Manager) get(id string) (*entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	e, ok := m.operations[id]
+	return e, ok
+}
+
+func (e *entry) snapshot() operation.Operation {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	op := e.op
+	op.Events = append([]operation.Event{}, e.op.Events...)
+	if e.op.Progress != nil {
+		progress := *e.op.Progress
+		op.Progress = &progress
+	}
+	return op
+}
+
+func (e *entry) update(f func(op *operation.Operation)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	f(&e.op)
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+func appendEvent(op *operation.Operation, eventType, message string) {
+	op.Events = append(op.Events, operation.Event{
+		Time:    time.Now(),
+		Type:    eventType,
+		Message: message,
+	})
+	if len(op.Events) > maxEvents {
+		op.Events = op.Events[len(op.Events)-maxEvents:]
+	}
+}
+
+func (f *Filter) matches(op *operation.Operation) bool {
+	return (len(f.User) == 0 || f.User == op.User) &&
+		(len(f.Cluster) == 0 || f.Cluster == op.Cluster) &&
+		(len(f.Type) == 0 || f.Type == op.Type) &&
+		(len(f.State) == 0 || f.State == op.State)
+}
+
+// Reporter reports the progress of a running operation.
+type Reporter struct {
+	entry *entry
+}
+
+// Progress sets the progress of the operation, a changed message is also recorded as an event.
+func (r *Reporter) Progress(current, total int, message string) {
+	r.entry.update(func(op *operation.Operation) {
+		if op.Progress == nil || op.Progress.Message != message {
+			appendEvent(op, operation.EventTypeNormal, message)
+		}
+		op.Progress = &operation.Progress{
+			Current: current,
+			Total:   total,
+			Message: message,
+		}
+	})
+}
+
+// Event records an event of the operation.
+func (r *Reporter) Event(eventType, message string) {
+	r.entry.update(func(op *operation.Operation) {
+		appendEvent(op, eventType, message)
+	})
+}
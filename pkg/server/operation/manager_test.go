@@ -0,0 +1,281 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operation
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+// waitFinished returns the operation id once it finished.
+func waitFinished(t *testing.T, m *Manager, id string) *operation.Operation {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		op, changed, err := m.Updates(id)
+		if err != nil {
+			t.Fatalf("failed to get operation %v: %v", id, err)
+		}
+		if op.State.Finished() {
+			return op
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("operation %v did not finish: %+v", id, op)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		fn      Func
+		// cancel cancels the operation once it started
+		cancel bool
+
+		state  operation.State
+		result interface{}
+		err    string
+	}{
+		{
+			name: "succeeded",
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				return "done", nil
+			},
+			state:  operation.StateSucceeded,
+			result: "done",
+		},
+		{
+			name: "failed",
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				return nil, errors.New("pods are not ready")
+			},
+			state: operation.StateFailed,
+			err:   "pods are not ready",
+		},
+		{
+			name: "cancelled",
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			cancel: true,
+			state:  operation.StateCancelled,
+			err:    "operation was cancelled",
+		},
+		{
+			name:    "timed out",
+			timeout: 50 * time.Millisecond,
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				r.Progress(1, 2, "waiting for pods")
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			state: operation.StateFailed,
+			err:   "operation timed out after 50ms: waiting for pods",
+		},
+		{
+			name:    "timed out without progress",
+			timeout: 50 * time.Millisecond,
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			state: operation.StateFailed,
+			err:   "operation timed out after 50ms",
+		},
+		{
+			name: "panicked",
+			fn: func(ctx context.Context, r *Reporter) (interface{}, error) {
+				panic("boom")
+			},
+			state: operation.StateFailed,
+			err:   "operation panicked: boom",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(Options{Retention: time.Hour})
+			op := m.Start(operation.Operation{Type: "restart", User: "alice"}, tt.timeout, tt.fn)
+			if op.State != operation.StateRunning {
+				t.Errorf("Start() state = %v, want %v", op.State, operation.StateRunning)
+			}
+			if (tt.timeout > 0) != (op.Deadline != nil) {
+				t.Errorf("Start() deadline = %v, want one with timeout %v", op.Deadline, tt.timeout)
+			}
+
+			if tt.cancel {
+				cancelled, err := m.Cancel(op.ID, "bob")
+				if err != nil {
+					t.Fatalf("Cancel() error = %v", err)
+				}
+				if !hasEvent(cancelled, "cancelled by bob") {
+					t.Errorf("Cancel() events = %+v, want the cancellation", cancelled.Events)
+				}
+			}
+
+			got := waitFinished(t, m, op.ID)
+			if got.State != tt.state {
+				t.Errorf("state = %v, want %v", got.State, tt.state)
+			}
+			if got.Result != tt.result {
+				t.Errorf("result = %v, want %v", got.Result, tt.result)
+			}
+			if got.Error != tt.err {
+				t.Errorf("error = %q, want %q", got.Error, tt.err)
+			}
+			if got.CompletedAt == nil {
+				t.Error("completedAt is not set")
+			}
+
+			if _, err := m.Cancel(op.ID, "bob"); !errors.Is(err, ErrFinished) {
+				t.Errorf("Cancel() of a finished operation error = %v, want %v", err, ErrFinished)
+			}
+		})
+	}
+}
+
+func TestCancelStored(t *testing.T) {
+	running := operation.Operation{ID: "running", State: operation.StateRunning, Events: []operation.Event{}}
+	succeeded := operation.Operation{ID: "succeeded", State: operation.StateSucceeded, Events: []operation.Event{}}
+
+	client := fake.NewSimpleClientset()
+	m := &Manager{
+		operations: make(map[string]*entry),
+		store:      newStore(client, "hcnmp"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, op := range []operation.Operation{running, succeeded} {
+		if err := m.store.save(ctx, op); err != nil {
+			t.Fatalf("failed to save operation %v: %v", op.ID, err)
+		}
+	}
+	go m.store.run(ctx, func(id, user string) {})
+
+	tests := []struct {
+		id string
+
+		err   error
+		state operation.State
+	}{
+		{id: "running", state: operation.StateRunning},
+		{id: "succeeded", err: ErrFinished},
+		{id: "unknown", err: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			op, err := m.Cancel(tt.id, "bob")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Cancel() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if op.State != tt.state {
+				t.Errorf("Cancel() state = %v, want %v", op.State, tt.state)
+			}
+			if !hasEvent(op, "cancellation requested by bob") {
+				t.Errorf("Cancel() events = %+v, want the cancellation request", op.Events)
+			}
+
+			cm, err := client.CoreV1().ConfigMaps("hcnmp").Get(ctx, configMapName(tt.id), metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get the ConfigMap: %v", err)
+			}
+			if user := cm.Annotations[CancelledByAnnotation]; user != "bob" {
+				t.Errorf("cancelled by annotation = %q, want %q", user, "bob")
+			}
+		})
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	op := &operation.Operation{User: "alice", Cluster: "c1", Type: "restart", State: operation.StateRunning}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", want: true},
+		{name: "all fields", filter: Filter{User: "alice", Cluster: "c1", Type: "restart", State: operation.StateRunning}, want: true},
+		{name: "other user", filter: Filter{User: "bob"}},
+		{name: "other cluster", filter: Filter{Cluster: "c2"}},
+		{name: "other type", filter: Filter{Type: "drain"}},
+		{name: "other state", filter: Filter{State: operation.StateFailed}},
+		{name: "one field differs", filter: Filter{User: "alice", Cluster: "c1", Type: "drain"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(op); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerGC(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+
+	tests := []struct {
+		name        string
+		completedAt *time.Time
+		kept        bool
+	}{
+		{name: "running", kept: true},
+		{name: "completed recently", completedAt: &now, kept: true},
+		{name: "completed before", completedAt: &old},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(Options{Retention: time.Hour})
+			m.operations["id"] = &entry{
+				op:      operation.Operation{ID: "id", CompletedAt: tt.completedAt},
+				changed: make(chan struct{}),
+			}
+
+			m.gc(now.Add(-m.opts.Retention))
+			if _, ok := m.get("id"); ok != tt.kept {
+				t.Errorf("operation kept = %v, want %v", ok, tt.kept)
+			}
+		})
+	}
+}
+
+func hasEvent(op *operation.Operation, message string) bool {
+	for _, event := range op.Events {
+		if event.Message == message {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,309 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+)
+
+const (
+	// OperationLabel selects the ConfigMaps keeping operations
+	OperationLabel = "hcnmp.io/operation"
+	// CancelledByAnnotation asks the replica running the operation to cancel it, the value is the user
+	CancelledByAnnotation = "hcnmp.io/cancelled-by"
+	// RenewedAtAnnotation is when the replica running the operation last wrote it
+	RenewedAtAnnotation = "hcnmp.io/renewed-at"
+
+	operationKey    = "operation"
+	configMapPrefix = "hcnmp-operation-"
+
+	// persistPeriod is the min interval between two writes of a running operation
+	persistPeriod = 2 * time.Second
+	// renewPeriod is how often a running operation is written even if it did not change
+	renewPeriod = 30 * time.Second
+	// orphanTimeout fails running operations not renewed for the duration, their replica is gone
+	orphanTimeout = 2 * time.Minute
+	// syncTimeout is how long reads wait for the ConfigMaps to be listed
+	syncTimeout = 10 * time.Second
+	// maxResultSize is the max size of a stored operation with its result, ConfigMaps are limited to 1MiB
+	maxResultSize = 512 * 1024
+)
+
+// store keeps the operations in ConfigMaps so that every replica serves and cancels them.
+type store struct {
+	client    clientset.Interface
+	namespace string
+	factory   informers.SharedInformerFactory
+	informer  cache.SharedIndexInformer
+	synced    chan struct{}
+
+	mu sync.Mutex
+	// changed is closed and replaced on every change of the ConfigMaps
+	changed chan struct{}
+}
+
+func newStore(client clientset.Interface, namespace string) *store {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.LabelSelector = OperationLabel + "=true"
+		}))
+
+	return &store{
+		client:    client,
+		namespace: namespace,
+		factory:   factory,
+		informer:  factory.Core().V1().ConfigMaps().Informer(),
+		synced:    make(chan struct{}),
+		changed:   make(chan struct{}),
+	}
+}
+
+// run watches the ConfigMaps of operations until ctx is done, cancelled calls the
+// cancellation requested by another replica.
+func (s *store) run(ctx context.Context, cancelled func(id, user string)) {
+	if _, err := s.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.notify()
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				if user, ok := cm.Annotations[CancelledByAnnotation]; ok {
+					cancelled(strings.TrimPrefix(cm.Name, configMapPrefix), user)
+				}
+			}
+			s.notify()
+		},
+		DeleteFunc: func(_ interface{}) {
+			s.notify()
+		},
+	}); err != nil {
+		klog.Errorf("failed to watch operations: %v", err)
+		return
+	}
+
+	s.factory.Start(ctx.Done())
+	if cache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		close(s.synced)
+	}
+	<-ctx.Done()
+	s.factory.Shutdown()
+}
+
+func (s *store) notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// waitForSync waits until the ConfigMaps are listed, before that the operations of other replicas are unknown.
+func (s *store) waitForSync() bool {
+	timer := time.NewTimer(syncTimeout)
+	defer timer.Stop()
+	select {
+	case <-s.synced:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// get returns the stored operation id and a channel closed at the next change of the operations.
+func (s *store) get(id string) (*operation.Operation, <-chan struct{}, bool) {
+	s.mu.Lock()
+	changed := s.changed
+	s.mu.Unlock()
+
+	if !s.waitForSync() {
+		return nil, nil, false
+	}
+	obj, ok, err := s.informer.GetStore().GetByKey(s.namespace + "/" + configMapName(id))
+	if err != nil || !ok {
+		return nil, nil, false
+	}
+	op, err := decode(obj.(*corev1.ConfigMap))
+	if err != nil {
+		klog.Errorf("failed to decode operation %v: %v", id, err)
+		return nil, nil, false
+	}
+	return op, changed, true
+}
+
+// list returns the stored operations.
+func (s *store) list() []operation.Operation {
+	if !s.waitForSync() {
+		return nil
+	}
+
+	objs := s.informer.GetStore().List()
+	list := make([]operation.Operation, 0, len(objs))
+	for _, obj := range objs {
+		op, err := decode(obj.(*corev1.ConfigMap))
+		if err != nil {
+			klog.Errorf("failed to decode operation %v: %v", obj.(*corev1.ConfigMap).Name, err)
+			continue
+		}
+		list = append(list, *op)
+	}
+	return list
+}
+
+// save writes op, the annotations set by other replicas are kept.
+func (s *store) save(ctx context.Context, op operation.Operation) error {
+	data, err := encode(op)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Format(time.RFC3339)
+
+	patch, err := utils.Std2Jsoniter.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				RenewedAtAnnotation: now,
+			},
+		},
+		"data": map[string]interface{}{
+			operationKey: data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.CoreV1().ConfigMaps(s.namespace).Patch(ctx, configMapName(op.ID), types.MergePatchType, patch, metav1.PatchOptions{})
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(op.ID),
+			Namespace: s.namespace,
+			Labels: map[string]string{
+				OperationLabel:                 "true",
+				"app.kubernetes.io/managed-by": "hcnmp",
+			},
+			Annotations: map[string]string{
+				RenewedAtAnnotation: now,
+			},
+		},
+		Data: map[string]string{
+			operationKey: data,
+		},
+	}, metav1.CreateOptions{})
+	return err
+}
+
+// cancel asks the replica running the operation id to cancel it.
+func (s *store) cancel(ctx context.Context, id, user string) error {
+	patch, err := utils.Std2Jsoniter.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				CancelledByAnnotation: user,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.CoreV1().ConfigMaps(s.namespace).Patch(ctx, configMapName(id), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// gc deletes the operations finished before, and fails the running operations whose replica is gone.
+func (s *store) gc(ctx context.Context, before time.Time) {
+	if !s.waitForSync() {
+		return
+	}
+
+	for _, obj := range s.informer.GetStore().List() {
+		cm := obj.(*corev1.ConfigMap)
+		op, err := decode(cm)
+		if err != nil {
+			klog.Errorf("failed to decode operation %v: %v", cm.Name, err)
+			continue
+		}
+
+		switch {
+		case op.CompletedAt != nil && op.CompletedAt.Before(before):
+			if err := s.client.CoreV1().ConfigMaps(s.namespace).Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				klog.Errorf("failed to delete operation %v: %v", op.ID, err)
+			}
+		case !op.State.Finished() && orphaned(cm):
+			now := time.Now()
+			op.State = operation.StateFailed
+			op.Error = "the hcnmp replica running the operation is gone"
+			op.CompletedAt = &now
+			if err := s.save(ctx, *op); err != nil {
+				klog.Errorf("failed to fail orphaned operation %v: %v", op.ID, err)
+			}
+		}
+	}
+}
+
+// orphaned reports whether the operation of cm was not renewed by its replica for orphanTimeout.
+func orphaned(cm *corev1.ConfigMap) bool {
+	renewedAt, err := time.Parse(time.RFC3339, cm.Annotations[RenewedAtAnnotation])
+	return err != nil || time.Since(renewedAt) > orphanTimeout
+}
+
+// encode marshals op, the result is dropped when it does not fit into a ConfigMap.
+func encode(op operation.Operation) (string, error) {
+	data, err := utils.Std2Jsoniter.Marshal(op)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxResultSize && op.Result != nil {
+		op.Result = nil
+		appendEvent(&op, operation.EventTypeWarning, "the result is too large to be stored, get it from the replica running the operation")
+		if data, err = utils.Std2Jsoniter.Marshal(op); err != nil {
+			return "", err
+		}
+	}
+	if len(data) > maxResultSize {
+		return "", fmt.Errorf("operation %v is too large to be stored: %v bytes", op.ID, len(data))
+	}
+	return string(data), nil
+}
+
+func decode(cm *corev1.ConfigMap) (*operation.Operation, error) {
+	op := &operation.Operation{}
+	if err := utils.Std2Jsoniter.Unmarshal([]byte(cm.Data[operationKey]), op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func configMapName(id string) string {
+	return configMapPrefix + id
+}
@@ -0,0 +1,183 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/operation"
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset/fake"
+)
+
+func TestEncode(t *testing.T) {
+	large := strings.Repeat("x", maxResultSize)
+
+	tests := []struct {
+		name string
+		op   operation.Operation
+
+		result  interface{}
+		warning bool
+		wantErr bool
+	}{
+		{
+			name:   "small result",
+			op:     operation.Operation{ID: "id", Result: "done"},
+			result: "done",
+		},
+		{
+			name:    "result too large",
+			op:      operation.Operation{ID: "id", Result: large},
+			warning: true,
+		},
+		{
+			name:    "too large without result",
+			op:      operation.Operation{ID: "id", Error: large},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := encode(tt.op)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(data) > maxResultSize {
+				t.Errorf("encode() size = %v, want at most %v", len(data), maxResultSize)
+			}
+
+			op, err := decode(&corev1.ConfigMap{Data: map[string]string{operationKey: data}})
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if op.Result != tt.result {
+				t.Errorf("result = %v, want %v", op.Result, tt.result)
+			}
+			if got := len(op.Events) == 1 && op.Events[0].Type == operation.EventTypeWarning; got != tt.warning {
+				t.Errorf("events = %+v, want a warning %v", op.Events, tt.warning)
+			}
+		})
+	}
+}
+
+func TestOrphaned(t *testing.T) {
+	tests := []struct {
+		name      string
+		renewedAt string
+		want      bool
+	}{
+		{name: "renewed", renewedAt: time.Now().Format(time.RFC3339)},
+		{name: "not renewed", renewedAt: time.Now().Add(-orphanTimeout - time.Minute).Format(time.RFC3339), want: true},
+		{name: "invalid", renewedAt: "yesterday", want: true},
+		{name: "missing", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &corev1.ConfigMap{}
+			if len(tt.renewedAt) != 0 {
+				cm.Annotations = map[string]string{RenewedAtAnnotation: tt.renewedAt}
+			}
+			if got := orphaned(cm); got != tt.want {
+				t.Errorf("orphaned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Hour)
+	stale := now.Add(-orphanTimeout - time.Minute)
+
+	tests := []struct {
+		id          string
+		state       operation.State
+		completedAt *time.Time
+		renewedAt   time.Time
+
+		deleted bool
+		// state is the stored state after gc
+		want operation.State
+	}{
+		{id: "running", state: operation.StateRunning, renewedAt: now, want: operation.StateRunning},
+		{id: "orphaned", state: operation.StateRunning, renewedAt: stale, want: operation.StateFailed},
+		{id: "completed-recently", state: operation.StateSucceeded, completedAt: &now, renewedAt: stale, want: operation.StateSucceeded},
+		{id: "completed-before", state: operation.StateSucceeded, completedAt: &old, renewedAt: old, deleted: true},
+	}
+
+	objs := make([]runtime.Object, 0, len(tests))
+	for _, tt := range tests {
+		data, err := encode(operation.Operation{ID: tt.id, State: tt.state, CompletedAt: tt.completedAt})
+		if err != nil {
+			t.Fatalf("failed to encode operation %v: %v", tt.id, err)
+		}
+		objs = append(objs, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        configMapName(tt.id),
+				Namespace:   "hcnmp",
+				Labels:      map[string]string{OperationLabel: "true"},
+				Annotations: map[string]string{RenewedAtAnnotation: tt.renewedAt.Format(time.RFC3339)},
+			},
+			Data: map[string]string{operationKey: data},
+		})
+	}
+	client := fake.NewSimpleClientset(objs...)
+	s := newStore(client, "hcnmp")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.run(ctx, func(id, user string) {})
+	s.gc(ctx, now.Add(-time.Hour))
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			cm, err := client.CoreV1().ConfigMaps("hcnmp").Get(ctx, configMapName(tt.id), metav1.GetOptions{})
+			if tt.deleted {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("get error = %v, want the operation deleted", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get the ConfigMap: %v", err)
+			}
+			op, err := decode(cm)
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if op.State != tt.want {
+				t.Errorf("state = %v, want %v", op.State, tt.want)
+			}
+			if op.State == operation.StateFailed && (len(op.Error) == 0 || op.CompletedAt == nil) {
+				t.Errorf("failed operation = %+v, want an error and completedAt", op)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package recording
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/recording"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+)
+
+const (
+	castExt  = ".cast"
+	indexExt = ".json"
+
+	// gcPeriod is how often recordings older than the retention are removed
+	gcPeriod = time.Hour
+)
+
+var (
+	// ErrNotFound is returned for unknown or malformed recording ids
+	ErrNotFound = errors.New("recording not found")
+
+	idRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+)
+
+// Options configures the Recorder.
+type Options struct {
+	// Dir stores the recordings, an empty Dir disables recording
+	Dir string
+	// Retention is how long recordings are kept, 0 keeps them forever
+	Retention time.Duration
+	// Auditors are the hcnmp users allowed to access the recordings of everyone,
+	// the other users can only access their own recordings
+	Auditors []string
+}
+
+// Recorder records exec terminal sessions in asciicast v2 files, indexed by a json file per recording.
+type Recorder struct {
+	opts     Options
+	auditors map[string]struct{}
+}
+
+// Filter selects recordings, empty fields match everything.
+type Filter struct {
+	User      string
+	Cluster   string
+	Namespace string
+	Pod       string
+	Since     time.Time
+	Until     time.Time
+}
+
+// New creates a Recorder.
+func New(opts Options) *Recorder {
+	auditors := make(map[string]struct{}, len(opts.Auditors))
+	for _, user := range opts.Auditors {
+		auditors[user] = struct{}{}
+	}
+	return &Recorder{
+		opts:     opts,
+		auditors: auditors,
+	}
+}
+
+// Enabled reports whether sessions are recorded.
+func (r *Recorder) Enabled() bool {
+	return len(r.opts.Dir) != 0
+}
+
+// CanAccess reports whether user may access rec.
+func (r *Recorder) CanAccess(user string, rec *recording.Recording) bool {
+	if _, ok := r.auditors[user]; ok {
+		return true
+	}
+	return rec.User == user
+}
+
+// IsAuditor reports whether user may access the recordings of everyone.
+func (r *Recorder) IsAuditor(user string) bool {
+	_, ok := r.auditors[user]
+	return ok
+}
+
+// Start starts recording the session of meta with the initial terminal size.
+func (r *Recorder) Start(meta recording.Recording, width, height uint16) (*Session, error) {
+	if err := os.MkdirAll(r.opts.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	meta.ID = string(uuid.NewUUID())
+	meta.StartedAt = time.Now()
+
+	f, err := os.OpenFile(r.castPath(meta.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		recorder: r,
+		file:     f,
+		meta:     meta,
+	}
+	if err := s.writeHeader(width, height); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := r.writeIndex(&s.meta); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the index entry of the recording id.
+func (r *Recorder) Get(id string) (*recording.Recording, error) {
+	if !idRegexp.MatchString(id) {
+		return nil, ErrNotFound
+	}
+
+	data, err := os.ReadFile(r.indexPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	rec := &recording.Recording{}
+	if err := utils.Std2Jsoniter.Unmarshal(data, rec); err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(r.castPath(id)); err == nil {
+		rec.Size = info.Size()
+	}
+	return rec, nil
+}
+
+// Open opens the asciicast file of the recording id.
+func (r *Recorder) Open(id string) (*os.File, error) {
+	if !idRegexp.MatchString(id) {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(r.castPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// List returns the recordings matching filter, the newest first.
+func (r *Recorder) List(filter Filter) ([]recording.Recording, error) {
+	entries, err := os.ReadDir(r.opts.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []recording.Recording{}, nil
+		}
+		return nil, err
+	}
+
+	list := make([]recording.Recording, 0, len(entries)/2)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), indexExt)
+		if !ok {
+			continue
+		}
+		rec, err := r.Get(id)
+		if err != nil {
+			klog.Errorf("failed to read recording %v: %v", id, err)
+			continue
+		}
+		if filter.matches(rec) {
+			list = append(list, *rec)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.After(list[j].StartedAt)
+	})
+	return list, nil
+}
+
+// Run removes the recordings older than the retention until ctx is done.
+func (r *Recorder) Run(ctx context.Context) {
+	if !r.Enabled() || r.opts.Retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(gcPeriod)
+	defer ticker.Stop()
+	for {
+		r.gc(time.Now().Add(-r.opts.Retention))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Recorder) gc(before time.Time) {
+	entries, err := os.ReadDir(r.opts.Dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("failed to read recording dir %v: %v", r.opts.Dir, err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(before) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.opts.Dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			klog.Errorf("failed to remove expired recording %v: %v", entry.Name(), err)
+		}
+	}
+}
+
+func (r *Recorder) writeIndex(meta *recording.Recording) error {
+	data, err := utils.Std2Jsoniter.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// write and rename so that List never reads a partial index
+	tmp := r.indexPath(meta.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.indexPath(meta.ID))
+}
+
+func (r *Recorder) castPath(id string) string {
+	return filepath.Join(r.opts.Dir, id+castExt)
+}
+
+func (r *Recorder) indexPath(id string) string {
+	return filepath.Join(r.opts.Dir, id+indexExt)
+}
+
+func (f *Filter) matches(rec *recording.Recording) bool {
+	return (len(f.User) == 0 || f.User == rec.User) &&
+		(len(f.Cluster) == 0 || f.Cluster == rec.Cluster) &&
+		(len(f.Namespace) == 0 || f.Namespace == rec.Namespace) &&
+		(len(f.Pod) == 0 || f.Pod == rec.Pod) &&
+		(f.Since.IsZero() || !rec.StartedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || rec.StartedAt.Before(f.Until))
+}
+
+// Session is a recording in progress.
+type Session struct {
+	recorder *Recorder
+
+	mu     sync.Mutex
+	file   *os.File
+	meta   recording.Recording
+	closed bool
+	err    error
+}
+
+// header is the first line of an asciicast v2 file.
+type header struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// ID returns the id of the recording.
+func (s *Session) ID() string {
+	return s.meta.ID
+}
+
+// Output records data written to the terminal, the session must be ended when it can not be recorded.
+func (s *Session) Output(data string) error {
+	return s.event("o", data)
+}
+
+// Input records data typed into the terminal.
+func (s *Session) Input(data string) error {
+	return s.event("i", data)
+}
+
+// Resize records a resize of the terminal.
+func (s *Session) Resize(width, height uint16) error {
+	return s.event("r", fmt.Sprintf("%vx%v", width, height))
+}
+
+// Close ends the recording with the exit code of the command, or the error the session failed with.
+func (s *Session) Close(exitCode *int, sessionErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	now := time.Now()
+	s.meta.EndedAt = &now
+	s.meta.ExitCode = exitCode
+	if sessionErr != nil {
+		s.meta.Error = sessionErr.Error()
+	}
+	if info, err := s.file.Stat(); err == nil {
+		s.meta.Size = info.Size()
+	}
+
+	err := s.file.Close()
+	if indexErr := s.recorder.writeIndex(&s.meta); indexErr != nil {
+		err = indexErr
+	}
+	if s.err != nil {
+		err = s.err
+	}
+	return err
+}
+
+func (s *Session) writeHeader(width, height uint16) error {
+	return s.writeLine(header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: s.meta.StartedAt.Unix(),
+		Command:   strings.Join(s.meta.Command, " "),
+		Title:     strings.TrimSpace(fmt.Sprintf("%v %v/%v %v", s.meta.Cluster, s.meta.Namespace, s.meta.Pod, s.meta.Container)),
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+}
+
+// event appends an event line, [elapsed seconds, type, data].
+func (s *Session) event(code, data string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return nil
+	}
+
+	elapsed := time.Since(s.meta.StartedAt).Seconds()
+	if err := s.writeLine([]interface{}{elapsed, code, data}); err != nil {
+		klog.Errorf("failed to record session %v: %v", s.meta.ID, err)
+		s.err = fmt.Errorf("failed to record session: %v", err)
+	}
+	return s.err
+}
+
+func (s *Session) writeLine(v interface{}) error {
+	data, err := utils.Std2Jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,279 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package recording
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/recording"
+)
+
+func TestRecorderSession(t *testing.T) {
+	r := New(Options{Dir: filepath.Join(t.TempDir(), "recordings")})
+	s, err := r.Start(recording.Recording{User: "alice", Cluster: "a", Namespace: "default", Pod: "web", Command: []string{"sh"}}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []func() error{
+		func() error { return s.Input("ls\r") },
+		func() error { return s.Output("file\r\n") },
+		func() error { return s.Resize(120, 40) },
+	} {
+		if err := fn(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	running, err := r.Get(s.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running.EndedAt != nil || running.User != "alice" {
+		t.Errorf("running recording = %+v, want not ended of alice", running)
+	}
+
+	exitCode := 0
+	if err := s.Close(&exitCode, nil); err != nil {
+		t.Fatal(err)
+	}
+	// events after close are dropped
+	if err := s.Output("late"); err != nil {
+		t.Errorf("Output() after close error = %v", err)
+	}
+
+	ended, err := r.Get(s.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ended.EndedAt == nil || ended.ExitCode == nil || *ended.ExitCode != 0 || ended.Size == 0 {
+		t.Errorf("ended recording = %+v, want ended with exit code 0 and size", ended)
+	}
+
+	f, err := r.Open(s.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	wantCodes := []string{`"version":2`, `"i","ls\r"`, `"o","file\r\n"`, `"r","120x40"`}
+	if len(lines) != len(wantCodes) {
+		t.Fatalf("cast = %q, want %d lines", lines, len(wantCodes))
+	}
+	for i := range wantCodes {
+		if !strings.Contains(lines[i], wantCodes[i]) {
+			t.Errorf("line %d = %q, want %q", i, lines[i], wantCodes[i])
+		}
+	}
+}
+
+func TestRecorderGet(t *testing.T) {
+	r := New(Options{Dir: t.TempDir()})
+	s, err := r.Start(recording.Recording{User: "alice"}, 80, 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(nil, errors.New("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r.indexPath("broken"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      string
+		wantErr error
+		anyErr  bool
+	}{
+		{name: "recorded", id: s.ID()},
+		{name: "unknown", id: "0123", wantErr: ErrNotFound},
+		{name: "path traversal", id: "../etc/passwd", wantErr: ErrNotFound},
+		{name: "upper case", id: strings.ToUpper(s.ID()), wantErr: ErrNotFound},
+		{name: "broken index", id: "broken", anyErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := r.Get(tt.id)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Get() error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.anyErr:
+				if err == nil {
+					t.Error("Get() error = nil, want an error")
+				}
+			case err != nil:
+				t.Errorf("Get() error = %v", err)
+			case rec.Error != "lost" || rec.ExitCode != nil:
+				t.Errorf("Get() = %+v, want failed with lost", rec)
+			}
+		})
+	}
+}
+
+func TestRecorderList(t *testing.T) {
+	r := New(Options{Dir: t.TempDir(), Auditors: []string{"auditor"}})
+	for _, meta := range []recording.Recording{
+		{User: "alice", Cluster: "a", Namespace: "default", Pod: "web"},
+		{User: "alice", Cluster: "b", Namespace: "kube-system", Pod: "dns"},
+		{User: "bob", Cluster: "a", Namespace: "default", Pod: "db"},
+	} {
+		s, err := r.Start(meta, 80, 24)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		// keep the order of StartedAt distinct
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		wantPods []string
+	}{
+		{name: "all newest first", wantPods: []string{"db", "dns", "web"}},
+		{name: "user", filter: Filter{User: "alice"}, wantPods: []string{"dns", "web"}},
+		{name: "cluster and namespace", filter: Filter{Cluster: "a", Namespace: "default"}, wantPods: []string{"db", "web"}},
+		{name: "pod", filter: Filter{Pod: "dns"}, wantPods: []string{"dns"}},
+		{name: "future", filter: Filter{Since: time.Now().Add(time.Hour)}, wantPods: []string{}},
+		{name: "past", filter: Filter{Until: time.Now().Add(-time.Hour)}, wantPods: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := r.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pods := []string{}
+			for i := range list {
+				pods = append(pods, list[i].Pod)
+			}
+			if strings.Join(pods, ",") != strings.Join(tt.wantPods, ",") {
+				t.Errorf("List() = %v, want %v", pods, tt.wantPods)
+			}
+		})
+	}
+
+	if list, err := New(Options{Dir: filepath.Join(t.TempDir(), "missing")}).List(Filter{}); err != nil || len(list) != 0 {
+		t.Errorf("List() of a missing dir = %v, %v, want empty", list, err)
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	now := time.Now()
+	rec := &recording.Recording{User: "alice", Cluster: "a", Namespace: "default", Pod: "web", StartedAt: now}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", want: true},
+		{name: "all fields", filter: Filter{User: "alice", Cluster: "a", Namespace: "default", Pod: "web"}, want: true},
+		{name: "other user", filter: Filter{User: "bob"}},
+		{name: "other cluster", filter: Filter{Cluster: "b"}},
+		{name: "other namespace", filter: Filter{Namespace: "kube-system"}},
+		{name: "other pod", filter: Filter{Pod: "db"}},
+		{name: "since is inclusive", filter: Filter{Since: now}, want: true},
+		{name: "since later", filter: Filter{Since: now.Add(time.Second)}},
+		{name: "until is exclusive", filter: Filter{Until: now}},
+		{name: "until later", filter: Filter{Until: now.Add(time.Second)}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.matches(rec); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecorderGC(t *testing.T) {
+	dir := t.TempDir()
+	r := New(Options{Dir: dir, Retention: 24 * time.Hour})
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		file     string
+		modTime  time.Time
+		wantKept bool
+	}{
+		{name: "expired cast", file: "old" + castExt, modTime: now.Add(-48 * time.Hour)},
+		{name: "expired index", file: "old" + indexExt, modTime: now.Add(-48 * time.Hour)},
+		{name: "recent cast", file: "new" + castExt, modTime: now.Add(-time.Hour), wantKept: true},
+		{name: "recent index", file: "new" + indexExt, modTime: now.Add(-time.Hour), wantKept: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.file)
+		if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, tt.modTime, tt.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.gc(now.Add(-r.opts.Retention))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(filepath.Join(dir, tt.file))
+			if kept := err == nil; kept != tt.wantKept {
+				t.Errorf("kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestRecorderCanAccess(t *testing.T) {
+	r := New(Options{Auditors: []string{"auditor"}})
+	rec := &recording.Recording{User: "alice"}
+
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{user: "alice", want: true},
+		{user: "auditor", want: true},
+		{user: "bob"},
+		{user: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			if got := r.CanAccess(tt.user, rec); got != tt.want {
+				t.Errorf("CanAccess() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -18,18 +18,27 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
 
 	"github.com/helen-frank/hcnmp/pkg/apis/config"
 	"github.com/helen-frank/hcnmp/pkg/server/handlers/clusters"
+	"github.com/helen-frank/hcnmp/pkg/server/handlers/operations"
 	"github.com/helen-frank/hcnmp/pkg/server/handlers/server"
+	"github.com/helen-frank/hcnmp/pkg/server/leader"
 	"github.com/helen-frank/hcnmp/pkg/server/middleware/auth"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/cache"
 	"github.com/helen-frank/hcnmp/pkg/server/middleware/monitor/prom"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/policy"
+	"github.com/helen-frank/hcnmp/pkg/server/middleware/ratelimit"
+	"github.com/helen-frank/hcnmp/pkg/server/operation"
+	"github.com/helen-frank/hcnmp/pkg/server/recording"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 )
 
@@ -39,8 +48,19 @@ type Server struct {
 	cfg    *config.Config
 	engine *gin.Engine
 	client clientset.Interface
+	tokens *auth.Tokens
+	// groupQuotas are the user quotas of route groups
+	groupQuotas map[string]ratelimit.Quota
 }
 
+// Route groups limited by their own user quotas.
+const (
+	groupCluster    = "cluster"
+	groupOperations = "operations"
+	groupServer     = "server"
+	groupGateway    = "gateway"
+)
+
 func Run(cfg *config.Config, client clientset.Interface) error {
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -52,8 +72,36 @@ func Run(cfg *config.Config, client clientset.Interface) error {
 		engine: gin.Default(),
 	}
 
+	defer s.cancel()
+
+	key, err := s.tokenSigningKey()
+	if err != nil {
+		return err
+	}
+	s.tokens = auth.NewTokens(key)
+
+	if s.groupQuotas, err = parseGroupQuotas(s.cfg.RateLimitGroupUserQuotas); err != nil {
+		return err
+	}
+
 	s.InstallHandlers()
 
+	// the disk discovery cache is local to every replica
+	go clientset.RunCacheGC(s.ctx)
+
+	go func() {
+		if err := leader.Run(s.ctx, s.client, leader.Options{
+			Enabled:       s.cfg.LeaderElect,
+			LeaseName:     s.cfg.LeaderElectLeaseName,
+			Namespace:     s.cfg.NameSpace,
+			LeaseDuration: s.cfg.LeaderElectLeaseDuration,
+			RenewDeadline: s.cfg.LeaderElectRenewDeadline,
+			RetryPeriod:   s.cfg.LeaderElectRetryPeriod,
+		}); err != nil {
+			klog.Errorf("failed to run leader election: %v", err)
+		}
+	}()
+
 	return s.engine.Run(":" + strconv.Itoa(s.cfg.Port))
 }
 
@@ -72,14 +120,107 @@ func (s *Server) InstallHandlers() {
 	s.engine.Use(prom.PromMiddleware(nil), gin.Recovery())
 	s.engine.GET("/metrics", prom.PromHandler(promhttp.Handler()))
 
+	policyEngine := policy.NewEngine(s.cfg.NameSpace, s.cfg.ProxyPolicy)
+	go policyEngine.Run(s.ctx, s.client)
+	responseCache := cache.New(cache.Options{
+		TTL:          s.cfg.ProxyCacheTTL,
+		ResourceTTLs: s.cfg.ProxyCacheResourceTTLs,
+		MaxSize:      s.cfg.ProxyCacheMaxSize,
+	})
+
+	recorder := recording.New(recording.Options{
+		Dir:       s.cfg.RecordingDir,
+		Retention: s.cfg.RecordingRetention,
+		Auditors:  append([]string{s.cfg.BasicAuthUser}, s.cfg.RecordingAuditors...),
+	})
+	// recordings are stored on the local volume of every replica
+	go recorder.Run(s.ctx)
+
+	operationManager := operation.New(operation.Options{
+		Retention: s.cfg.OperationRetention,
+		Admins:    []string{s.cfg.BasicAuthUser},
+		Client:    s.client,
+		Namespace: s.cfg.NameSpace,
+	})
+	// operations run in the replica which started them and are kept in ConfigMaps for every replica
+	go operationManager.Run(s.ctx)
+
+	userQuota := ratelimit.Quota{
+		QPS:         s.cfg.RateLimitUserQPS,
+		Burst:       s.cfg.RateLimitUserBurst,
+		MaxInFlight: s.cfg.RateLimitUserMaxInFlight,
+	}
+	clusterQuota := ratelimit.Quota{
+		QPS:         s.cfg.RateLimitClusterQPS,
+		Burst:       s.cfg.RateLimitClusterBurst,
+		MaxInFlight: s.cfg.RateLimitClusterMaxInFlight,
+	}
+	// cluster management only limits users, the proxy and the gateway share the quotas of every member cluster
+	clusterLimiter := ratelimit.New(ratelimit.Options{User: userQuota, Groups: s.groupQuotas})
+	proxyLimiter := ratelimit.New(ratelimit.Options{User: userQuota, Groups: s.groupQuotas, Cluster: clusterQuota})
+
 	authorized := s.engine.Group("/", auth.MultiAuth(gin.Accounts{
 		s.cfg.BasicAuthUser: s.cfg.BasicAuthPassword,
-	}))
+	}, s.tokens))
+
+	serverOptions := server.Options{
+		Client: s.client,
+		Policy: policyEngine,
+		Cache:  responseCache,
+		WebSocket: server.WebSocketOptions{
+			AllowedOrigins:  s.cfg.WebSocketAllowedOrigins,
+			ExecIdleTimeout: s.cfg.ExecIdleTimeout,
+		},
+		Recorder:   recorder,
+		Operations: operationManager,
+		Debug: server.DebugOptions{
+			DiagnosticsImage: s.cfg.DiagnosticsImage,
+			DebugImage:       s.cfg.DebugImage,
+
+			NodeDebugUsers:     append([]string{s.cfg.BasicAuthUser}, s.cfg.NodeDebugUsers...),
+			NodeDebugNamespace: s.cfg.NodeDebugNamespace,
+			NodeDebugTTL:       s.cfg.NodeDebugTTL,
+		},
+		Copy: server.CopyOptions{
+			MaxSize: s.cfg.CopyMaxSize,
+		},
+	}
 
 	apiGroup := authorized.Group("/apis")
 	{
-		clusters.InstallHandlers(apiGroup.Group("/cluster"), s.cfg.NameSpace, s.cfg.ClusterInfos, s.cfg.LocalClusterInfos, s.client)
-		server.InstallHandlers(apiGroup.Group("/server"), s.client)
+		clusters.InstallHandlers(apiGroup.Group("/cluster", clusterLimiter.Middleware(groupCluster)), s.cfg.NameSpace, s.cfg.ClusterInfos, s.cfg.LocalClusterInfos, s.client, s.tokens, policyEngine, s.cfg.ExternalURLs)
+		server.InstallHandlers(apiGroup.Group("/server", proxyLimiter.Middleware(groupServer)), serverOptions)
+		operations.InstallHandlers(apiGroup.Group("/operations", clusterLimiter.Middleware(groupOperations)), operationManager)
 	}
 
+	// kubectl compatible gateway
+	server.InstallGatewayHandlers(authorized.Group("/clusters", proxyLimiter.Middleware(groupGateway)), serverOptions)
+}
+
+// parseGroupQuotas parses the user quotas of route groups.
+func parseGroupQuotas(quotas map[string]string) (map[string]ratelimit.Quota, error) {
+	parsed := make(map[string]ratelimit.Quota, len(quotas))
+	for group, s := range quotas {
+		switch group {
+		case groupCluster, groupOperations, groupServer, groupGateway:
+		default:
+			return nil, fmt.Errorf("rate-limit-group-user-quotas: unknown route group %q, must be %v, %v, %v or %v",
+				group, groupCluster, groupOperations, groupServer, groupGateway)
+		}
+		quota, err := ratelimit.ParseQuota(s)
+		if err != nil {
+			return nil, fmt.Errorf("rate-limit-group-user-quotas %v: %v", group, err)
+		}
+		parsed[group] = quota
+	}
+	return parsed, nil
+}
+
+// tokenSigningKey returns the key signing the bearer tokens, when not configured a random key
+// is kept in a secret of the hcnmp namespace so that all replicas share it.
+func (s *Server) tokenSigningKey() ([]byte, error) {
+	if len(s.cfg.TokenSigningKey) != 0 {
+		return []byte(s.cfg.TokenSigningKey), nil
+	}
+	return auth.LoadSigningKey(s.ctx, s.client, s.cfg.NameSpace)
 }
@@ -4,6 +4,7 @@
 package utils
 
 import (
+	"strconv"
 	"strings"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -45,6 +46,8 @@ func status(u *unstructured.Unstructured) (string, error) {
 		return replicationControllerStatus(u)
 	case "Job.batch":
 		return jobStatus(u)
+	case "Rollout.argoproj.io":
+		return rolloutStatus(u)
 	default:
 		return statusFromStandardConditions(u)
 	}
@@ -82,9 +85,25 @@ func stsStatus(u *unstructured.Unstructured) (string, error) {
 		return StatusUnknown, err
 	}
 
-	if sts.Status.ObservedGeneration == sts.Generation &&
-		sts.Status.Replicas == *sts.Spec.Replicas &&
-		sts.Status.ReadyReplicas == *sts.Spec.Replicas &&
+	if sts.Status.ObservedGeneration != sts.Generation ||
+		sts.Status.Replicas != *sts.Spec.Replicas ||
+		sts.Status.ReadyReplicas != *sts.Spec.Replicas {
+		return StatusInProgress, nil
+	}
+
+	// pods of OnDelete statefulsets are only updated when deleted, like kubectl rollout status they are not waited for
+	if sts.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return StatusReady, nil
+	}
+	// a partitioned rolling update only updates the pods from the partition on
+	if rollingUpdate := sts.Spec.UpdateStrategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.Partition != nil && *rollingUpdate.Partition > 0 {
+		if sts.Status.UpdatedReplicas >= *sts.Spec.Replicas-*rollingUpdate.Partition {
+			return StatusReady, nil
+		}
+		return StatusInProgress, nil
+	}
+	if sts.Status.UpdateRevision == sts.Status.CurrentRevision &&
+		sts.Status.UpdatedReplicas == *sts.Spec.Replicas &&
 		sts.Status.CurrentReplicas == *sts.Spec.Replicas {
 		return StatusReady, nil
 	}
@@ -122,6 +141,7 @@ func deploymentStatus(u *unstructured.Unstructured) (string, error) {
 
 	if deployment.Status.ObservedGeneration == deployment.Generation &&
 		deployment.Status.Replicas == *deployment.Spec.Replicas &&
+		deployment.Status.UpdatedReplicas == *deployment.Spec.Replicas &&
 		deployment.Status.ReadyReplicas == *deployment.Spec.Replicas &&
 		deployment.Status.AvailableReplicas == *deployment.Spec.Replicas &&
 		deployment.Status.Conditions != nil && len(deployment.Status.Conditions) > 0 &&
@@ -165,6 +185,7 @@ func daemonsetStatus(u *unstructured.Unstructured) (string, error) {
 	}
 
 	if ds.Status.ObservedGeneration == ds.Generation &&
+		ds.Status.DesiredNumberScheduled == ds.Status.UpdatedNumberScheduled &&
 		ds.Status.DesiredNumberScheduled == ds.Status.NumberAvailable &&
 		ds.Status.DesiredNumberScheduled == ds.Status.NumberReady {
 		return StatusReady, nil
@@ -259,6 +280,28 @@ func jobStatus(u *unstructured.Unstructured) (string, error) {
 	return StatusReady, nil
 }
 
+// Argo Rollout
+func rolloutStatus(u *unstructured.Unstructured) (string, error) {
+	phase, _, err := unstructured.NestedString(u.Object, "status", "phase")
+	if err != nil {
+		return StatusUnknown, err
+	}
+	// the observedGeneration of a rollout is a string
+	observedGeneration, _, err := unstructured.NestedString(u.Object, "status", "observedGeneration")
+	if err != nil {
+		return StatusUnknown, err
+	}
+	restartAt, _, _ := unstructured.NestedString(u.Object, "spec", "restartAt")
+	restartedAt, _, _ := unstructured.NestedString(u.Object, "status", "restartedAt")
+
+	if phase == "Healthy" &&
+		observedGeneration == strconv.FormatInt(u.GetGeneration(), 10) &&
+		(isEmpty(restartAt) || restartAt == restartedAt) {
+		return StatusReady, nil
+	}
+	return StatusInProgress, nil
+}
+
 func hasEmptyIngressIP(ingress []corev1.LoadBalancerIngress) bool {
 	for _, i := range ingress {
 		if isEmpty(i.IP) {
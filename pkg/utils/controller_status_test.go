@@ -0,0 +1,117 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestStatus(t *testing.T) {
+	replicas := int32(3)
+	partition := int32(2)
+
+	statefulSet := func(strategy appsv1.StatefulSetUpdateStrategy, status appsv1.StatefulSetStatus) runtime.Object {
+		status.ObservedGeneration = 1
+		status.Replicas = replicas
+		status.ReadyReplicas = replicas
+		return &appsv1.StatefulSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+			ObjectMeta: metav1.ObjectMeta{Generation: 1},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas, UpdateStrategy: strategy},
+			Status:     status,
+		}
+	}
+	deployment := func(generation int64, status appsv1.DeploymentStatus) runtime.Object {
+		status.Conditions = []appsv1.DeploymentCondition{{Type: appsv1.DeploymentAvailable, Status: "True"}}
+		return &appsv1.Deployment{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+			ObjectMeta: metav1.ObjectMeta{Generation: generation},
+			Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			Status:     status,
+		}
+	}
+	daemonSet := func(status appsv1.DaemonSetStatus) runtime.Object {
+		status.ObservedGeneration = 1
+		return &appsv1.DaemonSet{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DaemonSet"},
+			ObjectMeta: metav1.ObjectMeta{Generation: 1},
+			Status:     status,
+		}
+	}
+	rollout := func(phase, observedGeneration, restartAt, restartedAt string) runtime.Object {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "argoproj.io/v1alpha1",
+			"kind":       "Rollout",
+			"metadata":   map[string]interface{}{"generation": int64(2)},
+			"spec":       map[string]interface{}{"restartAt": restartAt},
+			"status":     map[string]interface{}{"phase": phase, "observedGeneration": observedGeneration, "restartedAt": restartedAt},
+		}}
+	}
+	updated := appsv1.DeploymentStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 3, ReadyReplicas: 3, AvailableReplicas: 3}
+	rollingUpdate := appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType}
+	partitioned := appsv1.StatefulSetUpdateStrategy{
+		Type:          appsv1.RollingUpdateStatefulSetStrategyType,
+		RollingUpdate: &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition},
+	}
+
+	tests := []struct {
+		name string
+		obj  runtime.Object
+		want string
+	}{
+		{name: "statefulset updated", obj: statefulSet(rollingUpdate, appsv1.StatefulSetStatus{
+			CurrentRevision: "r2", UpdateRevision: "r2", UpdatedReplicas: 3, CurrentReplicas: 3}), want: StatusReady},
+		{name: "statefulset updating", obj: statefulSet(rollingUpdate, appsv1.StatefulSetStatus{
+			CurrentRevision: "r1", UpdateRevision: "r2", UpdatedReplicas: 1, CurrentReplicas: 2}), want: StatusInProgress},
+		{name: "statefulset on delete", obj: statefulSet(appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
+			appsv1.StatefulSetStatus{CurrentRevision: "r1", UpdateRevision: "r2"}), want: StatusReady},
+		{name: "statefulset partition updated", obj: statefulSet(partitioned, appsv1.StatefulSetStatus{
+			CurrentRevision: "r1", UpdateRevision: "r2", UpdatedReplicas: 1, CurrentReplicas: 2}), want: StatusReady},
+		{name: "statefulset partition updating", obj: statefulSet(partitioned, appsv1.StatefulSetStatus{
+			CurrentRevision: "r1", UpdateRevision: "r2", CurrentReplicas: 3}), want: StatusInProgress},
+		{name: "deployment updated", obj: deployment(2, updated), want: StatusReady},
+		{name: "deployment not observed", obj: deployment(3, updated), want: StatusInProgress},
+		{name: "deployment old replicas ready", obj: deployment(2, appsv1.DeploymentStatus{
+			ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 1, ReadyReplicas: 3, AvailableReplicas: 3}), want: StatusInProgress},
+		{name: "daemonset updated", obj: daemonSet(appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: 2, UpdatedNumberScheduled: 2, NumberAvailable: 2, NumberReady: 2}), want: StatusReady},
+		{name: "daemonset updating", obj: daemonSet(appsv1.DaemonSetStatus{
+			DesiredNumberScheduled: 2, UpdatedNumberScheduled: 1, NumberAvailable: 2, NumberReady: 2}), want: StatusInProgress},
+		{name: "rollout healthy", obj: rollout("Healthy", "2", "", ""), want: StatusReady},
+		{name: "rollout restarted", obj: rollout("Healthy", "2", "2026-01-01T00:00:00Z", "2026-01-01T00:00:00Z"), want: StatusReady},
+		{name: "rollout restarting", obj: rollout("Healthy", "2", "2026-01-01T00:00:00Z", ""), want: StatusInProgress},
+		{name: "rollout not observed", obj: rollout("Healthy", "1", "", ""), want: StatusInProgress},
+		{name: "rollout progressing", obj: rollout("Progressing", "2", "", ""), want: StatusInProgress},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StatusFromRuntime(tt.obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Status() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
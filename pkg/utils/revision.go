@@ -0,0 +1,80 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+)
+
+const (
+	// DeploymentRevisionAnnotation is the revision of a deployment and of its replicasets
+	DeploymentRevisionAnnotation = "deployment.kubernetes.io/revision"
+	// ChangeCauseAnnotation is the cause of a revision, as kubectl rollout history shows it
+	ChangeCauseAnnotation = "kubernetes.io/change-cause"
+)
+
+// ListDeploymentReplicaSets returns the replicasets controlled by given deployment, each of them is a revision.
+func ListDeploymentReplicaSets(ctx context.Context, client clientset.Interface, deployment appsv1.Deployment) ([]appsv1.ReplicaSet, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	allRS, err := client.AppsV1().ReplicaSets(deployment.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matchingRS := make([]appsv1.ReplicaSet, 0, len(allRS.Items))
+	for rsk := range allRS.Items {
+		if metav1.IsControlledBy(&allRS.Items[rsk], &deployment) {
+			matchingRS = append(matchingRS, allRS.Items[rsk])
+		}
+	}
+	return matchingRS, nil
+}
+
+// ListControllerRevisions returns the controller revisions controlled by given statefulset or daemonset,
+// selector is the pod selector of the owner.
+func ListControllerRevisions(ctx context.Context, client clientset.Interface, owner metav1.Object, selector *metav1.LabelSelector) ([]appsv1.ControllerRevision, error) {
+	labelSelector, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	allRevisions, err := client.AppsV1().ControllerRevisions(owner.GetNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matchingRevisions := make([]appsv1.ControllerRevision, 0, len(allRevisions.Items))
+	for rk := range allRevisions.Items {
+		if metav1.IsControlledBy(&allRevisions.Items[rk], owner) {
+			matchingRevisions = append(matchingRevisions, allRevisions.Items[rk])
+		}
+	}
+	return matchingRevisions, nil
+}
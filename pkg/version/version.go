@@ -0,0 +1,27 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version has the version of the running hcnmp build.
+package version
+
+// Version is the image tag hcnmp was built for, it is set at build time by
+// -ldflags "-X github.com/helen-frank/hcnmp/pkg/version.Version=v1.0.0"
+var Version = "latest"
+
+// Image is the hcnmp image of the running build.
+func Image() string {
+	return "helenfrank/hcnmp:" + Version
+}
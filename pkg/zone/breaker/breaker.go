@@ -0,0 +1,270 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package breaker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+
+	"github.com/helen-frank/hcnmp/pkg/apis/cluster"
+	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone"
+)
+
+const (
+	StateClosed   = "Closed"
+	StateHalfOpen = "HalfOpen"
+	StateOpen     = "Open"
+)
+
+var (
+	stateValue = map[string]float64{
+		StateClosed:   0,
+		StateHalfOpen: 1,
+		StateOpen:     2,
+	}
+
+	breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_cluster_circuit_breaker_state",
+			Help:      "Circuit breaker state of member cluster, 0 closed, 1 half-open, 2 open.",
+		}, []string{"cluster"},
+	)
+
+	breakerRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: zone.NameSpace,
+			Name:      "hcnmp_cluster_circuit_breaker_rejected_total",
+			Help:      "Total number of requests rejected by the circuit breaker of member cluster.",
+		}, []string{"cluster"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(breakerState, breakerRejected)
+}
+
+// Options configures the circuit breaker of member cluster.
+type Options struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker, 0 disables the breaker.
+	FailureThreshold int
+	// SlowThreshold is the latency over which a request is counted as failure, 0 means no limit.
+	SlowThreshold time.Duration
+	// OpenDuration is how long the breaker stays open before a half-open probe is allowed.
+	OpenDuration time.Duration
+}
+
+// Breaker is the circuit breaker of one member cluster.
+type Breaker struct {
+	cluster string
+	opts    Options
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	lastErr  string
+	openedAt time.Time
+	probing  bool
+}
+
+// New creates a closed Breaker of the cluster code.
+func New(code string, opts Options) *Breaker {
+	b := &Breaker{
+		cluster: code,
+		opts:    opts,
+		state:   StateClosed,
+	}
+	breakerState.WithLabelValues(code).Set(stateValue[StateClosed])
+	return b
+}
+
+// Delete removes the metrics of the cluster code, it should be called when the cluster is removed.
+func Delete(code string) {
+	breakerState.DeleteLabelValues(code)
+	breakerRejected.DeleteLabelValues(code)
+}
+
+// Status returns the current state of Breaker.
+func (b *Breaker) Status() cluster.CircuitBreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := cluster.CircuitBreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastFailure:         b.lastErr,
+	}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// allow reports whether a request may pass, and whether it is the half-open probe.
+func (b *Breaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if time.Since(b.openedAt) < b.opts.OpenDuration {
+			return false, false
+		}
+		b.setState(StateHalfOpen)
+		fallthrough
+	case StateHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		return true, true
+	}
+	return true, false
+}
+
+// release ends a request which tells nothing about the cluster, e.g. canceled by its client.
+func (b *Breaker) release(probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+}
+
+func (b *Breaker) done(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	if err == nil {
+		b.failures = 0
+		b.lastErr = ""
+		if b.state != StateClosed {
+			klog.Infof("cluster %v circuit breaker closed", b.cluster)
+			b.setState(StateClosed)
+		}
+		return
+	}
+
+	b.failures++
+	b.lastErr = err.Error()
+	if b.state == StateHalfOpen || (b.state == StateClosed && b.failures >= b.opts.FailureThreshold) {
+		klog.Warningf("cluster %v circuit breaker open after %v consecutive failures, last: %v", b.cluster, b.failures, err)
+		b.openedAt = time.Now()
+		b.setState(StateOpen)
+	}
+}
+
+func (b *Breaker) setState(state string) {
+	b.state = state
+	breakerState.WithLabelValues(b.cluster).Set(stateValue[state])
+}
+
+// WrapTransport returns a transport wrapper suitable for rest.Config.Wrap.
+func (b *Breaker) WrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if b.opts.FailureThreshold <= 0 {
+		return rt
+	}
+	return &roundTripper{breaker: b, delegate: rt}
+}
+
+type roundTripper struct {
+	breaker  *Breaker
+	delegate http.RoundTripper
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ok, probe := rt.breaker.allow()
+	if !ok {
+		breakerRejected.WithLabelValues(rt.breaker.cluster).Inc()
+		return rt.rejected(req)
+	}
+
+	start := time.Now()
+	resp, err := rt.delegate.RoundTrip(req)
+	latency := time.Since(start)
+
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || errors.Is(req.Context().Err(), context.Canceled)):
+		// the client went away, the cluster may be fine
+		rt.breaker.release(probe)
+	case err != nil:
+		rt.breaker.done(probe, err)
+	case unavailable(resp.StatusCode):
+		rt.breaker.done(probe, fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, resp.Status))
+	case rt.breaker.opts.SlowThreshold > 0 && latency > rt.breaker.opts.SlowThreshold:
+		rt.breaker.done(probe, fmt.Errorf("%v %v: took %v", req.Method, req.URL.Path, latency))
+	default:
+		rt.breaker.done(probe, nil)
+	}
+	return resp, err
+}
+
+// unavailable reports whether the status tells the apiserver itself is unavailable, other 5xx such as
+// a failing webhook are errors of single requests and must not open the breaker of the whole cluster.
+func unavailable(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// rejected builds a kubernetes Status 503 response so that client-go and the proxy surface it as is.
+func (rt *roundTripper) rejected(req *http.Request) (*http.Response, error) {
+	status := apierrors.NewServiceUnavailable(fmt.Sprintf("cluster %v is unavailable, circuit breaker is open", rt.breaker.cluster)).ErrStatus
+	status.APIVersion = "v1"
+	status.Kind = "Status"
+
+	data, err := utils.Std2Jsoniter.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)),
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}, nil
+}
+
+// WrappedRoundTripper implements utilnet.RoundTripperWrapper.
+func (rt *roundTripper) WrappedRoundTripper() http.RoundTripper {
+	return rt.delegate
+}
@@ -0,0 +1,184 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package breaker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeTransport replies status, or fails with err.
+type fakeTransport struct {
+	status int
+	err    error
+	calls  int
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.err != nil {
+		return nil, t.err
+	}
+	return &http.Response{StatusCode: t.status, Status: http.StatusText(t.status), Request: req}, nil
+}
+
+func roundTrip(ctx context.Context, t *testing.T, rt http.RoundTripper) int {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://cluster/api/v1/pods", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func TestBreakerFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		cancel bool
+		want   string
+	}{
+		{name: "ok", status: http.StatusOK, want: StateClosed},
+		{name: "not found", status: http.StatusNotFound, want: StateClosed},
+		{name: "internal server error", status: http.StatusInternalServerError, want: StateClosed},
+		{name: "bad gateway", status: http.StatusBadGateway, want: StateOpen},
+		{name: "service unavailable", status: http.StatusServiceUnavailable, want: StateOpen},
+		{name: "gateway timeout", status: http.StatusGatewayTimeout, want: StateOpen},
+		{name: "transport error", err: errors.New("connection refused"), want: StateOpen},
+		{name: "canceled error", err: context.Canceled, want: StateClosed},
+		{name: "canceled request", err: errors.New("net/http: request canceled"), cancel: true, want: StateClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := New("test-"+tt.name, Options{FailureThreshold: 2, OpenDuration: time.Hour})
+			rt := b.WrapTransport(&fakeTransport{status: tt.status, err: tt.err})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancel {
+				cancel()
+			}
+			defer cancel()
+
+			for i := 0; i < 2; i++ {
+				roundTrip(ctx, t, rt)
+			}
+			if got := b.Status().State; got != tt.want {
+				t.Errorf("state = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	b := New("test-transitions", Options{FailureThreshold: 2, OpenDuration: time.Hour})
+	transport := &fakeTransport{status: http.StatusServiceUnavailable}
+	rt := b.WrapTransport(transport)
+	ctx := context.Background()
+
+	// closed until the threshold
+	roundTrip(ctx, t, rt)
+	if got := b.Status(); got.State != StateClosed || got.ConsecutiveFailures != 1 {
+		t.Fatalf("after 1 failure: %+v, want Closed with 1 failure", got)
+	}
+	roundTrip(ctx, t, rt)
+	if got := b.Status().State; got != StateOpen {
+		t.Fatalf("after 2 failures: state = %v, want Open", got)
+	}
+
+	// open rejects without calling the cluster
+	calls := transport.calls
+	if got := roundTrip(ctx, t, rt); got != http.StatusServiceUnavailable {
+		t.Errorf("open: status = %v, want 503", got)
+	}
+	if transport.calls != calls {
+		t.Errorf("open: cluster called %v times, want 0", transport.calls-calls)
+	}
+
+	// half-open after the open duration, a failed probe opens it again
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	b.mu.Unlock()
+	roundTrip(ctx, t, rt)
+	if transport.calls != calls+1 {
+		t.Errorf("half-open: cluster called %v times, want 1 probe", transport.calls-calls)
+	}
+	if got := b.Status().State; got != StateOpen {
+		t.Fatalf("after failed probe: state = %v, want Open", got)
+	}
+
+	// only one probe at a time
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	b.mu.Unlock()
+	if ok, probe := b.allow(); !ok || !probe {
+		t.Fatalf("half-open: allow() = %v, %v, want the probe", ok, probe)
+	}
+	if got := b.Status().State; got != StateHalfOpen {
+		t.Fatalf("probing: state = %v, want HalfOpen", got)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Error("half-open: a second request was allowed while probing")
+	}
+
+	// a canceled probe keeps it half-open and allows another probe
+	b.release(true)
+	if got := b.Status().State; got != StateHalfOpen {
+		t.Fatalf("after canceled probe: state = %v, want HalfOpen", got)
+	}
+
+	// a successful probe closes it
+	transport.status = http.StatusOK
+	if got := roundTrip(ctx, t, rt); got != http.StatusOK {
+		t.Errorf("probe: status = %v, want 200", got)
+	}
+	if got := b.Status(); got.State != StateClosed || got.ConsecutiveFailures != 0 {
+		t.Errorf("after successful probe: %+v, want Closed without failures", got)
+	}
+}
+
+func TestBreakerSlowThreshold(t *testing.T) {
+	b := New("test-slow", Options{FailureThreshold: 1, SlowThreshold: time.Nanosecond, OpenDuration: time.Hour})
+	rt := b.WrapTransport(slowTransport{})
+
+	roundTrip(context.Background(), t, rt)
+	if got := b.Status().State; got != StateOpen {
+		t.Errorf("state = %v, want Open", got)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	transport := &fakeTransport{status: http.StatusOK}
+	if rt := New("test-disabled", Options{}).WrapTransport(transport); rt != transport {
+		t.Error("a breaker without failure threshold wrapped the transport")
+	}
+}
+
+type slowTransport struct{}
+
+func (slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	time.Sleep(time.Millisecond)
+	return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+}
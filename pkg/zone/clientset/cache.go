@@ -0,0 +1,271 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientset
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/disk"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// MemoryCache keeps discovery results in process memory, nothing is written to disk.
+	MemoryCache = "memory"
+	// DiskCache keeps discovery and http responses in a directory per cluster.
+	DiskCache = "disk"
+
+	// hashFile keeps the sha256 of the kubeconfig of the cluster in its cache directory,
+	// so that the cache of a changed kubeconfig is invalidated across restarts
+	hashFile = "kubeconfig.sha256"
+	// gcInterval is how often the size of the cache directories is checked
+	gcInterval = time.Minute
+)
+
+var (
+	overlyCautiousIllegalFileCharacters = regexp.MustCompile(`[^(\w/\.)]`)
+
+	cacheMu      sync.RWMutex
+	cacheOptions = CacheOptions{
+		Type: MemoryCache,
+		TTL:  10 * time.Minute,
+	}
+)
+
+// CacheOptions configures the discovery cache backend of member cluster clients.
+type CacheOptions struct {
+	// Type is MemoryCache or DiskCache.
+	Type string
+	// Dir is the root directory of DiskCache, every cluster gets its own sub directory.
+	Dir string
+	// MaxSize is the max bytes a cluster cache directory may use, 0 means no limit.
+	MaxSize int64
+	// TTL is how long DiskCache discovery results are considered fresh.
+	TTL time.Duration
+}
+
+// Validate checks the CacheOptions.
+func (o CacheOptions) Validate() error {
+	switch o.Type {
+	case MemoryCache:
+	case DiskCache:
+		if len(o.Dir) == 0 {
+			return fmt.Errorf("discovery-cache-dir must be set when discovery-cache is %v", DiskCache)
+		}
+	default:
+		return fmt.Errorf("unsupported discovery-cache %q, must be %v or %v", o.Type, MemoryCache, DiskCache)
+	}
+
+	if o.MaxSize < 0 {
+		return fmt.Errorf("discovery-cache-max-size must not be negative")
+	}
+	return nil
+}
+
+// SetCacheOptions sets the cache backend used by clients created afterwards.
+func SetCacheOptions(o CacheOptions) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	cacheOptions = o
+}
+
+func getCacheOptions() CacheOptions {
+	cacheMu.RLock()
+	defer cacheMu.RUnlock()
+	return cacheOptions
+}
+
+// newCachedDiscovery creates the CachedDiscoveryInterface of cacheKey.
+// An empty cacheKey always uses MemoryCache.
+func newCachedDiscovery(c *rest.Config, cacheKey string) (discovery.CachedDiscoveryInterface, error) {
+	o := getCacheOptions()
+	if o.Type != DiskCache || len(cacheKey) == 0 {
+		client, err := discovery.NewDiscoveryClientForConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		return memory.NewMemCacheClient(client), nil
+	}
+
+	dir := cacheDir(o.Dir, cacheKey)
+	if err := enforceMaxSize(dir, o.MaxSize); err != nil {
+		return nil, err
+	}
+
+	return disk.NewCachedDiscoveryClientForConfig(c, filepath.Join(dir, "discovery"), filepath.Join(dir, "http"), o.TTL)
+}
+
+// CheckCache invalidates the disk cache of cacheKey if it was written for another kubeconfig,
+// then records the kubeconfig in the cache directory.
+func CheckCache(cacheKey string, kubeconfig []byte) error {
+	o := getCacheOptions()
+	if o.Type != DiskCache || len(cacheKey) == 0 {
+		return nil
+	}
+
+	dir := cacheDir(o.Dir, cacheKey)
+	sum := sha256.Sum256(kubeconfig)
+	hash := []byte(hex.EncodeToString(sum[:]))
+	old, err := os.ReadFile(filepath.Join(dir, hashFile))
+	switch {
+	case err == nil && bytes.Equal(bytes.TrimSpace(old), hash):
+		return nil
+	case err == nil:
+		klog.Infof("kubeconfig of cache dir %v changed, purge it", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		// a cache of unknown kubeconfig, e.g. written by an older hcnmp, can not be trusted
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, hashFile), hash, 0o640)
+}
+
+// RunCacheGC purges the disk cache directories exceeding MaxSize periodically until ctx is done,
+// the clients keep writing the cache while the server runs.
+func RunCacheGC(ctx context.Context) {
+	o := getCacheOptions()
+	if o.Type != DiskCache || o.MaxSize <= 0 {
+		return
+	}
+
+	wait.UntilWithContext(ctx, func(_ context.Context) {
+		entries, err := os.ReadDir(o.Dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				klog.Warningf("failed to read cache dir %v: %v", o.Dir, err)
+			}
+			return
+		}
+		for i := range entries {
+			if !entries[i].IsDir() {
+				continue
+			}
+			if err := enforceMaxSize(filepath.Join(o.Dir, entries[i].Name()), o.MaxSize); err != nil {
+				klog.Warningf("failed to purge cache dir %v: %v", entries[i].Name(), err)
+			}
+		}
+	}, gcInterval)
+}
+
+// enforceMaxSize purges the cached responses of the cache directory if they use more than maxSize bytes,
+// the kubeconfig hash is kept.
+func enforceMaxSize(dir string, maxSize int64) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		klog.Warningf("failed to stat cache dir %v: %v", dir, err)
+		return nil
+	}
+	if size <= maxSize {
+		return nil
+	}
+
+	klog.Infof("cache dir %v size %v exceeds %v, purge it", dir, size, maxSize)
+	for _, sub := range []string{"discovery", "http"} {
+		if err := os.RemoveAll(filepath.Join(dir, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneCache removes the disk cache of every cacheKey not in keep.
+func PruneCache(keep []string) error {
+	o := getCacheOptions()
+	if o.Type != DiskCache {
+		return nil
+	}
+
+	entries, err := os.ReadDir(o.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	keepDirs := make(map[string]struct{}, len(keep))
+	for i := range keep {
+		keepDirs[filepath.Base(cacheDir(o.Dir, keep[i]))] = struct{}{}
+	}
+
+	for i := range entries {
+		if !entries[i].IsDir() {
+			continue
+		}
+		if _, ok := keepDirs[entries[i].Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(o.Dir, entries[i].Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheDir takes the parentDir and the cacheKey and comes up with a safe directory name.
+func cacheDir(parentDir, cacheKey string) string {
+	return filepath.Join(parentDir, overlyCautiousIllegalFileCharacters.ReplaceAllString(filepath.Base(cacheKey), "_"))
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
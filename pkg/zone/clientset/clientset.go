@@ -18,27 +18,21 @@ package clientset
 
 import (
 	"context"
-	"path/filepath"
-	"regexp"
+	"net/http"
 	"strings"
-	"time"
+	"sync"
 
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/discovery"
-	"k8s.io/client-go/discovery/cached/disk"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/util/homedir"
 	"k8s.io/klog"
 )
 
-var (
-	overlyCautiousIllegalFileCharacters = regexp.MustCompile(`[^(\w/\.)]`)
-	// make sure that a Clientset instance implement the interface.
-	_ = Interface(&Clientset{})
-)
+// make sure that a Clientset instance implement the interface.
+var _ = Interface(&Clientset{})
 
 type Interface interface {
 	kubernetes.Interface
@@ -55,8 +49,19 @@ type Clientset struct {
 	ctx                   context.Context
 	metadata              metadata.Interface
 	CachedDiscoveryClient discovery.CachedDiscoveryInterface
+
+	proxyOnce    sync.Once
+	proxyHandler http.Handler
+	proxyErr     error
+
+	impersonatedMu sync.Mutex
+	// impersonated holds the clients of Impersonate by identity, they are dropped with c when the cluster client is rebuilt
+	impersonated map[string]*Clientset
 }
 
+// maxImpersonatedClients bounds the clients cached by Impersonate, the cache is reset when it is full.
+const maxImpersonatedClients = 256
+
 // Metadata return metadata client
 func (c *Clientset) Metadata() metadata.Interface {
 	return c.metadata
@@ -80,8 +85,50 @@ func (c *Clientset) CachedDiscovery() discovery.CachedDiscoveryInterface {
 	return c.CachedDiscoveryClient
 }
 
-// NewForConfig creates a new Clientset for the given config.
+// Impersonate returns a Clientset of the config of c impersonating impersonation,
+// it is created once per identity and shares the discovery cache of c.
+func (c *Clientset) Impersonate(impersonation rest.ImpersonationConfig) (*Clientset, error) {
+	key := impersonation.UserName + "|" + impersonation.UID + "|" + strings.Join(impersonation.Groups, ",")
+	for k, v := range impersonation.Extra {
+		key += "|" + k + "=" + strings.Join(v, ",")
+	}
+
+	c.impersonatedMu.Lock()
+	defer c.impersonatedMu.Unlock()
+	if client, ok := c.impersonated[key]; ok {
+		return client, nil
+	}
+
+	config := rest.CopyConfig(c.config)
+	config.Impersonate = impersonation
+	client, err := newForConfig(config, c.CachedDiscoveryClient)
+	if err != nil {
+		return nil, err
+	}
+	if c.impersonated == nil || len(c.impersonated) >= maxImpersonatedClients {
+		c.impersonated = map[string]*Clientset{}
+	}
+	c.impersonated[key] = client
+	return client, nil
+}
+
+// NewForConfig creates a new Clientset for the given config, its discovery is cached in memory.
 func NewForConfig(c *rest.Config) (*Clientset, error) {
+	return NewForConfigWithCacheKey(c, "")
+}
+
+// NewForConfigWithCacheKey creates a new Clientset for the given config,
+// its discovery is cached by the configured backend under cacheKey.
+func NewForConfigWithCacheKey(c *rest.Config, cacheKey string) (*Clientset, error) {
+	cachedDiscovery, err := newCachedDiscovery(c, cacheKey)
+	if err != nil {
+		klog.Error(err)
+		return nil, err
+	}
+	return newForConfig(c, cachedDiscovery)
+}
+
+func newForConfig(c *rest.Config, cachedDiscovery discovery.CachedDiscoveryInterface) (*Clientset, error) {
 	var sc Clientset
 	var err error
 
@@ -104,22 +151,7 @@ func NewForConfig(c *rest.Config) (*Clientset, error) {
 		return nil, err
 	}
 
-	discoveryCacheDir := computeDiscoverCacheDir(filepath.Join(homedir.HomeDir(), ".kube", "cache", "discovery"), c.Host)
-	httpCacheDir := filepath.Join(homedir.HomeDir(), ".kube", "http-cache")
-	sc.CachedDiscoveryClient, err = disk.NewCachedDiscoveryClientForConfig(c, discoveryCacheDir, httpCacheDir, time.Duration(10*time.Minute))
-	if err != nil {
-		klog.Error(err)
-		return nil, err
-	}
+	sc.CachedDiscoveryClient = cachedDiscovery
 
 	return &sc, nil
 }
-
-// computeDiscoverCacheDir takes the parentDir and the host and comes up with a "usually non-colliding" name.
-func computeDiscoverCacheDir(parentDir, host string) string {
-	// strip the optional scheme from host if its there:
-	schemelessHost := strings.Replace(strings.Replace(host, "https://", "", 1), "http://", "", 1)
-	// now do a simple collapse of non-AZ09 characters.  Collisions are possible but unlikely.  Even if we do collide the problem is short lived
-	safeHost := overlyCautiousIllegalFileCharacters.ReplaceAllString(schemelessHost, "_")
-	return filepath.Join(parentDir, safeHost)
-}
@@ -0,0 +1,92 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientset
+
+import (
+	"strconv"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestClientsetImpersonate(t *testing.T) {
+	client, err := NewForConfig(&rest.Config{Host: "https://member.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := client.Impersonate(rest.ImpersonationConfig{UserName: "hcnmp:alice", Groups: []string{"hcnmp:users"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		impersonation rest.ImpersonationConfig
+		wantAlice     bool
+	}{
+		{name: "same identity", impersonation: rest.ImpersonationConfig{UserName: "hcnmp:alice", Groups: []string{"hcnmp:users"}}, wantAlice: true},
+		{name: "other user", impersonation: rest.ImpersonationConfig{UserName: "hcnmp:bob", Groups: []string{"hcnmp:users"}}},
+		{name: "other groups", impersonation: rest.ImpersonationConfig{UserName: "hcnmp:alice", Groups: []string{"system:masters"}}},
+		{name: "no groups", impersonation: rest.ImpersonationConfig{UserName: "hcnmp:alice"}},
+		{name: "extra", impersonation: rest.ImpersonationConfig{UserName: "hcnmp:alice", Groups: []string{"hcnmp:users"},
+			Extra: map[string][]string{"scopes": {"view"}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.Impersonate(tt.impersonation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == alice) != tt.wantAlice {
+				t.Errorf("client shared with alice = %v, want %v", got == alice, tt.wantAlice)
+			}
+			if got.ClientConfig().Impersonate.UserName != tt.impersonation.UserName {
+				t.Errorf("impersonated user = %q, want %q", got.ClientConfig().Impersonate.UserName, tt.impersonation.UserName)
+			}
+			if got.CachedDiscovery() != client.CachedDiscovery() {
+				t.Error("discovery cache is not shared with the cluster client")
+			}
+			if client.ClientConfig().Impersonate.UserName != "" {
+				t.Error("config of the cluster client is modified")
+			}
+		})
+	}
+
+	rebuilt, err := NewForConfig(&rest.Config{Host: "https://member.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rebuilt.Impersonate(rest.ImpersonationConfig{UserName: "hcnmp:alice", Groups: []string{"hcnmp:users"}}); err != nil || got == alice {
+		t.Errorf("client of the rebuilt cluster client = %p, %v, want a new client", got, err)
+	}
+}
+
+func TestClientsetImpersonateLimit(t *testing.T) {
+	client, err := NewForConfig(&rest.Config{Host: "https://member.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxImpersonatedClients+10; i++ {
+		if _, err := client.Impersonate(rest.ImpersonationConfig{UserName: "user-" + strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if len(client.impersonated) > maxImpersonatedClients {
+			t.Fatalf("%d cached clients, want at most %d", len(client.impersonated), maxImpersonatedClients)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake has a fake clientset of member clusters for tests.
+package fake
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/metadata"
+	metadatafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/rest"
+
+	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
+)
+
+// make sure that a Clientset instance implement the interface.
+var _ = clientset.Interface(&Clientset{})
+
+// Clientset is a clientset.Interface backed by the fake clients of client-go,
+// the typed objects are kept in its embedded kubernetes fake and in its dynamic fake.
+type Clientset struct {
+	*fake.Clientset
+	dynamic.Interface
+
+	metadata metadata.Interface
+}
+
+// NewSimpleClientset returns a Clientset holding objects in its typed and dynamic clients,
+// unstructured objects are only held by the dynamic client. The clients do not share their changes.
+func NewSimpleClientset(objects ...runtime.Object) *Clientset {
+	typed := make([]runtime.Object, 0, len(objects))
+	for i := range objects {
+		if _, ok := objects[i].(*unstructured.Unstructured); !ok {
+			typed = append(typed, objects[i])
+		}
+	}
+
+	client := fake.NewSimpleClientset(typed...)
+	return &Clientset{
+		Clientset: client,
+		Interface: dynamicfake.NewSimpleDynamicClient(scheme.Scheme, objects...),
+		metadata:  metadatafake.NewSimpleMetadataClient(metadatafake.NewTestScheme()),
+	}
+}
+
+func (c *Clientset) Metadata() metadata.Interface {
+	return c.metadata
+}
+
+func (c *Clientset) ClientConfig() *rest.Config {
+	return &rest.Config{Host: "https://fake"}
+}
+
+func (c *Clientset) CachedDiscovery() discovery.CachedDiscoveryInterface {
+	return memory.NewMemCacheClient(c.Discovery())
+}
@@ -0,0 +1,250 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientset
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/proxy"
+	"k8s.io/apimachinery/third_party/forked/golang/netutil"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog"
+)
+
+const proxyFlushInterval = 200 * time.Millisecond
+
+// ProxyHandler returns a reverse proxy to the kube-apiserver of the client.
+// It streams responses, supports SPDY/WebSocket upgrades and keeps upstream status codes and headers.
+// The request URL path must already be the kube-apiserver path, e.g. /api/v1/pods.
+func (c *Clientset) ProxyHandler() (http.Handler, error) {
+	c.proxyOnce.Do(func() {
+		c.proxyHandler, c.proxyErr = newProxyHandler(c.config)
+	})
+	return c.proxyHandler, c.proxyErr
+}
+
+func newProxyHandler(cfg *rest.Config) (http.Handler, error) {
+	host := cfg.Host
+	if !strings.HasSuffix(host, "/") {
+		host = host + "/"
+	}
+	target, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := rest.TransportFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upgradeTransport, err := newUpgradeTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	handler := proxy.NewUpgradeAwareHandler(target, rt, false, false, &responder{})
+	handler.UpgradeTransport = upgradeTransport
+	handler.UseRequestLocation = true
+	handler.UseLocationHost = true
+	handler.AppendLocationPath = true
+	handler.FlushInterval = proxyFlushInterval
+	return handler, nil
+}
+
+// newUpgradeTransport returns the transport used to dial SPDY/WebSocket upgrade requests,
+// it adds the authentication of cfg to the upgrade request. The connection is dialed at the bottom of
+// the wrappers of cfg, so that the circuit breaker of the cluster rejects and counts upgrades like other requests.
+func newUpgradeTransport(cfg *rest.Config) (proxy.UpgradeRequestRoundTripper, error) {
+	transportConfig, err := cfg.TransportConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+	dial := (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if transportConfig.DialHolder != nil {
+		dial = transportConfig.DialHolder.Dial
+	}
+
+	wrappers, err := transport.HTTPWrappersForConfig(transportConfig, &upgradeDialer{dial: dial, tlsConfig: tlsConfig})
+	if err != nil {
+		return nil, err
+	}
+	return &upgradeTransport{
+		// the upgrade aware handler takes the dialed connection from the dialer of the transport
+		Transport: &http.Transport{DialContext: dialedConn},
+		wrappers:  wrappers,
+	}, nil
+}
+
+// upgradeTransport is a proxy.UpgradeRequestRoundTripper dialing the connection in WrapRequest.
+type upgradeTransport struct {
+	*http.Transport
+	wrappers http.RoundTripper
+}
+
+type dialedConnKey struct{}
+
+// dialedConnHolder passes the connection dialed by the wrappers to the upgrade aware handler.
+type dialedConnHolder struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (t *upgradeTransport) WrapRequest(req *http.Request) (*http.Request, error) {
+	holder := &dialedConnHolder{}
+	resp, err := t.wrappers.RoundTrip(req.WithContext(context.WithValue(req.Context(), dialedConnKey{}, holder)))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || resp.Request == nil {
+		// rejected by a wrapper, e.g. the open circuit breaker
+		defer resp.Body.Close()
+		status := metav1.Status{}
+		if data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && json.Unmarshal(data, &status) == nil && status.Code != 0 {
+			return nil, &apierrors.StatusError{ErrStatus: status}
+		}
+		return nil, fmt.Errorf("upgrade request rejected: %v", resp.Status)
+	}
+	return resp.Request, nil
+}
+
+// WrappedRoundTripper returns the transport whose dialer is used by the upgrade aware handler.
+func (t *upgradeTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.Transport
+}
+
+// dialedConn returns the connection dialed by upgradeDialer for the request of ctx.
+func dialedConn(ctx context.Context, _, address string) (net.Conn, error) {
+	holder, ok := ctx.Value(dialedConnKey{}).(*dialedConnHolder)
+	if !ok {
+		return nil, fmt.Errorf("upgrade connection to %v was not dialed", address)
+	}
+	holder.mu.Lock()
+	defer holder.mu.Unlock()
+	if holder.conn == nil {
+		return nil, fmt.Errorf("upgrade connection to %v was already used", address)
+	}
+	conn := holder.conn
+	holder.conn = nil
+	return conn, nil
+}
+
+// upgradeDialer is the bottom of the wrappers of an upgrade request, it dials the connection including
+// the TLS handshake so that the wrappers see its failures, and mirrors the request like proxy.MirrorRequest.
+type upgradeDialer struct {
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	tlsConfig *tls.Config
+}
+
+func (d *upgradeDialer) RoundTrip(req *http.Request) (*http.Response, error) {
+	holder, ok := req.Context().Value(dialedConnKey{}).(*dialedConnHolder)
+	if !ok {
+		return nil, errors.New("upgrade request without connection holder")
+	}
+
+	address := netutil.CanonicalAddr(req.URL)
+	conn, err := d.dial(req.Context(), "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "https" {
+		tlsConn := tls.Client(conn, upgradeTLSConfig(d.tlsConfig, address))
+		if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	holder.mu.Lock()
+	holder.conn = conn
+	holder.mu.Unlock()
+
+	// the connection is already secured, the upgrade aware handler must use it as is
+	mirrored := req.Clone(req.Context())
+	mirrored.URL.Scheme = "http"
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Body:       http.NoBody,
+		Request:    mirrored,
+	}, nil
+}
+
+// upgradeTLSConfig negotiates http/1.1 with the host of address, the upgrade request is written as http/1.1.
+func upgradeTLSConfig(cfg *tls.Config, address string) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	if len(cfg.ServerName) == 0 && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		cfg.ServerName = host
+	}
+	cfg.NextProtos = []string{"http/1.1"}
+	return cfg
+}
+
+// responder writes proxy errors as kubernetes Status.
+type responder struct{}
+
+func (r *responder) Error(w http.ResponseWriter, req *http.Request, err error) {
+	klog.Errorf("error while proxying request %v %v: %v", req.Method, req.URL.Path, err)
+
+	var s metav1.Status
+	if status, ok := err.(apierrors.APIStatus); ok {
+		s = status.Status()
+	} else {
+		s = metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadGateway,
+			Message: err.Error(),
+		}
+	}
+	s.APIVersion = "v1"
+	s.Kind = "Status"
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(s.Code))
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		klog.Error(err)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright helen-frank
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package clientset
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+)
+
+// gate is a transport wrapper like the circuit breaker of a cluster,
+// it counts the failed round trips and rejects with a 503 Status after maxFailures.
+type gate struct {
+	delegate    http.RoundTripper
+	maxFailures int
+	calls       int
+	failures    int
+}
+
+func (g *gate) RoundTrip(req *http.Request) (*http.Response, error) {
+	g.calls++
+	if g.maxFailures > 0 && g.failures >= g.maxFailures {
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"circuit breaker is open","reason":"ServiceUnavailable","code":503}`)),
+		}, nil
+	}
+	resp, err := g.delegate.RoundTrip(req)
+	if err != nil {
+		g.failures++
+	}
+	return resp, err
+}
+
+// upgradeBackend is a kube-apiserver switching to an echo protocol when the request has the bearer token.
+func upgradeBackend(t *testing.T) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+}
+
+// upgrade sends an upgrade request through the proxy at address and returns the status, the echo of ping after a 101.
+func upgrade(t *testing.T, address string) (int, string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, _ = io.WriteString(conn, "GET /api/v1/namespaces/default/pods/web/exec HTTP/1.1\r\nHost: hcnmp\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return resp.StatusCode, ""
+	}
+
+	_, _ = io.WriteString(conn, "ping")
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(r, echo); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(echo)
+}
+
+func TestProxyHandlerUpgrade(t *testing.T) {
+	tests := []struct {
+		name string
+		// down stops the backend before the requests
+		down         bool
+		requests     int
+		wantStatus   []int
+		wantCalls    int
+		wantFailures int
+	}{
+		{
+			name:       "upgraded",
+			requests:   2,
+			wantStatus: []int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols},
+			wantCalls:  2,
+		},
+		{
+			name:         "failed dials are seen by the wrappers which reject the next upgrades",
+			down:         true,
+			requests:     3,
+			wantStatus:   []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusServiceUnavailable},
+			wantCalls:    3,
+			wantFailures: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := upgradeBackend(t)
+			defer backend.Close()
+			if tt.down {
+				backend.Close()
+			}
+
+			g := &gate{maxFailures: 2}
+			cfg := &rest.Config{
+				Host:            backend.URL,
+				BearerToken:     "secret",
+				TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			}
+			cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+				g.delegate = rt
+				return g
+			})
+
+			handler, err := newProxyHandler(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proxy := httptest.NewServer(handler)
+			defer proxy.Close()
+			// only the upgrades are counted
+			g.calls = 0
+
+			for i := 0; i < tt.requests; i++ {
+				status, echo := upgrade(t, proxy.Listener.Addr().String())
+				if status != tt.wantStatus[i] {
+					t.Errorf("request %v: status = %v, want %v", i, status, tt.wantStatus[i])
+				}
+				if status == http.StatusSwitchingProtocols && echo != "ping" {
+					t.Errorf("request %v: echo = %q, want ping", i, echo)
+				}
+			}
+			if g.calls != tt.wantCalls || g.failures != tt.wantFailures {
+				t.Errorf("wrapper calls = %v, failures = %v, want %v, %v", g.calls, g.failures, tt.wantCalls, tt.wantFailures)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ package proxy
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -35,16 +36,27 @@ import (
 
 	"github.com/helen-frank/hcnmp/pkg/apis/cluster"
 	"github.com/helen-frank/hcnmp/pkg/utils"
+	"github.com/helen-frank/hcnmp/pkg/zone/breaker"
 	"github.com/helen-frank/hcnmp/pkg/zone/clientset"
 )
 
 var (
 	codeClusterClient sync.Map
 	idClusterClient   sync.Map
-	clusterWatch      watch.Interface
-	retrySync         = make(chan struct{}, 1)
+	// code -> *cluster.Impersonation
+	codeImpersonation sync.Map
+	// code -> *breaker.Breaker, kept across client rebuilds
+	clusterBreaker sync.Map
+	breakerOptions breaker.Options
+	clusterWatch   watch.Interface
+	retrySync      = make(chan struct{}, 1)
 )
 
+// SetBreakerOptions sets the circuit breaker options of member clusters, it must be called before InitProxy.
+func SetBreakerOptions(o breaker.Options) {
+	breakerOptions = o
+}
+
 func InitProxy(clusterInfo, namespace, localClusterInfos string, kubeclient clientset.Interface) (err error) {
 	watchcm(clusterInfo, namespace, localClusterInfos, kubeclient)
 
@@ -161,8 +173,24 @@ func syncCodeClusterClient(clusterInfo, namespace string, cm *corev1.ConfigMap,
 	idtmp := make(map[string]*clientset.Clientset, len(cm.BinaryData))
 	codetmp := make(map[string]*clientset.Clientset, len(cm.BinaryData))
 	codes := make([]string, 0, len(cm.BinaryData))
+	keys := make([]string, 0, len(cm.BinaryData))
+	imptmp := make(map[string]*cluster.Impersonation, len(cm.BinaryData))
 	for code, data := range cm.BinaryData {
-		client, err := newClient(data)
+		clusterInfo := &cluster.ClusterInfo{}
+		if err := utils.Std2Jsoniter.Unmarshal(data, clusterInfo); err != nil {
+			return err
+		}
+
+		key := cacheKey(clusterInfo)
+		if err := clientset.CheckCache(key, clusterInfo.Kubeconfig); err != nil {
+			klog.Warningf("failed to check cache of cluster %v: %v", code, err)
+		}
+		keys = append(keys, key)
+		if clusterInfo.Impersonation != nil {
+			imptmp[code] = clusterInfo.Impersonation
+		}
+
+		client, err := newClient(clusterInfo)
 		if err != nil {
 			return err
 		}
@@ -194,16 +222,34 @@ func syncCodeClusterClient(clusterInfo, namespace string, cm *corev1.ConfigMap,
 	for k, v := range idtmp {
 		idClusterClient.Store(k, v)
 	}
+
+	codeImpersonation.Range(func(key, _ any) bool {
+		if _, ok := imptmp[key.(string)]; !ok {
+			codeImpersonation.Delete(key)
+		}
+		return true
+	})
+	for k, v := range imptmp {
+		codeImpersonation.Store(k, v)
+	}
+
+	clusterBreaker.Range(func(key, _ any) bool {
+		if _, ok := codetmp[key.(string)]; !ok {
+			clusterBreaker.Delete(key)
+			breaker.Delete(key.(string))
+		}
+		return true
+	})
+
+	// invalidate the cache of removed clusters
+	if err := clientset.PruneCache(keys); err != nil {
+		klog.Warningf("failed to prune cache: %v", err)
+	}
 	klog.Infof("cluster %v proxy successfull", codes)
 	return nil
 }
 
-func newClient(data []byte) (*clientset.Clientset, error) {
-	clusterInfo := &cluster.ClusterInfo{}
-	if err := utils.Std2Jsoniter.Unmarshal(data, clusterInfo); err != nil {
-		return nil, err
-	}
-
+func newClient(clusterInfo *cluster.ClusterInfo) (*clientset.Clientset, error) {
 	restConfig, err := clientcmd.RESTConfigFromKubeConfig(clusterInfo.Kubeconfig)
 	if err != nil {
 		return nil, err
@@ -211,7 +257,22 @@ func newClient(data []byte) (*clientset.Clientset, error) {
 
 	// set rateLimiter 1000
 	restConfig.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(1000, 1000)
-	return clientset.NewForConfig(restConfig)
+
+	b, ok := clusterBreaker.Load(clusterInfo.Code)
+	if !ok {
+		b, _ = clusterBreaker.LoadOrStore(clusterInfo.Code, breaker.New(clusterInfo.Code, breakerOptions))
+	}
+	restConfig.Wrap(b.(*breaker.Breaker).WrapTransport)
+	return clientset.NewForConfigWithCacheKey(restConfig, cacheKey(clusterInfo))
+}
+
+// cacheKey returns the discovery cache key of cluster, the cluster id is preferred
+// because the code of a cluster may be reused after it is removed.
+func cacheKey(clusterInfo *cluster.ClusterInfo) string {
+	if len(clusterInfo.ID) != 0 {
+		return clusterInfo.ID
+	}
+	return clusterInfo.Code
 }
 
 func GetClusterPorxyClientFromCode(code string) (*clientset.Clientset, error) {
@@ -229,3 +290,31 @@ func GetClusterPorxyClientFromID(id string) (*clientset.Clientset, error) {
 	}
 	return client.(*clientset.Clientset), nil
 }
+
+// GetClusterImpersonation returns the impersonation of cluster, nil if not configured.
+func GetClusterImpersonation(code string) *cluster.Impersonation {
+	impersonation, ok := codeImpersonation.Load(code)
+	if !ok {
+		return nil
+	}
+	return impersonation.(*cluster.Impersonation)
+}
+
+func GetClusterBreakerStatus(code string) (cluster.CircuitBreakerStatus, error) {
+	b, ok := clusterBreaker.Load(code)
+	if !ok {
+		return cluster.CircuitBreakerStatus{}, fmt.Errorf("cluster %v Not Found", code)
+	}
+	return b.(*breaker.Breaker).Status(), nil
+}
+
+// ListClusterCodes returns the sorted codes of all proxied clusters.
+func ListClusterCodes() []string {
+	codes := make([]string, 0)
+	codeClusterClient.Range(func(key, _ any) bool {
+		codes = append(codes, key.(string))
+		return true
+	})
+	sort.Strings(codes)
+	return codes
+}